@@ -0,0 +1,401 @@
+// Package bench measures the latency and throughput of transports, to
+// compare them and the tuning of their pollers with data. A Pair of
+// userspace nodes is linked through a Transport, and workloads between them
+// report their goodput, round trip times and the API calls they cost. Pairs
+// tune their TCP with a tcpprofile.Profile, to compare profiles too.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/adapters/gonet"
+	"github.com/google/netstack/tcpip/network/arp"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/tcpprofile"
+)
+
+// Transport links the nodes of a benchmark.
+type Transport interface {
+	// Name describes the transport in results.
+	Name() string
+	// Link returns the endpoint of a node with address mac. Endpoints carry
+	// Ethernet frames, and keep the statistics of a stats.Source.
+	Link(mac tcpip.LinkAddress) tcpip.LinkEndpointID
+}
+
+// Workloads run by a Pair.
+const (
+	// WorkloadBulk sends Size bytes over a connection, like iperf.
+	WorkloadBulk = "bulk"
+	// WorkloadRR opens a connection per request of Size bytes, answered
+	// with as many.
+	WorkloadRR = "rr"
+	// WorkloadPing echoes PingSize bytes over an open connection.
+	WorkloadPing = "ping"
+)
+
+// Workloads are the names of every workload.
+var Workloads = []string{WorkloadBulk, WorkloadRR, WorkloadPing}
+
+// PingSize is the size of the messages of WorkloadPing, that of an ICMP echo.
+const PingSize = 64
+
+// Defaults of Options.
+const (
+	DefaultBulkSize = 64 << 10
+	DefaultRRSize   = 512
+	DefaultCount    = 10
+	DefaultTimeout  = 5 * time.Minute
+)
+
+// Ports the servers of a Pair listen on.
+const (
+	bulkPort = 5201
+	rrPort   = 5202
+	pingPort = 5203
+)
+
+// Options configure a workload.
+type Options struct {
+	// Workload is one of Workloads.
+	Workload string
+	// Size is the bytes sent by WorkloadBulk, DefaultBulkSize if zero, or
+	// the size of the requests and responses of WorkloadRR, DefaultRRSize
+	// if zero.
+	Size int
+	// Count is the number of requests or pings, DefaultCount if zero.
+	Count int
+	// Timeout bounds the run, DefaultTimeout if zero.
+	Timeout time.Duration
+}
+
+// Result is the outcome of a workload.
+type Result struct {
+	Transport string
+	Workload  string
+	// Profile is the name of the TCP profile of the nodes.
+	Profile string
+	// Bytes are the application bytes exchanged in Duration.
+	Bytes    int64
+	Duration time.Duration
+	// RTTs are the round trip times of requests, including the handshake,
+	// or pings, and the time of the transfer for WorkloadBulk.
+	RTTs []time.Duration
+	// Calls are the API calls made by both nodes during the run, by
+	// operation.
+	Calls map[string]uint64
+}
+
+// Goodput returns the application bytes exchanged per second.
+func (r *Result) Goodput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Percentile returns the p-th percentile of the RTTs, by nearest rank.
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.RTTs) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), r.RTTs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// TotalCalls returns the number of API calls made during the run.
+func (r *Result) TotalCalls() uint64 {
+	var n uint64
+	for _, c := range r.Calls {
+		n += c
+	}
+	return n
+}
+
+// CallsPerMB returns the API calls made per megabyte of application data.
+func (r *Result) CallsPerMB() float64 {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return float64(r.TotalCalls()) / (float64(r.Bytes) / 1e6)
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%v %v %v: %.1f KB/s, rtt p50 %v p99 %v, %.0f calls/MB (%v calls in %v)",
+		r.Transport, r.Profile, r.Workload, r.Goodput()/1e3, r.Percentile(50), r.Percentile(99), r.CallsPerMB(), r.TotalCalls(), r.Duration.Round(time.Millisecond))
+}
+
+// node is a userspace stack on a transport.
+type node struct {
+	stack *stack.Stack
+	addr  tcpip.Address
+	link  stats.Source
+}
+
+func newNode(t Transport, profile *tcpprofile.Profile, mac tcpip.LinkAddress, ip net.IP) (*node, error) {
+	id := t.Link(mac)
+	s := stack.New([]string{ipv4.ProtocolName, arp.ProtocolName}, []string{tcp.ProtocolName}, stack.Options{})
+	if err := profile.Apply(s); err != nil {
+		return nil, fmt.Errorf("newNode: %v", err)
+	}
+	if err := s.CreateNIC(1, id); err != nil {
+		return nil, fmt.Errorf("newNode: could not create NIC: %v", err)
+	}
+	addr := tcpip.Address(ip.To4())
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		return nil, fmt.Errorf("newNode: could not add address: %v", err)
+	}
+	if err := s.AddAddress(1, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		return nil, fmt.Errorf("newNode: could not add ARP address: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: tcpip.Address(strings.Repeat("\x00", 4)),
+		Mask:        tcpip.AddressMask(strings.Repeat("\x00", 4)),
+		NIC:         1,
+	}})
+	return &node{stack: s, addr: addr, link: stats.Find(id)}, nil
+}
+
+func (n *node) calls() map[string]uint64 {
+	if n.link == nil {
+		return nil
+	}
+	return n.link.Stats().Calls
+}
+
+// Pair are a client and a server node linked by a transport. Links keep
+// polling until the process exits, so a pair is meant to run several
+// workloads.
+type Pair struct {
+	transport      Transport
+	profile        *tcpprofile.Profile
+	client, server *node
+}
+
+// NewPair links two nodes through t, tuned with profile, and starts the
+// servers of the workloads. Transports coalesce ACKs on their own, see
+// Cloudwatch.QoS. It pings the server once, so that runs don't include the
+// resolution of its address.
+func NewPair(t Transport, profile *tcpprofile.Profile) (*Pair, error) {
+	client, err := newNode(t, profile, "\x02\x00\x00\x00\xbe\x01", net.IPv4(10, 99, 0, 1))
+	if err != nil {
+		return nil, err
+	}
+	server, err := newNode(t, profile, "\x02\x00\x00\x00\xbe\x02", net.IPv4(10, 99, 0, 2))
+	if err != nil {
+		return nil, err
+	}
+	p := &Pair{transport: t, profile: profile, client: client, server: server}
+	for port, handle := range map[uint16]func(net.Conn){bulkPort: serveBulk, rrPort: serveRR, pingPort: serveEcho} {
+		l, err := gonet.NewListener(server.stack, tcpip.FullAddress{NIC: 1, Addr: server.addr, Port: port}, ipv4.ProtocolNumber)
+		if err != nil {
+			return nil, fmt.Errorf("NewPair: could not listen on %v: %v", port, err)
+		}
+		go serve(l, handle)
+	}
+	if _, err := p.Run(&Options{Workload: WorkloadPing, Count: 1}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func serve(l net.Listener, handle func(net.Conn)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			handle(c)
+		}()
+	}
+}
+
+// serveBulk reads the length of the data, the data, and acknowledges it
+// with a byte.
+func serveBulk(c net.Conn) {
+	var n uint64
+	if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+		return
+	}
+	if _, err := io.CopyN(ioutil.Discard, c, int64(n)); err != nil {
+		return
+	}
+	c.Write([]byte{1})
+}
+
+// serveRR reads the size of a request, the request, and answers with as
+// many bytes.
+func serveRR(c net.Conn) {
+	var n uint32
+	if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+		return
+	}
+	if _, err := io.CopyN(ioutil.Discard, c, int64(n)); err != nil {
+		return
+	}
+	c.Write(make([]byte, n))
+}
+
+func serveEcho(c net.Conn) {
+	io.Copy(c, c)
+}
+
+// Run runs a workload from the client to the server.
+func (p *Pair) Run(opts *Options) (*Result, error) {
+	o := *opts
+	if o.Count == 0 {
+		o.Count = DefaultCount
+	}
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.Timeout)
+	defer cancel()
+
+	r := &Result{Transport: p.transport.Name(), Profile: p.profile.Name, Workload: o.Workload}
+	before := p.calls()
+	start := time.Now()
+	var err error
+	switch o.Workload {
+	case WorkloadBulk:
+		if o.Size == 0 {
+			o.Size = DefaultBulkSize
+		}
+		err = p.bulk(ctx, r, o.Size)
+	case WorkloadRR:
+		if o.Size == 0 {
+			o.Size = DefaultRRSize
+		}
+		err = p.rr(ctx, r, o.Size, o.Count)
+	case WorkloadPing:
+		err = p.ping(ctx, r, o.Count)
+	default:
+		return nil, fmt.Errorf("Run: unknown workload %q", o.Workload)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Run: %v over %v: %v", o.Workload, r.Transport, err)
+	}
+	if r.Duration == 0 {
+		r.Duration = time.Since(start)
+	}
+	r.Calls = map[string]uint64{}
+	for op, n := range p.calls() {
+		if d := n - before[op]; d > 0 {
+			r.Calls[op] = d
+		}
+	}
+	return r, nil
+}
+
+// calls sums the API calls of both nodes.
+func (p *Pair) calls() map[string]uint64 {
+	calls := map[string]uint64{}
+	for _, n := range []*node{p.client, p.server} {
+		for op, c := range n.calls() {
+			calls[op] += c
+		}
+	}
+	return calls
+}
+
+func (p *Pair) dial(ctx context.Context, port uint16) (net.Conn, error) {
+	c, err := gonet.DialContextTCP(ctx, p.client.stack, tcpip.FullAddress{NIC: 1, Addr: p.server.addr, Port: port}, ipv4.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	return c, nil
+}
+
+// bulk times the transfer from the end of the handshake to the
+// acknowledgement of the server.
+func (p *Pair) bulk(ctx context.Context, r *Result, size int) error {
+	c, err := p.dial(ctx, bulkPort)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	start := time.Now()
+	if err := binary.Write(c, binary.BigEndian, uint64(size)); err != nil {
+		return err
+	}
+	if _, err := c.Write(make([]byte, size)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+		return err
+	}
+	r.Bytes = int64(size)
+	r.Duration = time.Since(start)
+	r.RTTs = append(r.RTTs, r.Duration)
+	return nil
+}
+
+func (p *Pair) rr(ctx context.Context, r *Result, size, count int) error {
+	req := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(req, uint32(size))
+	resp := make([]byte, size)
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		c, err := p.dial(ctx, rrPort)
+		if err != nil {
+			return err
+		}
+		_, err = c.Write(req)
+		if err == nil {
+			_, err = io.ReadFull(c, resp)
+		}
+		c.Close()
+		if err != nil {
+			return err
+		}
+		r.Bytes += int64(2 * size)
+		r.RTTs = append(r.RTTs, time.Since(start))
+	}
+	return nil
+}
+
+func (p *Pair) ping(ctx context.Context, r *Result, count int) error {
+	c, err := p.dial(ctx, pingPort)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	msg := make([]byte, PingSize)
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return err
+		}
+		r.Bytes += 2 * PingSize
+		r.RTTs = append(r.RTTs, time.Since(start))
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package bench
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/tcpprofile"
+)
+
+// Tuning of the benchmarks, i.e. go test -bench . ./bench -args -write-batch 16
+var (
+	readInterval      = flag.Duration("read-interval", cloudwatch.DefaultReadInterval, "read interval of the links")
+	broadcastInterval = flag.Duration("broadcast-interval", cloudwatch.DefaultBroadcastInterval, "broadcast read interval of the links")
+	writeInterval     = flag.Duration("write-interval", cloudwatch.DefaultWriteInterval, "write interval of the links")
+	writeBatch        = flag.Int("write-batch", cloudwatch.DefaultWriteBatch, "packets written per call")
+	latency           = flag.Duration("latency", 20*time.Millisecond, "latency of the simulated API calls")
+	rateLimit         = flag.Float64("rate-limit", 0, "calls per second allowed by the simulated APIs, unlimited if 0")
+	useAWS            = flag.Bool("aws", false, "also benchmark the aws transport, on log groups deleted when the benchmarks end")
+	region            = flag.String("region", "", "region of the aws transport")
+)
+
+// TestMain deletes the log groups of the aws transports once the
+// benchmarks are done.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	pairsMu.Lock()
+	for _, t := range cleanups {
+		if err := t.Cleanup(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	pairsMu.Unlock()
+	os.Exit(code)
+}
+
+func TestResult(t *testing.T) {
+	r := &Result{
+		Bytes:    2e6,
+		Duration: 4 * time.Second,
+		Calls:    map[string]uint64{"PutLogEvents": 30, "FilterLogEvents": 10},
+	}
+	for i := 100; i > 0; i-- {
+		r.RTTs = append(r.RTTs, time.Duration(i)*time.Millisecond)
+	}
+	if r.Goodput() != 5e5 || r.CallsPerMB() != 20 {
+		t.Errorf("Expected 500 KB/s and 20 calls/MB, got %v", r)
+	}
+	if p50, p99 := r.Percentile(50), r.Percentile(99); p50 != 50*time.Millisecond || p99 != 99*time.Millisecond {
+		t.Errorf("Expected p50 50ms and p99 99ms, got %v and %v", p50, p99)
+	}
+	if (&Result{}).Percentile(50) != 0 {
+		t.Errorf("Expected no percentile without samples")
+	}
+}
+
+// frames records the frames delivered by a link.
+type frames struct {
+	mu  sync.Mutex
+	got []tcpip.LinkAddress
+}
+
+func (f *frames) DeliverNetworkPacket(_ stack.LinkEndpoint, remote, _ tcpip.LinkAddress, _ tcpip.NetworkProtocolNumber, _ buffer.VectorisedView) {
+	f.mu.Lock()
+	f.got = append(f.got, remote)
+	f.mu.Unlock()
+}
+
+func (f *frames) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.got)
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(&MemoryOptions{Polling: cloudwatch.Polling{
+		ReadInterval:      time.Millisecond,
+		BroadcastInterval: time.Millisecond,
+		WriteInterval:     time.Millisecond,
+		WriteBatch:        4,
+	}})
+	a, b, c := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01"), tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02"), tcpip.LinkAddress("\x02\x00\x00\x00\x00\x03")
+	eps := map[tcpip.LinkAddress]*memoryLink{}
+	got := map[tcpip.LinkAddress]*frames{}
+	for _, addr := range []tcpip.LinkAddress{a, b, c} {
+		eps[addr] = m.newLink(addr)
+		got[addr] = &frames{}
+		eps[addr].Attach(got[addr])
+	}
+
+	write := func(dst tcpip.LinkAddress) {
+		hdr := buffer.NewPrependable(header.EthernetMinimumSize)
+		r := &stack.Route{LocalLinkAddress: a, RemoteLinkAddress: dst}
+		eps[a].WritePacket(r, nil, hdr, buffer.NewViewFromBytes([]byte("hello")).ToVectorisedView(), header.IPv4ProtocolNumber)
+	}
+	write(b)
+	write(tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for got[b].count() < 2 || got[c].count() < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected b to get 2 frames and c the broadcast, got %v and %v", got[b].count(), got[c].count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got[a].count() != 0 || got[c].count() != 1 {
+		t.Errorf("Expected the sender not to get its broadcast and c only the broadcast, got %v and %v", got[a].count(), got[c].count())
+	}
+	s := eps[a].Stats()
+	if s.TxPackets != 2 || s.Calls["PutFrames"] == 0 || s.Calls["GetFrames"] == 0 {
+		t.Errorf("Unexpected counters %v", s)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{rate: 2}
+	if !l.allow() || !l.allow() || l.allow() {
+		t.Errorf("Expected a burst of 2 calls")
+	}
+	l.last = l.last.Add(-time.Second)
+	if !l.allow() {
+		t.Errorf("Expected calls to be allowed again after a second")
+	}
+}
+
+func TestCloudwatch_Cleanup(t *testing.T) {
+	c := NewFake(0, 0, cloudwatch.Polling{})
+	for _, g := range []string{"BenchNet/members", "BenchNet/020000000001", "OtherNet/members"} {
+		c.svc.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: aws.String(g)})
+	}
+	if err := c.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	out, err := c.svc.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{})
+	if err != nil {
+		t.Fatalf("DescribeLogGroups: %v", err)
+	}
+	if len(out.LogGroups) != 1 || aws.StringValue(out.LogGroups[0].LogGroupName) != "OtherNet/members" {
+		t.Errorf("Expected only the groups of the network to be deleted, got %v", out.LogGroups)
+	}
+}
+
+func polling() cloudwatch.Polling {
+	return cloudwatch.Polling{
+		ReadInterval:      *readInterval,
+		BroadcastInterval: *broadcastInterval,
+		WriteInterval:     *writeInterval,
+		WriteBatch:        *writeBatch,
+	}
+}
+
+var (
+	pairsMu sync.Mutex
+	pairs   = map[string]*Pair{}
+	// cleanups are the transports on AWS, cleaned up by TestMain.
+	cleanups []*Cloudwatch
+)
+
+// pair returns a pair linked by the named transport and tuned with profile,
+// shared by the benchmarks since links can't be stopped.
+func pair(b *testing.B, name string, profile *tcpprofile.Profile) *Pair {
+	pairsMu.Lock()
+	defer pairsMu.Unlock()
+	key := name + "/" + profile.Name
+	if p, ok := pairs[key]; ok {
+		return p
+	}
+	var t Transport
+	switch name {
+	case "memory":
+		t = NewMemory(&MemoryOptions{Latency: *latency, RateLimit: *rateLimit, Polling: polling()})
+	case "fake":
+		fake := NewFake(*latency, *rateLimit, polling())
+		fake.QoS = profile.QoS(nil)
+		t = fake
+	case "aws":
+		if !*useAWS || testing.Short() {
+			b.Skip("Not using AWS without -aws")
+		}
+		cw, err := NewAWS(*region, polling())
+		if err != nil {
+			b.Fatal(err)
+		}
+		cleanups = append(cleanups, cw)
+		cw.QoS = profile.QoS(nil)
+		t = cw
+	}
+	p, err := NewPair(t, profile)
+	if err != nil {
+		b.Fatalf("NewPair: %v", err)
+	}
+	pairs[key] = p
+	return p
+}
+
+// benchmark runs a workload b.N times over every transport with every TCP
+// profile, and reports the goodput, round trip times and API calls per
+// megabyte of all of them.
+func benchmark(b *testing.B, opts *Options) {
+	for _, name := range []string{"memory", "fake", "aws"} {
+		for _, profile := range []*tcpprofile.Profile{tcpprofile.Default, tcpprofile.HighLatency} {
+			benchmarkPair(b, name, profile, opts)
+		}
+	}
+}
+
+func benchmarkPair(b *testing.B, name string, profile *tcpprofile.Profile, opts *Options) {
+	b.Run(name+"/"+profile.Name, func(b *testing.B) {
+		p := pair(b, name, profile)
+		total := &Result{Calls: map[string]uint64{}}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r, err := p.Run(opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			total.Bytes += r.Bytes
+			total.Duration += r.Duration
+			total.RTTs = append(total.RTTs, r.RTTs...)
+			for op, n := range r.Calls {
+				total.Calls[op] += n
+			}
+		}
+		b.ReportMetric(total.Goodput()/1e3, "KB/s")
+		b.ReportMetric(float64(total.Percentile(50))/float64(time.Millisecond), "p50-ms")
+		b.ReportMetric(float64(total.Percentile(99))/float64(time.Millisecond), "p99-ms")
+		b.ReportMetric(total.CallsPerMB(), "calls/MB")
+	})
+}
+
+func BenchmarkBulk(b *testing.B) {
+	benchmark(b, &Options{Workload: WorkloadBulk, Size: 16 << 10})
+}
+
+func BenchmarkRR(b *testing.B) {
+	benchmark(b, &Options{Workload: WorkloadRR, Count: 1})
+}
+
+func BenchmarkPing(b *testing.B) {
+	benchmark(b, &Options{Workload: WorkloadPing, Count: 1})
+}
@@ -0,0 +1,119 @@
+package bench
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch/cloudwatchtest"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// Cloudwatch links nodes with Cloudwatch links, through the fake service of
+// cloudwatchtest or Cloudwatch Logs.
+type Cloudwatch struct {
+	// QoS configures the queues of the links created after it is set, i.e.
+	// to coalesce ACKs as a tcpprofile.Profile does.
+	QoS *qos.Options
+
+	name    string
+	svc     cloudwatchlogsiface.CloudWatchLogsAPI
+	network string
+	polling cloudwatch.Polling
+	logger  logging.Logger
+}
+
+// NewFake returns a transport through a fake service adding latency to
+// every call and throttling calls over rateLimit per second and operation,
+// or none if zero.
+func NewFake(latency time.Duration, rateLimit float64, polling cloudwatch.Polling) *Cloudwatch {
+	svc := cloudwatchtest.New()
+	svc.Latency = latency
+	svc.RateLimit = rateLimit
+	return &Cloudwatch{name: "fake", svc: svc, network: "BenchNet", polling: polling, logger: logging.Discard}
+}
+
+// NewAWS returns a transport through Cloudwatch Logs in region, on a new
+// network whose log groups expire after a day, or are deleted by Cleanup.
+// It fails without AWS credentials.
+func NewAWS(region string, polling cloudwatch.Polling) (*Cloudwatch, error) {
+	if region == "" {
+		region = cloudwatch.DefaultRegion
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, fmt.Errorf("NewAWS: no AWS credentials: %v", err)
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	return &Cloudwatch{
+		name:    "aws",
+		svc:     cloudwatchlogs.New(sess),
+		network: fmt.Sprintf("bench-%x", id),
+		polling: polling,
+		logger:  logging.Default(),
+	}, nil
+}
+
+// Name implements Transport.
+func (c *Cloudwatch) Name() string {
+	return c.name
+}
+
+// Network returns the name of the network of the nodes.
+func (c *Cloudwatch) Network() string {
+	return c.network
+}
+
+// Link implements Transport.
+func (c *Cloudwatch) Link(mac tcpip.LinkAddress) tcpip.LinkEndpointID {
+	id, _ := cloudwatch.New(&cloudwatch.Options{
+		Address:        mac,
+		EthernetHeader: true,
+		NetworkName:    c.network,
+		LogService:     c.svc,
+		RetentionDays:  1,
+		Polling:        c.polling,
+		Logger:         c.logger,
+		QoS:            c.QoS,
+	})
+	return id
+}
+
+// Cleanup deletes the log groups of the network, the links of the transport
+// must not be used after.
+func (c *Cloudwatch) Cleanup() error {
+	var groups []string
+	err := c.svc.DescribeLogGroupsPages(&cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(c.network + "/"),
+	}, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, g := range page.LogGroups {
+			groups = append(groups, aws.StringValue(g.LogGroupName))
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Cleanup: could not list the log groups of %v: %v", c.network, err)
+	}
+	for _, g := range groups {
+		_, err := c.svc.DeleteLogGroup(&cloudwatchlogs.DeleteLogGroupInput{LogGroupName: aws.String(g)})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Cleanup: could not delete %v: %v", g, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package bench
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/link/bridge"
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+// MemoryOptions configure the in-memory transport.
+type MemoryOptions struct {
+	// Latency is added to every call to the simulated API.
+	Latency time.Duration
+	// RateLimit is the number of calls per second each link can make,
+	// calls over it are throttled and retried at the next interval. Calls
+	// are not limited if zero.
+	RateLimit float64
+	// Polling are the read and write intervals of the links, as for
+	// Cloudwatch links.
+	Polling cloudwatch.Polling
+	// MTU of the links, cloudwatch.MTU if zero.
+	MTU uint32
+}
+
+// Memory is a transport simulating a polled API in memory, like Cloudwatch
+// Logs without its ingestion delay: links put batches of frames in the
+// mailbox of their destination, and read their own and the broadcast
+// mailbox at intervals.
+type Memory struct {
+	opts MemoryOptions
+
+	mu        sync.Mutex
+	mailboxes map[tcpip.LinkAddress][][]byte
+	// broadcasts are the mailboxes of broadcast frames of every link.
+	broadcasts map[tcpip.LinkAddress][][]byte
+}
+
+// NewMemory creates an in-memory transport.
+func NewMemory(opts *MemoryOptions) *Memory {
+	m := &Memory{
+		opts:       *opts,
+		mailboxes:  map[tcpip.LinkAddress][][]byte{},
+		broadcasts: map[tcpip.LinkAddress][][]byte{},
+	}
+	m.opts.Polling = m.opts.Polling.WithDefaults()
+	if m.opts.MTU == 0 {
+		m.opts.MTU = cloudwatch.MTU
+	}
+	return m
+}
+
+// Name implements Transport.
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+// Link implements Transport.
+func (m *Memory) Link(mac tcpip.LinkAddress) tcpip.LinkEndpointID {
+	return stack.RegisterLinkEndpoint(m.newLink(mac))
+}
+
+// newLink adds a mailbox for mac and returns its endpoint.
+func (m *Memory) newLink(mac tcpip.LinkAddress) *memoryLink {
+	m.mu.Lock()
+	m.mailboxes[mac] = nil
+	m.broadcasts[mac] = nil
+	m.mu.Unlock()
+	l := &memoryLink{
+		m:       m,
+		addr:    mac,
+		tx:      make(chan []byte, 256),
+		limiter: &limiter{rate: m.opts.RateLimit},
+	}
+	l.stats.SetQueue("tx", func() int { return len(l.tx) })
+	return l
+}
+
+// put delivers frames to the mailboxes of their destination.
+func (m *Memory) put(src tcpip.LinkAddress, frames [][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range frames {
+		dst := header.Ethernet(f).DestinationAddress()
+		if !bridge.IsGroup(dst) {
+			if _, ok := m.mailboxes[dst]; ok {
+				m.mailboxes[dst] = append(m.mailboxes[dst], f)
+			}
+			continue
+		}
+		for addr := range m.broadcasts {
+			if addr != src {
+				m.broadcasts[addr] = append(m.broadcasts[addr], f)
+			}
+		}
+	}
+}
+
+// get empties a mailbox of addr.
+func (m *Memory) get(boxes map[tcpip.LinkAddress][][]byte, addr tcpip.LinkAddress) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	frames := boxes[addr]
+	boxes[addr] = nil
+	return frames
+}
+
+// errThrottled is returned by calls over the rate limit, as AWS does.
+var errThrottled = awserr.New("ThrottlingException", "Rate exceeded", nil)
+
+// memoryLink is the endpoint of a node on a Memory transport.
+type memoryLink struct {
+	m          *Memory
+	addr       tcpip.LinkAddress
+	dispatcher stack.NetworkDispatcher
+	tx         chan []byte
+	limiter    *limiter
+	stats      stats.Counters
+}
+
+// call simulates a call to the API, counted as op.
+func (l *memoryLink) call(op string, fn func()) error {
+	start := time.Now()
+	time.Sleep(l.m.opts.Latency)
+	var err error
+	if l.limiter.allow() {
+		fn()
+	} else {
+		err = errThrottled
+	}
+	l.stats.Call(op, start, err)
+	return err
+}
+
+func (l *memoryLink) Attach(dispatcher stack.NetworkDispatcher) {
+	l.dispatcher = dispatcher
+	go l.writeLoop()
+	go l.readLoop(l.m.mailboxes, l.m.opts.Polling.ReadInterval)
+	go l.readLoop(l.m.broadcasts, l.m.opts.Polling.BroadcastInterval)
+}
+
+func (l *memoryLink) IsAttached() bool {
+	return l.dispatcher != nil
+}
+
+func (l *memoryLink) MTU() uint32 {
+	return l.m.opts.MTU
+}
+
+func (l *memoryLink) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+func (l *memoryLink) MaxHeaderLength() uint16 {
+	return header.EthernetMinimumSize
+}
+
+func (l *memoryLink) LinkAddress() tcpip.LinkAddress {
+	return l.addr
+}
+
+func (l *memoryLink) WritePacket(r *stack.Route, _ *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
+	src := r.LocalLinkAddress
+	if src == "" {
+		src = l.addr
+	}
+	eth.Encode(&header.EthernetFields{SrcAddr: src, DstAddr: r.RemoteLinkAddress, Type: protocol})
+	frame := append(append([]byte{}, hdr.View()...), payload.ToView()...)
+	select {
+	case l.tx <- frame:
+		l.stats.Sent(len(frame))
+	default:
+		l.stats.Drop(stats.DropWriteFailed)
+	}
+	return nil
+}
+
+// Stats implements stats.Source.
+func (l *memoryLink) Stats() stats.Snapshot {
+	return l.stats.Snapshot()
+}
+
+// writeLoop puts up to a batch of queued frames every write interval.
+// Throttled frames are put again at the next interval.
+func (l *memoryLink) writeLoop() {
+	p := l.m.opts.Polling
+	var pending [][]byte
+	for range time.Tick(p.WriteInterval) {
+	drain:
+		for len(pending) < p.WriteBatch {
+			select {
+			case f := <-l.tx:
+				pending = append(pending, f)
+			default:
+				break drain
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if err := l.call("PutFrames", func() { l.m.put(l.addr, pending) }); err == nil {
+			pending = nil
+		}
+	}
+}
+
+// readLoop delivers the frames of a mailbox to the stack every interval.
+func (l *memoryLink) readLoop(boxes map[tcpip.LinkAddress][][]byte, interval time.Duration) {
+	for range time.Tick(interval) {
+		var frames [][]byte
+		l.call("GetFrames", func() { frames = l.m.get(boxes, l.addr) })
+		for _, f := range frames {
+			eth := header.Ethernet(f)
+			vv := buffer.NewViewFromBytes(f).ToVectorisedView()
+			vv.TrimFront(header.EthernetMinimumSize)
+			l.stats.Received(len(f))
+			l.dispatcher.DeliverNetworkPacket(l, eth.SourceAddress(), eth.DestinationAddress(), eth.Type(), vv)
+		}
+	}
+}
+
+// limiter is a token bucket allowing rate calls per second, with bursts of
+// as many.
+type limiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = l.rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/smithclay/rlinklayer/bench"
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/tcpprofile"
+)
+
+func init() {
+	register("bench", "measure goodput, round trips and API calls between two nodes", runBench)
+}
+
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	transport := fs.String("transport", "memory", "transport of the nodes, memory, fake or aws")
+	workload := fs.String("workload", "all", "workload to run, bulk, rr, ping or all")
+	size := fs.Int("size", 0, fmt.Sprintf("bytes sent by bulk, %d if 0, or size of the rr requests, %d if 0", bench.DefaultBulkSize, bench.DefaultRRSize))
+	count := fs.Int("count", bench.DefaultCount, "number of rr requests or pings")
+	timeout := fs.Duration("timeout", bench.DefaultTimeout, "timeout of each workload")
+	latency := fs.Duration("latency", 20*time.Millisecond, "latency of the calls of the memory and fake transports")
+	rateLimit := fs.Float64("rate-limit", 0, "calls per second allowed by the memory and fake transports, unlimited if 0")
+	readInterval := fs.Duration("read-interval", linkaws.DefaultReadInterval, "interval of the reads of the links")
+	broadcastInterval := fs.Duration("broadcast-interval", linkaws.DefaultBroadcastInterval, "interval of the broadcast reads of the links")
+	writeInterval := fs.Duration("write-interval", linkaws.DefaultWriteInterval, "interval of the writes of the links")
+	writeBatch := fs.Int("write-batch", linkaws.DefaultWriteBatch, "packets written per call")
+	profile := fs.String("tcp-profile", "all", "TCP profile of the nodes, high-latency, default or all to compare them")
+	parse(fs, c, args)
+
+	polling := linkaws.Polling{
+		ReadInterval:      *readInterval,
+		BroadcastInterval: *broadcastInterval,
+		WriteInterval:     *writeInterval,
+		WriteBatch:        *writeBatch,
+	}
+	// The log groups of aws networks are deleted when the command ends,
+	// once no link uses them anymore.
+	var cleanups []*bench.Cloudwatch
+	cleanup := func() {
+		for _, t := range cleanups {
+			if err := t.Cleanup(); err != nil {
+				log.Printf("runBench: %v", err)
+			}
+		}
+	}
+	fatalf := func(format string, v ...interface{}) {
+		cleanup()
+		log.Fatalf(format, v...)
+	}
+	// Every profile gets its own transport, so that nodes of different
+	// profiles never share a network.
+	newTransport := func(p *tcpprofile.Profile) bench.Transport {
+		switch *transport {
+		case "memory":
+			return bench.NewMemory(&bench.MemoryOptions{Latency: *latency, RateLimit: *rateLimit, Polling: polling})
+		case "fake":
+			fake := bench.NewFake(*latency, *rateLimit, polling)
+			fake.QoS = p.QoS(nil)
+			return fake
+		case "aws":
+			aws, err := bench.NewAWS(*c.region, polling)
+			if err != nil {
+				fatalf("runBench: %v", err)
+			}
+			cleanups = append(cleanups, aws)
+			aws.QoS = p.QoS(nil)
+			fmt.Printf("benchmarking %v on network %v in %v\n", p, aws.Network(), *c.region)
+			return aws
+		}
+		log.Fatalf("runBench: unknown -transport %q", *transport)
+		return nil
+	}
+	workloads := []string{*workload}
+	if *workload == "all" {
+		workloads = bench.Workloads
+	}
+	profiles := []*tcpprofile.Profile{tcpprofile.Default, tcpprofile.HighLatency}
+	if *profile != "all" {
+		p, err := tcpprofile.Parse(*profile)
+		if err != nil {
+			log.Fatalf("runBench: invalid -tcp-profile: %v", err)
+		}
+		profiles = []*tcpprofile.Profile{p}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TRANSPORT\tPROFILE\tWORKLOAD\tBYTES\tTIME\tKB/S\tRTT P50\tRTT P99\tCALLS\tCALLS/MB")
+	for _, prof := range profiles {
+		p, err := bench.NewPair(newTransport(prof), prof)
+		if err != nil {
+			fatalf("runBench: could not start nodes: %v", err)
+		}
+		for _, name := range workloads {
+			r, err := p.Run(&bench.Options{Workload: name, Size: *size, Count: *count, Timeout: *timeout})
+			if err != nil {
+				w.Flush()
+				fatalf("runBench: %v failed: %v", name, err)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%.1f\t%v\t%v\t%v\t%.0f\n",
+				r.Transport, r.Profile, r.Workload, r.Bytes, r.Duration.Round(time.Millisecond), r.Goodput()/1e3,
+				r.Percentile(50).Round(time.Millisecond), r.Percentile(99).Round(time.Millisecond), r.TotalCalls(), r.CallsPerMB())
+		}
+	}
+	w.Flush()
+	cleanup()
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 Clay Smith
+
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/sniffer"
+	"github.com/google/netstack/tcpip/network/arp"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	linkbridge "github.com/smithclay/rlinklayer/link/bridge"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/metrics"
+	"github.com/smithclay/rlinklayer/utils"
+)
+
+func init() {
+	register("bridge", "connect a Cloudwatch network to a tap or tun device", runBridge)
+}
+
+// bridgeFlags configure the bridge command.
+type bridgeFlags struct {
+	*commonFlags
+	*keyFlags
+	*pcapFlags
+	*metricsFlags
+	*traceFlags
+	*budgetFlags
+	*qosFlags
+	mode       *string
+	dev        *string
+	devAddr    *string
+	devMac     *string
+	ip         *string
+	cidr       *string
+	routes     *string
+	masquerade *bool
+	publish    *string
+	retention  *int64
+}
+
+func runBridge(args []string) {
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	b := &bridgeFlags{
+		commonFlags:  addCommonFlags(fs),
+		keyFlags:     addKeyFlags(fs),
+		pcapFlags:    addPcapFlags(fs),
+		metricsFlags: addMetricsFlags(fs),
+		traceFlags:   addTraceFlags(fs),
+		budgetFlags:  addBudgetFlags(fs),
+		qosFlags:     addQoSFlags(fs),
+		mode:         fs.String("mode", "tun", "tap bridges frames, tun routes packets"),
+		dev:          fs.String("dev", "", "device name, tap0 or tun0 if empty"),
+		devAddr:      fs.String("dev-addr", "", "address and prefix length given to the device, as 192.168.1.1/24"),
+		devMac:       fs.String("dev-mac", "", "link address of the tap device, random if empty, must differ from -mac"),
+		ip:           fs.String("ip", "", "overlay address of the bridge or gateway, required in tun mode"),
+		cidr:         fs.String("cidr", "192.168.1.0/24", "overlay network, routed through the device in tun mode"),
+		routes:       fs.String("routes", "", "comma separated networks behind the tun device (default everything outside -cidr)"),
+		masquerade:   fs.Bool("masquerade", false, "rewrite the source of packets from the tun device to the -ip address"),
+		publish:      fs.String("publish", "", "overlay services published on the tun device, as proto:[address:]port=to[:toport]"),
+		retention:    fs.Int64("retention", 0, "retention in days of log groups created on the network, 0 keeps them forever"),
+	}
+	parse(fs, b.commonFlags, args)
+	if *b.dev == "" {
+		*b.dev = *b.mode + "0"
+	}
+	defer b.stop()
+	defer b.stopTracer()
+
+	switch *b.mode {
+	case "tap":
+		b.startTap()
+	case "tun":
+		b.startGateway()
+	default:
+		log.Fatalf("runBridge: unknown -mode %q", *b.mode)
+	}
+	waitForSignal()
+}
+
+// setupDevice gives the device its address and routes and brings it up.
+func (b *bridgeFlags) setupDevice(mac tcpip.LinkAddress, routes ...*net.IPNet) {
+	if mac != "" {
+		if err := utils.SetLinkAddress(*b.dev, mac); err != nil {
+			log.Fatalf("setupDevice: could not set the address of %v: %v", *b.dev, err)
+		}
+	}
+	if *b.devAddr != "" {
+		ip, n, err := net.ParseCIDR(*b.devAddr)
+		if err != nil {
+			log.Fatalf("setupDevice: invalid -dev-addr: %v", err)
+		}
+		n.IP = ip
+		if err := utils.AddLinkAddress(*b.dev, n); err != nil {
+			log.Fatalf("setupDevice: could not add %v to %v: %v", n, *b.dev, err)
+		}
+	}
+	if err := utils.SetLinkUp(*b.dev); err != nil {
+		log.Fatalf("setupDevice: could not bring %v up: %v", *b.dev, err)
+	}
+	for _, r := range routes {
+		if err := utils.AddRoute(r, *b.dev); err != nil {
+			log.Fatalf("setupDevice: could not route %v through %v: %v", r, *b.dev, err)
+		}
+	}
+	logging.Default().Info("device is up", "dev", *b.dev)
+}
+
+// startGateway routes between the tun device and the overlay.
+func (b *bridgeFlags) startGateway() *linkbridge.Gateway {
+	if *b.ip == "" {
+		log.Fatalf("startGateway: -ip is required in tun mode")
+	}
+	_, network, err := net.ParseCIDR(*b.cidr)
+	if err != nil {
+		log.Fatalf("startGateway: invalid -cidr: %v", err)
+	}
+	var behindTun []*net.IPNet
+	for _, r := range strings.Split(*b.routes, ",") {
+		if r == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			log.Fatalf("startGateway: invalid route %v: %v", r, err)
+		}
+		behindTun = append(behindTun, n)
+	}
+	forwards, err := linkbridge.ParsePortForwards(*b.publish)
+	if err != nil {
+		log.Fatalf("startGateway: invalid -publish: %v", err)
+	}
+
+	tunLink := sniffer.New(b.wrap(utils.NewTunLink(*b.dev), *b.dev, false))
+	b.setupDevice("", network)
+	overlayLink, overlayEP := linkaws.New(&linkaws.Options{
+		NetworkName:    *b.net,
+		EthernetHeader: true,
+		Address:        b.linkAddress(),
+		LogService:     b.logService(),
+		RetentionDays:  *b.retention,
+		Sealer:         b.sealer(b.commonFlags),
+		Tracer:         b.startTracer(b.commonFlags),
+		Budget:         b.budget(b.commonFlags),
+		QoS:            b.qos(),
+	})
+	overlayLink = b.wrap(overlayLink, "overlay", true)
+
+	gw, err := linkbridge.NewGateway(&linkbridge.GatewayOptions{
+		Tun:          tunLink,
+		Overlay:      overlayLink,
+		Address:      net.ParseIP(*b.ip),
+		Network:      network,
+		Routes:       behindTun,
+		Masquerade:   *b.masquerade,
+		PortForwards: forwards,
+	})
+	if err != nil {
+		log.Fatalf("startGateway: %v", err)
+	}
+	gw.Start()
+	logging.Default().Info("routing", "dev", *b.dev, "network", network, "ip", *b.ip)
+	for _, f := range forwards {
+		logging.Default().Info("publishing", "forward", f)
+	}
+	onSignal(syscall.SIGUSR1, func() {
+		dumpNeighbors(gw, overlayEP)
+		fmt.Printf("Budget: %v\n", b.budget(b.commonFlags).Usage())
+	})
+	b.serve(
+		metrics.WithLabels(metrics.Link("cloudwatch", overlayEP), map[string]string{"network": *b.net}),
+		metrics.WithLabels(gatewayMetrics(gw), map[string]string{"network": *b.net}),
+		metrics.WithLabels(metrics.Budget(b.budget(b.commonFlags)), map[string]string{"network": *b.net}),
+	)
+	return gw
+}
+
+// startTap bridges the tap device to the overlay.
+func (b *bridgeFlags) startTap() *stack.Stack {
+	localLink := b.linkAddress()
+	devLink := utils.GenerateRandomMac()
+	if *b.devMac != "" {
+		devLink = parseMAC("-dev-mac", *b.devMac)
+	}
+	if devLink == localLink {
+		log.Fatalf("startTap: -dev-mac must differ from -mac, frames from the device would look local")
+	}
+
+	s := stack.New([]string{ipv4.ProtocolName, arp.ProtocolName}, []string{tcp.ProtocolName}, stack.Options{})
+	if err := b.profile().Apply(s); err != nil {
+		log.Fatalf("startTap: %v", err)
+	}
+	tapLink := sniffer.New(b.wrap(utils.NewTapLink(*b.dev, localLink), *b.dev, true))
+	b.setupDevice(devLink)
+
+	logging.Default().Info("bridging", "dev", *b.dev, "dev_mac", devLink, "network", *b.net, "mac", localLink)
+	awsLinkID, awsEP := linkaws.New(&linkaws.Options{
+		NetworkName:    *b.net,
+		EthernetHeader: true,
+		Address:        localLink,
+		LogService:     b.logService(),
+		RetentionDays:  *b.retention,
+		Sealer:         b.sealer(b.commonFlags),
+		Tracer:         b.startTracer(b.commonFlags),
+		Budget:         b.budget(b.commonFlags),
+		QoS:            b.qos(),
+	})
+	// The stack is a host on the bridge, reached from both ports.
+	br, err := linkbridge.NewBridge(&linkbridge.BridgeOptions{
+		Ports: []linkbridge.PortOptions{
+			{Name: linkbridge.Port(*b.dev), Endpoint: tapLink},
+			{Name: "cloudwatch", Endpoint: awsLinkID},
+		},
+		Address: localLink,
+	})
+	if err != nil {
+		log.Fatalf("startTap: %v", err)
+	}
+	onSignal(syscall.SIGUSR1, func() {
+		fmt.Printf("MAC table:\n%v\n", br.MACTable())
+		for _, p := range br.Stats() {
+			fmt.Printf("Port: %v\n", p)
+		}
+		fmt.Printf("Overlay link: %v\n", awsEP.Stats())
+		fmt.Printf("Budget: %v\n", b.budget(b.commonFlags).Usage())
+	})
+
+	if err := s.CreateNIC(1, stack.RegisterLinkEndpoint(br)); err != nil {
+		log.Fatalf("startTap: could not create NIC: %v", err)
+	}
+	if err := s.AddAddress(1, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		log.Fatalf("startTap: could not enable ARP: %v", err)
+	}
+	if *b.ip != "" {
+		addr := utils.IpToAddress(net.ParseIP(*b.ip))
+		if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+			log.Fatalf("startTap: could not add %v: %v", *b.ip, err)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		Gateway:     "",
+		NIC:         1,
+	}})
+	b.serve(metrics.WithLabels(metrics.CollectorFunc(func() []metrics.Sample {
+		samples := append(metrics.LinkSamples("cloudwatch", awsEP.Stats()), metrics.TCPSamples(s.Stats())...)
+		return append(samples, metrics.BudgetSamples(b.budget(b.commonFlags).Usage())...)
+	}), map[string]string{"network": *b.net}))
+	return s
+}
+
+// dumpNeighbors prints the gateway's resolved overlay addresses, translated
+// flows and counters.
+func dumpNeighbors(gw *linkbridge.Gateway, overlay stats.Source) {
+	fmt.Println("Neighbors:")
+	for _, n := range gw.Neighbors() {
+		fmt.Println(n)
+	}
+	for _, f := range gw.NATFlows() {
+		fmt.Println(f)
+	}
+	fmt.Printf("%+v\n", gw.Stats())
+	fmt.Printf("Overlay link: %v\n", overlay.Stats())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/smithclay/rlinklayer/link/budget"
+)
+
+// budgetFlags configure the cost estimates and budget of the network, in the
+// commands that create links.
+type budgetFlags struct {
+	bytesPerHour   *uint64
+	callsPerMinute *uint64
+	budgetAction   *string
+	budgetMaxDelay *time.Duration
+	priceGB        *float64
+	priceCalls     *float64
+
+	meter *budget.Meter
+}
+
+func addBudgetFlags(fs *flag.FlagSet) *budgetFlags {
+	return &budgetFlags{
+		bytesPerHour:   fs.Uint64("budget-bytes-per-hour", 0, "bytes CloudWatch Logs may ingest in an hour, unlimited if 0"),
+		callsPerMinute: fs.Uint64("budget-calls-per-minute", 0, "calls to AWS allowed in a minute, unlimited if 0"),
+		budgetAction:   fs.String("budget-action", budget.Shed, "what to do with calls over budget, shed or delay"),
+		budgetMaxDelay: fs.Duration("budget-max-delay", budget.DefaultMaxDelay, "longest a call waits for the budget with -budget-action delay"),
+		priceGB:        fs.Float64("price-ingested-gb", budget.DefaultPrices.IngestedGB, "dollars per GB ingested by CloudWatch Logs, for cost estimates"),
+		priceCalls:     fs.Float64("price-calls", budget.DefaultPrices.OtherCalls, "dollars per thousand calls to AWS, for cost estimates"),
+	}
+}
+
+// budget returns the meter of the network, shared by the links of the
+// command.
+func (b *budgetFlags) budget(c *commonFlags) *budget.Meter {
+	if b.meter != nil {
+		return b.meter
+	}
+	if *b.budgetAction != budget.Shed && *b.budgetAction != budget.Delay {
+		log.Fatalf("budget: unknown -budget-action %q", *b.budgetAction)
+	}
+	b.meter = budget.New(&budget.Options{
+		Network: *c.net,
+		Prices:  &budget.Prices{IngestedGB: *b.priceGB, OtherCalls: *b.priceCalls},
+		Limits: budget.Limits{
+			BytesPerHour:   *b.bytesPerHour,
+			CallsPerMinute: *b.callsPerMinute,
+			Action:         *b.budgetAction,
+			MaxDelay:       *b.budgetMaxDelay,
+		},
+	})
+	return b.meter
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/sniffer"
+	"github.com/google/netstack/tcpip/stack"
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/link/capture"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+func init() {
+	register("capture", "log or record the frames broadcast on a Cloudwatch network or sent to some members", runCapture)
+}
+
+// discard is the dispatcher of captured frames, they are only logged and
+// recorded.
+type discard struct{}
+
+func (discard) DeliverNetworkPacket(stack.LinkEndpoint, tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, buffer.VectorisedView) {
+}
+
+// runCapture reads the network without taking part in it. Reading log groups
+// doesn't consume frames, so members keep receiving the frames sent to the
+// addresses given with -watch. With -pcap the frames are recorded to a
+// pcapng file.
+//
+// With -from-logs it converts the frames already logged on the network
+// between -start and -end to the -pcap file instead, and exits.
+func runCapture(args []string) {
+	fs := flag.NewFlagSet("capture", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	k := addKeyFlags(fs)
+	p := addPcapFlags(fs)
+	var watch listFlag
+	fs.Var(&watch, "watch", "also capture frames sent to this link address (repeatable)")
+	fromLogs := fs.Bool("from-logs", false, "convert the frames logged between -start and -end to -pcap, without joining the network")
+	start := fs.String("start", "", "with -from-logs, RFC 3339 time of the first frame (default -since ago)")
+	end := fs.String("end", "", "with -from-logs, RFC 3339 time of the last frame (default now)")
+	since := fs.Duration("since", time.Hour, "with -from-logs and no -start, how far back to read")
+	parse(fs, c, args)
+
+	if *fromLogs {
+		if *p.pcap == "" {
+			log.Fatalf("runCapture: -from-logs needs a -pcap file")
+		}
+		to := parseTime("-end", *end, time.Now())
+		from := parseTime("-start", *start, to.Add(-*since))
+		f, err := os.Create(*p.pcap)
+		if err != nil {
+			log.Fatalf("runCapture: %v", err)
+		}
+		n, err := convertLogs(f, c.logService(), *c.net, from, to, k.sealer(c), *p.filter)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("runCapture: could not convert the logs of %v: %v", *c.net, err)
+		}
+		logging.Default().Info("wrote logged frames", "frames", n, "network", *c.net, "from", from.Format(time.RFC3339), "to", to.Format(time.RFC3339), "path", *p.pcap)
+		return
+	}
+
+	id, ep := linkaws.New(&linkaws.Options{
+		NetworkName:    *c.net,
+		EthernetHeader: true,
+		Address:        c.linkAddress(),
+		LogService:     c.logService(),
+		Sealer:         k.sealer(c),
+	})
+	defer p.stop()
+	stack.FindLinkEndpoint(sniffer.New(p.wrap(id, *c.net, true))).Attach(discard{})
+	logging.Default().Info("capturing broadcasts", "network", *c.net)
+	for _, s := range watch {
+		mac := parseMAC("-watch", s)
+		if err := ep.Listen(mac); err != nil {
+			log.Fatalf("runCapture: could not listen for %v: %v", mac, err)
+		}
+		logging.Default().Info("capturing frames", "network", *c.net, "mac", mac)
+	}
+	waitForSignal()
+}
+
+// parseTime parses the RFC 3339 time of flag name, def if it is empty.
+func parseTime(name, s string, def time.Time) time.Time {
+	if s == "" {
+		return def
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		log.Fatalf("parseTime: invalid %v: %v", name, err)
+	}
+	return t
+}
+
+// convertLogs writes the frames logged on a network between start and end
+// that pass filter to w as pcapng. Each log stream, a source writing to a
+// destination group, is an interface. It returns the number of frames
+// written.
+func convertLogs(w io.Writer, svc cloudwatchlogsiface.CloudWatchLogsAPI, netName string, start, end time.Time, sealer *secure.Sealer, filter string) (int, error) {
+	expr, err := capture.ParseExpr(filter)
+	if err != nil {
+		return 0, err
+	}
+	packets, err := linkaws.ReadPackets(svc, netName, start, end, sealer)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	pw, err := capture.NewWriter(bw)
+	if err != nil {
+		return 0, err
+	}
+	ifaces := map[string]uint32{}
+	n := 0
+	for _, p := range packets {
+		frame := p.Frame()
+		if !expr.MatchEthernet(frame) {
+			continue
+		}
+		name := p.Group + "/" + p.Stream
+		i, ok := ifaces[name]
+		if !ok {
+			if i, err = pw.AddInterface(name, capture.LinkTypeEthernet); err != nil {
+				return n, err
+			}
+			ifaces[name] = i
+		}
+		if err := pw.WritePacket(i, p.Time, frame); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch/cloudwatchtest"
+)
+
+// logPacket logs pl like a link would, tokens holds the sequence tokens of
+// the streams.
+func logPacket(t *testing.T, svc *cloudwatchtest.Service, tokens map[string]*string, group, stream string, pl linkaws.PacketLog, at time.Time) {
+	svc.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: aws.String(group)})
+	svc.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{LogGroupName: aws.String(group), LogStreamName: aws.String(stream)})
+	data, _ := json.Marshal(pl)
+	out, err := svc.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		SequenceToken: tokens[group+"/"+stream],
+		LogEvents: []*cloudwatchlogs.InputLogEvent{{
+			Message:   aws.String(string(data)),
+			Timestamp: aws.Int64(at.UnixNano() / int64(time.Millisecond)),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("PutLogEvents: %v", err)
+	}
+	tokens[group+"/"+stream] = out.NextSequenceToken
+}
+
+func udpPacket(dport uint16) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address("\xc0\xa8\x01\x03"),
+		DstAddr:     tcpip.Address("\xc0\xa8\x01\x15"),
+	})
+	header.UDP(b[header.IPv4MinimumSize:]).Encode(&header.UDPFields{SrcPort: 40000, DstPort: dport, Length: header.UDPMinimumSize})
+	return b
+}
+
+func TestConvertLogs(t *testing.T) {
+	svc := cloudwatchtest.New()
+	tokens := map[string]*string{}
+	start := time.Unix(1546300800, 0)
+	for i, p := range []struct {
+		group, stream, src, dest string
+		port                     uint16
+	}{
+		{"TestNet/020000000002", "020000000001", "02:00:00:00:00:01", "02:00:00:00:00:02", 53},
+		{"TestNet/ffffffffffff", "020000000001", "02:00:00:00:00:01", "ff:ff:ff:ff:ff:ff", 53},
+		{"TestNet/020000000002", "020000000003", "02:00:00:00:00:03", "02:00:00:00:00:02", 123},
+		{"TestNet/020000000002", "020000000001", "02:00:00:00:00:01", "02:00:00:00:00:02", 53},
+	} {
+		pkt := udpPacket(p.port)
+		logPacket(t, svc, tokens, p.group, p.stream, linkaws.PacketLog{
+			Type:    "ipv4",
+			Src:     p.src,
+			Dest:    p.dest,
+			Header:  base64.StdEncoding.EncodeToString(pkt[:header.IPv4MinimumSize]),
+			Payload: base64.StdEncoding.EncodeToString(pkt[header.IPv4MinimumSize:]),
+		}, start.Add(time.Duration(i)*time.Second))
+	}
+
+	var buf bytes.Buffer
+	n, err := convertLogs(&buf, svc, "TestNet", start, start.Add(time.Minute), nil, "udp port 53")
+	if err != nil {
+		t.Fatalf("convertLogs: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected the 3 DNS packets, got %v", n)
+	}
+
+	// Expect a section, the interface of the first stream, its packet, the
+	// broadcast stream and its packet, then a packet of the first stream.
+	var types, ifaces []uint32
+	var times []time.Time
+	for b := buf.Bytes(); len(b) > 0; {
+		typ, size := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		types = append(types, typ)
+		if typ == 6 {
+			ifaces = append(ifaces, binary.LittleEndian.Uint32(b[8:]))
+			usec := int64(binary.LittleEndian.Uint32(b[12:]))<<32 | int64(binary.LittleEndian.Uint32(b[16:]))
+			times = append(times, time.Unix(0, usec*int64(time.Microsecond)))
+		}
+		b = b[size:]
+	}
+	if len(types) != 6 || types[1] != 1 || types[3] != 1 {
+		t.Fatalf("Unexpected blocks %v", types)
+	}
+	if ifaces[0] != 0 || ifaces[1] != 1 || ifaces[2] != 0 {
+		t.Errorf("Expected packets on interfaces 0, 1, 0, got %v", ifaces)
+	}
+	if !times[0].Equal(start) || !times[2].Equal(start.Add(3*time.Second)) {
+		t.Errorf("Expected the timestamps of the log events, got %v", times)
+	}
+}
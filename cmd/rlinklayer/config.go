@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the environment variable of every flag.
+const envPrefix = "RLINKLAYER_"
+
+// listFlag is a flag that can be repeated. In environment variables the
+// values are comma separated, in the config file they are an array.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// envName returns the environment variable of a flag, RLINKLAYER_DEV_ADDR
+// for -dev-addr.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// configure sets the flags of fs that weren't given on the command line.
+// A flag's environment variable wins over the config file at path, if any.
+//
+// The config file is a JSON object keyed by flag name, without the dash.
+// Keys apply to every command that has the flag, and an object named
+// after a command holds keys for that command only, which win:
+//
+//	{"net": "TestNet", "region": "us-east-1", "bridge": {"mode": "tap"}}
+func configure(fs *flag.FlagSet, cmd, path string) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	file, err := readConfig(path, cmd)
+	if err != nil {
+		return err
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		var values []string
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			values = []string{v}
+			if _, ok := f.Value.(*listFlag); ok {
+				values = strings.Split(v, ",")
+			}
+		} else if v, ok := file[f.Name]; ok {
+			values = v
+		}
+		for _, v := range values {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value %q for flag -%v: %v", v, f.Name, e)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// readConfig returns the values of every key of the config file at path
+// that applies to cmd, nothing if path is empty.
+func readConfig(path, cmd string) (map[string][]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var doc map[string]interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("readConfig: %v: %v", path, err)
+	}
+
+	values := map[string][]string{}
+	add := func(section map[string]interface{}) error {
+		for k, v := range section {
+			if _, ok := v.(map[string]interface{}); ok {
+				continue
+			}
+			vs, err := configValues(v)
+			if err != nil {
+				return fmt.Errorf("readConfig: %v: key %q: %v", path, k, err)
+			}
+			values[k] = vs
+		}
+		return nil
+	}
+	if err := add(doc); err != nil {
+		return nil, err
+	}
+	if section, ok := doc[cmd].(map[string]interface{}); ok {
+		if err := add(section); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// configValues converts a JSON value to flag values.
+func configValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{fmt.Sprint(v)}, nil
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			vs, err := configValues(e)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, vs...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", v)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rlinklayer")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	config := `{
+		"net": "FileNet",
+		"region": "eu-west-1",
+		"retention": 7,
+		"L": ["8080:192.168.1.21:80", "8443:192.168.1.21:443"],
+		"bridge": {"mode": "tap"},
+		"proxy": {"region": "us-east-1"}
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	os.Setenv("RLINKLAYER_DEV_ADDR", "10.0.0.1/24")
+	defer os.Unsetenv("RLINKLAYER_DEV_ADDR")
+	os.Setenv("RLINKLAYER_SOCKS", "127.0.0.1:1080")
+	defer os.Unsetenv("RLINKLAYER_SOCKS")
+
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	netName := fs.String("net", "TestNet", "")
+	region := fs.String("region", "", "")
+	retention := fs.Int64("retention", 0, "")
+	socks := fs.String("socks", "", "")
+	devAddr := fs.String("dev-addr", "", "")
+	mode := fs.String("mode", "tun", "")
+	var forwards listFlag
+	fs.Var(&forwards, "L", "")
+	if err := fs.Parse([]string{"-net", "FlagNet"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := configure(fs, "proxy", path); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+
+	if *netName != "FlagNet" {
+		t.Errorf("Expected the command line to win, got -net %v", *netName)
+	}
+	if *region != "us-east-1" {
+		t.Errorf("Expected the proxy section to win, got -region %v", *region)
+	}
+	if *mode != "tun" {
+		t.Errorf("Expected the bridge section to be ignored, got -mode %v", *mode)
+	}
+	if *retention != 7 || *socks != "127.0.0.1:1080" || *devAddr != "10.0.0.1/24" {
+		t.Errorf("Unexpected -retention %v -socks %v -dev-addr %v", *retention, *socks, *devAddr)
+	}
+	want := listFlag{"8080:192.168.1.21:80", "8443:192.168.1.21:443"}
+	if !reflect.DeepEqual(forwards, want) {
+		t.Errorf("Expected -L %v, got %v", want, forwards)
+	}
+
+	os.Setenv("RLINKLAYER_RETENTION", "three")
+	defer os.Unsetenv("RLINKLAYER_RETENTION")
+	fs2 := flag.NewFlagSet("node", flag.ContinueOnError)
+	fs2.Int64("retention", 0, "")
+	if err := configure(fs2, "node", ""); err == nil {
+		t.Errorf("Expected an error for an invalid value")
+	}
+}
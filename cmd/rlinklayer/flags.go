@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/sniffer"
+	"github.com/smithclay/rlinklayer/ipam"
+	"github.com/smithclay/rlinklayer/lambda/overlay"
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/link/filter"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/secure/awskeys"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/netspec"
+	"github.com/smithclay/rlinklayer/utils"
+)
+
+// commonFlags are the flags of every command.
+type commonFlags struct {
+	net    *string
+	region *string
+	role   *string
+	mac    *string
+	config *string
+	spec   *string
+	member *string
+	level  *string
+	// loaded is the network spec, nil without -spec.
+	loaded *netspec.Spec
+}
+
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = linkaws.DefaultRegion
+	}
+	return &commonFlags{
+		net:    fs.String("net", "TestNet", "network name"),
+		region: fs.String("region", region, "AWS region of the network"),
+		role:   fs.String("role-arn", "", "IAM role to assume to use Cloudwatch Logs, for a network in another account"),
+		mac:    fs.String("mac", "", "link address, random if empty"),
+		config: fs.String("config", "", "JSON config file, see the readme"),
+		spec:   fs.String("spec", "", "network spec, a path or a file:, env:, s3: or ssm: URL, it sets the flags not given otherwise"),
+		member: fs.String("member", "", "static member of the -spec to join as"),
+		level:  fs.String("log-level", "info", "least important messages printed, debug, info, warn or error"),
+	}
+}
+
+// linkAddress returns the -mac address, or a random one.
+func (c *commonFlags) linkAddress() tcpip.LinkAddress {
+	if *c.mac == "" {
+		return utils.GenerateRandomMac()
+	}
+	return parseMAC("-mac", *c.mac)
+}
+
+// setupLogging makes the -log-level logger the default one. Below debug,
+// the frames going through sniffers are not printed.
+func (c *commonFlags) setupLogging() {
+	level, err := logging.ParseLevel(*c.level)
+	if err != nil {
+		log.Fatalf("setupLogging: invalid -log-level: %v", err)
+	}
+	logging.SetDefault(logging.New(&logging.Options{Level: level}))
+	if level > logging.LevelDebug {
+		atomic.StoreUint32(&sniffer.LogPackets, 0)
+	}
+}
+
+// logService returns a Cloudwatch Logs client for the -region, with the
+// -role-arn if set.
+func (c *commonFlags) logService() cloudwatchlogsiface.CloudWatchLogsAPI {
+	return linkaws.NewLogServiceForRole(*c.region, *c.role)
+}
+
+func parseMAC(name, s string) tcpip.LinkAddress {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		log.Fatalf("parseMAC: invalid %v: %v", name, err)
+	}
+	return tcpip.LinkAddress(mac)
+}
+
+// keyFlags configure frame encryption.
+type keyFlags struct {
+	key      *string
+	keyParam *string
+}
+
+func addKeyFlags(fs *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		key:      fs.String("key", "", "base64 encoded network key shared by every member, frames are sent in the clear if empty"),
+		keyParam: fs.String("key-param", "", "SSM parameter holding rotating network keys, used instead of -key"),
+	}
+}
+
+func (k *keyFlags) networkKey() []byte {
+	if *k.key == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(*k.key)
+	if err != nil {
+		log.Fatalf("networkKey: invalid -key: %v", err)
+	}
+	return key
+}
+
+func (k *keyFlags) provider(c *commonFlags) secure.KeyProvider {
+	if *k.keyParam == "" {
+		return nil
+	}
+	return awskeys.New(&awskeys.Options{NetworkName: *c.net, ParameterName: *k.keyParam, Region: *c.region})
+}
+
+// sealer returns the sealer for links created outside an overlay, nil if
+// frames are sent in the clear. Rotating keys are refreshed until exit.
+func (k *keyFlags) sealer(c *commonFlags) *secure.Sealer {
+	if p := k.provider(c); p != nil {
+		s, err := secure.NewProviderSealer(p, 0)
+		if err != nil {
+			log.Fatalf("sealer: could not get network keys: %v", err)
+		}
+		secure.NewKeyWatcher(p, s, 0).Start()
+		return s
+	}
+	if key := k.networkKey(); key != nil {
+		s, err := secure.NewPSK(key)
+		if err != nil {
+			log.Fatalf("sealer: could not use network key: %v", err)
+		}
+		return s
+	}
+	return nil
+}
+
+// overlayFlags configure a userspace member of the network.
+type overlayFlags struct {
+	*commonFlags
+	*keyFlags
+	*pcapFlags
+	*metricsFlags
+	*traceFlags
+	*budgetFlags
+	*qosFlags
+	*routingFlags
+	transport *string
+	ip        *string
+	cidr      *string
+	leaseTTL  *time.Duration
+	leaseArn  *string
+	localArn  *string
+	remoteArn *string
+	remoteMac *string
+	retention *int64
+	acl       *string
+	redundant *bool
+}
+
+func addOverlayFlags(fs *flag.FlagSet) *overlayFlags {
+	return &overlayFlags{
+		commonFlags:  addCommonFlags(fs),
+		keyFlags:     addKeyFlags(fs),
+		pcapFlags:    addPcapFlags(fs),
+		metricsFlags: addMetricsFlags(fs),
+		traceFlags:   addTraceFlags(fs),
+		budgetFlags:  addBudgetFlags(fs),
+		qosFlags:     addQoSFlags(fs),
+		routingFlags: addRoutingFlags(fs),
+		transport:    fs.String("transport", "cloudwatch", "link layer, cloudwatch, tag or multipath for both"),
+		ip:           fs.String("ip", "", "overlay address, leased from -cidr if empty"),
+		cidr:         fs.String("cidr", "", "network addresses are leased from when -ip is empty"),
+		leaseTTL:     fs.Duration("lease-ttl", ipam.DefaultTTL, "lifetime of leased addresses"),
+		leaseArn:     fs.String("lease-arn", "", "function whose tags hold leases, with -transport tag"),
+		localArn:     fs.String("local-arn", "", "function whose tags this end reads, with -transport tag or multipath"),
+		remoteArn:    fs.String("remote-arn", "", "function whose tags this end writes, with -transport tag or multipath"),
+		remoteMac:    fs.String("remote-mac", "", "link address of the other end, with -transport tag or multipath"),
+		retention:    fs.Int64("retention", 0, "retention in days of log groups created on the network, 0 keeps them forever"),
+		acl:          fs.String("acl", "", "packet filter rules, every packet is accepted if empty"),
+		redundant:    fs.Bool("redundant", true, "with -transport multipath, send control frames through both paths, through one like other frames if false"),
+	}
+}
+
+// printStats prints the statistics of the link of the overlay, the usage of
+// its budget, the state of its paths on multipath networks, its other
+// interfaces and the routes it learned.
+func (o *overlayFlags) printStats(no *overlay.NetworkOverlay) {
+	fmt.Printf("%v\nbudget: %v\n", no.Stats(), o.budget(o.commonFlags).Usage())
+	for _, p := range no.Paths() {
+		fmt.Printf("path: %v\n", p)
+	}
+	if interfaces := no.Interfaces(); len(interfaces) > 1 {
+		for _, i := range interfaces {
+			fmt.Printf("interface: %v\n", i)
+		}
+	}
+	for _, r := range no.LearnedRoutes() {
+		fmt.Printf("route: %v\n", r)
+	}
+}
+
+func (o *overlayFlags) options() overlay.Options {
+	opts := overlay.Options{
+		IP:            *o.ip,
+		NetworkName:   *o.net,
+		CIDR:          *o.cidr,
+		LeaseTTL:      *o.leaseTTL,
+		LeaseArn:      *o.leaseArn,
+		LocalArn:      *o.localArn,
+		RemoteArn:     *o.remoteArn,
+		RetentionDays: *o.retention,
+		NetworkKey:    o.networkKey(),
+		KeyProvider:   o.provider(o.commonFlags),
+		Region:        *o.region,
+		RoleArn:       *o.role,
+		Capture:       o.start(),
+		Tracer:        o.startTracer(o.commonFlags),
+		Budget:        o.budget(o.commonFlags),
+		QoS:           o.qos(),
+		TCPProfile:    o.profile(),
+		NoRedundancy:  !*o.redundant,
+	}
+	if o.loaded != nil {
+		opts.Reserved = o.loaded.Reserved(*o.member)
+	}
+	switch *o.transport {
+	case "cloudwatch":
+		opts.OverlayType = overlay.CloudwatchLog
+	case "tag":
+		opts.OverlayType = overlay.LambdaTag
+		if *o.localArn == "" || *o.remoteArn == "" {
+			log.Fatalf("options: -transport tag needs -local-arn and -remote-arn")
+		}
+	case "multipath":
+		opts.OverlayType = overlay.Multipath
+		if *o.localArn == "" || *o.remoteArn == "" || *o.remoteMac == "" {
+			log.Fatalf("options: -transport multipath needs -local-arn, -remote-arn and -remote-mac")
+		}
+	default:
+		log.Fatalf("options: unknown -transport %q", *o.transport)
+	}
+	if *o.mac != "" {
+		opts.MacAddress = string(parseMAC("-mac", *o.mac))
+	}
+	if *o.remoteMac != "" {
+		opts.RemoteMacAddress = string(parseMAC("-remote-mac", *o.remoteMac))
+	}
+	if *o.acl != "" {
+		rules, err := filter.ParseRules(*o.acl)
+		if err != nil {
+			log.Fatalf("options: invalid -acl: %v", err)
+		}
+		opts.ACL = rules
+	}
+	opts.Routes = o.staticRoutes()
+	opts.Routing = o.routingOptions()
+	if joined := o.joined(o.commonFlags); len(joined) > 0 {
+		primary := opts.Interface()
+		primary.Name = "overlay"
+		opts.Interfaces = append([]overlay.Interface{primary}, joined...)
+		// Interfaces have the keys of their network.
+		opts.NetworkKey, opts.KeyProvider = nil, nil
+	}
+	return opts
+}
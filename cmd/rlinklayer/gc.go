@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+)
+
+func init() {
+	register("gc", "remove the log groups and streams of stale members", runGC)
+}
+
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	b := addBudgetFlags(fs)
+	staleAfter := fs.Duration("stale", linkaws.DefaultStaleAfter, "remove members without a heartbeat for this long")
+	apply := fs.Bool("apply", false, "delete the listed log groups and streams instead of only listing them")
+	parse(fs, c, args)
+
+	j := linkaws.NewJanitor(&linkaws.JanitorOptions{
+		NetworkName: *c.net,
+		StaleAfter:  *staleAfter,
+		LogService:  c.logService(),
+		Budget:      b.budget(c),
+	})
+	actions, err := j.Plan()
+	if err != nil {
+		log.Fatalf("runGC: could not plan cleanup of %v: %v", *c.net, err)
+	}
+	if len(actions) == 0 {
+		fmt.Printf("%v: nothing to clean up\n", *c.net)
+		return
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+	if !*apply {
+		fmt.Printf("%d actions, dry run: re-run with -apply to delete (members stale after %v)\n", len(actions), staleAfter.Round(time.Minute))
+		return
+	}
+	if err := j.Apply(actions); err != nil {
+		log.Printf("runGC: cleanup failed: %v", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d actions applied\n", len(actions))
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Clay Smith
+
+// Command rlinklayer joins, bridges and inspects rlinklayer networks.
+//
+// Every flag can also be set with an RLINKLAYER_ environment variable or in a
+// config file, see configure.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// command is a subcommand, run with the arguments after its name.
+type command struct {
+	summary string
+	run     func(args []string)
+}
+
+var commands = map[string]*command{}
+
+func register(name, summary string, run func(args []string)) {
+	commands[name] = &command{summary: summary, run: run}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rlinklayer <command> [flags]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun rlinklayer <command> -h for the flags of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "help" {
+		usage()
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rlinklayer: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(os.Args[2:])
+}
+
+// parse parses the command line of a subcommand, then fills the flags that
+// weren't given from the environment, the config file and the network spec,
+// and sets up logging.
+func parse(fs *flag.FlagSet, c *commonFlags, args []string) {
+	fs.Parse(args)
+	path := *c.config
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+	if err := configure(fs, fs.Name(), path); err != nil {
+		log.Fatalf("%v: %v", fs.Name(), err)
+	}
+	if *c.spec != "" {
+		if err := applySpec(fs, c); err != nil {
+			log.Fatalf("%v: %v", fs.Name(), err)
+		}
+	}
+	c.setupLogging()
+}
+
+// waitForSignal blocks until the process is interrupted or terminated.
+func waitForSignal() {
+	fmt.Println("Press CTRL-C to exit.")
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	fmt.Println()
+	fmt.Println(sig)
+	fmt.Println("exiting")
+}
+
+// onSignal calls fn every time the process gets sig, until it exits.
+func onSignal(sig os.Signal, fn func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, sig)
+	go func() {
+		for range sigs {
+			fn()
+		}
+	}()
+}
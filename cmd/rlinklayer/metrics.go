@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+
+	linkbridge "github.com/smithclay/rlinklayer/link/bridge"
+	"github.com/smithclay/rlinklayer/metrics"
+)
+
+// metricsFlags configure the Prometheus metrics endpoint.
+type metricsFlags struct {
+	metrics *string
+}
+
+func addMetricsFlags(fs *flag.FlagSet) *metricsFlags {
+	return &metricsFlags{
+		metrics: fs.String("metrics", "", "listen address of the Prometheus metrics endpoint, as localhost:9100, none if empty"),
+	}
+}
+
+// serve serves the samples of collectors at /metrics on the -metrics
+// address, if given.
+func (m *metricsFlags) serve(collectors ...metrics.Collector) {
+	if *m.metrics == "" {
+		return
+	}
+	r := &metrics.Registry{}
+	for _, c := range collectors {
+		r.Register(c)
+	}
+	go metrics.Serve(*m.metrics, r)
+}
+
+// gatewayMetrics collects the counters of a tun gateway.
+func gatewayMetrics(gw *linkbridge.Gateway) metrics.Collector {
+	return metrics.CollectorFunc(func() []metrics.Sample {
+		s := gw.Stats()
+		var samples []metrics.Sample
+		for _, c := range []struct {
+			name, help string
+			value      uint64
+		}{
+			{"rlinklayer_gateway_forwarded_total", "Packets routed between the tun device and the overlay.", s.Forwarded},
+			{"rlinklayer_gateway_ttl_exceeded_total", "Packets dropped because their TTL expired.", s.TTLExceeded},
+			{"rlinklayer_gateway_unreachable_total", "Packets dropped for lack of a route or neighbor.", s.Unreachable},
+			{"rlinklayer_gateway_too_big_total", "Packets dropped for being larger than the MTU.", s.TooBig},
+			{"rlinklayer_gateway_arp_requests_total", "ARP requests sent to the overlay.", s.ARPRequests},
+			{"rlinklayer_gateway_arp_replies_total", "ARP replies sent for addresses behind the gateway.", s.ARPReplies},
+			{"rlinklayer_gateway_translated_total", "Packets rewritten by masquerading or published ports.", s.Translated},
+			{"rlinklayer_gateway_dropped_total", "Packets dropped for other reasons.", s.Dropped},
+		} {
+			samples = append(samples, metrics.Sample{Name: c.name, Help: c.help, Type: metrics.Counter, Value: float64(c.value)})
+		}
+		return samples
+	})
+}
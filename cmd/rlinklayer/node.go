@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"syscall"
+
+	"github.com/smithclay/rlinklayer/lambda/overlay"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+func init() {
+	register("node", "join a network and forward its connections to local ports", runNode)
+}
+
+// runNode joins the network with a userspace stack, like a function does,
+// and forwards TCP connections from the overlay to the same port on
+// localhost.
+func runNode(args []string) {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	o := addOverlayFlags(fs)
+	parse(fs, o.commonFlags, args)
+
+	no := overlay.New(o.options())
+	no.Start()
+	defer no.Stop()
+	defer o.stop()
+	defer o.stopTracer()
+	onSignal(syscall.SIGUSR1, func() { o.printStats(no) })
+	o.serve(no)
+	logging.Default().Info("joined network", "network", *o.net, "ip", no.IP(), "mac", no.LinkAddress())
+	waitForSignal()
+}
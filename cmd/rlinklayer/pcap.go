@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/link/capture"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// pcapFlags configure packet capture, in the commands that create links.
+type pcapFlags struct {
+	pcap    *string
+	filter  *string
+	maxSize *int64
+	maxAge  *time.Duration
+	files   *int
+	control *string
+	paused  *bool
+
+	capture *capture.Capture
+}
+
+func addPcapFlags(fs *flag.FlagSet) *pcapFlags {
+	return &pcapFlags{
+		pcap:    fs.String("pcap", "", "pcapng file packets are captured to, no capture if empty"),
+		filter:  fs.String("pcap-filter", "", "capture filter, as \"tcp and port 80\", every packet if empty"),
+		maxSize: fs.Int64("pcap-max-size", 0, "rotate the capture file at this size in bytes, 0 never rotates"),
+		maxAge:  fs.Duration("pcap-max-age", 0, "rotate the capture file at this age, 0 never rotates"),
+		files:   fs.Int("pcap-files", capture.DefaultMaxFiles, "number of rotated capture files kept"),
+		control: fs.String("pcap-control", "", "listen address of the capture control API, as localhost:8081"),
+		paused:  fs.Bool("pcap-paused", false, "wait for the control API or SIGUSR2 to start capturing"),
+	}
+}
+
+// start creates the capture given with -pcap, or returns nil. SIGUSR2
+// toggles it.
+func (p *pcapFlags) start() *capture.Capture {
+	if *p.pcap == "" || p.capture != nil {
+		return p.capture
+	}
+	c, err := capture.NewCapture(&capture.Options{
+		Path:     *p.pcap,
+		Filter:   *p.filter,
+		MaxSize:  *p.maxSize,
+		MaxAge:   *p.maxAge,
+		MaxFiles: *p.files,
+	})
+	if err != nil {
+		log.Fatalf("start: invalid capture: %v", err)
+	}
+	p.capture = c
+	onSignal(syscall.SIGUSR2, func() {
+		if err := c.Toggle(); err != nil {
+			logging.Default().Warn("could not toggle the capture", "err", err)
+		}
+	})
+	if *p.control != "" {
+		go func() {
+			log.Fatalf("start: capture control API: %v", http.ListenAndServe(*p.control, c.Handler()))
+		}()
+		logging.Default().Info("serving the capture control API", "addr", *p.control)
+	}
+	if !*p.paused {
+		if err := c.Start(); err != nil {
+			log.Fatalf("start: could not start the capture: %v", err)
+		}
+	}
+	return c
+}
+
+// wrap records the packets of the link as interface name, when capturing.
+func (p *pcapFlags) wrap(id tcpip.LinkEndpointID, name string, ethernet bool) tcpip.LinkEndpointID {
+	c := p.start()
+	if c == nil {
+		return id
+	}
+	return capture.New(id, c, capture.Interface{Name: name, EthernetHeader: ethernet})
+}
+
+// stop flushes and closes the capture file, the process should defer it.
+func (p *pcapFlags) stop() {
+	if p.capture != nil {
+		p.capture.Stop()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+)
+
+func init() {
+	register("peers", "list the members of a Cloudwatch network", runPeers)
+}
+
+func runPeers(args []string) {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	c := addCommonFlags(fs)
+	k := addKeyFlags(fs)
+	since := fs.Duration("since", 2*linkaws.DefaultHeartbeatInterval, "list members seen this recently")
+	parse(fs, c, args)
+
+	members, err := linkaws.Members(c.logService(), *c.net, time.Now().Add(-*since), k.sealer(c))
+	if err != nil {
+		log.Fatalf("runPeers: could not read members of %v: %v", *c.net, err)
+	}
+	if len(members) == 0 {
+		fmt.Printf("%v: no members seen in the last %v\n", *c.net, *since)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MAC\tIP\tLAST SEEN")
+	for _, m := range members {
+		ip := "-"
+		if m.IP != nil {
+			ip = m.IP.String()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v ago\n", m.MAC, ip, time.Since(m.LastSeen).Round(time.Second))
+	}
+	w.Flush()
+}
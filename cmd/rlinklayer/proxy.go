@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/smithclay/rlinklayer/lambda/overlay"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/proxy"
+)
+
+func init() {
+	register("proxy", "reach a network through local port forwards and SOCKS5, without privileges", runProxy)
+}
+
+// runProxy joins the network with a userspace stack, reached through port
+// forwards and SOCKS5 instead of a kernel device.
+func runProxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	o := addOverlayFlags(fs)
+	var forwardArgs listFlag
+	fs.Var(&forwardArgs, "L", "forward a local port to the overlay, as [bind_address:]port:host:hostport (repeatable)")
+	socksAddr := fs.String("socks", "", "SOCKS5 listen address")
+	parse(fs, o.commonFlags, args)
+
+	var forwards []proxy.Forward
+	for _, s := range forwardArgs {
+		f, err := proxy.ParseForward(s)
+		if err != nil {
+			log.Fatalf("runProxy: %v", err)
+		}
+		forwards = append(forwards, f)
+	}
+	if len(forwards) == 0 && *socksAddr == "" {
+		log.Fatalf("runProxy: nothing to serve, use -L or -socks")
+	}
+
+	opts := o.options()
+	opts.NoInbound = true
+	no := overlay.New(opts)
+	no.Start()
+	defer no.Stop()
+	defer o.stop()
+	defer o.stopTracer()
+	onSignal(syscall.SIGUSR1, func() { o.printStats(no) })
+	o.serve(no)
+	logging.Default().Info("joined network", "network", *o.net, "ip", no.IP(), "mac", no.LinkAddress())
+
+	for _, f := range forwards {
+		l, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			log.Fatalf("runProxy: could not listen for %v: %v", f, err)
+		}
+		logging.Default().Info("forwarding", "forward", f)
+		go proxy.ServeForward(l, no.DialContext, f.To)
+	}
+	if *socksAddr != "" {
+		l, err := net.Listen("tcp", *socksAddr)
+		if err != nil {
+			log.Fatalf("runProxy: could not listen for SOCKS5: %v", err)
+		}
+		logging.Default().Info("serving SOCKS5", "addr", l.Addr())
+		go proxy.ServeSOCKS(l, no.DialContext)
+	}
+	waitForSignal()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/tcpprofile"
+)
+
+// qosFlags configure the queues of the packets sent on Cloudwatch networks
+// and the tuning of TCP, in the commands that create links.
+type qosFlags struct {
+	qosLimits  *string
+	qosCoDel   *bool
+	qosPorts   *string
+	qosWeight  *int
+	tcpProfile *string
+}
+
+func addQoSFlags(fs *flag.FlagSet) *qosFlags {
+	return &qosFlags{
+		qosLimits:  fs.String("qos-limits", "", "packets queued per class, as control=32,ack=32,interactive=32,bulk=64, defaults for classes missing"),
+		qosCoDel:   fs.Bool("qos-codel", false, "drop packets queued for too long with CoDel, instead of only when queues are full"),
+		qosPorts:   fs.String("qos-interactive-ports", "", "comma separated ports of interactive packets (default 22,23,53,3389)"),
+		qosWeight:  fs.Int("qos-interactive-weight", qos.DefaultInteractiveWeight, "share of interactive packets for every share of bulk packets"),
+		tcpProfile: fs.String("tcp-profile", tcpprofile.HighLatency.Name, "tuning of TCP and ACK coalescing, high-latency or default"),
+	}
+}
+
+// profile returns the tuning of TCP.
+func (q *qosFlags) profile() *tcpprofile.Profile {
+	p, err := tcpprofile.Parse(*q.tcpProfile)
+	if err != nil {
+		log.Fatalf("qos: invalid -tcp-profile: %v", err)
+	}
+	return p
+}
+
+// qos returns the options of the queues of links, coalescing ACKs as the
+// TCP profile does.
+func (q *qosFlags) qos() *qos.Options {
+	limits, err := qos.ParseLimits(*q.qosLimits)
+	if err != nil {
+		log.Fatalf("qos: invalid -qos-limits: %v", err)
+	}
+	opts := &qos.Options{Limits: limits, InteractiveWeight: *q.qosWeight, CoDel: *q.qosCoDel}
+	if *q.qosPorts != "" {
+		if opts.InteractivePorts, err = qos.ParsePorts(*q.qosPorts); err != nil {
+			log.Fatalf("qos: invalid -qos-interactive-ports: %v", err)
+		}
+	}
+	return q.profile().QoS(opts)
+}
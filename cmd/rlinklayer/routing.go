@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/smithclay/rlinklayer/lambda/overlay"
+	"github.com/smithclay/rlinklayer/netspec"
+	"github.com/smithclay/rlinklayer/netspec/awsspec"
+	"github.com/smithclay/rlinklayer/routing"
+)
+
+// routingFlags configure the routes of a userspace member, and the other
+// networks it joins.
+type routingFlags struct {
+	routes   listFlag
+	join     listFlag
+	routing  *string
+	interval *time.Duration
+}
+
+func addRoutingFlags(fs *flag.FlagSet) *routingFlags {
+	r := &routingFlags{
+		routing:  fs.String("routing", "off", "routing protocol: learn routes from gateways, gateway to also forward between networks and announce them, or off"),
+		interval: fs.Duration("routing-interval", routing.DefaultInterval, "how often routes are read and announced"),
+	}
+	fs.Var(&r.routes, "route", "static route, as network [via gateway] (repeatable)")
+	fs.Var(&r.join, "join", "network spec of another network to join, as the -member if it has one (repeatable)")
+	return r
+}
+
+// staticRoutes returns the static routes of -route.
+func (r *routingFlags) staticRoutes() []overlay.Route {
+	var routes []overlay.Route
+	for _, s := range r.routes {
+		route, err := overlay.ParseRoute(s)
+		if err != nil {
+			log.Fatalf("routing: invalid -route: %v", err)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// routingOptions returns the options of the routing protocol, nil when it
+// is off.
+func (r *routingFlags) routingOptions() *routing.Options {
+	switch *r.routing {
+	case "off":
+		return nil
+	case "learn":
+		return &routing.Options{Interval: *r.interval}
+	case "gateway":
+		return &routing.Options{Interval: *r.interval, Gateway: true}
+	}
+	log.Fatalf("routing: unknown -routing %q, expected off, learn or gateway", *r.routing)
+	return nil
+}
+
+// joined returns an interface on the network of each -join spec, as member
+// when the spec has it. Their networks are routed through them, and their
+// static routes.
+func (r *routingFlags) joined(c *commonFlags) []overlay.Interface {
+	if len(r.join) == 0 {
+		return nil
+	}
+	awsspec.Register(*c.region)
+	var interfaces []overlay.Interface
+	for _, location := range r.join {
+		s, err := netspec.Load(location)
+		if err != nil {
+			log.Fatalf("routing: invalid -join: %v", err)
+		}
+		member := ""
+		if _, ok := s.Member(*c.member); ok {
+			member = *c.member
+		}
+		opts, err := s.Options(member)
+		if err != nil {
+			log.Fatalf("routing: invalid -join: %v", err)
+		}
+		ifc := opts.Interface()
+		ifc.Routes = opts.Routes
+		interfaces = append(interfaces, ifc)
+	}
+	return interfaces
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/netspec"
+	"github.com/smithclay/rlinklayer/netspec/awsspec"
+)
+
+// applySpec loads the -spec and sets the flags of fs that no other layer
+// set from it.
+func applySpec(fs *flag.FlagSet, c *commonFlags) error {
+	awsspec.Register(*c.region)
+	s, err := netspec.Load(*c.spec)
+	if err != nil {
+		return err
+	}
+	values, err := specValues(s, *c.member)
+	if err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		for _, v := range values[f.Name] {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("spec value %q for flag -%v: %v", v, f.Name, e)
+				return
+			}
+		}
+	})
+	c.loaded = s
+	return err
+}
+
+// specValues returns the flag values of a spec, with the identity of member
+// if it isn't empty.
+func specValues(s *netspec.Spec, member string) (map[string][]string, error) {
+	values := map[string][]string{}
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = []string{value}
+		}
+	}
+	set("net", s.Name)
+	set("region", s.Transport.Region)
+	set("role-arn", s.Transport.RoleArn)
+	set("transport", s.Transport.Type)
+	set("lease-arn", s.Transport.LeaseArn)
+	if s.Transport.RetentionDays > 0 {
+		set("retention", fmt.Sprint(s.Transport.RetentionDays))
+	}
+	set("cidr", s.CIDR)
+	if s.LeaseTTL > 0 {
+		set("lease-ttl", s.LeaseTTL.String())
+	}
+	set("key", s.Encryption.Key)
+	set("key-param", s.Encryption.KeyParam)
+	set("acl", strings.Join(s.ACL, "\n"))
+	set("publish", strings.Join(s.Publish, ","))
+	if len(s.Forwards) > 0 {
+		values["L"] = s.Forwards
+	}
+	if len(s.Routes) > 0 {
+		values["route"] = s.Routes
+	}
+	if s.Routing != nil {
+		set("routing", "learn")
+		if s.Routing.Interval > 0 {
+			set("routing-interval", s.Routing.Interval.String())
+		}
+	}
+
+	if member == "" {
+		return values, nil
+	}
+	opts, err := s.Options(member)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := s.Member(member)
+	set("mac", m.MAC)
+	set("ip", m.IP)
+	if m.Gateway {
+		set("routing", "gateway")
+	}
+	set("local-arn", opts.LocalArn)
+	set("remote-arn", opts.RemoteArn)
+	if opts.RemoteMacAddress != "" {
+		set("remote-mac", tcpip.LinkAddress(opts.RemoteMacAddress).String())
+	}
+	return values, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestApplySpec(t *testing.T) {
+	os.Setenv("RLINKLAYER_TEST_SPEC", `{"name": "SpecNet", "cidr": "192.168.1.0/24", "acl": ["allow dport=22", "allow dport=80"],
+		"members": [{"name": "bridge", "mac": "02:00:00:00:00:01", "ip": "192.168.1.3"}]}`)
+	defer os.Unsetenv("RLINKLAYER_TEST_SPEC")
+
+	fs := flag.NewFlagSet("bridge", flag.ContinueOnError)
+	c := addCommonFlags(fs)
+	ip := fs.String("ip", "", "")
+	cidr := fs.String("cidr", "10.0.0.0/8", "")
+	acl := fs.String("acl", "", "")
+	args := []string{"-spec", "env:RLINKLAYER_TEST_SPEC", "-member", "bridge", "-ip", "192.168.1.4"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := applySpec(fs, c); err != nil {
+		t.Fatalf("applySpec: %v", err)
+	}
+	if *c.net != "SpecNet" || *c.mac != "02:00:00:00:00:01" || *cidr != "192.168.1.0/24" {
+		t.Errorf("Expected the spec values, got -net %v -mac %v -cidr %v", *c.net, *c.mac, *cidr)
+	}
+	if *ip != "192.168.1.4" {
+		t.Errorf("Expected the command line to win, got -ip %v", *ip)
+	}
+	if *acl != "allow dport=22\nallow dport=80" {
+		t.Errorf("Unexpected -acl %q", *acl)
+	}
+	if c.loaded == nil || len(c.loaded.Reserved("bridge")) != 0 {
+		t.Errorf("Expected the spec to be kept, without reserved addresses for its own member")
+	}
+
+	*c.member = "nobody"
+	if err := applySpec(fs, c); err == nil {
+		t.Errorf("Expected an error for an unknown member")
+	}
+}
+
+func TestApplySpec_Routing(t *testing.T) {
+	os.Setenv("RLINKLAYER_TEST_SPEC", `{"name": "SpecNet", "cidr": "192.168.1.0/24", "routes": ["10.2.0.0/16 via 192.168.1.1"],
+		"routing": {"interval": "30s"}, "members": [{"name": "gw", "ip": "192.168.1.1", "gateway": true}]}`)
+	defer os.Unsetenv("RLINKLAYER_TEST_SPEC")
+
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	c := addCommonFlags(fs)
+	r := addRoutingFlags(fs)
+	if err := fs.Parse([]string{"-spec", "env:RLINKLAYER_TEST_SPEC", "-member", "gw"}); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := applySpec(fs, c); err != nil {
+		t.Fatalf("applySpec: %v", err)
+	}
+	routes := r.staticRoutes()
+	if len(routes) != 1 || routes[0].String() != "10.2.0.0/16 via 192.168.1.1" {
+		t.Errorf("Unexpected routes %v", routes)
+	}
+	if opts := r.routingOptions(); opts == nil || !opts.Gateway || opts.Interval != 30*time.Second {
+		t.Errorf("Expected the member to be a gateway announcing every 30s, got %+v", opts)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/smithclay/rlinklayer/tracing"
+)
+
+// traceFlags configure packet tracing, in the commands that create
+// Cloudwatch links.
+type traceFlags struct {
+	trace       *string
+	traceFile   *string
+	traceSample *float64
+
+	tracer *tracing.Tracer
+	file   *tracing.File
+}
+
+func addTraceFlags(fs *flag.FlagSet) *traceFlags {
+	return &traceFlags{
+		trace:       fs.String("trace", "", "OTLP/HTTP endpoint of the collector spans are exported to, as http://localhost:4318, no tracing if empty"),
+		traceFile:   fs.String("trace-file", "", "file spans are appended to as OTLP JSON lines, instead of -trace"),
+		traceSample: fs.Float64("trace-sample", tracing.DefaultSampleRate, "fraction of sent packets that are traced, none if 0"),
+	}
+}
+
+// startTracer creates the tracer given with -trace or -trace-file, or
+// returns nil.
+func (t *traceFlags) startTracer(c *commonFlags) *tracing.Tracer {
+	if t.tracer != nil || (*t.trace == "" && *t.traceFile == "") {
+		return t.tracer
+	}
+	var exporter tracing.Exporter
+	if *t.traceFile != "" {
+		f, err := tracing.CreateFile(*t.traceFile)
+		if err != nil {
+			log.Fatalf("startTracer: could not open -trace-file: %v", err)
+		}
+		t.file = f
+		exporter = f
+	} else {
+		exporter = tracing.NewOTLP(*t.trace)
+	}
+	t.tracer = tracing.New(&tracing.Options{
+		Exporter:   exporter,
+		SampleRate: *t.traceSample,
+		Resource:   map[string]interface{}{"rlinklayer.network": *c.net},
+	})
+	return t.tracer
+}
+
+// stopTracer exports the pending spans, the process should defer it.
+func (t *traceFlags) stopTracer() {
+	t.tracer.Stop()
+	if t.file != nil {
+		t.file.Close()
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Clay Smith
+
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	linkaws "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
+	"github.com/smithclay/rlinklayer/link/aws/tag"
+	"github.com/smithclay/rlinklayer/link/bridge"
+	"github.com/smithclay/rlinklayer/utils"
+)
+
+var networks = flag.String("net", "TestNet", "comma separated Cloudwatch networks to bridge")
+var tapName = flag.String("tap", "", "tap device to bridge")
+var tagLocal = flag.String("tag-local", "", "ARN of the function whose tags this end reads")
+var tagRemote = flag.String("tag-remote", "", "ARN of the function whose tags this end writes, bridges a tag link when set")
+
+func main() {
+	flag.Parse()
+
+	var ports []bridge.PortOptions
+	for _, name := range strings.Split(*networks, ",") {
+		if name == "" {
+			continue
+		}
+		id, _ := linkaws.New(&linkaws.Options{
+			NetworkName:    name,
+			EthernetHeader: true,
+			Address:        utils.GenerateRandomMac(),
+		})
+		ports = append(ports, bridge.PortOptions{Name: bridge.Port("cloudwatch/" + name), Endpoint: id})
+	}
+	if *tagRemote != "" {
+		id := tag.New(&tag.Options{
+			LocalArn:       *tagLocal,
+			RemoteArn:      *tagRemote,
+			LocalAddress:   utils.GenerateRandomMac(),
+			EthernetHeader: true,
+		})
+		ports = append(ports, bridge.PortOptions{Name: "tag", Endpoint: id})
+	}
+	if *tapName != "" {
+		id := utils.NewTapLink(*tapName, utils.GenerateRandomMac())
+		ports = append(ports, bridge.PortOptions{Name: bridge.Port(*tapName), Endpoint: id})
+	}
+
+	b, err := bridge.NewBridge(&bridge.BridgeOptions{Ports: ports})
+	if err != nil {
+		log.Fatalf("main: %v", err)
+	}
+	b.Start()
+	for _, p := range ports {
+		log.Printf("main: bridging %v", p.Name)
+	}
+
+	fmt.Println("Press CTRL-C to exit, SIGUSR1 prints the MAC table.")
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	for sig := range sigs {
+		if sig == syscall.SIGUSR1 {
+			fmt.Printf("MAC table:\n%v\n", b.MACTable())
+			for _, s := range b.Stats() {
+				fmt.Println(s)
+			}
+			continue
+		}
+		fmt.Println()
+		fmt.Println(sig)
+		break
+	}
+	fmt.Println("exiting")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/secure/awskeys"
+)
+
+var netName = flag.String("net", "TestNet", "network the key belongs to")
+var param = flag.String("param", "/rlinklayer/TestNet/key", "SSM parameter holding the network keys")
+var kmsKey = flag.String("kms-key", "", "KMS key that encrypts data keys")
+var activate = flag.Duration("activate", 2*secure.DefaultRefreshInterval, "delay before members start sealing with the new key")
+var keep = flag.Int("keep", awskeys.DefaultKeep, "number of key versions to keep")
+
+func main() {
+	flag.Parse()
+	if *kmsKey == "" {
+		log.Fatalf("-kms-key is required")
+	}
+
+	p := awskeys.New(&awskeys.Options{
+		NetworkName:   *netName,
+		ParameterName: *param,
+		KeyID:         *kmsKey,
+		Keep:          *keep,
+	})
+	k, err := p.Rotate(time.Now().Add(*activate))
+	if err != nil {
+		log.Fatalf("Could not rotate key of %v: %v", *netName, err)
+	}
+	fmt.Printf("%v: key version %d active at %v\n", *netName, k.Version, k.NotBefore.Format(time.RFC3339))
+}
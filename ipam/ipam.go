@@ -0,0 +1,409 @@
+// Package ipam assigns overlay addresses to network members from a CIDR.
+//
+// Addresses are handed out as leases that are kept in the network transport
+// itself (a log group or function tags), so concurrent members of the same
+// network can see each other's claims without any extra infrastructure.
+package ipam
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// DefaultTTL is the lease duration used when Options.TTL is not set.
+const DefaultTTL = 5 * time.Minute
+
+// DefaultSettle is how long a new claim is left alone before checking it
+// against the claims of other members.
+const DefaultSettle = 3 * time.Second
+
+var (
+	// ErrExhausted is returned when every address in the network is leased.
+	ErrExhausted = errors.New("ipam: no free addresses in network")
+	// ErrConflict is returned when another member holds an earlier claim on
+	// the same address.
+	ErrConflict = errors.New("ipam: address claimed by another member")
+)
+
+// Lease records that a member holds an address until Expires.
+type Lease struct {
+	IP      net.IP
+	MAC     tcpip.LinkAddress
+	Claimed time.Time // time of the first claim, the earliest claim wins a conflict
+	Expires time.Time
+}
+
+// Expired reports whether the lease is no longer valid at t.
+func (l *Lease) Expired(t time.Time) bool {
+	return !t.Before(l.Expires)
+}
+
+// wins reports whether l takes precedence over other for the same address.
+func (l *Lease) wins(other *Lease) bool {
+	if !l.Claimed.Equal(other.Claimed) {
+		return l.Claimed.Before(other.Claimed)
+	}
+	return l.MAC < other.MAC
+}
+
+// Store persists leases for a single network.
+type Store interface {
+	// Leases returns the most recent lease written by each member. Expired
+	// leases may be included, callers are expected to filter them.
+	Leases() ([]Lease, error)
+	// Put claims or renews a lease.
+	Put(l Lease) error
+	// Release gives up the lease held by l.MAC.
+	Release(l Lease) error
+}
+
+// Options configure an Allocator.
+type Options struct {
+	CIDR     string
+	MAC      tcpip.LinkAddress
+	TTL      time.Duration
+	Settle   time.Duration
+	Reserved []net.IP // addresses never handed out, i.e. statically configured members
+	Retries  int
+	// Logger gets lease conflicts and renewal failures, logging.Default if nil.
+	Logger logging.Logger
+	// OnChange is called from Start when the held lease is lost to another
+	// member, with ok false, and when a new address is acquired in its
+	// place. The member must stop using the lost address.
+	OnChange func(l Lease, ok bool)
+}
+
+// Allocator acquires and keeps a single lease for the local member.
+type Allocator struct {
+	store    Store
+	network  *net.IPNet
+	mac      tcpip.LinkAddress
+	ttl      time.Duration
+	settle   time.Duration
+	reserved map[string]bool
+	retries  int
+	logger   logging.Logger
+	onChange func(Lease, bool)
+
+	mu    sync.Mutex
+	lease *Lease
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// New creates an allocator for the network described by opts.
+func New(store Store, opts *Options) (*Allocator, error) {
+	ip, network, err := net.ParseCIDR(opts.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, errors.New("ipam: only IPv4 networks are supported")
+	}
+	network.IP = network.IP.To4()
+	if opts.MAC == "" {
+		return nil, errors.New("ipam: a link address is required")
+	}
+
+	a := &Allocator{
+		store:    store,
+		network:  network,
+		mac:      opts.MAC,
+		ttl:      opts.TTL,
+		settle:   opts.Settle,
+		reserved: map[string]bool{},
+		retries:  opts.Retries,
+		logger:   logging.OrDefault(opts.Logger),
+		onChange: opts.OnChange,
+	}
+	if a.ttl == 0 {
+		a.ttl = DefaultTTL
+	}
+	if a.settle == 0 {
+		a.settle = DefaultSettle
+	}
+	if a.retries == 0 {
+		a.retries = 8
+	}
+	for _, r := range opts.Reserved {
+		a.reserved[r.To4().String()] = true
+	}
+	return a, nil
+}
+
+// Lease returns the currently held lease, if any.
+func (a *Allocator) Lease() (Lease, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lease == nil {
+		return Lease{}, false
+	}
+	return *a.lease, true
+}
+
+// Acquire claims a free address in the network. An unexpired lease that is
+// already held by this member's link address is reused.
+func (a *Allocator) Acquire() (Lease, error) {
+	lost := map[string]bool{}
+	for i := 0; i < a.retries; i++ {
+		leases, err := a.store.Leases()
+		if err != nil {
+			return Lease{}, err
+		}
+		now := time.Now()
+
+		claim, err := a.pick(leases, lost, now)
+		if err != nil {
+			return Lease{}, err
+		}
+		if err := a.store.Put(claim); err != nil {
+			return Lease{}, err
+		}
+
+		// Give concurrent members time to publish their claims before
+		// deciding who owns the address.
+		time.Sleep(a.settle)
+		if err := a.check(claim); err != nil {
+			if err != ErrConflict {
+				return Lease{}, err
+			}
+			a.logger.Info("lost address to another member, retrying", "ip", claim.IP)
+			lost[claim.IP.String()] = true
+			if err := a.store.Release(claim); err != nil {
+				a.logger.Warn("could not release conflicting claim", "ip", claim.IP, "err", err)
+			}
+			continue
+		}
+
+		a.mu.Lock()
+		a.lease = &claim
+		a.mu.Unlock()
+		return claim, nil
+	}
+	return Lease{}, ErrConflict
+}
+
+// pick returns a claim for an unused address, preferring a live lease this
+// member already holds.
+func (a *Allocator) pick(leases []Lease, lost map[string]bool, now time.Time) (Lease, error) {
+	used := map[string]bool{}
+	for i := range leases {
+		l := &leases[i]
+		if l.Expired(now) {
+			continue
+		}
+		if l.MAC == a.mac && a.network.Contains(l.IP) && !lost[l.IP.String()] {
+			l.Expires = now.Add(a.ttl)
+			return *l, nil
+		}
+		used[l.IP.To4().String()] = true
+	}
+
+	first, size := a.hostRange()
+	if size == 0 {
+		return Lease{}, ErrExhausted
+	}
+	// Start at a random offset so members booting at the same time are
+	// unlikely to race for the same address.
+	start := rand.Uint32() % size
+	for i := uint32(0); i < size; i++ {
+		ip := uint32ToIP(first + (start+i)%size)
+		key := ip.String()
+		if used[key] || a.reserved[key] || lost[key] {
+			continue
+		}
+		// Claims are kept at millisecond precision so every store can
+		// round-trip them and members agree on who claimed first.
+		claimed := now.Round(0).Truncate(time.Millisecond)
+		return Lease{IP: ip, MAC: a.mac, Claimed: claimed, Expires: now.Add(a.ttl)}, nil
+	}
+	return Lease{}, ErrExhausted
+}
+
+// check verifies that no other member holds a winning claim on l.IP.
+func (a *Allocator) check(l Lease) error {
+	leases, err := a.store.Leases()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range leases {
+		other := &leases[i]
+		if other.MAC == a.mac || other.Expired(now) || !other.IP.Equal(l.IP) {
+			continue
+		}
+		if other.wins(&l) {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+// Renew extends the held lease. ErrConflict is returned if another member
+// has since taken the address.
+func (a *Allocator) Renew() error {
+	a.mu.Lock()
+	if a.lease == nil {
+		a.mu.Unlock()
+		return errors.New("ipam: no lease to renew")
+	}
+	l := *a.lease
+	a.mu.Unlock()
+
+	if err := a.check(l); err != nil {
+		return err
+	}
+	l.Expires = time.Now().Add(a.ttl)
+	if err := a.store.Put(l); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.lease = &l
+	a.mu.Unlock()
+	return nil
+}
+
+// Start renews the held lease in the background until Release is called. A
+// lease lost to another member is dropped and a new address acquired,
+// reported to Options.OnChange.
+func (a *Allocator) Start() {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		t := time.NewTicker(a.ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				a.maintain()
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+// maintain renews the held lease, or acquires a new one when it was lost.
+func (a *Allocator) maintain() {
+	a.mu.Lock()
+	held := a.lease
+	a.mu.Unlock()
+	if held != nil {
+		err := a.Renew()
+		if err != ErrConflict {
+			if err != nil {
+				a.logger.Warn("could not renew lease", "err", err)
+			}
+			return
+		}
+		a.logger.Warn("lost leased address to another member", "ip", held.IP)
+		a.mu.Lock()
+		a.lease = nil
+		a.mu.Unlock()
+		if err := a.store.Release(*held); err != nil {
+			a.logger.Warn("could not release conflicting claim", "ip", held.IP, "err", err)
+		}
+		if a.onChange != nil {
+			a.onChange(*held, false)
+		}
+	}
+	lease, err := a.Acquire()
+	if err != nil {
+		// Retried at the next renewal.
+		a.logger.Warn("could not lease a new address", "err", err)
+		return
+	}
+	a.logger.Info("leased new address", "ip", lease.IP, "expires", lease.Expires)
+	if a.onChange != nil {
+		a.onChange(lease, true)
+	}
+}
+
+// Release stops renewing and frees the held lease.
+func (a *Allocator) Release() error {
+	if a.stop != nil {
+		close(a.stop)
+		<-a.done
+		a.stop = nil
+	}
+
+	a.mu.Lock()
+	l := a.lease
+	a.lease = nil
+	a.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	return a.store.Release(*l)
+}
+
+// hostRange returns the first usable host address and the number of usable
+// addresses in the network, skipping the network and broadcast addresses.
+func (a *Allocator) hostRange() (uint32, uint32) {
+	ones, bits := a.network.Mask.Size()
+	base := binary.BigEndian.Uint32(a.network.IP)
+	switch hostBits := uint(bits - ones); {
+	case hostBits == 0:
+		return base, 1
+	case hostBits == 1:
+		return base, 2
+	default:
+		return base + 1, uint32(1)<<hostBits - 2
+	}
+}
+
+func uint32ToIP(v uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// MemoryStore keeps leases in memory. It is useful for tests and for members
+// that share a single process.
+type MemoryStore struct {
+	mu     sync.Mutex
+	leases map[tcpip.LinkAddress]Lease
+}
+
+// NewMemoryStore creates an empty in-memory lease store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{leases: map[tcpip.LinkAddress]Lease{}}
+}
+
+// Leases implements Store.Leases.
+func (m *MemoryStore) Leases() ([]Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	leases := make([]Lease, 0, len(m.leases))
+	for _, l := range m.leases {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// Put implements Store.Put.
+func (m *MemoryStore) Put(l Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leases[l.MAC] = l
+	return nil
+}
+
+// Release implements Store.Release.
+func (m *MemoryStore) Release(l Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.leases[l.MAC]; ok && cur.IP.Equal(l.IP) {
+		delete(m.leases, l.MAC)
+	}
+	return nil
+}
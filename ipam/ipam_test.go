@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+func setupAllocator(t *testing.T, store Store, cidr string, mac tcpip.LinkAddress) *Allocator {
+	a, err := New(store, &Options{CIDR: cidr, MAC: mac, Settle: time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	return a
+}
+
+func TestAllocator_AcquireUnique(t *testing.T) {
+	store := NewMemoryStore()
+	macs := []tcpip.LinkAddress{"\x02\x00\x00\x00\x00\x01", "\x02\x00\x00\x00\x00\x02", "\x02\x00\x00\x00\x00\x03", "\x02\x00\x00\x00\x00\x04"}
+
+	var wg sync.WaitGroup
+	leases := make([]Lease, len(macs))
+	errs := make([]error, len(macs))
+	for i, mac := range macs {
+		wg.Add(1)
+		go func(i int, mac tcpip.LinkAddress) {
+			defer wg.Done()
+			leases[i], errs[i] = setupAllocator(t, store, "192.168.1.0/29", mac).Acquire()
+		}(i, mac)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i, l := range leases {
+		if errs[i] != nil {
+			t.Fatalf("[%d] Acquire: unexpected error: %v", i, errs[i])
+		}
+		if seen[l.IP.String()] {
+			t.Fatalf("[%d] Acquire: %v handed out twice", i, l.IP)
+		}
+		seen[l.IP.String()] = true
+	}
+}
+
+func TestAllocator_Exhausted(t *testing.T) {
+	store := NewMemoryStore()
+	tables := []struct {
+		mac tcpip.LinkAddress
+		err error
+	}{
+		{"\x02\x00\x00\x00\x00\x01", nil},
+		{"\x02\x00\x00\x00\x00\x02", nil},
+		{"\x02\x00\x00\x00\x00\x03", ErrExhausted},
+	}
+	for i, table := range tables {
+		_, err := setupAllocator(t, store, "10.0.0.0/30", table.mac).Acquire()
+		if err != table.err {
+			t.Errorf("[%d] Expected error %v, got: %v", i, table.err, err)
+		}
+	}
+}
+
+func TestAllocator_Reserved(t *testing.T) {
+	store := NewMemoryStore()
+	a, err := New(store, &Options{
+		CIDR:     "10.0.0.0/30",
+		MAC:      "\x02\x00\x00\x00\x00\x01",
+		Settle:   time.Millisecond,
+		Reserved: []net.IP{net.ParseIP("10.0.0.1")},
+	})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	l, err := a.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: unexpected error: %v", err)
+	}
+	if !l.IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Expected 10.0.0.2, got: %v", l.IP)
+	}
+}
+
+func TestAllocator_Conflict(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	early := Lease{IP: net.ParseIP("10.0.0.1").To4(), MAC: "\x02\x00\x00\x00\x00\x09", Claimed: now.Add(-time.Minute), Expires: now.Add(time.Minute)}
+
+	a := setupAllocator(t, store, "10.0.0.0/30", "\x02\x00\x00\x00\x00\x01")
+	late := Lease{IP: early.IP, MAC: a.mac, Claimed: now, Expires: now.Add(time.Minute)}
+	store.Put(early)
+	store.Put(late)
+	if err := a.check(late); err != ErrConflict {
+		t.Fatalf("Expected conflict with earlier claim, got: %v", err)
+	}
+
+	// The member keeps its lease when it holds the earlier claim.
+	if err := setupAllocator(t, store, "10.0.0.0/30", early.MAC).check(early); err != nil {
+		t.Fatalf("Expected earlier claim to win, got: %v", err)
+	}
+}
+
+func TestAllocator_ReleaseAndReuse(t *testing.T) {
+	store := NewMemoryStore()
+	a := setupAllocator(t, store, "10.0.0.0/30", "\x02\x00\x00\x00\x00\x01")
+	first, err := a.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: unexpected error: %v", err)
+	}
+
+	// A restarted member with the same link address gets its old lease back.
+	again, err := setupAllocator(t, store, "10.0.0.0/30", a.mac).Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: unexpected error: %v", err)
+	}
+	if !again.IP.Equal(first.IP) {
+		t.Errorf("Expected lease %v to be reused, got: %v", first.IP, again.IP)
+	}
+
+	if err := a.Release(); err != nil {
+		t.Fatalf("Release: unexpected error: %v", err)
+	}
+	leases, _ := store.Leases()
+	if len(leases) != 0 {
+		t.Errorf("Expected no leases after release, got: %v", leases)
+	}
+}
+
+func TestAllocator_LostLease(t *testing.T) {
+	store := NewMemoryStore()
+	var changes []string
+	a, err := New(store, &Options{CIDR: "10.0.0.0/29", MAC: "\x02\x00\x00\x00\x00\x01", Settle: time.Millisecond, OnChange: func(l Lease, ok bool) {
+		changes = append(changes, l.IP.String())
+		if !ok {
+			changes = append(changes, "lost")
+		}
+	}})
+	if err != nil {
+		t.Fatalf("New: unexpected error: %v", err)
+	}
+	held, err := a.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: unexpected error: %v", err)
+	}
+
+	// Another member turns out to have claimed the address first.
+	store.Put(Lease{IP: held.IP, MAC: "\x02\x00\x00\x00\x00\x09", Claimed: held.Claimed.Add(-time.Second), Expires: time.Now().Add(time.Minute)})
+	a.maintain()
+	lease, ok := a.Lease()
+	if !ok || lease.IP.Equal(held.IP) {
+		t.Fatalf("Expected a new address in place of %v, got %v", held.IP, lease.IP)
+	}
+	if want := []string{held.IP.String(), "lost", lease.IP.String()}; len(changes) != 3 || changes[0] != want[0] || changes[1] != want[1] || changes[2] != want[2] {
+		t.Errorf("Expected changes %v, got %v", want, changes)
+	}
+}
@@ -1,13 +1,32 @@
 package main
 
 import (
+	"encoding/base64"
+	"github.com/google/netstack/tcpip/link/sniffer"
 	"github.com/smithclay/rlinklayer/lambda/overlay"
 	"github.com/smithclay/rlinklayer/lambda/runtime"
 	"github.com/smithclay/rlinklayer/lambda/utils"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/filter"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/secure/awskeys"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/metrics"
+	"github.com/smithclay/rlinklayer/netspec"
+	"github.com/smithclay/rlinklayer/netspec/awsspec"
+	"github.com/smithclay/rlinklayer/routing"
+	"github.com/smithclay/rlinklayer/tcpprofile"
+	"github.com/smithclay/rlinklayer/tracing"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -44,7 +63,7 @@ func processEvents(rc *runtime.Client) {
 			}
 		}
 		// TODO: configure this
-		log.Printf("Function deadline in: %v", deadline)
+		logging.Default().Debug("got invocation", "request", requestId, "deadline", deadline)
 
 		// Keep accepting connections until 5 seconds before the funtion times out.
 		remainingTime := time.Duration(deadline-time.Now().Unix()*1000) * time.Millisecond
@@ -54,24 +73,327 @@ func processEvents(rc *runtime.Client) {
 	}
 }
 
-func startNetwork() {
+func startNetwork(tracer *tracing.Tracer) *overlay.NetworkOverlay {
+	// OL_SPEC is the location of a network spec, see netspec.Load, used
+	// instead of the other OL_ variables. OL_MEMBER names the static member
+	// this function is, it joins with a leased address when empty. Both
+	// may be comma separated to join several networks.
+	if v := os.Getenv("OL_SPEC"); v != "" {
+		return startFromSpecs(strings.Split(v, ","), strings.Split(os.Getenv("OL_MEMBER"), ","), tracer)
+	}
 	netName := os.Getenv("OL_NET_NAME")
 	macAddress := os.Getenv("OL_MAC_ADDR")
 	ipAddr := os.Getenv("OL_IP_ADDR")
+	// When OL_IP_ADDR is empty an address is leased from OL_CIDR, which lets
+	// several concurrent instances of a function join the same network.
+	cidr := os.Getenv("OL_CIDR")
+	var retentionDays int64
+	if v := os.Getenv("OL_LOG_RETENTION_DAYS"); v != "" {
+		days, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("Error: invalid OL_LOG_RETENTION_DAYS '%v': %v", v, err)
+		}
+		retentionDays = days
+	}
+	// OL_NET_KEY is a base64 encoded key shared by every member of the network.
+	var networkKey []byte
+	if v := os.Getenv("OL_NET_KEY"); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			log.Fatalf("Error: invalid OL_NET_KEY: %v", err)
+		}
+		networkKey = key
+	}
+	// OL_KEY_PARAM names an SSM parameter with KMS encrypted, rotating keys.
+	var keyProvider secure.KeyProvider
+	if v := os.Getenv("OL_KEY_PARAM"); v != "" {
+		keyProvider = awskeys.New(&awskeys.Options{NetworkName: netName, ParameterName: v})
+	}
+	// OL_ACL holds packet filter rules, see filter.ParseRules.
+	var acl []filter.Rule
+	if v := os.Getenv("OL_ACL"); v != "" {
+		rules, err := filter.ParseRules(v)
+		if err != nil {
+			log.Fatalf("Error: invalid OL_ACL: %v", err)
+		}
+		acl = rules
+	}
+	routes, routingOpts := startRouting()
 	opts := overlay.Options{MacAddress: macAddress,
-		IP:          ipAddr,
-		NetworkName: netName,
-		OverlayType: overlay.CloudwatchLog,
+		IP:            ipAddr,
+		NetworkName:   netName,
+		OverlayType:   overlay.CloudwatchLog,
+		CIDR:          cidr,
+		RetentionDays: retentionDays,
+		NetworkKey:    networkKey,
+		KeyProvider:   keyProvider,
+		ACL:           acl,
+		Tracer:        tracer,
+		Budget:        startBudget(netName),
+		QoS:           startQoS(),
+		TCPProfile:    tcpProfile(),
+		Routes:        routes,
+		Routing:       routingOpts,
 	}
 	no := overlay.New(opts)
 	no.Start()
+	logging.Default().Info("joined network", "network", netName, "ip", no.IP(), "mac", no.LinkAddress())
+	return no
+}
+
+// startFromSpecs joins the network of each spec with an interface, as the
+// member of the same position, or the only member given. The first network
+// has the default route and sets the ACL and budget of the overlay.
+// Routing runs when a spec enables it, as a gateway if the function is a
+// gateway of any of them.
+func startFromSpecs(locations, members []string, tracer *tracing.Tracer) *overlay.NetworkOverlay {
+	if len(members) != 1 && len(members) != len(locations) {
+		log.Fatalf("Error: OL_MEMBER must name one member or one per spec of OL_SPEC")
+	}
+	awsspec.Register(os.Getenv("AWS_REGION"))
+	var opts overlay.Options
+	var names []string
+	for i, location := range locations {
+		spec, err := netspec.Load(strings.TrimSpace(location))
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		member := members[0]
+		if len(members) > 1 {
+			member = members[i]
+		}
+		o, err := spec.Options(strings.TrimSpace(member))
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		ifc := o.Interface()
+		if i == 0 {
+			opts = o
+		} else {
+			ifc.Routes = o.Routes
+			if opts.Routing == nil {
+				opts.Routing = o.Routing
+			} else if o.Routing != nil && o.Routing.Gateway {
+				opts.Routing.Gateway = true
+			}
+		}
+		opts.Interfaces = append(opts.Interfaces, ifc)
+		names = append(names, spec.Name)
+	}
+	// Interfaces have the keys of their spec, networks without are in the
+	// clear.
+	opts.NetworkKey, opts.KeyProvider = nil, nil
+	opts.Tracer = tracer
+	opts.Budget = startBudget(names[0])
+	opts.QoS = startQoS()
+	opts.TCPProfile = tcpProfile()
+	no := overlay.New(opts)
+	no.Start()
+	for _, ifc := range no.Interfaces() {
+		logging.Default().Info("joined network", "network", ifc.Network, "ip", ifc.IP, "mac", ifc.MAC)
+	}
+	return no
+}
+
+// reportFilter logs the counters of packet filter rules that dropped packets
+// since the last report.
+func reportFilter(f *filter.Filter, interval time.Duration) {
+	last := map[string]uint64{}
+	for range time.Tick(interval) {
+		for _, s := range f.Stats() {
+			if s.Dropped != last[s.Rule] {
+				logging.Default().Info("filter rule dropped packets", "rule", s.Rule, "dropped", s.Dropped)
+				last[s.Rule] = s.Dropped
+			}
+		}
+	}
+}
+
+// reportLink logs the counters of the overlay link when it was used since
+// the last report.
+func reportLink(no *overlay.NetworkOverlay, interval time.Duration) {
+	var last uint64
+	for range time.Tick(interval) {
+		s := no.Stats()
+		if n := s.RxPackets + s.TxPackets; n != last {
+			logging.Default().Info("link stats", "stats", s, "budget", no.Usage())
+			last = n
+		}
+	}
+}
+
+// emitMetrics prints the metrics of the overlay to stdout in the embedded
+// metric format every interval, which CloudWatch turns into metrics of the
+// rlinklayer namespace.
+func emitMetrics(no *overlay.NetworkOverlay, interval time.Duration) {
+	var r metrics.Registry
+	r.Register(no)
+	metrics.NewEMF(os.Stdout, "rlinklayer").Run(&r, interval, nil)
+}
+
+// startTracer returns a tracer exporting spans to the OTLP/HTTP endpoint of
+// OL_TRACE, tracing the fraction of packets in OL_TRACE_SAMPLE, or nil if
+// OL_TRACE is empty.
+func startTracer() *tracing.Tracer {
+	endpoint := os.Getenv("OL_TRACE")
+	if endpoint == "" {
+		return nil
+	}
+	sampleRate := tracing.DefaultSampleRate
+	if v := os.Getenv("OL_TRACE_SAMPLE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("Error: invalid OL_TRACE_SAMPLE '%v': %v", v, err)
+		}
+		sampleRate = rate
+	}
+	return tracing.New(&tracing.Options{
+		Exporter:   tracing.NewOTLP(endpoint),
+		SampleRate: sampleRate,
+		Service:    os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+	})
+}
+
+// startBudget returns the meter of the network, limiting the bytes ingested
+// in an hour to OL_BUDGET_BYTES_PER_HOUR and the calls in a minute to
+// OL_BUDGET_CALLS_PER_MINUTE, unlimited when empty. OL_BUDGET_ACTION is
+// shed, the default, or delay.
+func startBudget(netName string) *budget.Meter {
+	limits := budget.Limits{Action: os.Getenv("OL_BUDGET_ACTION")}
+	if limits.Action != "" && limits.Action != budget.Shed && limits.Action != budget.Delay {
+		log.Fatalf("Error: invalid OL_BUDGET_ACTION '%v'", limits.Action)
+	}
+	for _, v := range []struct {
+		name  string
+		limit *uint64
+	}{
+		{"OL_BUDGET_BYTES_PER_HOUR", &limits.BytesPerHour},
+		{"OL_BUDGET_CALLS_PER_MINUTE", &limits.CallsPerMinute},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			log.Fatalf("Error: invalid %v '%v': %v", v.name, s, err)
+		}
+		*v.limit = n
+	}
+	return budget.New(&budget.Options{Network: netName, Limits: limits})
+}
+
+// startQoS returns the options of the queues of sent packets: OL_QOS_LIMITS
+// are the packets queued per class, as control=32,bulk=64, OL_QOS_CODEL=1
+// enables CoDel and OL_QOS_INTERACTIVE_PORTS are the ports of interactive
+// packets.
+func startQoS() *qos.Options {
+	limits, err := qos.ParseLimits(os.Getenv("OL_QOS_LIMITS"))
+	if err != nil {
+		log.Fatalf("Error: invalid OL_QOS_LIMITS: %v", err)
+	}
+	opts := &qos.Options{Limits: limits, CoDel: os.Getenv("OL_QOS_CODEL") == "1"}
+	if v := os.Getenv("OL_QOS_INTERACTIVE_PORTS"); v != "" {
+		if opts.InteractivePorts, err = qos.ParsePorts(v); err != nil {
+			log.Fatalf("Error: invalid OL_QOS_INTERACTIVE_PORTS: %v", err)
+		}
+	}
+	return opts
+}
+
+// startRouting returns the static routes in OL_ROUTES, separated by
+// commas, and the options of the routing protocol: OL_ROUTING is learn or
+// gateway, off when empty, and OL_ROUTING_INTERVAL how often routes are
+// announced.
+func startRouting() ([]overlay.Route, *routing.Options) {
+	var routes []overlay.Route
+	if v := os.Getenv("OL_ROUTES"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			r, err := overlay.ParseRoute(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("Error: invalid OL_ROUTES: %v", err)
+			}
+			routes = append(routes, r)
+		}
+	}
+	var opts *routing.Options
+	switch v := os.Getenv("OL_ROUTING"); v {
+	case "", "off":
+	case "learn", "gateway":
+		opts = &routing.Options{Gateway: v == "gateway"}
+	default:
+		log.Fatalf("Error: invalid OL_ROUTING '%v'", v)
+	}
+	if v := os.Getenv("OL_ROUTING_INTERVAL"); v != "" && opts != nil {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Error: invalid OL_ROUTING_INTERVAL '%v'", v)
+		}
+		opts.Interval = d
+	}
+	return routes, opts
+}
+
+// tcpProfile returns the tuning of TCP named by OL_TCP_PROFILE,
+// high-latency when empty.
+func tcpProfile() *tcpprofile.Profile {
+	name := os.Getenv("OL_TCP_PROFILE")
+	if name == "" {
+		return tcpprofile.HighLatency
+	}
+	p, err := tcpprofile.Parse(name)
+	if err != nil {
+		log.Fatalf("Error: invalid OL_TCP_PROFILE: %v", err)
+	}
+	return p
+}
+
+// stopOnSignal releases the network lease and exports the pending spans when
+// the runtime shuts down.
+func stopOnSignal(no *overlay.NetworkOverlay, tracer *tracing.Tracer) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	no.Stop()
+	tracer.Stop()
+	os.Exit(0)
+}
+
+// setupLogging makes a logger printing messages at OL_LOG_LEVEL and above
+// the default one. Below debug, the frames going through sniffers are not
+// printed.
+func setupLogging() {
+	level, err := logging.ParseLevel(os.Getenv("OL_LOG_LEVEL"))
+	if err != nil {
+		log.Fatalf("Error: invalid OL_LOG_LEVEL: %v", err)
+	}
+	// Lambda adds the time to every line of the function logs.
+	logging.SetDefault(logging.New(&logging.Options{Level: level, NoTime: true}))
+	if level > logging.LevelDebug {
+		atomic.StoreUint32(&sniffer.LogPackets, 0)
+	}
 }
 
 func main() {
 	log.SetPrefix("[bootstrap] ")
+	setupLogging()
 
 	runtimeClient := runtime.New(&http.Client{})
 	go execProcess()
-	startNetwork()
+	tracer := startTracer()
+	no := startNetwork(tracer)
+	go stopOnSignal(no, tracer)
+	go reportLink(no, time.Minute)
+	// OL_METRICS=emf publishes the metrics of the overlay to CloudWatch.
+	switch v := os.Getenv("OL_METRICS"); v {
+	case "":
+	case "emf":
+		go emitMetrics(no, time.Minute)
+	default:
+		log.Fatalf("Error: invalid OL_METRICS '%v'", v)
+	}
+	if f := no.Filter(); f != nil {
+		go reportFilter(f, time.Minute)
+	}
 	processEvents(runtimeClient)
 }
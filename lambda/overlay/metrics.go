@@ -0,0 +1,52 @@
+package overlay
+
+import (
+	"sync/atomic"
+
+	"github.com/smithclay/rlinklayer/metrics"
+)
+
+// forwardCounters count the connections from the overlay forwarded to local
+// ports.
+type forwardCounters struct {
+	accepted uint64
+	failed   uint64
+	active   int64
+}
+
+// linkName is the name of the transport link of n in metrics.
+func (n *nic) linkName() string {
+	switch n.netType {
+	case LambdaTag:
+		return "tag"
+	case Multipath:
+		return "bond"
+	}
+	return "cloudwatch"
+}
+
+// Collect returns the metrics of the overlay: the statistics of the
+// transport link of each interface, labelled with its network name,
+// forwarded connections, the TCP counters of its stack and the usage of its
+// budget, labelled with the network of the first interface.
+func (no *NetworkOverlay) Collect() []metrics.Sample {
+	var samples []metrics.Sample
+	for _, n := range no.nics {
+		if n.linkStats != nil {
+			link := metrics.LinkSamples(n.linkName(), n.linkStats.Stats())
+			samples = append(samples, metrics.Label(link, map[string]string{"network": n.netName})...)
+		}
+	}
+	samples = append(samples,
+		metrics.Sample{Name: "rlinklayer_forward_connections_total", Help: "Connections from the overlay forwarded to local ports.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&no.forwards.accepted))},
+		metrics.Sample{Name: "rlinklayer_forward_failures_total", Help: "Connections from the overlay that could not be forwarded.", Type: metrics.Counter, Value: float64(atomic.LoadUint64(&no.forwards.failed))},
+		metrics.Sample{Name: "rlinklayer_forward_connections_active", Help: "Forwarded connections currently open.", Type: metrics.Gauge, Value: float64(atomic.LoadInt64(&no.forwards.active))},
+	)
+	if no.stack != nil {
+		samples = append(samples, metrics.TCPSamples(no.stack.Stats())...)
+	}
+	if no.budget != nil {
+		samples = append(samples, metrics.BudgetSamples(no.budget.Usage())...)
+	}
+	return metrics.Label(samples, map[string]string{"network": no.primary().netName})
+}
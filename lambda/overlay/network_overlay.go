@@ -1,6 +1,8 @@
 package overlay
 
 import (
+	"context"
+	"fmt"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/adapters/gonet"
 	"github.com/google/netstack/tcpip/link/sniffer"
@@ -9,14 +11,28 @@ import (
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/tcpip/transport/tcp"
 	"github.com/google/netstack/waiter"
+	"github.com/smithclay/rlinklayer/ipam"
 	cwLink "github.com/smithclay/rlinklayer/link/aws/cloudwatch"
 	tagLink "github.com/smithclay/rlinklayer/link/aws/tag"
+	"github.com/smithclay/rlinklayer/link/bond"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/capture"
+	"github.com/smithclay/rlinklayer/link/filter"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/routing"
+	"github.com/smithclay/rlinklayer/tcpprofile"
+	"github.com/smithclay/rlinklayer/tracing"
 	"github.com/smithclay/rlinklayer/utils"
 	"io"
 	"log"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type NetworkType int
@@ -24,84 +40,688 @@ type NetworkType int
 const (
 	CloudwatchLog NetworkType = 1
 	LambdaTag     NetworkType = 2
+	// Multipath networks are Cloudwatch networks where the member also
+	// reaches the member of RemoteArn through tags, both links bonded.
+	Multipath NetworkType = 3
 )
 
 type NetworkOverlay struct {
+	stack *stack.Stack
+	// Interfaces of the stack, the first one is the primary
+	nics []*nic
+	// Packet filter
+	acl    []filter.Rule
+	filter *filter.Filter
+	// Packet capture
+	capture *capture.Capture
+	// Packet tracing
+	tracer *tracing.Tracer
+	// Cost metering and budget
+	budget *budget.Meter
+	// Queues of sent packets
+	qos *qos.Options
+	// Tuning of TCP
+	tcpProfile *tcpprofile.Profile
+	// Static routes of the interfaces, and routes learned from gateways
+	static  []tcpip.Route
+	routing *routing.Options
+	speaker *routing.Speaker
+	// Connections forwarded to local ports
+	forwards forwardCounters
+	logger   logging.Logger
+	// Connections from the overlay
+	noInbound bool
+	// Control frames on a single path of Multipath networks
+	noRedundancy bool
+}
+
+// nic is an interface of the stack on a network.
+type nic struct {
+	id        tcpip.NICID
+	name      string
 	netName   string
-	stack     *stack.Stack
 	mac       tcpip.LinkAddress
 	remoteMac tcpip.LinkAddress
 	netType   NetworkType
+	// ip changes when a leased address is lost to another member.
+	ipMu      sync.Mutex
 	ip        string
+	addresses []string
+	routes    []Route
+	region    string
+	roleArn   string
 	// Lambda Tag Specific
 	localArn  string
 	remoteArn string
+	// Address assignment
+	cidr      string
+	leaseTTL  time.Duration
+	leaseArn  string
+	reserved  []net.IP
+	allocator *ipam.Allocator
+	// Cloudwatch specific
+	retentionDays int64
+	// Frame encryption
+	networkKey  []byte
+	keyProvider secure.KeyProvider
+	sealer      *secure.Sealer
+	keyWatcher  *secure.KeyWatcher
+	// Statistics of the transport link
+	linkStats stats.Source
+	// Links of Multipath networks
+	bond *bond.Bond
+	// Route announcements of gateways, nil on networks without
+	channel routing.Channel
+	logger  logging.Logger
 }
 
 type Options struct {
+	// IP through RetentionDays describe the only interface of the overlay
+	// when Interfaces is empty, which has a default route.
 	IP               string
 	OverlayType      NetworkType
 	NetworkName      string
 	MacAddress       string
 	RemoteMacAddress string
-	// Lambda Tag specific
+	// Lambda Tag and Multipath specific
 	LocalArn  string
 	RemoteArn string
+	// CIDR is the network addresses are leased from when IP is empty.
+	CIDR     string
+	LeaseTTL time.Duration
+	// LeaseArn is the function whose tags hold leases on LambdaTag networks.
+	LeaseArn string
+	// Reserved are addresses in CIDR that are never leased, i.e. of
+	// statically configured members.
+	Reserved []net.IP
+	// RetentionDays is the retention of log groups created on Cloudwatch networks.
+	RetentionDays int64
+	// Routes are static routes of the interface, on top of its default
+	// route.
+	Routes []Route
+	// Interfaces are the interfaces of the stack, each on its own network.
+	Interfaces []Interface
+	// NetworkKey encrypts and authenticates packets, sent in the clear if
+	// empty. It is used by interfaces without a key of their own.
+	NetworkKey []byte
+	// KeyProvider distributes rotating network keys, used instead of NetworkKey.
+	KeyProvider secure.KeyProvider
+	// ACL are packet filter rules. When set, inbound packets are dropped
+	// unless a rule allows them, when nil every packet is accepted.
+	ACL []filter.Rule
+	// Capture records the packets of the overlay interfaces as they are
+	// sent and received, before the ACL.
+	Capture *capture.Capture
+	// Tracer traces the transit of a sample of packets across Cloudwatch
+	// networks. The caller stops it after the overlay.
+	Tracer *tracing.Tracer
+	// Budget meters the calls of the transport links to AWS, and sheds or
+	// delays those over the budget. Calls are only limited by AWS if nil.
+	Budget *budget.Meter
+	// QoS configures the classes and queues of the packets sent on
+	// Cloudwatch networks, the defaults of qos.Options if nil.
+	QoS *qos.Options
+	// TCPProfile tunes the TCP of the stack for the latency of the
+	// transport, tcpprofile.HighLatency if nil.
+	TCPProfile *tcpprofile.Profile
+	// Routing learns routes from the gateways of the Cloudwatch networks of
+	// the interfaces, and with Gateway forwards packets between interfaces
+	// and announces their networks. Only static routes are used if nil.
+	Routing *routing.Options
+	// NoInbound stops forwarding connections from the overlay to local
+	// ports, for members that only dial out.
+	NoInbound bool
+	// NoRedundancy sends control frames of Multipath networks through a
+	// single path like other frames, instead of through both.
+	NoRedundancy bool
+	// Region of the AWS services used as transport, us-west-2 if empty.
+	Region string
+	// RoleArn is a role assumed to use Cloudwatch Logs, for a network in
+	// another account. The default credentials are used if empty.
+	RoleArn string
+	// Logger gets the messages of the overlay and its links, with the
+	// network and link address as fields. logging.Default is used if nil.
+	Logger logging.Logger
+}
+
+// Interface is an interface of the overlay on a network, with its own
+// transport, link address, addresses and routes.
+type Interface struct {
+	// Name of the interface in captures and logs, the network name if empty.
+	Name             string
+	OverlayType      NetworkType
+	NetworkName      string
+	MacAddress       string
+	RemoteMacAddress string
+	// Lambda Tag and Multipath specific
+	LocalArn  string
+	RemoteArn string
+	// IP is the primary address of the interface, leased from CIDR if
+	// empty.
+	IP string
+	// Addresses are more addresses of the interface, as an IP or a CIDR
+	// whose network is routed through the interface.
+	Addresses []string
+	// CIDR is the network of the interface, routed through it, and
+	// addresses are leased from when IP is empty.
+	CIDR     string
+	LeaseTTL time.Duration
+	// LeaseArn is the function whose tags hold leases on LambdaTag networks.
+	LeaseArn string
+	// Reserved are addresses in CIDR that are never leased.
+	Reserved []net.IP
+	// RetentionDays is the retention of log groups created on Cloudwatch networks.
+	RetentionDays int64
+	// Region of the AWS services of the transport, the Region of Options
+	// if empty.
+	Region string
+	// RoleArn is a role assumed to use Cloudwatch Logs on Cloudwatch and
+	// Multipath networks, for a network in another account. Tags and keys
+	// are read with the default credentials.
+	RoleArn string
+	// NetworkKey and KeyProvider are the keys of the network, those of
+	// Options if both are empty.
+	NetworkKey  []byte
+	KeyProvider secure.KeyProvider
+	// Routes are the destinations beyond the networks of the interface
+	// reached through it.
+	Routes []Route
+}
+
+// Interface returns the interface described by the fields of opts, with
+// its keys, its routes and a default route.
+func (opts Options) Interface() Interface {
+	return Interface{
+		OverlayType:      opts.OverlayType,
+		NetworkName:      opts.NetworkName,
+		MacAddress:       opts.MacAddress,
+		RemoteMacAddress: opts.RemoteMacAddress,
+		LocalArn:         opts.LocalArn,
+		RemoteArn:        opts.RemoteArn,
+		IP:               opts.IP,
+		CIDR:             opts.CIDR,
+		LeaseTTL:         opts.LeaseTTL,
+		LeaseArn:         opts.LeaseArn,
+		Reserved:         opts.Reserved,
+		RetentionDays:    opts.RetentionDays,
+		Region:           opts.Region,
+		RoleArn:          opts.RoleArn,
+		NetworkKey:       opts.NetworkKey,
+		KeyProvider:      opts.KeyProvider,
+		Routes:           append(append([]Route(nil), opts.Routes...), Route{Destination: DefaultRoute}),
+	}
 }
 
 func New(opts Options) *NetworkOverlay {
-	return &NetworkOverlay{netName: opts.NetworkName,
-		mac:     tcpip.LinkAddress(opts.MacAddress),
-		ip:      opts.IP,
-		netType: opts.OverlayType}
+	interfaces := opts.Interfaces
+	if len(interfaces) == 0 {
+		ifc := opts.Interface()
+		ifc.Name = "overlay"
+		interfaces = []Interface{ifc}
+	}
+	no := &NetworkOverlay{
+		acl:          opts.ACL,
+		capture:      opts.Capture,
+		tracer:       opts.Tracer,
+		budget:       opts.Budget,
+		qos:          opts.QoS,
+		tcpProfile:   opts.TCPProfile,
+		routing:      opts.Routing,
+		noInbound:    opts.NoInbound,
+		noRedundancy: opts.NoRedundancy,
+		logger:       logging.OrDefault(opts.Logger),
+	}
+	for i, ifc := range interfaces {
+		n := &nic{
+			id:        tcpip.NICID(i + 1),
+			name:      ifc.Name,
+			netName:   ifc.NetworkName,
+			mac:       tcpip.LinkAddress(ifc.MacAddress),
+			remoteMac: tcpip.LinkAddress(ifc.RemoteMacAddress),
+			netType:   ifc.OverlayType,
+			ip:        ifc.IP,
+			addresses: ifc.Addresses,
+			routes:    ifc.Routes,
+			region:    ifc.Region,
+			roleArn:   ifc.RoleArn,
+			localArn:  ifc.LocalArn,
+			remoteArn: ifc.RemoteArn,
+			cidr:      ifc.CIDR,
+			leaseTTL:  ifc.LeaseTTL,
+			leaseArn:  ifc.LeaseArn,
+			reserved:  ifc.Reserved,
+
+			retentionDays: ifc.RetentionDays,
+			networkKey:    ifc.NetworkKey,
+			keyProvider:   ifc.KeyProvider,
+		}
+		if n.name == "" {
+			n.name = n.netName
+		}
+		if n.region == "" {
+			n.region = opts.Region
+		}
+		if n.netType == 0 {
+			n.netType = CloudwatchLog
+		}
+		if len(n.networkKey) == 0 && n.keyProvider == nil {
+			n.networkKey, n.keyProvider = opts.NetworkKey, opts.KeyProvider
+		}
+		no.nics = append(no.nics, n)
+	}
+	return no
+}
+
+// primary returns the first interface.
+func (no *NetworkOverlay) primary() *nic {
+	return no.nics[0]
+}
+
+// IP returns the address of the first interface, which is only known after
+// Start when it is leased.
+func (no *NetworkOverlay) IP() string {
+	return no.primary().address()
+}
+
+// Filter returns the packet filter, or nil if no ACL is configured.
+func (no *NetworkOverlay) Filter() *filter.Filter {
+	return no.filter
+}
+
+// Stats returns a snapshot of the counters of the transport link of the
+// first interface, empty before Start.
+func (no *NetworkOverlay) Stats() stats.Snapshot {
+	return no.primary().stats()
+}
+
+// InterfaceStatus is the state of an interface of the overlay.
+type InterfaceStatus struct {
+	Name    string
+	Network string
+	MAC     tcpip.LinkAddress
+	IP      string
+	Stats   stats.Snapshot
+}
+
+func (s InterfaceStatus) String() string {
+	return fmt.Sprintf("%v network %v mac %v ip %v: %v", s.Name, s.Network, s.MAC, s.IP, s.Stats)
+}
+
+// Interfaces returns the state of every interface.
+func (no *NetworkOverlay) Interfaces() []InterfaceStatus {
+	var status []InterfaceStatus
+	for _, n := range no.nics {
+		status = append(status, InterfaceStatus{Name: n.name, Network: n.netName, MAC: n.mac, IP: n.address(), Stats: n.stats()})
+	}
+	return status
+}
+
+// Paths returns the state of the links of the first interface on Multipath
+// networks, nil on other networks.
+func (no *NetworkOverlay) Paths() []bond.Status {
+	if no.primary().bond == nil {
+		return nil
+	}
+	return no.primary().bond.Members()
+}
+
+// Usage returns what the transport links used of the budget, empty without
+// one.
+func (no *NetworkOverlay) Usage() budget.Usage {
+	return no.budget.Usage()
+}
+
+// LinkAddress returns the MAC address of the first interface.
+func (no *NetworkOverlay) LinkAddress() tcpip.LinkAddress {
+	return no.primary().mac
+}
+
+func (n *nic) stats() stats.Snapshot {
+	if n.linkStats == nil {
+		return stats.Snapshot{}
+	}
+	return n.linkStats.Stats()
+}
+
+// Frames per second the links of Multipath networks can send: a batch every
+// write interval on Cloudwatch, and a frame per tag between reads of the
+// peer on tags.
+var (
+	cloudwatchCapacity = float64(cwLink.DefaultWriteBatch) / cwLink.DefaultWriteInterval.Seconds()
+	tagCapacity        = float64(len(tagLink.BufConfig)) / tagLink.PollInterval.Seconds()
+)
+
+// newTagLink creates the link of n to the member of the remote function.
+func (no *NetworkOverlay) newTagLink(n *nic, base logging.Logger, ethernetHeader bool) tcpip.LinkEndpointID {
+	return tagLink.New(&tagLink.Options{
+		LocalArn:       n.localArn,
+		RemoteArn:      n.remoteArn,
+		LocalAddress:   n.mac,
+		RemoteAddress:  n.remoteMac,
+		Sealer:         n.sealer,
+		EthernetHeader: ethernetHeader,
+		Region:         n.region,
+		Logger:         base.With("network", n.netName),
+		Budget:         no.budget,
+	})
+}
+
+// newCloudwatchLink creates the link of n to its Cloudwatch network, and the
+// store of its leases. The members group of the network also carries the
+// route announcements of n.
+func (no *NetworkOverlay) newCloudwatchLink(n *nic, base logging.Logger) (tcpip.LinkEndpointID, ipam.Store) {
+	svc := cwLink.NewLogServiceForRole(n.region, n.roleArn)
+	endpointID, ep := cwLink.New(&cwLink.Options{
+		NetworkName:    n.netName,
+		Address:        n.mac,
+		EthernetHeader: true,
+		LogService:     svc,
+		RetentionDays:  n.retentionDays,
+		Sealer:         n.sealer,
+		Logger:         base,
+		Tracer:         no.tracer,
+		Budget:         no.budget,
+		QoS:            no.tcpProfile.QoS(no.qos),
+	})
+	n.channel = cwLink.NewRouteStore(ep.Members())
+	leaseStore := cwLink.NewLeaseStore(ep.Members())
+	if n.leaseTTL > 0 {
+		leaseStore.Lookback = 2 * n.leaseTTL
+	}
+	return endpointID, leaseStore
 }
 
 func (no *NetworkOverlay) Start() {
 	no.stack = stack.New([]string{ipv4.ProtocolName, arp.ProtocolName}, []string{tcp.ProtocolName}, stack.Options{})
+	if no.tcpProfile == nil {
+		no.tcpProfile = tcpprofile.HighLatency
+	}
+	if err := no.tcpProfile.Apply(no.stack); err != nil {
+		log.Fatalf("Start: %v", err)
+	}
+
+	if no.acl != nil {
+		no.filter = filter.NewFilter(no.acl)
+		for _, r := range no.filter.Rules() {
+			no.logger.Info("filter rule", "rule", &r)
+		}
+	}
+
+	static, err := routeTable(no.nics)
+	if err != nil {
+		log.Fatalf("Start: %v", err)
+	}
+	for _, n := range no.nics {
+		no.startNIC(n)
+	}
+	no.static = static
+	no.setRoutes(nil)
+	if no.routing != nil {
+		no.startRouting()
+	}
+	if !no.noInbound {
+		no.forwardTCP()
+	}
+}
+
+// startNIC creates the transport link of n and its interface on the stack.
+func (no *NetworkOverlay) startNIC(n *nic) {
+	if n.mac == "" {
+		n.mac = utils.GenerateRandomMac()
+		no.logger.Info("no link address configured, using a random one", "network", n.netName, "mac", n.mac)
+	}
+	base := no.logger
+	n.logger = base.With("network", n.netName, "mac", n.mac)
+	n.startSealer()
 
 	var endpointID tcpip.LinkEndpointID
+	var store ipam.Store
 
-	if no.netType == LambdaTag {
-		opts := &tagLink.Options{no.localArn,
-			no.remoteArn,
-			tcpip.LinkAddress(no.mac),
-			tcpip.LinkAddress(no.remoteMac),
+	switch n.netType {
+	case LambdaTag:
+		endpointID = no.newTagLink(n, base, false)
+		if n.leaseArn != "" {
+			store = tagLink.NewLeaseStore(tagLink.NewLambdaServiceForRegion(n.region), n.leaseArn)
 		}
-		endpointID = tagLink.New(opts)
+	case CloudwatchLog:
+		endpointID, store = no.newCloudwatchLink(n, base)
+	case Multipath:
+		if n.remoteMac == "" {
+			log.Fatalf("Start: multipath networks need the link address of the member of the remote function")
+		}
+		cwID, cwStore := no.newCloudwatchLink(n, base)
+		endpointID, n.bond = bond.New(&bond.Options{
+			Members: []bond.Member{
+				{Name: "cloudwatch", Endpoint: cwID, Capacity: cloudwatchCapacity},
+				{Name: "tag", Endpoint: no.newTagLink(n, base, true), Peer: n.remoteMac, Capacity: tagCapacity},
+			},
+			Redundant: !no.noRedundancy,
+			Logger:    n.logger,
+		})
+		store = cwStore
+	default:
+		log.Fatalf("Start: unknown network type %v of interface %v", n.netType, n.name)
 	}
 
-	if no.netType == CloudwatchLog {
-		opts := &cwLink.Options{
-			NetworkName:    no.netName,
-			Address:        tcpip.LinkAddress(no.mac),
-			EthernetHeader: true,
-		}
-		endpointID, _ = cwLink.New(opts)
+	n.linkStats = stats.Find(endpointID)
+
+	if n.address() == "" {
+		n.setAddress(n.acquireAddress(store, no.stack))
+	}
+
+	if no.capture != nil {
+		endpointID = capture.New(endpointID, no.capture, capture.Interface{
+			Name:           n.name,
+			EthernetHeader: n.netType != LambdaTag,
+		})
+	}
+
+	if no.filter != nil {
+		endpointID = filter.New(endpointID, no.filter)
 	}
 
 	sniffed := sniffer.New(endpointID)
-	if err := no.stack.CreateNIC(1, sniffed); err != nil {
-		log.Fatalf("Could not create NIC card")
+	if err := no.stack.CreateNamedNIC(n.id, n.name, sniffed); err != nil {
+		log.Fatalf("Start: could not create NIC %v: %v", n.name, err)
 	}
-	addr := utils.IpToAddress(net.ParseIP(no.ip))
 
-	if err := no.stack.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
-		log.Fatalf("AddAddress error [ipv4]: %s", err)
+	addresses := append([]string{n.address()}, n.addresses...)
+	for _, a := range addresses {
+		ip, _, err := parseAddress(a)
+		if err != nil {
+			log.Fatalf("Start: interface %v: %v", n.name, err)
+		}
+		if err := no.stack.AddAddress(n.id, ipv4.ProtocolNumber, utils.IpToAddress(ip)); err != nil {
+			log.Fatalf("AddAddress error [ipv4]: %s", err)
+		}
 	}
 
-	if err := no.stack.AddAddress(1, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+	if err := no.stack.AddAddress(n.id, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
 		log.Fatalf("AddAddress error [arp]: %s", err)
 	}
+	if n.allocator != nil {
+		// Changes of the lease replace the address of the NIC, which must
+		// exist first.
+		n.allocator.Start()
+	}
+}
 
-	no.stack.SetRouteTable([]tcpip.Route{
-		{
-			Destination: tcpip.Address(strings.Repeat("\x00", 4)),
-			Mask:        tcpip.AddressMask(strings.Repeat("\x00", 4)),
-			Gateway:     "",
-			NIC:         1,
-		},
+// setRoutes sets the route table of the stack to the static routes of the
+// interfaces and the learned routes.
+func (no *NetworkOverlay) setRoutes(learned []routing.Route) {
+	table := append([]tcpip.Route(nil), no.static...)
+	for _, r := range learned {
+		e, err := Route{Destination: r.Destination, Gateway: r.Gateway}.entry(r.NIC)
+		if err != nil {
+			no.logger.Warn("ignoring learned route", "route", r, "err", err)
+			continue
+		}
+		table = append(table, e)
+	}
+	sortRoutes(table)
+	no.stack.SetRouteTable(table)
+}
+
+// startRouting runs the routing protocol on the interfaces with a channel.
+// Gateways forward packets between interfaces and announce the networks of
+// the interfaces and their static routes through a gateway.
+func (no *NetworkOverlay) startRouting() {
+	var interfaces []routing.Interface
+	var local []routing.Advert
+	for _, n := range no.nics {
+		if n.channel != nil {
+			interfaces = append(interfaces, routing.Interface{NIC: n.id, Name: n.name, MAC: n.mac, Address: n.address, Channel: n.channel})
+		}
+		local = append(local, n.localAdverts()...)
+	}
+	if len(interfaces) == 0 {
+		no.logger.Warn("no interface can carry route announcements, only static routes are used")
+		return
+	}
+	if no.routing.Gateway {
+		no.stack.SetForwarding(true)
+	}
+	opts := *no.routing
+	if opts.Logger == nil {
+		opts.Logger = no.logger
+	}
+	no.speaker = routing.NewSpeaker(&opts, interfaces, local, no.setRoutes)
+	no.speaker.Start()
+}
+
+// LearnedRoutes returns the routes learned from gateways, nil without
+// Routing.
+func (no *NetworkOverlay) LearnedRoutes() []routing.Route {
+	if no.speaker == nil {
+		return nil
+	}
+	return no.speaker.Routes()
+}
+
+// DialContext connects to a TCP address on the overlay from the userspace
+// stack, through the interface routing it. The network must be "tcp" or
+// "tcp4" and the host an address.
+func (no *NetworkOverlay) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("DialContext: unsupported network %v", network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("DialContext: %v is not an IPv4 address", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("DialContext: invalid port %v", portStr)
+	}
+	// The interface is picked by the route table.
+	addr := tcpip.FullAddress{Addr: tcpip.Address(ip), Port: uint16(port)}
+	return gonet.DialContextTCP(ctx, no.stack, addr, ipv4.ProtocolNumber)
+}
+
+// acquireAddress leases an address from the CIDR of n. The lease is renewed
+// once n.allocator is started, until Stop.
+func (n *nic) acquireAddress(store ipam.Store, s *stack.Stack) string {
+	if n.cidr == "" {
+		log.Fatalf("Start: either an IP address or a CIDR to lease from is required")
+	}
+	if store == nil {
+		log.Fatalf("Start: no lease store available for this network type")
+	}
+	a, err := ipam.New(store, &ipam.Options{CIDR: n.cidr, MAC: n.mac, TTL: n.leaseTTL, Reserved: n.reserved, Logger: n.logger,
+		OnChange: func(l ipam.Lease, ok bool) { n.leaseChanged(s, l, ok) },
 	})
-	no.forwardTCP()
+	if err != nil {
+		log.Fatalf("Start: could not create address allocator: %v", err)
+	}
+	lease, err := a.Acquire()
+	if err != nil {
+		log.Fatalf("Start: could not lease an address from %v: %v", n.cidr, err)
+	}
+	n.allocator = a
+	n.logger.Info("leased address", "ip", lease.IP, "expires", lease.Expires)
+	return lease.IP.String()
+}
+
+// leaseChanged replaces the address of the interface on the stack when its
+// lease is lost to another member, and a new one is acquired.
+func (n *nic) leaseChanged(s *stack.Stack, l ipam.Lease, ok bool) {
+	addr := utils.IpToAddress(l.IP)
+	if !ok {
+		if err := s.RemoveAddress(n.id, addr); err != nil {
+			n.logger.Warn("could not remove lost address", "ip", l.IP, "err", err)
+		}
+		n.setAddress("")
+		return
+	}
+	if err := s.AddAddress(n.id, ipv4.ProtocolNumber, addr); err != nil {
+		n.logger.Warn("could not add leased address", "ip", l.IP, "err", err)
+		return
+	}
+	n.setAddress(l.IP.String())
+}
+
+// address returns the address of the interface, empty while a lost lease
+// is being replaced.
+func (n *nic) address() string {
+	n.ipMu.Lock()
+	defer n.ipMu.Unlock()
+	return n.ip
+}
+
+func (n *nic) setAddress(ip string) {
+	n.ipMu.Lock()
+	n.ip = ip
+	n.ipMu.Unlock()
+}
+
+// Stop releases resources held on the networks, such as leased addresses.
+func (no *NetworkOverlay) Stop() {
+	if no.speaker != nil {
+		no.speaker.Stop()
+		no.speaker = nil
+	}
+	for _, n := range no.nics {
+		n.stop()
+	}
+}
+
+func (n *nic) stop() {
+	if n.keyWatcher != nil {
+		n.keyWatcher.Stop()
+		n.keyWatcher = nil
+	}
+	if n.allocator == nil {
+		return
+	}
+	if err := n.allocator.Release(); err != nil {
+		n.logger.Warn("could not release lease", "err", err)
+	}
+	n.allocator = nil
+}
+
+// startSealer sets up frame encryption, keys from a provider are refreshed
+// until Stop.
+func (n *nic) startSealer() {
+	var err error
+	switch {
+	case n.keyProvider != nil:
+		n.sealer, err = secure.NewProviderSealer(n.keyProvider, 0)
+		if err != nil {
+			log.Fatalf("Start: could not get network keys: %v", err)
+		}
+		n.keyWatcher = secure.NewKeyWatcher(n.keyProvider, n.sealer, 0)
+		n.keyWatcher.Logger = n.logger
+		n.keyWatcher.Start()
+	case len(n.networkKey) > 0:
+		n.sealer, err = secure.NewPSK(n.networkKey)
+		if err != nil {
+			log.Fatalf("Start: could not use network key: %v", err)
+		}
+	}
 }
 
 func (no *NetworkOverlay) forwardTCP() {
@@ -110,20 +730,25 @@ func (no *NetworkOverlay) forwardTCP() {
 		ep, er := r.CreateEndpoint(&wq)
 		if er != nil {
 			transportEndpointID := r.ID()
-			log.Println(er, net.JoinHostPort(transportEndpointID.LocalAddress.String(), strconv.Itoa(int(transportEndpointID.LocalPort))))
+			no.logger.Warn("could not accept forwarded connection", "port", transportEndpointID.LocalPort, "peer", transportEndpointID.RemoteAddress, "err", er)
 			r.Complete(false)
+			atomic.AddUint64(&no.forwards.failed, 1)
 			return
 		}
 		defer ep.Close()
 		transportEndpointID := r.ID()
 		r.Complete(false)
-		log.Printf("NewForwarder Remote: %v:%v", transportEndpointID.RemoteAddress, transportEndpointID.RemotePort)
+		no.logger.Debug("forwarding connection", "port", transportEndpointID.LocalPort, "peer", net.JoinHostPort(transportEndpointID.RemoteAddress.String(), strconv.Itoa(int(transportEndpointID.RemotePort))))
 		conn, err := net.Dial("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(int(transportEndpointID.LocalPort))))
 		if err != nil {
-			log.Println(err)
+			no.logger.Warn("could not forward connection", "port", transportEndpointID.LocalPort, "err", err)
+			atomic.AddUint64(&no.forwards.failed, 1)
 			return
 		}
 		defer conn.Close()
+		atomic.AddUint64(&no.forwards.accepted, 1)
+		atomic.AddInt64(&no.forwards.active, 1)
+		defer atomic.AddInt64(&no.forwards.active, -1)
 		fwdConn := gonet.NewConn(&wq, ep)
 		go io.Copy(fwdConn, conn)
 		io.Copy(conn, fwdConn)
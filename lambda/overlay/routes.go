@@ -0,0 +1,173 @@
+package overlay
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/routing"
+	"github.com/smithclay/rlinklayer/utils"
+)
+
+// DefaultRoute is the destination of every address.
+const DefaultRoute = "0.0.0.0/0"
+
+// Route sends the packets to the addresses of Destination, a CIDR, through
+// an interface, to Gateway if set or else straight to their destination.
+type Route struct {
+	Destination string
+	Gateway     string
+}
+
+func (r Route) String() string {
+	if r.Gateway == "" {
+		return r.Destination
+	}
+	return r.Destination + " via " + r.Gateway
+}
+
+// ParseRoute parses a route written as a CIDR, optionally followed by
+// "via" and a gateway, i.e. "10.0.0.0/8 via 192.168.1.1".
+func ParseRoute(s string) (Route, error) {
+	f := strings.Fields(s)
+	var r Route
+	switch {
+	case len(f) == 1:
+		r = Route{Destination: f[0]}
+	case len(f) == 3 && f[1] == "via":
+		r = Route{Destination: f[0], Gateway: f[2]}
+	default:
+		return Route{}, fmt.Errorf("ParseRoute: %q is not a CIDR optionally followed by via and a gateway", s)
+	}
+	if _, err := r.entry(0); err != nil {
+		return Route{}, fmt.Errorf("ParseRoute: %v", err)
+	}
+	return r, nil
+}
+
+// entry returns the route as an entry of the route table of the stack.
+func (r Route) entry(id tcpip.NICID) (tcpip.Route, error) {
+	_, network, err := net.ParseCIDR(r.Destination)
+	if err != nil || network.IP.To4() == nil {
+		return tcpip.Route{}, fmt.Errorf("destination %q is not an IPv4 CIDR", r.Destination)
+	}
+	e := tcpip.Route{
+		Destination: utils.IpToAddress(network.IP),
+		Mask:        tcpip.AddressMask(net.IP(network.Mask).To4()),
+		NIC:         id,
+	}
+	if r.Gateway != "" {
+		gw := net.ParseIP(r.Gateway).To4()
+		if gw == nil {
+			return tcpip.Route{}, fmt.Errorf("gateway %q of %v is not an IPv4 address", r.Gateway, r.Destination)
+		}
+		e.Gateway = utils.IpToAddress(gw)
+	}
+	return e, nil
+}
+
+// parseAddress parses an address of an interface, an IP or a CIDR, and
+// returns its network if it is a CIDR.
+func parseAddress(s string) (net.IP, *net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, network, err := net.ParseCIDR(s)
+		if err != nil || ip.To4() == nil {
+			return nil, nil, fmt.Errorf("address %q is not an IPv4 CIDR", s)
+		}
+		return ip, network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip.To4() == nil {
+		return nil, nil, fmt.Errorf("address %q is not an IPv4 address", s)
+	}
+	return ip, nil, nil
+}
+
+// allRoutes returns the routes through n: its networks, then its
+// routes.
+func (n *nic) allRoutes() ([]Route, error) {
+	var routes []Route
+	if n.cidr != "" {
+		_, network, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			return nil, fmt.Errorf("network %q is not a CIDR", n.cidr)
+		}
+		routes = append(routes, Route{Destination: network.String()})
+	}
+	for _, a := range n.addresses {
+		_, network, err := parseAddress(a)
+		if err != nil {
+			return nil, err
+		}
+		if network != nil {
+			routes = append(routes, Route{Destination: network.String()})
+		}
+	}
+	return append(routes, n.routes...), nil
+}
+
+// routeTable returns the route table of the stack with the static routes of
+// every interface. The stack uses the first route matching a destination,
+// so routes are sorted from the longest prefix to the shortest, and routes
+// of the same length by interface. Learned routes come after static routes
+// of the same length.
+//
+// Interfaces after the first need a network, a CIDR or an address with a
+// prefix: only the first has the default route, and the stack wouldn't
+// send anything through an interface with a bare IP.
+func routeTable(nics []*nic) ([]tcpip.Route, error) {
+	var table []tcpip.Route
+	for i, n := range nics {
+		routes, err := n.allRoutes()
+		if err != nil {
+			return nil, fmt.Errorf("interface %v: %v", n.name, err)
+		}
+		if i > 0 && len(routes) == len(n.routes) {
+			return nil, fmt.Errorf("interface %v: no network, set its CIDR or give it an address with a prefix", n.name)
+		}
+		for _, r := range routes {
+			e, err := r.entry(n.id)
+			if err != nil {
+				return nil, fmt.Errorf("interface %v: %v", n.name, err)
+			}
+			table = append(table, e)
+		}
+	}
+	sortRoutes(table)
+	return table, nil
+}
+
+// sortRoutes sorts table from the longest prefix to the shortest, keeping
+// the order of routes of the same length.
+func sortRoutes(table []tcpip.Route) {
+	sort.SliceStable(table, func(i, j int) bool {
+		return prefixLength(table[i].Mask) > prefixLength(table[j].Mask)
+	})
+}
+
+func prefixLength(mask tcpip.AddressMask) int {
+	ones, _ := net.IPMask(mask).Size()
+	return ones
+}
+
+// localAdverts returns the networks n announces as a gateway: its own
+// networks, and its static routes through a gateway one hop further.
+func (n *nic) localAdverts() []routing.Advert {
+	var adverts []routing.Advert
+	routes, err := n.allRoutes()
+	if err != nil {
+		return nil
+	}
+	for _, r := range routes {
+		switch {
+		case r.Destination == DefaultRoute:
+		case r.Gateway == "":
+			adverts = append(adverts, routing.Advert{Destination: r.Destination})
+		default:
+			adverts = append(adverts, routing.Advert{Destination: r.Destination, Metric: 1})
+		}
+	}
+	return adverts
+}
@@ -0,0 +1,82 @@
+package overlay
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/routing"
+)
+
+func TestRouteTable(t *testing.T) {
+	no := New(Options{Interfaces: []Interface{
+		{NetworkName: "prod-net", CIDR: "192.168.1.0/24", Routes: []Route{{Destination: DefaultRoute}}},
+		{NetworkName: "debug-net", IP: "10.1.0.5", Addresses: []string{"10.1.1.5/24"}, Routes: []Route{{Destination: "10.0.0.0/8", Gateway: "10.1.1.1"}}},
+	}})
+	table, err := routeTable(no.nics)
+	if err != nil {
+		t.Fatalf("routeTable: %v", err)
+	}
+	var got []string
+	for _, r := range table {
+		got = append(got, fmt.Sprintf("%v/%d via %v nic %d", net.IP(r.Destination), prefixLength(r.Mask), net.IP(r.Gateway), r.NIC))
+	}
+	want := []string{
+		"192.168.1.0/24 via <nil> nic 1",
+		"10.1.1.0/24 via <nil> nic 2",
+		"10.0.0.0/8 via 10.1.1.1 nic 2",
+		"0.0.0.0/0 via <nil> nic 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected routes from the longest prefix\n%v, got\n%v", want, got)
+	}
+
+	no = New(Options{Interfaces: []Interface{{NetworkName: "prod-net", Routes: []Route{{Destination: "10.0.0.0"}}}}})
+	if _, err := routeTable(no.nics); err == nil {
+		t.Errorf("Expected a destination without a prefix to be invalid")
+	}
+
+	no = New(Options{Interfaces: []Interface{
+		{NetworkName: "prod-net", CIDR: "192.168.1.0/24", Routes: []Route{{Destination: DefaultRoute}}},
+		{NetworkName: "debug-net", IP: "10.1.0.5", Routes: []Route{{Destination: "10.0.0.0/8", Gateway: "10.1.0.1"}}},
+	}})
+	if _, err := routeTable(no.nics); err == nil {
+		t.Errorf("Expected a second interface without a network to be invalid")
+	}
+}
+
+func TestNew_SingleInterface(t *testing.T) {
+	no := New(Options{NetworkName: "TestNet", IP: "192.168.1.5", OverlayType: LambdaTag, NetworkKey: []byte("key")})
+	if len(no.nics) != 1 {
+		t.Fatalf("Expected one interface, got %d", len(no.nics))
+	}
+	n := no.nics[0]
+	if n.id != 1 || n.name != "overlay" || n.netName != "TestNet" || n.netType != LambdaTag || string(n.networkKey) != "key" {
+		t.Errorf("Unexpected interface %+v", n)
+	}
+	table, err := routeTable(no.nics)
+	if err != nil || len(table) != 1 || table[0] != (tcpip.Route{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 1}) {
+		t.Errorf("Expected a default route, got %v, %v", table, err)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	if r, err := ParseRoute("10.0.0.0/8 via 192.168.1.1"); err != nil || r != (Route{Destination: "10.0.0.0/8", Gateway: "192.168.1.1"}) {
+		t.Errorf("Unexpected route %v, %v", r, err)
+	}
+	for _, s := range []string{"", "10.0.0.0/8 through 192.168.1.1", "10.0.0.0/8 via host", "fd00::/8"} {
+		if _, err := ParseRoute(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestLocalAdverts(t *testing.T) {
+	no := New(Options{NetworkName: "prod-net", CIDR: "192.168.1.7/24", Routes: []Route{{Destination: "10.9.0.0/16", Gateway: "192.168.1.1"}}})
+	want := []routing.Advert{{Destination: "192.168.1.0/24", Metric: 0}, {Destination: "10.9.0.0/16", Metric: 1}}
+	if got := no.nics[0].localAdverts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the network and the static route without the default route\n%v, got\n%v", want, got)
+	}
+}
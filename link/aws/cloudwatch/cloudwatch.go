@@ -2,13 +2,23 @@ package cloudwatch
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/bridge"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/tracing"
 	"log"
+	"time"
 )
 
 // todo: configure this
@@ -22,6 +32,7 @@ type endpoint struct {
 	logLink    *LogLink
 	hdrSize    int
 	p2p        bool
+	logger     logging.Logger
 }
 
 type Options struct {
@@ -30,21 +41,106 @@ type Options struct {
 	PointToPoint   bool
 	EthernetHeader bool
 	NetworkName    string
-	LinkEndpoint   tcpip.LinkEndpointID
+	// LogService overrides the Amazon Cloudwatch Logs client, NewLogService is used if nil.
+	LogService cloudwatchlogsiface.CloudWatchLogsAPI
+	// RetentionDays sets the retention of log groups created by the link, so
+	// packet data doesn't stay in the account forever. Zero keeps logs forever.
+	// Must be one of the values accepted by PutRetentionPolicy (1, 3, 5, 7, 14, ...).
+	RetentionDays int64
+	// HeartbeatInterval is how often the link announces itself in the members
+	// group, DefaultHeartbeatInterval is used if zero.
+	HeartbeatInterval time.Duration
+	// NetworkKey enables encryption and authentication of packets with a key
+	// shared by all members, at least secure.MinKeySize bytes.
+	NetworkKey []byte
+	// Sealer is used instead of NetworkKey for keys that rotate.
+	Sealer *secure.Sealer
+	// Logger gets the messages of the link, with the network and address as
+	// fields. logging.Default is used if nil.
+	Logger logging.Logger
+	// Tracer traces a sample of the packets sent by the link, and exports
+	// the transit of traced packets it receives. Nothing is traced if nil.
+	Tracer *tracing.Tracer
+	// Polling tunes how often the link reads and writes packets.
+	Polling Polling
+	// Budget meters the calls of the link and sheds or delays those over
+	// the budget of the network. Links of a network should share it.
+	Budget *budget.Meter
+	// QoS configures the classes and queues of sent packets, the defaults
+	// of qos.Options if nil.
+	QoS *qos.Options
 }
 
-// New creates a new endpoint for transmitting data using Amazon Cloudwathc gorups
-func New(opts *Options) (tcpip.LinkEndpointID, *endpoint) {
+// newLogger returns the logger of a link created with opts.
+func newLogger(opts *Options) logging.Logger {
+	return logging.OrDefault(opts.Logger).With("link", "cloudwatch", "network", opts.NetworkName, "mac", opts.Address)
+}
+
+// newSealer returns a sealer for the network key in opts, or nil if packets
+// are sent in the clear.
+func newSealer(opts *Options) *secure.Sealer {
+	if opts.Sealer != nil {
+		return opts.Sealer
+	}
+	if len(opts.NetworkKey) == 0 {
+		return nil
+	}
+	sealer, err := secure.NewPSK(opts.NetworkKey)
+	if err != nil {
+		log.Fatalf("New: Could not use network key: %v", err)
+	}
+	return sealer
+}
+
+// DefaultRegion is the region of clients created without one.
+const DefaultRegion = "us-west-2"
+
+// NewLogService creates an Amazon Cloudwatch Logs client for the default region.
+func NewLogService() cloudwatchlogsiface.CloudWatchLogsAPI {
+	return NewLogServiceForRegion(DefaultRegion)
+}
+
+// NewLogServiceForRegion creates an Amazon Cloudwatch Logs client for region,
+// or the default region if empty.
+func NewLogServiceForRegion(region string) cloudwatchlogsiface.CloudWatchLogsAPI {
+	if region == "" {
+		region = DefaultRegion
+	}
+	sess, _ := session.NewSession(&aws.Config{
+		Region: aws.String(region)},
+	)
+	return cloudwatchlogs.New(sess)
+}
+
+// NewLogServiceForRole creates an Amazon Cloudwatch Logs client for region
+// that assumes the role roleArn, for networks in another account. It is
+// NewLogServiceForRegion if roleArn is empty.
+func NewLogServiceForRole(region, roleArn string) cloudwatchlogsiface.CloudWatchLogsAPI {
+	if roleArn == "" {
+		return NewLogServiceForRegion(region)
+	}
+	if region == "" {
+		region = DefaultRegion
+	}
 	sess, _ := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2")},
+		Region: aws.String(region)},
 	)
-	svc := cloudwatchlogs.New(sess)
+	return cloudwatchlogs.New(sess, &aws.Config{Credentials: stscreds.NewCredentials(sess, roleArn)})
+}
+
+// New creates a new endpoint for transmitting data using Amazon Cloudwathc gorups
+func New(opts *Options) (tcpip.LinkEndpointID, *endpoint) {
+	svc := opts.LogService
+	if svc == nil {
+		svc = NewLogService()
+	}
 
 	ep := &endpoint{
 		laddr:   opts.Address,
 		raddr:   opts.RemoteAddress,
 		netName: opts.NetworkName,
 		p2p:     opts.PointToPoint,
+		logger:  newLogger(opts),
 	}
 
 	if opts.PointToPoint && opts.RemoteAddress == "" {
@@ -56,7 +152,20 @@ func New(opts *Options) (tcpip.LinkEndpointID, *endpoint) {
 		ep.hdrSize = header.EthernetMinimumSize
 	}
 
-	ep.logLink = NewLogLink(&LogConfig{LogService: svc, Endpoint: ep, NetName: opts.NetworkName})
+	ep.logLink = NewLogLink(&LogConfig{
+		LogService:        svc,
+		Endpoint:          ep,
+		NetName:           opts.NetworkName,
+		RetentionDays:     opts.RetentionDays,
+		HeartbeatInterval: opts.HeartbeatInterval,
+		Sealer:            newSealer(opts),
+		Logger:            ep.logger,
+		Tracer:            opts.Tracer,
+		Polling:           opts.Polling,
+		Budget:            opts.Budget,
+		QoS:               opts.QoS,
+		EthernetHeader:    opts.EthernetHeader,
+	})
 
 	return stack.RegisterLinkEndpoint(ep), ep
 }
@@ -128,28 +237,48 @@ func (e *endpoint) WritePacket(r *stack.Route, _ *stack.GSO, hdr buffer.Prependa
 	vv := buffer.NewVectorisedView(payload.Size(), views)
 
 	// Fail if there is no remote address to write to
-	cwLinkAddr := CloudwatchLinkAddress{r.LocalLinkAddress, r.RemoteLinkAddress, e.netName}
+	dst := r.RemoteLinkAddress
+	if bridge.IsGroup(dst) {
+		dst = broadcastMAC
+	}
+	cwLinkAddr := CloudwatchLinkAddress{r.LocalLinkAddress, dst, e.netName}
 
 	// Open stream for writing (which creates if it doesn't exist)
-	err := e.logLink.OpenLogStream(cwLinkAddr)
+	err := e.logLink.openForWrite(cwLinkAddr)
 	if err != nil {
-		log.Fatalf("WritePacket: Could not create remote log group: %v", err)
+		return nil
 	}
-	//log.Printf("WritePacket: %v -> %v (%v)", cwLinkAddr.raddr, cwLinkAddr.raddr, protocol)
 
 	// Write outbound packet
 	_, err = e.logLink.Write(cwLinkAddr, protocol, hdr.View(), vv.ToView())
 	if err != nil {
-		log.Printf("WritePacket: Error writing to link buffer, dropping packet: %v", err)
+		e.logger.Warn("dropping packet, could not write it", "peer", dst, "err", err)
 		return nil
 	}
 	return nil
 }
 
+// Stats implements stats.Source.
+func (e *endpoint) Stats() stats.Snapshot {
+	return e.logLink.Stats()
+}
+
+// Members returns the writer of the link's heartbeats, for the lease and
+// route stores of the member to share.
+func (e *endpoint) Members() *MemberWriter {
+	return e.logLink.members
+}
+
+// Listen starts reading frames sent to addr, so that bridges receive frames
+// for hosts on their other ports. It implements bridge.Listener.
+func (e *endpoint) Listen(addr tcpip.LinkAddress) error {
+	return e.logLink.Listen(addr)
+}
+
 func (e *endpoint) ReadPacket() {
 	vv, err := e.logLink.Read()
 	if err != nil {
-		log.Printf("ReadPacket: error reading: %v", err)
+		e.logger.Warn("could not read packet", "err", err)
 		return
 	}
 	var (
@@ -177,7 +306,8 @@ func (e *endpoint) ReadPacket() {
 
 	// Message coming from the sending link, ignore
 	if remote != "" && remote == e.LinkAddress() {
-		log.Printf("ReadPacket: ignoring frame, address is local")
+		e.logger.Debug("dropping frame sent by the link")
+		e.logLink.stats.Drop(stats.DropLooped)
 		return
 	}
 
@@ -16,6 +16,12 @@ func NewCloudwatchLinkAddress(laddr, raddr tcpip.LinkAddress, netName string) *C
 	return &CloudwatchLinkAddress{laddr, raddr, netName}
 }
 
+// MembersGroupName is the log group where members of a network publish leases
+// and heartbeats, one log stream per member link address.
+func MembersGroupName(netName string) string {
+	return fmt.Sprintf("%v/members", netName)
+}
+
 func (cw *CloudwatchLinkAddress) FullPath() string {
 	return fmt.Sprintf("%s/%s", cw.LogGroupName(), cw.LogStreamName())
 }
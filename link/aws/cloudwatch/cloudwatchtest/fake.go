@@ -0,0 +1,420 @@
+// Package cloudwatchtest provides an in-memory Amazon Cloudwatch Logs service
+// for testing links without AWS credentials.
+package cloudwatchtest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+type stream struct {
+	name          string
+	created       int64
+	sequenceToken int
+	events        []*cloudwatchlogs.FilteredLogEvent
+}
+
+type group struct {
+	name      string
+	created   int64
+	retention *int64
+	streams   map[string]*stream
+}
+
+// Service is a fake cloudwatchlogsiface.CloudWatchLogsAPI. Operations that
+// aren't implemented panic through the embedded nil interface.
+type Service struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+
+	mu     sync.Mutex
+	groups map[string]*group
+	calls  map[string]int
+
+	// Now returns the current time, it can be replaced to control timestamps.
+	Now func() time.Time
+	// Latency is added to every call to simulate the round trip to AWS.
+	Latency time.Duration
+	// PageSize limits the number of items returned per page.
+	PageSize int
+	// RateLimit is the number of calls per second allowed for each
+	// operation, like the quotas of the real service. Calls over it fail
+	// with a ThrottlingException. Calls are not limited if zero.
+	RateLimit float64
+
+	buckets map[string]*bucket
+}
+
+// bucket is a token bucket limiting the calls to an operation.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New creates an empty fake service.
+func New() *Service {
+	return &Service{
+		groups:   map[string]*group{},
+		calls:    map[string]int{},
+		buckets:  map[string]*bucket{},
+		Now:      time.Now,
+		PageSize: 50,
+	}
+}
+
+// Calls returns the number of calls made to operation op.
+func (s *Service) Calls(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+// delay simulates the round trip to AWS, it must not be called with the lock held.
+func (s *Service) delay() {
+	if s.Latency > 0 {
+		time.Sleep(s.Latency)
+	}
+}
+
+// call counts a call to op, or fails it if it is over the RateLimit.
+func (s *Service) call(op string) error {
+	s.calls[op]++
+	if s.RateLimit <= 0 {
+		return nil
+	}
+	now := time.Now()
+	b, ok := s.buckets[op]
+	if !ok {
+		b = &bucket{tokens: s.RateLimit, last: now}
+		s.buckets[op] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * s.RateLimit
+	if b.tokens > s.RateLimit {
+		b.tokens = s.RateLimit
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return awserr.New("ThrottlingException", "Rate exceeded", nil)
+	}
+	b.tokens--
+	return nil
+}
+
+func (s *Service) now() int64 {
+	return s.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func notFound(what string) error {
+	return awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "The specified "+what+" does not exist.", nil)
+}
+
+func (s *Service) stream(groupName, streamName *string) (*stream, error) {
+	g, ok := s.groups[aws.StringValue(groupName)]
+	if !ok {
+		return nil, notFound("log group")
+	}
+	st, ok := g.streams[aws.StringValue(streamName)]
+	if !ok {
+		return nil, notFound("log stream")
+	}
+	return st, nil
+}
+
+// CreateLogGroup implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) CreateLogGroup(in *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("CreateLogGroup"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(in.LogGroupName)
+	if _, ok := s.groups[name]; ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log group already exists", nil)
+	}
+	s.groups[name] = &group{name: name, created: s.now(), streams: map[string]*stream{}}
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+// CreateLogStream implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) CreateLogStream(in *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("CreateLogStream"); err != nil {
+		return nil, err
+	}
+	g, ok := s.groups[aws.StringValue(in.LogGroupName)]
+	if !ok {
+		return nil, notFound("log group")
+	}
+	name := aws.StringValue(in.LogStreamName)
+	if _, ok := g.streams[name]; ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceAlreadyExistsException, "The specified log stream already exists", nil)
+	}
+	g.streams[name] = &stream{name: name, created: s.now()}
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+// PutRetentionPolicy implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) PutRetentionPolicy(in *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("PutRetentionPolicy"); err != nil {
+		return nil, err
+	}
+	g, ok := s.groups[aws.StringValue(in.LogGroupName)]
+	if !ok {
+		return nil, notFound("log group")
+	}
+	g.retention = aws.Int64(aws.Int64Value(in.RetentionInDays))
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+// PutLogEvents implements cloudwatchlogsiface.CloudWatchLogsAPI. Sequence
+// tokens are checked like the real service does.
+func (s *Service) PutLogEvents(in *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("PutLogEvents"); err != nil {
+		return nil, err
+	}
+	st, err := s.stream(in.LogGroupName, in.LogStreamName)
+	if err != nil {
+		return nil, err
+	}
+	expected := strconv.Itoa(st.sequenceToken)
+	if st.sequenceToken > 0 && aws.StringValue(in.SequenceToken) != expected {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException,
+			"The given sequenceToken is invalid. The next expected sequenceToken is: "+expected, nil)
+	}
+
+	ingested := s.now()
+	for _, e := range in.LogEvents {
+		st.events = append(st.events, &cloudwatchlogs.FilteredLogEvent{
+			EventId:       aws.String(strconv.Itoa(len(st.events))),
+			LogStreamName: aws.String(st.name),
+			Message:       e.Message,
+			Timestamp:     e.Timestamp,
+			IngestionTime: aws.Int64(ingested),
+		})
+	}
+	st.sequenceToken++
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(strconv.Itoa(st.sequenceToken))}, nil
+}
+
+// FilterLogEvents implements cloudwatchlogsiface.CloudWatchLogsAPI. Filter
+// patterns are not supported, events are returned ordered by timestamp.
+func (s *Service) FilterLogEvents(in *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("FilterLogEvents"); err != nil {
+		return nil, err
+	}
+	g, ok := s.groups[aws.StringValue(in.LogGroupName)]
+	if !ok {
+		return nil, notFound("log group")
+	}
+
+	names := map[string]bool{}
+	for _, n := range in.LogStreamNames {
+		names[aws.StringValue(n)] = true
+	}
+	var events []*cloudwatchlogs.FilteredLogEvent
+	for _, st := range g.streams {
+		if len(names) > 0 && !names[st.name] {
+			continue
+		}
+		for _, e := range st.events {
+			ts := aws.Int64Value(e.Timestamp)
+			if in.StartTime != nil && ts < *in.StartTime {
+				continue
+			}
+			if in.EndTime != nil && ts > *in.EndTime {
+				continue
+			}
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return aws.Int64Value(events[i].Timestamp) < aws.Int64Value(events[j].Timestamp)
+	})
+
+	out := &cloudwatchlogs.FilterLogEventsOutput{}
+	start, end, next := page(len(events), in.NextToken, s.limit(in.Limit))
+	out.Events, out.NextToken = events[start:end], next
+	return out, nil
+}
+
+// FilterLogEventsPages implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) FilterLogEventsPages(in *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+	params := *in
+	for {
+		out, err := s.FilterLogEvents(&params)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		params.NextToken = out.NextToken
+	}
+}
+
+// DescribeLogGroups implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) DescribeLogGroups(in *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("DescribeLogGroups"); err != nil {
+		return nil, err
+	}
+	var groups []*cloudwatchlogs.LogGroup
+	for _, g := range s.groups {
+		if !strings.HasPrefix(g.name, aws.StringValue(in.LogGroupNamePrefix)) {
+			continue
+		}
+		groups = append(groups, &cloudwatchlogs.LogGroup{
+			LogGroupName:    aws.String(g.name),
+			CreationTime:    aws.Int64(g.created),
+			RetentionInDays: g.retention,
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return aws.StringValue(groups[i].LogGroupName) < aws.StringValue(groups[j].LogGroupName)
+	})
+
+	out := &cloudwatchlogs.DescribeLogGroupsOutput{}
+	start, end, next := page(len(groups), in.NextToken, s.limit(in.Limit))
+	out.LogGroups, out.NextToken = groups[start:end], next
+	return out, nil
+}
+
+// DescribeLogGroupsPages implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) DescribeLogGroupsPages(in *cloudwatchlogs.DescribeLogGroupsInput, fn func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool) error {
+	params := *in
+	for {
+		out, err := s.DescribeLogGroups(&params)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		params.NextToken = out.NextToken
+	}
+}
+
+// DescribeLogStreams implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) DescribeLogStreams(in *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("DescribeLogStreams"); err != nil {
+		return nil, err
+	}
+	g, ok := s.groups[aws.StringValue(in.LogGroupName)]
+	if !ok {
+		return nil, notFound("log group")
+	}
+	var streams []*cloudwatchlogs.LogStream
+	for _, st := range g.streams {
+		if !strings.HasPrefix(st.name, aws.StringValue(in.LogStreamNamePrefix)) {
+			continue
+		}
+		ls := &cloudwatchlogs.LogStream{
+			LogStreamName: aws.String(st.name),
+			CreationTime:  aws.Int64(st.created),
+		}
+		if n := len(st.events); n > 0 {
+			ls.LastEventTimestamp = st.events[n-1].Timestamp
+			ls.LastIngestionTime = st.events[n-1].IngestionTime
+		}
+		streams = append(streams, ls)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return aws.StringValue(streams[i].LogStreamName) < aws.StringValue(streams[j].LogStreamName)
+	})
+
+	out := &cloudwatchlogs.DescribeLogStreamsOutput{}
+	start, end, next := page(len(streams), in.NextToken, s.limit(in.Limit))
+	out.LogStreams, out.NextToken = streams[start:end], next
+	return out, nil
+}
+
+// DescribeLogStreamsPages implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) DescribeLogStreamsPages(in *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error {
+	params := *in
+	for {
+		out, err := s.DescribeLogStreams(&params)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		params.NextToken = out.NextToken
+	}
+}
+
+// DeleteLogGroup implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) DeleteLogGroup(in *cloudwatchlogs.DeleteLogGroupInput) (*cloudwatchlogs.DeleteLogGroupOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("DeleteLogGroup"); err != nil {
+		return nil, err
+	}
+	name := aws.StringValue(in.LogGroupName)
+	if _, ok := s.groups[name]; !ok {
+		return nil, notFound("log group")
+	}
+	delete(s.groups, name)
+	return &cloudwatchlogs.DeleteLogGroupOutput{}, nil
+}
+
+// DeleteLogStream implements cloudwatchlogsiface.CloudWatchLogsAPI.
+func (s *Service) DeleteLogStream(in *cloudwatchlogs.DeleteLogStreamInput) (*cloudwatchlogs.DeleteLogStreamOutput, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.call("DeleteLogStream"); err != nil {
+		return nil, err
+	}
+	if _, err := s.stream(in.LogGroupName, in.LogStreamName); err != nil {
+		return nil, err
+	}
+	delete(s.groups[aws.StringValue(in.LogGroupName)].streams, aws.StringValue(in.LogStreamName))
+	return &cloudwatchlogs.DeleteLogStreamOutput{}, nil
+}
+
+func (s *Service) limit(l *int64) int {
+	if l != nil && int(*l) < s.PageSize {
+		return int(*l)
+	}
+	return s.PageSize
+}
+
+// page returns the bounds of the listing page starting at the offset held
+// in token, and the token for the next page.
+func page(n int, token *string, limit int) (int, int, *string) {
+	start, _ := strconv.Atoi(aws.StringValue(token))
+	if start > n {
+		start = n
+	}
+	end := start + limit
+	if end >= n {
+		return start, n, nil
+	}
+	return start, end, aws.String(strconv.Itoa(end))
+}
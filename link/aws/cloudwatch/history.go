@@ -0,0 +1,132 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// LoggedPacket is a packet read back from the log groups of a network.
+type LoggedPacket struct {
+	// Time is the timestamp of the log event, with millisecond precision.
+	Time time.Time
+	// Group and Stream are where the packet was logged: the group of its
+	// destination and the stream of its source.
+	Group    string
+	Stream   string
+	Src      tcpip.LinkAddress
+	Dest     tcpip.LinkAddress
+	Protocol tcpip.NetworkProtocolNumber
+	Header   []byte
+	Payload  []byte
+}
+
+// Frame returns the packet with an Ethernet header. Packets written by
+// links with EthernetHeader already have one, the others get one built
+// from the logged addresses.
+func (p *LoggedPacket) Frame() []byte {
+	b := append(append([]byte{}, p.Header...), p.Payload...)
+	if len(b) >= header.EthernetMinimumSize {
+		eth := header.Ethernet(b)
+		if eth.SourceAddress() == p.Src && eth.Type() == p.Protocol {
+			return b
+		}
+	}
+	frame := make([]byte, header.EthernetMinimumSize, header.EthernetMinimumSize+len(b))
+	header.Ethernet(frame).Encode(&header.EthernetFields{SrcAddr: p.Src, DstAddr: p.Dest, Type: p.Protocol})
+	return append(frame, b...)
+}
+
+// ReadPackets returns the packets logged on a network between start and end,
+// ordered by time. Sealed packets are opened with sealer.OpenOffline, with
+// any key version it knew and however old they are, events that can't be
+// decoded are logged and skipped.
+func ReadPackets(svc cloudwatchlogsiface.CloudWatchLogsAPI, netName string, start, end time.Time, sealer *secure.Sealer) ([]LoggedPacket, error) {
+	var open func(sealed, ad []byte) ([]byte, error)
+	if sealer != nil {
+		open = sealer.OpenOffline
+	}
+	var groups []string
+	err := svc.DescribeLogGroupsPages(&cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(netName + "/"),
+	}, func(out *cloudwatchlogs.DescribeLogGroupsOutput, last bool) bool {
+		for _, g := range out.LogGroups {
+			if name := aws.StringValue(g.LogGroupName); name != MembersGroupName(netName) {
+				groups = append(groups, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []LoggedPacket
+	skipped := 0
+	for _, group := range groups {
+		err := svc.FilterLogEventsPages(&cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName: aws.String(group),
+			StartTime:    aws.Int64(start.UnixNano() / int64(time.Millisecond)),
+			EndTime:      aws.Int64(end.UnixNano() / int64(time.Millisecond)),
+			Interleaved:  aws.Bool(true),
+		}, func(out *cloudwatchlogs.FilterLogEventsOutput, last bool) bool {
+			for _, e := range out.Events {
+				p, err := decodeEvent(e, open)
+				if err != nil {
+					if skipped++; skipped == 1 {
+						logging.Default().Warn("skipping events that can't be decoded", "group", group, "stream", aws.StringValue(e.LogStreamName), "err", err)
+					}
+					continue
+				}
+				p.Group = group
+				packets = append(packets, *p)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if skipped > 0 {
+		logging.Default().Warn("skipped events", "count", skipped)
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].Time.Before(packets[j].Time) })
+	return packets, nil
+}
+
+func decodeEvent(e *cloudwatchlogs.FilteredLogEvent, open func(sealed, ad []byte) ([]byte, error)) (*LoggedPacket, error) {
+	var pl PacketLog
+	if err := json.Unmarshal([]byte(aws.StringValue(e.Message)), &pl); err != nil {
+		return nil, err
+	}
+	src, err := net.ParseMAC(pl.Src)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := net.ParseMAC(pl.Dest)
+	if err != nil {
+		return nil, err
+	}
+	h, payload, err := decodePacketLog(open, &pl)
+	if err != nil {
+		return nil, err
+	}
+	return &LoggedPacket{
+		Time:     millisToTime(e.Timestamp),
+		Stream:   aws.StringValue(e.LogStreamName),
+		Src:      tcpip.LinkAddress(src),
+		Dest:     tcpip.LinkAddress(dest),
+		Protocol: stringToProtocol(pl.Type),
+		Header:   h,
+		Payload:  payload,
+	}, nil
+}
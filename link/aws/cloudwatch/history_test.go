@@ -0,0 +1,265 @@
+package cloudwatch
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch/cloudwatchtest"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/tracing"
+)
+
+// putPacket logs a packet like a link with sealer would, at a given time.
+func putPacket(t *testing.T, svc *cloudwatchtest.Service, sealer *secure.Sealer, l CloudwatchLinkAddress, h, payload []byte, at time.Time) {
+	ll := NewLogLink(&LogConfig{LogService: svc, NetName: l.netName, Sealer: sealer})
+	if _, err := ll.Write(l, header.IPv4ProtocolNumber, h, payload); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	in, _ := ll.writePoller.next()
+	openStream(t, svc, l.laddr, l.raddr, l.netName)
+	err := ll.writePoller.flush([]*cloudwatchlogs.InputLogEvent{{
+		Message:   aws.String(string(in.data)),
+		Timestamp: aws.Int64(at.UnixNano() / int64(time.Millisecond)),
+	}}, "", l.LogGroupName(), l.LogStreamName())
+	if err != nil {
+		t.Fatalf("putPacket: unexpected error: %v", err)
+	}
+}
+
+func TestReadPackets(t *testing.T) {
+	svc := cloudwatchtest.New()
+	sealer, _ := secure.NewPSK(bytes.Repeat([]byte{1}, 32))
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	b := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	start := time.Unix(1546300800, 0)
+
+	eth := make([]byte, header.EthernetMinimumSize+header.IPv4MinimumSize)
+	header.Ethernet(eth).Encode(&header.EthernetFields{SrcAddr: b, DstAddr: a, Type: header.IPv4ProtocolNumber})
+	putPacket(t, svc, sealer, CloudwatchLinkAddress{b, a, "TestNet"}, eth, []byte("reply"), start.Add(2*time.Second))
+	putPacket(t, svc, sealer, CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}, make([]byte, header.IPv4MinimumSize), []byte("hello"), start.Add(time.Second))
+	putPacket(t, svc, sealer, CloudwatchLinkAddress{a, b, "TestNet"}, make([]byte, header.IPv4MinimumSize), []byte("late"), start.Add(time.Hour))
+	putPacket(t, svc, nil, CloudwatchLinkAddress{a, b, "TestNet"}, make([]byte, header.IPv4MinimumSize), []byte("clear"), start.Add(3*time.Second))
+	putMemberEvent(t, svc, "TestNet", a, start.Add(time.Second))
+
+	packets, err := ReadPackets(svc, "TestNet", start, start.Add(time.Minute), sealer)
+	if err != nil {
+		t.Fatalf("ReadPackets: %v", err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected the 2 sealed packets in range, got %v", len(packets))
+	}
+	hello, reply := packets[0], packets[1]
+	if string(hello.Payload) != "hello" || hello.Group != "TestNet/ffffffffffff" || hello.Stream != "020000000001" || !hello.Time.Equal(start.Add(time.Second)) {
+		t.Errorf("Unexpected first packet %+v", hello)
+	}
+	if string(reply.Payload) != "reply" || reply.Src != b || reply.Dest != a || reply.Protocol != header.IPv4ProtocolNumber {
+		t.Errorf("Unexpected second packet %+v", reply)
+	}
+
+	frame := header.Ethernet(hello.Frame())
+	if frame.SourceAddress() != a || frame.DestinationAddress() != broadcastMAC || len(frame) != header.EthernetMinimumSize+header.IPv4MinimumSize+5 {
+		t.Errorf("Expected an Ethernet header to be added to %v", hello.Frame())
+	}
+	if !bytes.Equal(reply.Frame(), append(eth, "reply"...)) {
+		t.Errorf("Expected the Ethernet header of the packet to be kept")
+	}
+}
+
+func TestLogLink_Stats(t *testing.T) {
+	svc := cloudwatchtest.New()
+	sealer, _ := secure.NewPSK(bytes.Repeat([]byte{1}, 32))
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	ll := NewLogLink(&LogConfig{LogService: svc, NetName: "TestNet", Sealer: sealer})
+	if err := ll.Listen(a); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ll.Write(CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}, header.IPv4ProtocolNumber, make([]byte, 20), make([]byte, 30))
+
+	ll.readPoller.Cr <- ReadPollOutput{data: []byte("{")}
+	ll.readPoller.Cr <- ReadPollOutput{data: []byte(`{"type":"ipv4","header":"AAAA"}`)}
+	for i := 0; i < 2; i++ {
+		if _, err := ll.Read(); err == nil {
+			t.Errorf("Expected an error reading invalid packet %d", i)
+		}
+	}
+
+	s := ll.Stats()
+	if s.TxPackets != 1 || s.TxBytes != 50 || s.Queues["tx"] != 1 {
+		t.Errorf("Expected a queued packet of 50 bytes, got %v", s)
+	}
+	if s.Calls["CreateLogGroup"] != 1 || s.DecodeErrors != 1 || s.Drops["malformed"] != 1 || s.Drops["unauthenticated"] != 1 {
+		t.Errorf("Unexpected counters %v", s)
+	}
+}
+
+func TestLogLink_Trace(t *testing.T) {
+	svc := cloudwatchtest.New()
+	var spans bytes.Buffer
+	tracer := tracing.New(&tracing.Options{Exporter: tracing.NewFile(&spans), SampleRate: 1})
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	ll := NewLogLink(&LogConfig{LogService: svc, NetName: "TestNet", Tracer: tracer})
+	ll.Write(CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}, header.IPv4ProtocolNumber, make([]byte, 20), make([]byte, 30))
+	in, _ := ll.writePoller.next()
+	if !bytes.Contains(in.data, []byte(`"trace":{"id":"`)) || in.trace == nil {
+		t.Fatalf("Expected the packet to be stamped, got %s", in.data)
+	}
+	ll.writePoller.sent([]*tracing.Context{in.trace}, PutEventInput{groupName: in.cwLink.LogGroupName(), streamName: in.cwLink.LogStreamName()}, nil)
+
+	now := time.Now()
+	ll.readPoller.Cr <- ReadPollOutput{data: in.data, logged: now, ingested: now.Add(time.Second), fetched: now.Add(3 * time.Second)}
+	if _, err := ll.Read(); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	tracer.Stop()
+	for _, want := range []string{`"name":"send"`, `"name":"transit"`, `"name":"queue"`, `"name":"api"`, `"name":"poll"`, `"key":"src","value":{"stringValue":"02:00:00:00:00:01"}`} {
+		if !strings.Contains(spans.String(), want) {
+			t.Errorf("Expected %v in the exported spans %v", want, spans.String())
+		}
+	}
+}
+
+func TestLogLink_Budget(t *testing.T) {
+	svc := cloudwatchtest.New()
+	meter := budget.New(&budget.Options{Network: "TestNet", Limits: budget.Limits{BytesPerHour: 200}, Logger: logging.Discard})
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	ll := NewLogLink(&LogConfig{LogService: svc, NetName: "TestNet", Budget: meter})
+	l := CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}
+	openStream(t, svc, a, broadcastMAC, "TestNet")
+	events := []*cloudwatchlogs.InputLogEvent{{Message: aws.String(strings.Repeat("x", 100)), Timestamp: aws.Int64(0)}}
+	if err := ll.writePoller.flush(events, "", l.LogGroupName(), l.LogStreamName()); err != nil {
+		t.Fatalf("Expected the first put to be within the budget: %v", err)
+	}
+	if err := ll.writePoller.flush(events, "", l.LogGroupName(), l.LogStreamName()); err != budget.ErrOverBudget {
+		t.Fatalf("Expected the second put to be over budget, got %v", err)
+	}
+
+	s, u := ll.Stats(), meter.Usage()
+	if s.Calls["PutLogEvents"] != 1 || s.Drops[stats.DropOverBudget] != 1 {
+		t.Errorf("Expected one put and one dropped packet, got %v", s)
+	}
+	if u.IngestedBytes != 100+budget.EventOverhead || u.Shed["PutLogEvents"] != 1 {
+		t.Errorf("Unexpected usage %v", u)
+	}
+}
+
+func TestLogLink_BudgetBeforeFirstWrite(t *testing.T) {
+	svc := cloudwatchtest.New()
+	meter := budget.New(&budget.Options{Network: "TestNet", Limits: budget.Limits{CallsPerMinute: 1}, Logger: logging.Discard})
+	if err := meter.Admit("PutLogEvents", 0); err != nil {
+		t.Fatalf("Admit: %v", err)
+	}
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	ll := NewLogLink(&LogConfig{LogService: svc, NetName: "TestNet", Budget: meter})
+	l := CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}
+	if err := ll.openForWrite(l); err != budget.ErrOverBudget {
+		t.Fatalf("Expected the stream not to be opened over budget, got %v", err)
+	}
+	if s := ll.Stats(); s.Drops[stats.DropOverBudget] != 1 || s.Calls["CreateLogGroup"] != 0 {
+		t.Errorf("Expected the frame to be dropped over budget without calls, got %v", s)
+	}
+}
+
+func TestLeaseStore_Budget(t *testing.T) {
+	meter := budget.New(&budget.Options{Network: "TestNet", Limits: budget.Limits{CallsPerMinute: 1}, Logger: logging.Discard})
+	if err := meter.Admit("PutLogEvents", 0); err != nil {
+		t.Fatalf("Admit: %v", err)
+	}
+	counters := &stats.Counters{}
+	svc := &countedLogService{cloudwatchtest.New(), counters, meter}
+	s := NewLeaseStore(NewMemberWriter(svc, "TestNet"))
+	if _, err := s.Leases(); err != budget.ErrOverBudget {
+		t.Fatalf("Expected the lease read to be over budget, got %v", err)
+	}
+	if u := meter.Usage(); u.Shed["FilterLogEvents"] != 1 {
+		t.Errorf("Expected the read to be shed, got %v", u)
+	}
+	if c := counters.Snapshot().Calls["FilterLogEvents"]; c != 0 {
+		t.Errorf("Expected no calls over budget, got %d", c)
+	}
+}
+
+func TestLogLink_SealOnDequeue(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	sender, _ := secure.NewPSK(key)
+	receiver, _ := secure.NewPSK(key)
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	l := CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}
+	ll := NewLogLink(&LogConfig{LogService: cloudwatchtest.New(), NetName: "TestNet", Sealer: sender})
+
+	// Control frames overtake a queued bulk frame by more than the replay
+	// window of the receiver.
+	ll.Write(l, header.IPv4ProtocolNumber, make([]byte, header.IPv4MinimumSize), []byte("bulk"))
+	var sent [][]byte
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 30; i++ {
+			ll.Write(l, header.ARPProtocolNumber, make([]byte, header.ARPSize), nil)
+		}
+		for i := 0; i < 30; i++ {
+			in, _ := ll.writePoller.next()
+			sent = append(sent, in.data)
+		}
+	}
+	in, ok := ll.writePoller.next()
+	if !ok {
+		t.Fatalf("Expected the bulk frame to be sent last")
+	}
+	sent = append(sent, in.data)
+
+	rx := NewLogLink(&LogConfig{LogService: cloudwatchtest.New(), NetName: "TestNet", Sealer: receiver})
+	for i, data := range sent {
+		rx.readPoller.Cr <- ReadPollOutput{data: data}
+		if _, err := rx.Read(); err != nil {
+			t.Fatalf("Read frame %d: %v", i, err)
+		}
+	}
+}
+
+func TestReadPackets_Offline(t *testing.T) {
+	svc := cloudwatchtest.New()
+	p := secure.NewMemoryKeyProvider()
+	sealer, err := secure.NewProviderSealer(p, 0)
+	if err != nil {
+		t.Fatalf("NewProviderSealer: %v", err)
+	}
+	a := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	b := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	start := time.Now().Add(-time.Hour)
+
+	// Groups are read one after the other, the frames of the second group
+	// are more than a replay window behind those of the first.
+	for i := 0; i < 70; i++ {
+		putPacket(t, svc, sealer, CloudwatchLinkAddress{a, broadcastMAC, "TestNet"}, make([]byte, header.IPv4MinimumSize), []byte("hello"), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	for i := 0; i < 70; i++ {
+		putPacket(t, svc, sealer, CloudwatchLinkAddress{a, b, "TestNet"}, make([]byte, header.IPv4MinimumSize), []byte("hello"), start.Add(time.Second+time.Duration(i)*time.Millisecond))
+	}
+	// Frames sealed with a key version retired since are still read.
+	if _, err := p.Rotate(start); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if err := secure.NewKeyWatcher(p, sealer, 0).Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	putPacket(t, svc, sealer, CloudwatchLinkAddress{a, b, "TestNet"}, make([]byte, header.IPv4MinimumSize), []byte("rotated"), start.Add(2*time.Second))
+
+	reader, err := secure.NewProviderSealer(p, 0)
+	if err != nil {
+		t.Fatalf("NewProviderSealer: %v", err)
+	}
+	packets, err := ReadPackets(svc, "TestNet", start, start.Add(time.Minute), reader)
+	if err != nil {
+		t.Fatalf("ReadPackets: %v", err)
+	}
+	if len(packets) != 141 || string(packets[140].Payload) != "rotated" {
+		t.Errorf("Expected every packet to be read, got %d", len(packets))
+	}
+}
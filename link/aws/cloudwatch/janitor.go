@@ -0,0 +1,199 @@
+package cloudwatch
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+// DefaultStaleAfter is how long a member can go without a heartbeat before a
+// janitor considers it gone.
+const DefaultStaleAfter = 24 * time.Hour
+
+// JanitorOptions configure a Janitor.
+type JanitorOptions struct {
+	NetworkName string
+	StaleAfter  time.Duration
+	LogService  cloudwatchlogsiface.CloudWatchLogsAPI
+	// Stats counts the calls the janitor makes, if set.
+	Stats *stats.Counters
+	// Budget limits the calls the janitor makes, they are not limited if
+	// nil.
+	Budget *budget.Meter
+}
+
+// Janitor removes log groups and streams of members that stopped
+// heartbeating. Every link writes to the log group of each destination and
+// to its own stream in the broadcast group, so those are left behind when a
+// member goes away.
+type Janitor struct {
+	svc        cloudwatchlogsiface.CloudWatchLogsAPI
+	netName    string
+	staleAfter time.Duration
+	now        func() time.Time
+}
+
+// CleanupAction is a log group or stream that a janitor will delete. A whole
+// group is deleted when LogStreamName is empty.
+type CleanupAction struct {
+	LogGroupName  string
+	LogStreamName string
+	Reason        string
+}
+
+func (a CleanupAction) String() string {
+	if a.LogStreamName == "" {
+		return fmt.Sprintf("delete group %s (%s)", a.LogGroupName, a.Reason)
+	}
+	return fmt.Sprintf("delete stream %s/%s (%s)", a.LogGroupName, a.LogStreamName, a.Reason)
+}
+
+// NewJanitor creates a janitor for a single network.
+func NewJanitor(opts *JanitorOptions) *Janitor {
+	j := &Janitor{
+		svc:        opts.LogService,
+		netName:    opts.NetworkName,
+		staleAfter: opts.StaleAfter,
+		now:        time.Now,
+	}
+	if j.svc == nil {
+		j.svc = NewLogService()
+	}
+	counters := opts.Stats
+	if counters == nil {
+		counters = &stats.Counters{}
+	}
+	j.svc = &countedLogService{j.svc, counters, opts.Budget}
+	if j.staleAfter == 0 {
+		j.staleAfter = DefaultStaleAfter
+	}
+	return j
+}
+
+// Plan lists what would be deleted without changing anything, so that it can
+// be reviewed before calling Apply.
+func (j *Janitor) Plan() ([]CleanupAction, error) {
+	cutoff := j.now().Add(-j.staleAfter)
+	alive, err := j.aliveMembers(cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []CleanupAction
+	var groups []*cloudwatchlogs.LogGroup
+	err = j.svc.DescribeLogGroupsPages(&cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(j.netName + "/"),
+	}, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		groups = append(groups, page.LogGroups...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	broadcastGroup := CloudwatchLinkAddress{"", broadcastMAC, j.netName}
+	for _, g := range groups {
+		groupName := aws.StringValue(g.LogGroupName)
+		owner := strings.TrimPrefix(groupName, j.netName+"/")
+		if !isStreamAddress(owner) && groupName != MembersGroupName(j.netName) {
+			// Not created by a link.
+			continue
+		}
+
+		// A receive group belongs to the member with that link address, it
+		// goes away with its owner.
+		if isStreamAddress(owner) && groupName != broadcastGroup.LogGroupName() &&
+			!alive[owner] && millisToTime(g.CreationTime).Before(cutoff) {
+			actions = append(actions, CleanupAction{LogGroupName: groupName, Reason: "no heartbeat from owner " + owner})
+			continue
+		}
+
+		// Streams are named after the sending member.
+		staleStreams, err := j.staleStreams(groupName, alive, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, staleStreams...)
+	}
+	return actions, nil
+}
+
+// Apply deletes the groups and streams listed in actions. Resources that are
+// already gone are ignored.
+func (j *Janitor) Apply(actions []CleanupAction) error {
+	for _, a := range actions {
+		var err error
+		if a.LogStreamName == "" {
+			_, err = j.svc.DeleteLogGroup(&cloudwatchlogs.DeleteLogGroupInput{LogGroupName: aws.String(a.LogGroupName)})
+		} else {
+			_, err = j.svc.DeleteLogStream(&cloudwatchlogs.DeleteLogStreamInput{
+				LogGroupName:  aws.String(a.LogGroupName),
+				LogStreamName: aws.String(a.LogStreamName),
+			})
+		}
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("Apply: could not %v: %v", a, err)
+		}
+	}
+	return nil
+}
+
+// aliveMembers returns the stream names of members that wrote a heartbeat or
+// lease since cutoff.
+func (j *Janitor) aliveMembers(cutoff time.Time) (map[string]bool, error) {
+	// Sealed events keep their MAC in the clear, the janitor needs no key.
+	events, err := readMemberEvents(j.svc, j.netName, cutoff, nil)
+	if err != nil {
+		return nil, err
+	}
+	alive := map[string]bool{}
+	for _, e := range events {
+		if e.Type == releaseEvent {
+			continue
+		}
+		alive[strings.Replace(e.MAC, ":", "", -1)] = true
+	}
+	return alive, nil
+}
+
+func (j *Janitor) staleStreams(groupName string, alive map[string]bool, cutoff time.Time) ([]CleanupAction, error) {
+	var actions []CleanupAction
+	err := j.svc.DescribeLogStreamsPages(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName: aws.String(groupName),
+	}, func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+		for _, st := range page.LogStreams {
+			name := aws.StringValue(st.LogStreamName)
+			if alive[name] || !millisToTime(st.CreationTime).Before(cutoff) {
+				continue
+			}
+			actions = append(actions, CleanupAction{LogGroupName: groupName, LogStreamName: name, Reason: "no heartbeat from sender " + name})
+		}
+		return true
+	})
+	return actions, err
+}
+
+// isStreamAddress reports whether s is a link address formatted for use in
+// log group and stream names.
+func isStreamAddress(s string) bool {
+	if len(s) != 12 {
+		return false
+	}
+	_, err := net.ParseMAC(strings.Join([]string{s[0:2], s[2:4], s[4:6], s[6:8], s[8:10], s[10:12]}, ":"))
+	return err == nil
+}
+
+func millisToTime(ms *int64) time.Time {
+	return time.Unix(0, aws.Int64Value(ms)*int64(time.Millisecond))
+}
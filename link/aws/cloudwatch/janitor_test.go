@@ -0,0 +1,109 @@
+package cloudwatch
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch/cloudwatchtest"
+)
+
+func putMemberEvent(t *testing.T, svc *cloudwatchtest.Service, netName string, mac tcpip.LinkAddress, at time.Time) {
+	l := CloudwatchLinkAddress{mac, "", netName}
+	createLogGroup(svc, MembersGroupName(netName), 0)
+	createLogStream(svc, MembersGroupName(netName), l.LogStreamName())
+	data, _ := json.Marshal(MemberEvent{Type: heartbeatEvent, MAC: mac.String()})
+	p := NewWritePoller(svc)
+	err := p.flush([]*cloudwatchlogs.InputLogEvent{{
+		Message:   aws.String(string(data)),
+		Timestamp: aws.Int64(at.UnixNano() / int64(time.Millisecond)),
+	}}, "", MembersGroupName(netName), l.LogStreamName())
+	if err != nil {
+		t.Fatalf("putMemberEvent: unexpected error: %v", err)
+	}
+}
+
+func openStream(t *testing.T, svc *cloudwatchtest.Service, src, dst tcpip.LinkAddress, netName string) {
+	l := CloudwatchLinkAddress{src, dst, netName}
+	if err := createLogGroup(svc, l.LogGroupName(), 0); err != nil {
+		t.Fatalf("openStream: unexpected error: %v", err)
+	}
+	if err := createLogStream(svc, l.LogGroupName(), l.LogStreamName()); err != nil {
+		t.Fatalf("openStream: unexpected error: %v", err)
+	}
+}
+
+func TestJanitor_Plan(t *testing.T) {
+	now := time.Now()
+	svc := cloudwatchtest.New()
+	svc.Now = func() time.Time { return now.Add(-48 * time.Hour) }
+
+	alive := tcpip.LinkAddress("\x42\x42\x42\x42\x42\x42")
+	dead := tcpip.LinkAddress("\x74\x74\x74\x74\x74\x74")
+	for _, src := range []tcpip.LinkAddress{alive, dead} {
+		openStream(t, svc, src, broadcastMAC, "TestNet")
+	}
+	openStream(t, svc, alive, dead, "TestNet")
+	openStream(t, svc, dead, alive, "TestNet")
+	putMemberEvent(t, svc, "TestNet", dead, now.Add(-48*time.Hour))
+	putMemberEvent(t, svc, "TestNet", alive, now.Add(-time.Minute))
+	createLogGroup(svc, "TestNet/not-a-link", 0)
+
+	j := NewJanitor(&JanitorOptions{NetworkName: "TestNet", LogService: svc})
+	j.now = func() time.Time { return now }
+	actions, err := j.Plan()
+	if err != nil {
+		t.Fatalf("Plan: unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, a := range actions {
+		got = append(got, a.LogGroupName+"|"+a.LogStreamName)
+	}
+	sort.Strings(got)
+	expected := []string{
+		"TestNet/424242424242|747474747474",
+		"TestNet/747474747474|",
+		"TestNet/ffffffffffff|747474747474",
+		"TestNet/members|747474747474",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Plan: expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("[%d] Plan: expected %v, got %v", i, expected[i], got[i])
+		}
+	}
+
+	// Nothing is deleted until the plan is applied.
+	if n := svc.Calls("DeleteLogGroup") + svc.Calls("DeleteLogStream"); n != 0 {
+		t.Fatalf("Plan: expected no deletes, got %d", n)
+	}
+	if err := j.Apply(actions); err != nil {
+		t.Fatalf("Apply: unexpected error: %v", err)
+	}
+	actions, err = j.Plan()
+	if err != nil || len(actions) != 0 {
+		t.Errorf("Plan: expected nothing left to clean up, got %v (err: %v)", actions, err)
+	}
+}
+
+func TestLogLink_Retention(t *testing.T) {
+	svc := cloudwatchtest.New()
+	if err := createLogGroup(svc, "TestNet/424242424242", 7); err != nil {
+		t.Fatalf("createLogGroup: unexpected error: %v", err)
+	}
+	// Existing groups are left alone.
+	if err := createLogGroup(svc, "TestNet/424242424242", 30); err != nil {
+		t.Fatalf("createLogGroup: unexpected error: %v", err)
+	}
+	out, _ := svc.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{LogGroupNamePrefix: aws.String("TestNet/")})
+	if len(out.LogGroups) != 1 || aws.Int64Value(out.LogGroups[0].RetentionInDays) != 7 {
+		t.Errorf("Expected a single group with 7 day retention, got %v", out.LogGroups)
+	}
+}
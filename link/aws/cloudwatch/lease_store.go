@@ -0,0 +1,173 @@
+package cloudwatch
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/ipam"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/routing"
+)
+
+// MemberEvent is the log event members write to the network's members group.
+type MemberEvent struct {
+	Type    string `json:"type"`
+	MAC     string `json:"mac"`
+	IP      string `json:"ip,omitempty"`
+	Claimed int64  `json:"claimed,omitempty"` // unix milliseconds
+	Expires int64  `json:"expires,omitempty"` // unix milliseconds
+	// Routes are the networks announced by a gateway.
+	Routes []routing.Advert `json:"routes,omitempty"`
+	// Sealed holds the encrypted event when a network key is used, only
+	// Type and MAC are sent in the clear.
+	Sealed string `json:"sealed,omitempty"`
+	// Written is the timestamp of the log event, in unix milliseconds.
+	Written int64 `json:"-"`
+}
+
+const (
+	leaseEvent   = "lease"
+	releaseEvent = "release"
+	routesEvent  = "routes"
+)
+
+// LeaseStore implements ipam.Store on top of the network's members log group.
+// Every member appends lease and release events to its own log stream, the
+// latest event of each stream is its current lease.
+type LeaseStore struct {
+	members  *MemberWriter
+	Lookback time.Duration // how far back to read events, should exceed the lease TTL
+}
+
+// NewLeaseStore creates a lease store writing with members, which should be
+// the writer of the member's link.
+func NewLeaseStore(members *MemberWriter) *LeaseStore {
+	return &LeaseStore{
+		members:  members,
+		Lookback: 2 * ipam.DefaultTTL,
+	}
+}
+
+// Leases implements ipam.Store.Leases.
+func (s *LeaseStore) Leases() ([]ipam.Lease, error) {
+	events, err := readMemberEvents(s.members.svc, s.members.netName, time.Now().Add(-s.Lookback), s.members.Sealer)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]*MemberEvent{}
+	for i := range events {
+		e := &events[i]
+		if e.Type != leaseEvent && e.Type != releaseEvent {
+			continue
+		}
+		latest[e.MAC] = e
+	}
+
+	leases := make([]ipam.Lease, 0, len(latest))
+	for _, e := range latest {
+		if e.Type != leaseEvent {
+			continue
+		}
+		mac, err := net.ParseMAC(e.MAC)
+		if err != nil {
+			continue
+		}
+		leases = append(leases, ipam.Lease{
+			IP:      net.ParseIP(e.IP).To4(),
+			MAC:     tcpip.LinkAddress(mac),
+			Claimed: time.Unix(0, e.Claimed*int64(time.Millisecond)),
+			Expires: time.Unix(0, e.Expires*int64(time.Millisecond)),
+		})
+	}
+	return leases, nil
+}
+
+// Put implements ipam.Store.Put.
+func (s *LeaseStore) Put(l ipam.Lease) error {
+	return s.members.Write(l.MAC, MemberEvent{
+		Type:    leaseEvent,
+		MAC:     l.MAC.String(),
+		IP:      l.IP.String(),
+		Claimed: l.Claimed.UnixNano() / int64(time.Millisecond),
+		Expires: l.Expires.UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// Release implements ipam.Store.Release.
+func (s *LeaseStore) Release(l ipam.Lease) error {
+	return s.members.Write(l.MAC, MemberEvent{Type: releaseEvent, MAC: l.MAC.String(), IP: l.IP.String()})
+}
+
+// readMemberEvents returns all member events written since start, oldest
+// first. With a sealer, events that don't open are skipped. Without one,
+// sealed events only have their Type and MAC.
+func readMemberEvents(svc cloudwatchlogsiface.CloudWatchLogsAPI, netName string, start time.Time, sealer *secure.Sealer) ([]MemberEvent, error) {
+	var events []MemberEvent
+	params := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(MembersGroupName(netName)),
+		StartTime:    aws.Int64(start.UnixNano() / int64(time.Millisecond)),
+		Interleaved:  aws.Bool(true),
+	}
+	err := svc.FilterLogEventsPages(params, func(page *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+		for _, fe := range page.Events {
+			var e MemberEvent
+			if err := json.Unmarshal([]byte(aws.StringValue(fe.Message)), &e); err != nil {
+				continue
+			}
+			if sealer != nil {
+				opened, err := openMemberEvent(sealer, netName, aws.StringValue(fe.LogStreamName), e)
+				if err != nil {
+					continue
+				}
+				e = opened
+			}
+			e.Written = aws.Int64Value(fe.Timestamp)
+			events = append(events, e)
+		}
+		return true
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			// Nobody has joined the network yet.
+			return nil, nil
+		}
+		return nil, err
+	}
+	return events, nil
+}
+
+// memberAD returns the additional data of an event sealed for a stream of
+// the members group, so that it can't be copied to another stream.
+func memberAD(netName, streamName string) []byte {
+	return []byte(netName + "\x00" + streamName)
+}
+
+// openMemberEvent returns the event sealed in e, read from streamName. It
+// opens offline, since member events are read again on every poll and would
+// be rejected as replays.
+func openMemberEvent(sealer *secure.Sealer, netName, streamName string, e MemberEvent) (MemberEvent, error) {
+	if e.Sealed == "" {
+		return MemberEvent{}, secure.ErrUnauthenticated
+	}
+	sealed, err := base64.StdEncoding.DecodeString(e.Sealed)
+	if err != nil {
+		return MemberEvent{}, err
+	}
+	data, err := sealer.OpenOffline(sealed, memberAD(netName, streamName))
+	if err != nil {
+		return MemberEvent{}, err
+	}
+	var opened MemberEvent
+	if err := json.Unmarshal(data, &opened); err != nil {
+		return MemberEvent{}, err
+	}
+	return opened, nil
+}
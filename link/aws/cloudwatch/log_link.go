@@ -2,18 +2,29 @@ package cloudwatch
 
 import (
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/network/arp"
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/tracing"
 	"log"
+	"sync"
+	"time"
 )
 
 // PacketLog represents the log event emitted from Amazon Cloudwatch
@@ -21,94 +32,347 @@ type PacketLog struct {
 	Type    string `json:"type"`
 	Src     string `json:"src"`
 	Dest    string `json:"dest"`
-	Header  string `json:"header"`
-	Payload string `json:"payload"`
+	Header  string `json:"header,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// Sealed holds the encrypted header and payload when a network key is used.
+	Sealed string `json:"sealed,omitempty"`
+	// Trace is set on frames sampled for tracing.
+	Trace *tracing.Context `json:"trace,omitempty"`
+}
+
+// additionalData returns the fields of a sealed packet that are sent in the
+// clear, authenticated with it.
+func (pl *PacketLog) additionalData() []byte {
+	return []byte(pl.Type + "\x00" + pl.Src + "\x00" + pl.Dest)
 }
 
 // LogLink reads/writes L2 data to AWS service(s)
 type LogLink struct {
-	svc         cloudwatchlogsiface.CloudWatchLogsAPI
-	ep          stack.LinkEndpoint
-	netName     string
-	readPoller  *ReadPoller
-	writePoller *WritePoller
+	svc               cloudwatchlogsiface.CloudWatchLogsAPI
+	ep                stack.LinkEndpoint
+	netName           string
+	readPoller        *ReadPoller
+	writePoller       *WritePoller
+	members           *MemberWriter
+	retentionDays     int64
+	heartbeatInterval time.Duration
+	sealer            *secure.Sealer
+	stats             *stats.Counters
+	logger            logging.Logger
+	tracer            *tracing.Tracer
+	// linkHeaderSize is the size of the link header of written frames.
+	linkHeaderSize int
+
+	mu        sync.Mutex
+	listening map[tcpip.LinkAddress]bool
+	// streams are the log streams known to exist, by full path.
+	streams map[string]bool
 }
 
 type LogConfig struct {
-	LogService   cloudwatchlogsiface.CloudWatchLogsAPI
-	Endpoint     stack.LinkEndpoint
-	NetName      string
-	LogGroupName string
+	LogService        cloudwatchlogsiface.CloudWatchLogsAPI
+	Endpoint          stack.LinkEndpoint
+	NetName           string
+	LogGroupName      string
+	RetentionDays     int64
+	HeartbeatInterval time.Duration
+	// Sealer encrypts and authenticates packets, they are sent in the clear if nil.
+	Sealer *secure.Sealer
+	// Stats counts calls to the service and packets that can't be read,
+	// the link keeps its own if nil.
+	Stats *stats.Counters
+	// Logger gets the messages of the link, logging.Default if nil.
+	Logger logging.Logger
+	// Tracer stamps sent packets and records the transit of received ones,
+	// packets aren't traced if nil.
+	Tracer *tracing.Tracer
+	// Polling tunes how often the link calls the service.
+	Polling Polling
+	// Budget meters the calls to the service and limits them to the
+	// budget of the network, calls are not limited if nil.
+	Budget *budget.Meter
+	// QoS configures the queues of written packets, the defaults of
+	// qos.Options if nil.
+	QoS *qos.Options
+	// EthernetHeader is set when written headers start with an Ethernet
+	// header, which packets are classified without.
+	EthernetHeader bool
+}
+
+// DefaultHeartbeatInterval is how often a link announces itself in the
+// network's members group when LogConfig.HeartbeatInterval is not set.
+const DefaultHeartbeatInterval = time.Minute
+
+// Defaults of Polling.
+const (
+	DefaultReadInterval      = time.Second / 4
+	DefaultBroadcastInterval = time.Second
+	DefaultWriteInterval     = time.Second / 5
+	DefaultWriteBatch        = 1
+)
+
+// Polling tunes how often a link calls Cloudwatch Logs, trading the latency
+// of packets for API calls. Zero fields are the defaults.
+type Polling struct {
+	// ReadInterval is how often the groups of the addresses the link
+	// listens on are read, all of them sharing the rate.
+	ReadInterval time.Duration
+	// BroadcastInterval is how often the broadcast group is read.
+	BroadcastInterval time.Duration
+	// WriteInterval is how often queued packets are put.
+	WriteInterval time.Duration
+	// WriteBatch is the most packets put at every WriteInterval.
+	WriteBatch int
+}
+
+// WithDefaults returns p with its zero fields set to the defaults.
+func (p Polling) WithDefaults() Polling {
+	if p.ReadInterval == 0 {
+		p.ReadInterval = DefaultReadInterval
+	}
+	if p.BroadcastInterval == 0 {
+		p.BroadcastInterval = DefaultBroadcastInterval
+	}
+	if p.WriteInterval == 0 {
+		p.WriteInterval = DefaultWriteInterval
+	}
+	if p.WriteBatch == 0 {
+		p.WriteBatch = DefaultWriteBatch
+	}
+	return p
 }
 
+const heartbeatEvent = "heartbeat"
+
 // Log Group format `/network/link-address`
 // Log Stream format `/network/link-address/tx-stream-local-link-address`
 
 func NewLogLink(config *LogConfig) *LogLink {
-	return &LogLink{svc: config.LogService, ep: config.Endpoint, netName: config.NetName, readPoller: NewReadPoller(config.LogService), writePoller: NewWritePoller(config.LogService)}
+	counters := config.Stats
+	if counters == nil {
+		counters = &stats.Counters{}
+	}
+	svc := &countedLogService{config.LogService, counters, config.Budget}
+	var qosOpts qos.Options
+	if config.QoS != nil {
+		qosOpts = *config.QoS
+	}
+	qosOpts.OnDrop = func(_ qos.Class, reason string) { counters.Drop(reason) }
+	queue := qos.New(&qosOpts)
+	ll := &LogLink{svc: svc, ep: config.Endpoint, netName: config.NetName, readPoller: newReadPoller(svc, config.Polling), writePoller: newWritePoller(svc, config.Polling, queue),
+		retentionDays: config.RetentionDays, heartbeatInterval: config.HeartbeatInterval, sealer: config.Sealer,
+		stats: counters, logger: logging.OrDefault(config.Logger), tracer: config.Tracer, listening: map[tcpip.LinkAddress]bool{}, streams: map[string]bool{}}
+	if ll.heartbeatInterval == 0 {
+		ll.heartbeatInterval = DefaultHeartbeatInterval
+	}
+	ll.members = NewMemberWriter(svc, config.NetName)
+	ll.members.RetentionDays = config.RetentionDays
+	ll.members.Sealer = config.Sealer
+	ll.members.writer.logger = ll.logger
+	ll.readPoller.stats = counters
+	ll.writePoller.stats = counters
+	ll.writePoller.tracer = config.Tracer
+	ll.readPoller.logger = ll.logger
+	ll.writePoller.logger = ll.logger
+	counters.SetQueue("rx", func() int { return len(ll.readPoller.Cr) })
+	counters.SetQueue("tx", func() int {
+		n := 0
+		for _, c := range qos.Classes {
+			n += queue.Len(c)
+		}
+		return n
+	})
+	for _, c := range qos.Classes {
+		c := c
+		counters.SetQueue("tx-"+c.String(), func() int { return queue.Len(c) })
+	}
+	if config.EthernetHeader {
+		ll.linkHeaderSize = header.EthernetMinimumSize
+	}
+	return ll
 }
 
 func (ll *LogLink) createLogGroup(groupName string) error {
+	return createLogGroup(ll.svc, groupName, ll.retentionDays)
+}
+
+// createLogGroup creates a log group if it doesn't exist. Groups created here
+// get a retention policy of retentionDays, unless it is zero.
+func createLogGroup(svc cloudwatchlogsiface.CloudWatchLogsAPI, groupName string, retentionDays int64) error {
 	// Create log group, if it doesn't exist.
-	_, err := ll.svc.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: aws.String(groupName)})
+	_, err := svc.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: aws.String(groupName)})
 	if awsErr, ok := err.(awserr.Error); ok {
 		// Ignore if resource already exists
 		if awsErr.Code() != cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
 			return err
 		}
+		return nil
 	} else if err != nil {
 		return err
 	}
 
+	if retentionDays > 0 {
+		_, err = svc.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+			LogGroupName:    aws.String(groupName),
+			RetentionInDays: aws.Int64(retentionDays),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-var logstreamExistsCache = map[string]bool{}
-
 var broadcastMAC = tcpip.LinkAddress([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 
 func (ll *LogLink) Start() {
-	// Create broadcast log group and stream (/net/broadcast/local)
-	broadcastAddrRx := CloudwatchLinkAddress{ll.ep.LinkAddress(), broadcastMAC, ll.netName}
-	err := ll.OpenLogStream(broadcastAddrRx)
-	if err != nil {
-		log.Fatalf("WritePacket: Could not create remote log group: %v", err)
+	err := ll.open()
+	if err == budget.ErrOverBudget {
+		// Frames sent to the link are lost until the budget allows creating
+		// its groups.
+		go ll.retryOpen()
+	} else if err != nil {
+		log.Fatalf("Start: could not create remote log groups: %v", err)
 	}
 
-	localReadRx := CloudwatchLinkAddress{"", ll.ep.LinkAddress(), ll.netName}
-	err = ll.createLogGroup(localReadRx.LogGroupName())
-	if err != nil {
-		log.Fatalf("OpenLogStream: Could not create remote log group: %v", err)
+	go ll.writePoller.WritePoll()
+	go ll.heartbeat()
+}
+
+// open creates the broadcast log group and stream (/net/broadcast/local)
+// and the group of the link's address, and starts reading them.
+func (ll *LogLink) open() error {
+	broadcastAddrRx := CloudwatchLinkAddress{ll.ep.LinkAddress(), broadcastMAC, ll.netName}
+	if err := ll.OpenLogStream(broadcastAddrRx); err != nil {
+		return err
+	}
+	if err := ll.Listen(ll.ep.LinkAddress()); err != nil {
+		return err
 	}
-	go ll.readPoller.ReadPollForLogGroup(localReadRx.LogGroupName())
 	go ll.readPoller.ReadPollForBroadcast(broadcastAddrRx.LogGroupName())
+	return nil
+}
 
-	go ll.writePoller.WritePoll()
+// retryOpen opens the link every heartbeat until the budget allows it.
+func (ll *LogLink) retryOpen() {
+	t := time.NewTicker(ll.heartbeatInterval)
+	defer t.Stop()
+	for range t.C {
+		err := ll.open()
+		if err == nil {
+			return
+		}
+		if err != budget.ErrOverBudget {
+			ll.logger.Warn("could not create remote log groups", "err", err)
+		}
+	}
 }
 
+// Listen starts reading packets sent to addr. The link listens on its own
+// address, bridges also listen on the addresses of hosts on their other side.
+func (ll *LogLink) Listen(addr tcpip.LinkAddress) error {
+	ll.mu.Lock()
+	if ll.listening[addr] {
+		ll.mu.Unlock()
+		return nil
+	}
+	ll.listening[addr] = true
+	ll.mu.Unlock()
+
+	rx := CloudwatchLinkAddress{"", addr, ll.netName}
+	if err := ll.createLogGroup(rx.LogGroupName()); err != nil {
+		ll.mu.Lock()
+		delete(ll.listening, addr)
+		ll.mu.Unlock()
+		return err
+	}
+	go ll.readPoller.ReadPollForLogGroup(rx.LogGroupName())
+	return nil
+}
+
+// Stats returns the counters of the link. Packets are counted as they are
+// read from and written to Cloudwatch.
+func (ll *LogLink) Stats() stats.Snapshot {
+	return ll.stats.Snapshot()
+}
+
+// Listening returns the addresses the link reads packets for.
+func (ll *LogLink) Listening() []tcpip.LinkAddress {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	addrs := make([]tcpip.LinkAddress, 0, len(ll.listening))
+	for addr := range ll.listening {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// heartbeat periodically writes to the members group so that janitors and
+// peers can tell this link, and every address it listens on, is still part
+// of the network.
+func (ll *LogLink) heartbeat() {
+	t := time.NewTicker(ll.heartbeatInterval)
+	defer t.Stop()
+	for {
+		for _, mac := range ll.Listening() {
+			err := ll.members.Write(mac, MemberEvent{Type: heartbeatEvent, MAC: mac.String()})
+			if err != nil {
+				ll.logger.Warn("could not write heartbeat", "mac", mac, "err", err)
+			}
+		}
+		<-t.C
+	}
+}
+
+// OpenLogStream creates the log group and stream of l unless the link did
+// already. It returns budget.ErrOverBudget when the budget refuses it.
 func (ll *LogLink) OpenLogStream(l CloudwatchLinkAddress) error {
-	if _, ok := logstreamExistsCache[l.FullPath()]; !ok {
+	ll.mu.Lock()
+	exists := ll.streams[l.FullPath()]
+	ll.mu.Unlock()
+	if !exists {
 		// Create group
 		err := ll.createLogGroup(l.LogGroupName())
 		if err != nil {
-			log.Fatalf("OpenLogStream: Could not create remote log group: %v", err)
+			return err
 		}
 
 		// Create log stream
 		err = ll.createLogStream(l)
 		if err != nil {
-			log.Fatalf("WritePacket: Could not create remote log stream: %v", err)
+			return err
 		}
-		logstreamExistsCache[l.FullPath()] = true
+		ll.mu.Lock()
+		ll.streams[l.FullPath()] = true
+		ll.mu.Unlock()
 	}
 
 	return nil
 }
 
+// openForWrite opens the stream of l for a frame, which is counted as
+// dropped if it can't be.
+func (ll *LogLink) openForWrite(l CloudwatchLinkAddress) error {
+	err := ll.OpenLogStream(l)
+	if err == budget.ErrOverBudget {
+		// The budget logs why.
+		ll.stats.Drop(stats.DropOverBudget)
+	} else if err != nil {
+		ll.stats.Drop(stats.DropWriteFailed)
+		ll.logger.Warn("dropping packet, could not open stream", "group", l.LogGroupName(), "stream", l.LogStreamName(), "err", err)
+	}
+	return err
+}
+
 func (ll *LogLink) createLogStream(l CloudwatchLinkAddress) error {
-	_, err := ll.svc.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
-		LogGroupName:  aws.String(l.LogGroupName()),
-		LogStreamName: aws.String(l.LogStreamName()),
+	return createLogStream(ll.svc, l.LogGroupName(), l.LogStreamName())
+}
+
+func createLogStream(svc cloudwatchlogsiface.CloudWatchLogsAPI, groupName string, streamName string) error {
+	_, err := svc.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(groupName),
+		LogStreamName: aws.String(streamName),
 	})
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
@@ -126,41 +390,103 @@ func (ll *LogLink) createLogStream(l CloudwatchLinkAddress) error {
 
 // Read reads one packet from the internal buffers
 func (ll *LogLink) Read() (*buffer.VectorisedView, error) {
-	select {
-	case event := <-ll.readPoller.Cr:
-		if event.err != nil {
-			log.Printf("Read: Poll Error: %v", event.err)
-			break
-		}
+	event := <-ll.readPoller.Cr
+	if event.err != nil {
+		return nil, event.err
+	}
 
-		// Unmarshal
-		var packetLog PacketLog
-		err := json.Unmarshal(event.data, &packetLog)
-		if err != nil {
-			return nil, err
+	// Unmarshal
+	var packetLog PacketLog
+	err := json.Unmarshal(event.data, &packetLog)
+	if err != nil {
+		ll.stats.DecodeError()
+		ll.stats.Drop(stats.DropMalformed)
+		return nil, err
+	}
+
+	h, p, err := ll.decode(&packetLog)
+	if err != nil {
+		if packetLog.Sealed != "" || ll.sealer != nil {
+			ll.stats.Drop(stats.OpenFailure(err))
+		} else {
+			ll.stats.DecodeError()
+			ll.stats.Drop(stats.DropMalformed)
 		}
+		return nil, err
+	}
+	ll.stats.Received(len(h) + len(p))
+	if packetLog.Trace != nil {
+		ll.tracer.Received(packetLog.Trace, tracing.Transit{
+			Origin:    packetLog.Trace.Origin,
+			Sent:      event.logged,
+			Ingested:  event.ingested,
+			Fetched:   event.fetched,
+			Delivered: time.Now(),
+		}, map[string]interface{}{
+			"network": ll.netName,
+			"src":     packetLog.Src,
+			"dst":     packetLog.Dest,
+			"type":    packetLog.Type,
+			"bytes":   len(h) + len(p),
+		})
+	}
+	header := buffer.NewViewFromBytes(h)
+	payload := buffer.NewViewFromBytes(p)
+
+	vv := buffer.NewVectorisedView(len(h)+len(p), []buffer.View{header, payload})
+	return &vv, nil
+}
+
+// decode returns the header and payload of a packet. When a network key is
+// configured, packets that aren't sealed with it are rejected.
+func (ll *LogLink) decode(pl *PacketLog) ([]byte, []byte, error) {
+	if ll.sealer == nil {
+		return decodePacketLog(nil, pl)
+	}
+	return decodePacketLog(ll.sealer.Open, pl)
+}
 
-		h := make([]byte, 1024)
-		n, err := base64.StdEncoding.Decode(h, []byte(packetLog.Header))
+// decodePacketLog returns the header and payload of a packet, sealed
+// packets are opened with open, nil without a network key.
+func decodePacketLog(open func(sealed, ad []byte) ([]byte, error), pl *PacketLog) ([]byte, []byte, error) {
+	if open == nil {
+		if pl.Sealed != "" {
+			return nil, nil, errors.New("decode: received sealed packet but no network key is configured")
+		}
+		header, err := base64.StdEncoding.DecodeString(pl.Header)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		header := buffer.NewViewFromBytes(h[:n])
-
-		j := make([]byte, ll.ep.MTU())
-		m, err := base64.StdEncoding.Decode(j, []byte(packetLog.Payload))
+		payload, err := base64.StdEncoding.DecodeString(pl.Payload)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		payload := buffer.NewViewFromBytes(j[:m])
+		return header, payload, nil
+	}
 
-		vv := buffer.NewVectorisedView(n+m, []buffer.View{header, payload})
-		return &vv, nil
+	if pl.Sealed == "" {
+		return nil, nil, secure.ErrUnauthenticated
+	}
+	sealed, err := base64.StdEncoding.DecodeString(pl.Sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	frame, err := open(sealed, pl.additionalData())
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(frame) < 2 || int(binary.BigEndian.Uint16(frame))+2 > len(frame) {
+		return nil, nil, errors.New("decode: malformed sealed packet")
 	}
-	return nil, nil
+	n := int(binary.BigEndian.Uint16(frame)) + 2
+	return frame[2:n], frame[n:], nil
 }
 
 func (ll *LogLink) StringToProtocol(protocol string) tcpip.NetworkProtocolNumber {
+	return stringToProtocol(protocol)
+}
+
+func stringToProtocol(protocol string) tcpip.NetworkProtocolNumber {
 	switch protocol {
 	case ipv4.ProtocolName:
 		return ipv4.ProtocolNumber
@@ -189,12 +515,59 @@ func (ll *LogLink) ProtocolToString(protocol tcpip.NetworkProtocolNumber) string
 // Write writes one packet to the internal buffers
 func (ll *LogLink) Write(l CloudwatchLinkAddress, protocol tcpip.NetworkProtocolNumber, header []byte, payload []byte) (int, error) {
 	// todo: replace with pcap-friendly format
-	pl := PacketLog{ll.ProtocolToString(protocol), l.Src().String(), l.Dest().String(),
-		base64.StdEncoding.EncodeToString(header), base64.StdEncoding.EncodeToString(payload)}
+	pl := PacketLog{Type: ll.ProtocolToString(protocol), Src: l.Src().String(), Dest: l.Dest().String(), Trace: ll.tracer.Start()}
+	var frame []byte
+	if ll.sealer != nil {
+		// Header length, header and payload are sealed together.
+		frame = make([]byte, 2, 2+len(header)+len(payload))
+		binary.BigEndian.PutUint16(frame, uint16(len(header)))
+		frame = append(append(frame, header...), payload...)
+	} else {
+		pl.Header = base64.StdEncoding.EncodeToString(header)
+		pl.Payload = base64.StdEncoding.EncodeToString(payload)
+	}
 	plBytes, err := json.Marshal(pl)
 	if err != nil {
+		ll.stats.EncodeError()
+		ll.stats.Drop(stats.DropWriteFailed)
 		return 0, err
 	}
-	ll.writePoller.Cw <- WritePollInput{plBytes, &l}
-	return len(plBytes), nil
+	in := NewWritePollInput(plBytes, &l)
+	in.trace = pl.Trace
+	size := len(plBytes)
+	if frame != nil {
+		// Queues reorder frames, so they are sealed when they are dequeued
+		// for receivers to get sequence numbers in order, within their
+		// replay window.
+		in.data, in.encode = nil, func() ([]byte, error) {
+			pl.Sealed = base64.StdEncoding.EncodeToString(ll.sealer.Seal(frame, pl.additionalData()))
+			return json.Marshal(pl)
+		}
+		size += len(`,"sealed":""`) + base64.StdEncoding.EncodedLen(len(frame)+secure.Overhead)
+	}
+	// Packets dropped by the queue are counted with their reason, like a
+	// NIC's queue discipline the link doesn't fail the write.
+	start := ll.packetStart(header, payload)
+	class := ll.writePoller.Queue.Classify(protocol, start)
+	if ll.writePoller.Queue.Enqueue(class, start, size, in) {
+		ll.stats.Sent(len(header) + len(payload))
+	}
+	return size, nil
+}
+
+// packetStart returns the start of the network packet of a written frame,
+// as much as qos.Scheduler.Classify looks at.
+func (ll *LogLink) packetStart(header, payload []byte) []byte {
+	b := header
+	if len(b) < ll.linkHeaderSize+qos.HeaderSize && len(payload) > 0 {
+		n := ll.linkHeaderSize + qos.HeaderSize - len(b)
+		if n > len(payload) {
+			n = len(payload)
+		}
+		b = append(append(make([]byte, 0, len(b)+n), b...), payload[:n]...)
+	}
+	if len(b) < ll.linkHeaderSize {
+		return nil
+	}
+	return b[ll.linkHeaderSize:]
 }
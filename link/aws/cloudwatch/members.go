@@ -0,0 +1,126 @@
+package cloudwatch
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/link/secure"
+)
+
+// MemberWriter appends events to the log streams of a network's members
+// group. The heartbeats, leases and routes of a member go to the same stream,
+// so they must share a writer to agree on the stream's sequence token.
+type MemberWriter struct {
+	svc     cloudwatchlogsiface.CloudWatchLogsAPI
+	netName string
+	writer  *WritePoller
+	mu      sync.Mutex
+	streams map[string]bool
+	// RetentionDays is set on the members group if the writer creates it.
+	RetentionDays int64
+	// Sealer seals events, and opens them for the lease and route stores,
+	// if the network has a key.
+	Sealer *secure.Sealer
+}
+
+// NewMemberWriter creates a writer for the members group of netName.
+func NewMemberWriter(svc cloudwatchlogsiface.CloudWatchLogsAPI, netName string) *MemberWriter {
+	return &MemberWriter{
+		svc:     svc,
+		netName: netName,
+		writer:  NewWritePoller(svc),
+		streams: map[string]bool{},
+	}
+}
+
+// Write appends e to the log stream of mac, creating the group and stream
+// on first use.
+func (w *MemberWriter) Write(mac tcpip.LinkAddress, e MemberEvent) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	groupName := MembersGroupName(w.netName)
+	streamName := strings.Replace(mac.String(), ":", "", -1)
+	fullPath := groupName + "/" + streamName
+	if !w.streams[fullPath] {
+		if err := createLogGroup(w.svc, groupName, w.RetentionDays); err != nil {
+			return err
+		}
+		if err := createLogStream(w.svc, groupName, streamName); err != nil {
+			return err
+		}
+		w.streams[fullPath] = true
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if w.Sealer != nil {
+		sealed := w.Sealer.Seal(data, memberAD(w.netName, streamName))
+		data, err = json.Marshal(MemberEvent{Type: e.Type, MAC: e.MAC, Sealed: base64.StdEncoding.EncodeToString(sealed)})
+		if err != nil {
+			return err
+		}
+	}
+	event := &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(string(data)),
+		Timestamp: aws.Int64(time.Now().UnixNano() / int64(time.Millisecond)),
+	}
+	return w.writer.flush([]*cloudwatchlogs.InputLogEvent{event}, fullPath, groupName, streamName)
+}
+
+// Member is a link seen in the members group of a network.
+type Member struct {
+	MAC tcpip.LinkAddress
+	// IP is the leased address, nil if the member didn't lease one.
+	IP       net.IP
+	LastSeen time.Time
+}
+
+// Members returns the links that wrote a heartbeat or lease since start,
+// most recently seen first. Members that released their lease are left out.
+// Leased addresses are only known with the sealer of a network with a key.
+func Members(svc cloudwatchlogsiface.CloudWatchLogsAPI, netName string, start time.Time, sealer *secure.Sealer) ([]Member, error) {
+	events, err := readMemberEvents(svc, netName, start, sealer)
+	if err != nil {
+		return nil, err
+	}
+	members := map[string]*Member{}
+	for _, e := range events {
+		mac, err := net.ParseMAC(e.MAC)
+		if err != nil {
+			continue
+		}
+		if e.Type == releaseEvent {
+			delete(members, e.MAC)
+			continue
+		}
+		m, ok := members[e.MAC]
+		if !ok {
+			m = &Member{MAC: tcpip.LinkAddress(mac)}
+			members[e.MAC] = m
+		}
+		if e.Type == leaseEvent {
+			m.IP = net.ParseIP(e.IP).To4()
+		}
+		if seen := time.Unix(0, e.Written*int64(time.Millisecond)); seen.After(m.LastSeen) {
+			m.LastSeen = seen
+		}
+	}
+
+	list := make([]Member, 0, len(members))
+	for _, m := range members {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list, nil
+}
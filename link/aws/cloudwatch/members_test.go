@@ -0,0 +1,176 @@
+package cloudwatch
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/ipam"
+	"github.com/smithclay/rlinklayer/link/aws/cloudwatch/cloudwatchtest"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/routing"
+)
+
+func TestMembers(t *testing.T) {
+	svc := cloudwatchtest.New()
+	now := time.Now()
+	quiet := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	leased := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	gone := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x03")
+
+	putMemberEvent(t, svc, "TestNet", quiet, now.Add(-10*time.Minute))
+	s := NewLeaseStore(NewMemberWriter(svc, "TestNet"))
+	lease := ipam.Lease{IP: net.ParseIP("192.168.1.7").To4(), MAC: leased, Claimed: now, Expires: now.Add(time.Hour)}
+	if err := s.Put(lease); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	goneLease := ipam.Lease{IP: net.ParseIP("192.168.1.8").To4(), MAC: gone, Claimed: now, Expires: now.Add(time.Hour)}
+	if err := s.Put(goneLease); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.Release(goneLease); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	members, err := Members(svc, "TestNet", now.Add(-time.Hour), nil)
+	if err != nil {
+		t.Fatalf("Members: %v", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members, got %v", members)
+	}
+	if members[0].MAC != leased || !members[0].IP.Equal(lease.IP) {
+		t.Errorf("Expected %v with %v first, got %+v", leased, lease.IP, members[0])
+	}
+	if members[1].MAC != quiet || members[1].IP != nil {
+		t.Errorf("Expected %v without an address last, got %+v", quiet, members[1])
+	}
+}
+
+func TestLeaseStore_Sealed(t *testing.T) {
+	svc := cloudwatchtest.New()
+	now := time.Now()
+	sealer, _ := secure.NewPSK(bytes.Repeat([]byte{1}, 32))
+	sealed := NewMemberWriter(svc, "TestNet")
+	sealed.Sealer = sealer
+	s := NewLeaseStore(sealed)
+	member := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	lease := ipam.Lease{IP: net.ParseIP("192.168.1.7").To4(), MAC: member, Claimed: now, Expires: now.Add(time.Hour)}
+	if err := s.Put(lease); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// Somebody without the key claims an address in the clear.
+	forger := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	forged := ipam.Lease{IP: net.ParseIP("192.168.1.8").To4(), MAC: forger, Claimed: now, Expires: now.Add(time.Hour)}
+	if err := NewLeaseStore(NewMemberWriter(svc, "TestNet")).Put(forged); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	out, err := svc.FilterLogEvents(&cloudwatchlogs.FilterLogEventsInput{LogGroupName: aws.String(MembersGroupName("TestNet"))})
+	if err != nil {
+		t.Fatalf("FilterLogEvents: %v", err)
+	}
+	for _, e := range out.Events {
+		if aws.StringValue(e.LogStreamName) == "020000000001" && strings.Contains(aws.StringValue(e.Message), "192.168.1.7") {
+			t.Errorf("Expected the lease to be sealed, got %v", aws.StringValue(e.Message))
+		}
+	}
+	leases, err := s.Leases()
+	if err != nil {
+		t.Fatalf("Leases: %v", err)
+	}
+	if len(leases) != 1 || leases[0].MAC != member || !leases[0].IP.Equal(lease.IP) {
+		t.Errorf("Expected only the sealed lease, got %v", leases)
+	}
+	members, err := Members(svc, "TestNet", now.Add(-time.Hour), nil)
+	if err != nil {
+		t.Fatalf("Members: %v", err)
+	}
+	if len(members) != 2 {
+		t.Errorf("Expected both members without the key, got %v", members)
+	}
+}
+
+func TestRouteStore(t *testing.T) {
+	svc := cloudwatchtest.New()
+	now := time.Now()
+	gateway := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	putMemberEvent(t, svc, "TestNet", gateway, now.Add(-time.Minute))
+
+	s := NewRouteStore(NewMemberWriter(svc, "TestNet"))
+	routes := []routing.Advert{{Destination: "10.2.0.0/16", Metric: 0}, {Destination: "10.3.0.0/16", Metric: 1}}
+	if err := s.Announce(routing.Announcement{From: gateway, Gateway: "192.168.1.3", Routes: routes}); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	announcements, err := s.Announcements(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Announcements: %v", err)
+	}
+	if len(announcements) != 1 {
+		t.Fatalf("Expected the heartbeat to be left out, got %v", announcements)
+	}
+	a := announcements[0]
+	if a.From != gateway || a.Gateway != "192.168.1.3" || !reflect.DeepEqual(a.Routes, routes) || a.Sent.Before(now.Add(-time.Second)) {
+		t.Errorf("Unexpected announcement %+v", a)
+	}
+}
+
+func TestRouteStore_Forged(t *testing.T) {
+	svc := cloudwatchtest.New()
+	sealer, _ := secure.NewPSK(bytes.Repeat([]byte{1}, 32))
+	members := NewMemberWriter(svc, "TestNet")
+	members.Sealer = sealer
+	s := NewRouteStore(members)
+	gateway := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	routes := []routing.Advert{{Destination: "10.2.0.0/16"}}
+	if err := s.Announce(routing.Announcement{From: gateway, Gateway: "192.168.1.3", Routes: routes}); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	// Somebody without the key announces a default route in the clear.
+	forger := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	forged := routing.Announcement{From: forger, Gateway: "192.168.1.66", Routes: []routing.Advert{{Destination: "0.0.0.0/0"}}}
+	if err := NewRouteStore(NewMemberWriter(svc, "TestNet")).Announce(forged); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+
+	announcements, err := s.Announcements(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Announcements: %v", err)
+	}
+	if len(announcements) != 1 || announcements[0].From != gateway || !reflect.DeepEqual(announcements[0].Routes, routes) {
+		t.Errorf("Expected the forged announcement to be ignored, got %+v", announcements)
+	}
+}
+
+func TestMemberWriter_Shared(t *testing.T) {
+	svc := cloudwatchtest.New()
+	now := time.Now()
+	gateway := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	members := NewMemberWriter(svc, "TestNet")
+	leases := NewLeaseStore(members)
+	routes := NewRouteStore(members)
+
+	// Heartbeats, leases and routes of a member share its stream, every
+	// write has the current sequence token and is put once.
+	for i := 0; i < 3; i++ {
+		if err := members.Write(gateway, MemberEvent{Type: heartbeatEvent, MAC: gateway.String()}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		lease := ipam.Lease{IP: net.ParseIP("192.168.1.3").To4(), MAC: gateway, Claimed: now, Expires: now.Add(time.Hour)}
+		if err := leases.Put(lease); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := routes.Announce(routing.Announcement{From: gateway, Gateway: "192.168.1.3"}); err != nil {
+			t.Fatalf("Announce: %v", err)
+		}
+	}
+	if n := svc.Calls("PutLogEvents"); n != 9 {
+		t.Errorf("Expected 9 calls to PutLogEvents, got %d", n)
+	}
+}
@@ -4,13 +4,19 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
-	"log"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"sync"
 	"time"
 )
 
 type ReadPollOutput struct {
 	data []byte
 	err  error
+	// logged and ingested are the timestamp and ingestion time of the log
+	// event, fetched when it was read, for tracing.
+	logged, ingested, fetched time.Time
 }
 
 func (p *ReadPollOutput) Data() []byte {
@@ -26,34 +32,53 @@ type ReadPoller struct {
 	readThrottle      <-chan time.Time
 	broadcastThrottle <-chan time.Time
 	limit             int
-	nextTokens        map[string]*string
-	startTimes        map[string]int64
+
+	// Groups are polled from separate goroutines.
+	mu         sync.Mutex
+	nextTokens map[string]*string
+	startTimes map[string]int64
+
+	// stats, if set, gets the delay from events being logged to being read.
+	stats  *stats.Counters
+	logger logging.Logger
 
 	Cr chan ReadPollOutput
 }
 
 func NewReadPoller(client cloudwatchlogsiface.CloudWatchLogsAPI) *ReadPoller {
+	return newReadPoller(client, Polling{})
+}
+
+func newReadPoller(client cloudwatchlogsiface.CloudWatchLogsAPI, polling Polling) *ReadPoller {
+	polling = polling.WithDefaults()
 	p := &ReadPoller{
-		readThrottle:      time.Tick(time.Second / 4),
-		broadcastThrottle: time.Tick(time.Second / 1),
+		readThrottle:      time.Tick(polling.ReadInterval),
+		broadcastThrottle: time.Tick(polling.BroadcastInterval),
 		limit:             32,
 		nextTokens:        map[string]*string{},
 		startTimes:        map[string]int64{},
 		client:            client,
+		logger:            logging.Default(),
 		Cr:                make(chan ReadPollOutput, 32),
 	}
 	return p
 }
 
 func (p *ReadPoller) fetch(groupName string) {
+	p.mu.Lock()
 	params := &cloudwatchlogs.FilterLogEventsInput{
 		LogGroupName: aws.String(groupName),
 		NextToken:    p.nextTokens[groupName],
 		Interleaved:  aws.Bool(true),
 		StartTime:    aws.Int64(p.startTimes[groupName]),
 	}
+	p.mu.Unlock()
 
 	resp, err := p.client.FilterLogEvents(params)
+	if err == budget.ErrOverBudget {
+		// Skip this poll, events are read at the next one.
+		return
+	}
 	if err != nil {
 		p.Cr <- ReadPollOutput{err: err}
 		return
@@ -63,22 +88,38 @@ func (p *ReadPoller) fetch(groupName string) {
 	// NextForwardToken is nil, which means there's no new messages to
 	// consume.
 	if resp.NextToken != nil {
+		p.mu.Lock()
 		p.nextTokens[groupName] = resp.NextToken
+		p.mu.Unlock()
 	}
 
 	// If there are no messages, return so that the consumer can read again.
 	if len(resp.Events) == 0 {
 		return
 	}
+	fetched := time.Now()
 	for _, event := range resp.Events {
-		p.Cr <- ReadPollOutput{[]byte(*event.Message), nil}
-		p.startTimes[groupName] = aws.Int64Value(event.Timestamp) + 1
+		if p.stats != nil {
+			p.stats.Latency("delivery", time.Since(millisToTime(event.Timestamp)))
+		}
+		out := ReadPollOutput{data: []byte(*event.Message), logged: millisToTime(event.Timestamp), fetched: fetched}
+		if event.IngestionTime != nil {
+			out.ingested = millisToTime(event.IngestionTime)
+		}
+		p.Cr <- out
+		p.setStartTime(groupName, aws.Int64Value(event.Timestamp)+1)
 	}
 }
 
+func (p *ReadPoller) setStartTime(groupName string, ms int64) {
+	p.mu.Lock()
+	p.startTimes[groupName] = ms
+	p.mu.Unlock()
+}
+
 func (p *ReadPoller) ReadPollForBroadcast(groupName string) {
-	log.Printf("Reading bcast poll: %v", groupName)
-	p.startTimes[groupName] = time.Now().Unix() * 1000
+	p.logger.Debug("polling broadcast group", "group", groupName)
+	p.setStartTime(groupName, time.Now().Unix()*1000)
 	for {
 		<-p.broadcastThrottle
 		p.fetch(groupName)
@@ -86,8 +127,8 @@ func (p *ReadPoller) ReadPollForBroadcast(groupName string) {
 }
 
 func (p *ReadPoller) ReadPollForLogGroup(groupName string) {
-	log.Printf("Reading stream poll: %v", groupName)
-	p.startTimes[groupName] = time.Now().Unix() * 1000
+	p.logger.Debug("polling group", "group", groupName)
+	p.setStartTime(groupName, time.Now().Unix()*1000)
 	for {
 		<-p.readThrottle
 		p.fetch(groupName)
@@ -0,0 +1,60 @@
+package cloudwatch
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/routing"
+)
+
+// RouteStore implements routing.Channel on top of the network's members log
+// group. Gateways append their announcements to their own log stream, next
+// to their heartbeats and leases. On a network with a key, announcements are
+// sealed for the network and stream, and those that don't open are dropped,
+// so only members can add routes.
+type RouteStore struct {
+	members *MemberWriter
+}
+
+// NewRouteStore creates a route store writing with members, which should be
+// the writer of the gateway's link.
+func NewRouteStore(members *MemberWriter) *RouteStore {
+	return &RouteStore{members: members}
+}
+
+// Announce implements routing.Channel.Announce.
+func (s *RouteStore) Announce(a routing.Announcement) error {
+	return s.members.Write(a.From, MemberEvent{
+		Type:   routesEvent,
+		MAC:    a.From.String(),
+		IP:     a.Gateway,
+		Routes: a.Routes,
+	})
+}
+
+// Announcements implements routing.Channel.Announcements, they were sent
+// when CloudWatch received them.
+func (s *RouteStore) Announcements(start time.Time) ([]routing.Announcement, error) {
+	events, err := readMemberEvents(s.members.svc, s.members.netName, start, s.members.Sealer)
+	if err != nil {
+		return nil, err
+	}
+	var announcements []routing.Announcement
+	for _, e := range events {
+		if e.Type != routesEvent {
+			continue
+		}
+		mac, err := net.ParseMAC(e.MAC)
+		if err != nil {
+			continue
+		}
+		announcements = append(announcements, routing.Announcement{
+			From:    tcpip.LinkAddress(mac),
+			Gateway: e.IP,
+			Routes:  e.Routes,
+			Sent:    time.Unix(0, e.Written*int64(time.Millisecond)),
+		})
+	}
+	return announcements, nil
+}
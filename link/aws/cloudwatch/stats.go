@@ -0,0 +1,164 @@
+package cloudwatch
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+// countedLogService counts the calls links and janitors make to Cloudwatch
+// Logs, and makes them only if the budget allows it. Each page of a paged
+// operation is a call. Other operations go to the wrapped service uncounted.
+type countedLogService struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	stats  *stats.Counters
+	budget *budget.Meter
+}
+
+func (s *countedLogService) CreateLogGroup(in *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	if err := s.budget.Admit("CreateLogGroup", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.CreateLogGroup(in)
+	s.stats.Call("CreateLogGroup", start, err)
+	return out, err
+}
+
+func (s *countedLogService) CreateLogStream(in *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	if err := s.budget.Admit("CreateLogStream", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.CreateLogStream(in)
+	s.stats.Call("CreateLogStream", start, err)
+	return out, err
+}
+
+func (s *countedLogService) PutRetentionPolicy(in *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	if err := s.budget.Admit("PutRetentionPolicy", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.PutRetentionPolicy(in)
+	s.stats.Call("PutRetentionPolicy", start, err)
+	return out, err
+}
+
+func (s *countedLogService) PutLogEvents(in *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	if err := s.budget.Admit("PutLogEvents", ingestedSize(in.LogEvents)); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.PutLogEvents(in)
+	s.stats.Call("PutLogEvents", start, err)
+	return out, err
+}
+
+func (s *countedLogService) FilterLogEvents(in *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	if err := s.budget.Admit("FilterLogEvents", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.FilterLogEvents(in)
+	s.stats.Call("FilterLogEvents", start, err)
+	return out, err
+}
+
+func (s *countedLogService) FilterLogEventsPages(in *cloudwatchlogs.FilterLogEventsInput, fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+	page := *in
+	for {
+		out, err := s.FilterLogEvents(&page)
+		if err != nil {
+			return err
+		}
+		last := out.NextToken == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		page.NextToken = out.NextToken
+	}
+}
+
+func (s *countedLogService) DescribeLogGroups(in *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	if err := s.budget.Admit("DescribeLogGroups", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.DescribeLogGroups(in)
+	s.stats.Call("DescribeLogGroups", start, err)
+	return out, err
+}
+
+func (s *countedLogService) DescribeLogGroupsPages(in *cloudwatchlogs.DescribeLogGroupsInput, fn func(*cloudwatchlogs.DescribeLogGroupsOutput, bool) bool) error {
+	page := *in
+	for {
+		out, err := s.DescribeLogGroups(&page)
+		if err != nil {
+			return err
+		}
+		last := out.NextToken == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		page.NextToken = out.NextToken
+	}
+}
+
+func (s *countedLogService) DescribeLogStreams(in *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	if err := s.budget.Admit("DescribeLogStreams", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.DescribeLogStreams(in)
+	s.stats.Call("DescribeLogStreams", start, err)
+	return out, err
+}
+
+func (s *countedLogService) DescribeLogStreamsPages(in *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error {
+	page := *in
+	for {
+		out, err := s.DescribeLogStreams(&page)
+		if err != nil {
+			return err
+		}
+		last := out.NextToken == nil
+		if !fn(out, last) || last {
+			return nil
+		}
+		page.NextToken = out.NextToken
+	}
+}
+
+func (s *countedLogService) DeleteLogGroup(in *cloudwatchlogs.DeleteLogGroupInput) (*cloudwatchlogs.DeleteLogGroupOutput, error) {
+	if err := s.budget.Admit("DeleteLogGroup", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.DeleteLogGroup(in)
+	s.stats.Call("DeleteLogGroup", start, err)
+	return out, err
+}
+
+func (s *countedLogService) DeleteLogStream(in *cloudwatchlogs.DeleteLogStreamInput) (*cloudwatchlogs.DeleteLogStreamOutput, error) {
+	if err := s.budget.Admit("DeleteLogStream", 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	out, err := s.CloudWatchLogsAPI.DeleteLogStream(in)
+	s.stats.Call("DeleteLogStream", start, err)
+	return out, err
+}
+
+// ingestedSize returns the bytes Cloudwatch Logs bills for events.
+func ingestedSize(events []*cloudwatchlogs.InputLogEvent) int {
+	n := 0
+	for _, e := range events {
+		n += len(aws.StringValue(e.Message)) + budget.EventOverhead
+	}
+	return n
+}
@@ -5,7 +5,11 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
-	"log"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+	"github.com/smithclay/rlinklayer/tracing"
 	"strings"
 	"time"
 )
@@ -13,31 +17,77 @@ import (
 type WritePollInput struct {
 	data   []byte
 	cwLink *CloudwatchLinkAddress
+	queued time.Time
+	// encode, if set, returns data when the input is dequeued.
+	encode func() ([]byte, error)
+	// trace is the context of a traced frame, its send span ends when the
+	// frame is put.
+	trace *tracing.Context
 }
 
 func NewWritePollInput(data []byte, link *CloudwatchLinkAddress) WritePollInput {
-	return WritePollInput{data, link}
+	return WritePollInput{data: data, cwLink: link, queued: time.Now()}
 }
 
 type WritePoller struct {
 	client         cloudwatchlogsiface.CloudWatchLogsAPI
-	writeThrottle  <-chan time.Time
+	writeInterval  time.Duration
 	limit          int
 	sequenceTokens map[string]*string
-	Cw             chan WritePollInput
+	// batch is the most inputs put every writeInterval.
+	batch int
+	// stats, if set, gets the time inputs spend queued before being put.
+	stats  *stats.Counters
+	tracer *tracing.Tracer
+	logger logging.Logger
+	// Queue schedules the inputs waiting to be put by class.
+	Queue *qos.Scheduler
 }
 
 func NewWritePoller(client cloudwatchlogsiface.CloudWatchLogsAPI) *WritePoller {
+	return newWritePoller(client, Polling{}, qos.New(nil))
+}
+
+func newWritePoller(client cloudwatchlogsiface.CloudWatchLogsAPI, polling Polling, queue *qos.Scheduler) *WritePoller {
+	polling = polling.WithDefaults()
 	p := &WritePoller{
-		writeThrottle:  time.Tick(time.Second / 5),
+		writeInterval:  polling.WriteInterval,
 		limit:          16,
+		batch:          polling.WriteBatch,
 		client:         client,
 		sequenceTokens: map[string]*string{},
-		Cw:             make(chan WritePollInput, 16),
+		logger:         logging.Default(),
+		Queue:          queue,
 	}
 	return p
 }
 
+// next returns the next input to put, false if none is queued. Inputs with
+// encode are encoded as they are dequeued, those that fail are dropped.
+func (p *WritePoller) next() (WritePollInput, bool) {
+	for {
+		v, ok := p.Queue.Dequeue()
+		if !ok {
+			return WritePollInput{}, false
+		}
+		in := v.(WritePollInput)
+		if in.encode == nil {
+			return in, true
+		}
+		data, err := in.encode()
+		if err != nil {
+			p.logger.Warn("dropping packet, could not encode it", "err", err)
+			if p.stats != nil {
+				p.stats.EncodeError()
+				p.stats.Drop(stats.DropWriteFailed)
+			}
+			continue
+		}
+		in.data, in.encode = data, nil
+		return in, true
+	}
+}
+
 func (p *WritePoller) putLogEvents(events []*cloudwatchlogs.InputLogEvent, sequenceToken *string, groupName string, streamName string) (nextSequenceToken *string, err error) {
 	resp, err := p.client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
 		LogEvents:     events,
@@ -46,21 +96,6 @@ func (p *WritePoller) putLogEvents(events []*cloudwatchlogs.InputLogEvent, seque
 		SequenceToken: sequenceToken,
 	})
 	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() != cloudwatchlogs.ErrCodeInvalidSequenceTokenException {
-				log.Printf(
-					"Failed to put log: events: errorCode: %s message: %s, origError: %s log-group: %s log-stream: %s",
-					awsErr.Code(),
-					awsErr.Message(),
-					awsErr.OrigErr(),
-					groupName,
-					streamName,
-				)
-			}
-		} else {
-			log.Printf("Failed to put log: %s", err)
-		}
-
 		return nil, err
 	}
 	sequenceToken = resp.NextSequenceToken
@@ -75,14 +110,7 @@ func (p *WritePoller) flush(events []*cloudwatchlogs.InputLogEvent, fullPath str
 				// already submitted, just grab the correct sequence token
 				parts := strings.Split(awsErr.Message(), " ")
 				nextSequenceToken = &parts[len(parts)-1]
-				// TODO log locally...
-				log.Println(
-					"Data already accepted, ignoring error",
-					"errorCode: ", awsErr.Code(),
-					"message: ", awsErr.Message(),
-					"logGroupName: ", groupName,
-					"logStreamName: ", streamName,
-				)
+				p.logger.Debug("events already accepted", "group", groupName, "stream", streamName)
 				err = nil
 			} else if awsErr.Code() == cloudwatchlogs.ErrCodeInvalidSequenceTokenException {
 
@@ -94,8 +122,17 @@ func (p *WritePoller) flush(events []*cloudwatchlogs.InputLogEvent, fullPath str
 		}
 	}
 
+	if err == budget.ErrOverBudget {
+		// The budget logs why, the packets are counted as dropped.
+		if p.stats != nil {
+			for range events {
+				p.stats.Drop(stats.DropOverBudget)
+			}
+		}
+		return err
+	}
 	if err != nil {
-		log.Println("error flushing", err)
+		p.logger.Warn("could not put log events", "group", groupName, "stream", streamName, "err", err)
 		return err
 	} else {
 		p.sequenceTokens[fullPath] = nextSequenceToken
@@ -110,30 +147,48 @@ type PutEventInput struct {
 }
 
 func (p *WritePoller) WritePoll() {
+	t := time.NewTicker(p.writeInterval)
+	defer t.Stop()
 	for {
-		<-p.writeThrottle
+		<-t.C
 		events := make(map[PutEventInput][]*cloudwatchlogs.InputLogEvent, 0)
-		select {
-		case writeInput := <-p.Cw:
+		traces := map[PutEventInput][]*tracing.Context{}
+		for n := 0; n < p.batch; n++ {
+			writeInput, ok := p.next()
+			if !ok {
+				break
+			}
+			if p.stats != nil && !writeInput.queued.IsZero() {
+				p.stats.Latency("queue", time.Since(writeInput.queued))
+			}
 			cwInput := &cloudwatchlogs.InputLogEvent{
 				Message:   aws.String(string(writeInput.data)),
 				Timestamp: aws.Int64(time.Now().UnixNano() / 1000000),
 			}
 			pei := PutEventInput{writeInput.cwLink.LogGroupName(), writeInput.cwLink.LogStreamName(), writeInput.cwLink.FullPath()}
 			events[pei] = append(events[pei], cwInput)
-		default:
-			continue
+			if writeInput.trace != nil {
+				traces[pei] = append(traces[pei], writeInput.trace)
+			}
 		}
 		if len(events) > 0 {
 			// Flush written events for each unique EndpointLogStream
 			for k, v := range events {
+				// flush logs its errors.
 				err := p.flush(v, k.fullPath, k.groupName, k.streamName)
-				if err != nil {
-					log.Printf("Error flushing: %v", err)
-				}
+				p.sent(traces[k], k, err)
 			}
-		} else {
-			log.Printf("WritePoll: no events to flush")
 		}
 	}
 }
+
+// sent ends the send spans of the traced frames put to a stream.
+func (p *WritePoller) sent(traces []*tracing.Context, k PutEventInput, err error) {
+	for _, ctx := range traces {
+		attrs := map[string]interface{}{"group": k.groupName, "stream": k.streamName}
+		if err != nil {
+			attrs["error"] = err.Error()
+		}
+		p.tracer.Sent(ctx, attrs)
+	}
+}
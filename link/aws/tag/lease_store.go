@@ -0,0 +1,124 @@
+package tag
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/ipam"
+)
+
+const leaseTagPrefix = "lease:"
+
+// LeaseStore implements ipam.Store with tags on a single AWS Lambda function
+// that every member of the network can read and tag. Each member's lease is
+// one tag keyed by its link address, so competing claims for the same
+// address are all kept and the allocator sees the earliest one when checking
+// for conflicts.
+type LeaseStore struct {
+	svc lambdaiface.LambdaAPI
+	arn string
+}
+
+// NewLeaseStore creates a lease store kept in the tags of the function arn.
+func NewLeaseStore(svc lambdaiface.LambdaAPI, arn string) *LeaseStore {
+	return &LeaseStore{svc: svc, arn: arn}
+}
+
+// Leases implements ipam.Store.Leases.
+func (s *LeaseStore) Leases() ([]ipam.Lease, error) {
+	out, err := s.svc.ListTags(&lambda.ListTagsInput{Resource: aws.String(s.arn)})
+	if err != nil {
+		return nil, err
+	}
+	var leases []ipam.Lease
+	for k, v := range out.Tags {
+		if !strings.HasPrefix(k, leaseTagPrefix) {
+			continue
+		}
+		l, err := decodeLease(strings.TrimPrefix(k, leaseTagPrefix), aws.StringValue(v))
+		if err != nil {
+			continue
+		}
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// Put implements ipam.Store.Put.
+func (s *LeaseStore) Put(l ipam.Lease) error {
+	_, err := s.svc.TagResource(&lambda.TagResourceInput{
+		Resource: aws.String(s.arn),
+		Tags:     aws.StringMap(map[string]string{leaseTag(l.MAC): encodeLease(l)}),
+	})
+	return err
+}
+
+// Release implements ipam.Store.Release. The tag is only removed while it
+// still holds l.IP.
+func (s *LeaseStore) Release(l ipam.Lease) error {
+	leases, err := s.Leases()
+	if err != nil {
+		return err
+	}
+	for _, cur := range leases {
+		if !cur.IP.Equal(l.IP) || cur.MAC != l.MAC {
+			continue
+		}
+		_, err := s.svc.UntagResource(&lambda.UntagResourceInput{
+			Resource: aws.String(s.arn),
+			TagKeys:  aws.StringSlice([]string{leaseTag(l.MAC)}),
+		})
+		return err
+	}
+	return nil
+}
+
+// leaseTag returns the key of the tag holding the lease of mac.
+func leaseTag(mac tcpip.LinkAddress) string {
+	return fmt.Sprintf("%s%x", leaseTagPrefix, []byte(mac))
+}
+
+// encodeLease formats a lease as a tag value, `ip/claimed/expires` with
+// times in unix milliseconds. Tag values can't contain commas or colons.
+func encodeLease(l ipam.Lease) string {
+	return fmt.Sprintf("%v/%d/%d", l.IP,
+		l.Claimed.UnixNano()/int64(time.Millisecond),
+		l.Expires.UnixNano()/int64(time.Millisecond))
+}
+
+func decodeLease(key string, v string) (ipam.Lease, error) {
+	mac, err := hex.DecodeString(key)
+	if err != nil {
+		return ipam.Lease{}, err
+	}
+	parts := strings.Split(v, "/")
+	if len(parts) != 3 {
+		return ipam.Lease{}, fmt.Errorf("decodeLease: malformed lease %q", v)
+	}
+	ip := net.ParseIP(parts[0]).To4()
+	if ip == nil {
+		return ipam.Lease{}, fmt.Errorf("decodeLease: malformed address %q", parts[0])
+	}
+	claimed, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ipam.Lease{}, err
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return ipam.Lease{}, err
+	}
+	return ipam.Lease{
+		IP:      ip,
+		MAC:     tcpip.LinkAddress(mac),
+		Claimed: time.Unix(0, claimed*int64(time.Millisecond)),
+		Expires: time.Unix(0, expires*int64(time.Millisecond)),
+	}, nil
+}
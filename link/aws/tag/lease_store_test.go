@@ -0,0 +1,75 @@
+package tag
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/smithclay/rlinklayer/ipam"
+)
+
+// tagService keeps the tags of a function in memory.
+type tagService struct {
+	lambdaiface.LambdaAPI
+	tags map[string]*string
+}
+
+func (s *tagService) ListTags(in *lambda.ListTagsInput) (*lambda.ListTagsOutput, error) {
+	tags := map[string]*string{}
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	return &lambda.ListTagsOutput{Tags: tags}, nil
+}
+
+func (s *tagService) TagResource(in *lambda.TagResourceInput) (*lambda.TagResourceOutput, error) {
+	for k, v := range in.Tags {
+		s.tags[k] = v
+	}
+	return &lambda.TagResourceOutput{}, nil
+}
+
+func (s *tagService) UntagResource(in *lambda.UntagResourceInput) (*lambda.UntagResourceOutput, error) {
+	for _, k := range in.TagKeys {
+		delete(s.tags, aws.StringValue(k))
+	}
+	return &lambda.UntagResourceOutput{}, nil
+}
+
+func TestLeaseStore_Conflict(t *testing.T) {
+	s := NewLeaseStore(&tagService{tags: map[string]*string{}}, "arn:aws:lambda:us-west-2:123456789012:function:leases")
+	now := time.Now().Truncate(time.Millisecond)
+	ip := net.ParseIP("10.0.0.1").To4()
+	early := ipam.Lease{IP: ip, MAC: "\x02\x00\x00\x00\x00\x01", Claimed: now, Expires: now.Add(time.Minute)}
+	late := ipam.Lease{IP: ip, MAC: "\x02\x00\x00\x00\x00\x02", Claimed: now.Add(time.Second), Expires: now.Add(time.Minute)}
+	s.Put(early)
+	s.Put(late)
+
+	leases, err := s.Leases()
+	if err != nil {
+		t.Fatalf("Leases: %v", err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("Expected both claims on %v to be kept, got %v", ip, leases)
+	}
+	for _, l := range leases {
+		want := early
+		if l.MAC == late.MAC {
+			want = late
+		}
+		if !l.IP.Equal(want.IP) || !l.Claimed.Equal(want.Claimed) || !l.Expires.Equal(want.Expires) {
+			t.Errorf("Expected lease %+v, got %+v", want, l)
+		}
+	}
+
+	// The losing member only releases its own claim.
+	if err := s.Release(late); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if leases, _ := s.Leases(); len(leases) != 1 || leases[0].MAC != early.MAC {
+		t.Errorf("Expected the earlier claim to remain, got %v", leases)
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
 	"io"
 	"log"
 )
@@ -16,9 +20,12 @@ import (
 type endpoint struct {
 	dispatcher stack.NetworkDispatcher
 	tagLink    *TagLink
-	stats      *AwsStats
+	stats      *stats.Counters
 	laddr      tcpip.LinkAddress
 	raddr      tcpip.LinkAddress
+	sealer     *secure.Sealer
+	hdrSize    int
+	logger     logging.Logger
 }
 
 // Options specify the details about the AWS service-based endpoint to be created.
@@ -27,38 +34,77 @@ type Options struct {
 	RemoteArn     string
 	LocalAddress  tcpip.LinkAddress
 	RemoteAddress tcpip.LinkAddress
-}
-
-// AwsStats collects link-specific stats.
-type AwsStats struct {
-	RxPackets uint32
-	TxPackets uint32
-	TxErrors  uint32
-	RxErrors  uint32
+	// NetworkKey enables encryption and authentication of packets with a key
+	// shared by both ends, at least secure.MinKeySize bytes.
+	NetworkKey []byte
+	// Sealer is used instead of NetworkKey for keys that rotate.
+	Sealer *secure.Sealer
+	// EthernetHeader sends frames with link addresses, so that the link can
+	// carry ARP and be bridged. Both ends must agree.
+	EthernetHeader bool
+	// Region of the functions, the default region if empty.
+	Region string
+	// Logger gets the messages of the link, with the functions and
+	// addresses as fields. logging.Default is used if nil.
+	Logger logging.Logger
+	// Budget meters the calls of the link and sheds or delays those over
+	// the budget of the network.
+	Budget *budget.Meter
 }
 
 // New creates a new endpoint for transmitting data using AWS Lambda tags.
 func New(opts *Options) tcpip.LinkEndpointID {
 	ep := &endpoint{
-		laddr: opts.LocalAddress,
-		raddr: opts.RemoteAddress,
-		stats: &AwsStats{},
+		laddr:  opts.LocalAddress,
+		raddr:  opts.RemoteAddress,
+		stats:  &stats.Counters{},
+		sealer: opts.Sealer,
+		logger: logging.OrDefault(opts.Logger).With("link", "tag", "mac", opts.LocalAddress, "peer", opts.RemoteAddress),
 	}
-	ep.tagLink = newTagLink(opts.LocalArn, opts.RemoteArn, ep)
-	log.Printf("New AWS Link: local %s, remote %s", ep.laddr, ep.raddr)
+	if opts.EthernetHeader {
+		ep.hdrSize = header.EthernetMinimumSize
+	}
+	if ep.sealer == nil && len(opts.NetworkKey) > 0 {
+		sealer, err := secure.NewPSK(opts.NetworkKey)
+		if err != nil {
+			log.Fatalf("New: Could not use network key: %v", err)
+		}
+		ep.sealer = sealer
+	}
+	ep.tagLink = newTagLink(opts.Region, opts.LocalArn, opts.RemoteArn, opts.Budget, ep)
+	ep.logger.Info("created link", "local_arn", opts.LocalArn, "remote_arn", opts.RemoteArn)
 	return stack.RegisterLinkEndpoint(ep)
 }
 
-func newTagLink(localArn string, remoteArn string, e *endpoint) *TagLink {
+// DefaultRegion is the region of clients created without one.
+const DefaultRegion = "us-west-2"
+
+// NewLambdaService creates an AWS Lambda client for the default region.
+func NewLambdaService() *lambda.Lambda {
+	return NewLambdaServiceForRegion(DefaultRegion)
+}
+
+// NewLambdaServiceForRegion creates an AWS Lambda client for region, or the
+// default region if empty.
+func NewLambdaServiceForRegion(region string) *lambda.Lambda {
+	if region == "" {
+		region = DefaultRegion
+	}
 	sess, _ := session.NewSession(&aws.Config{
-		Region: aws.String("us-west-2")},
+		Region: aws.String(region)},
 	)
-	svc := lambda.New(sess, &aws.Config{Region: aws.String("us-west-2")})
+	return lambda.New(sess, &aws.Config{Region: aws.String(region)})
+}
+
+func newTagLink(region string, localArn string, remoteArn string, meter *budget.Meter, e *endpoint) *TagLink {
+	svc := NewLambdaServiceForRegion(region)
 	config := TagConfig{
 		LambdaService: svc,
 		Endpoint:      e,
 		TxArn:         remoteArn,
 		RxArn:         localArn,
+		Stats:         e.stats,
+		Budget:        meter,
 	}
 	return NewTagLink(&config)
 }
@@ -74,13 +120,26 @@ func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
 func (e *endpoint) dispatchLoop() {
 	for {
 		decoded, err := e.readSinglePacket(BufConfig[0])
+		if err == budget.ErrOverBudget {
+			e.stats.Drop(stats.DropOverBudget)
+			continue
+		}
 		if err != nil {
-			log.Printf("dispatchLoop: Error reading single packet: %v", err)
-			e.stats.RxErrors++
+			e.logger.Warn("could not read packet", "err", err)
+			e.stats.DecodeError()
+			e.stats.Drop(stats.DropMalformed)
 			continue
 		}
+		if len(decoded) > 0 && e.sealer != nil {
+			decoded, err = e.sealer.Open(decoded, nil)
+			if err != nil {
+				e.logger.Debug("dropping packet that could not be opened", "err", err)
+				e.stats.Drop(stats.OpenFailure(err))
+				continue
+			}
+		}
 		if len(decoded) > 0 {
-			e.stats.RxPackets++
+			e.stats.Received(len(decoded))
 			e.dispatchSinglePacket(decoded)
 		}
 	}
@@ -97,16 +156,24 @@ func (e *endpoint) readSinglePacket(size int) ([]byte, error) {
 }
 
 func (e *endpoint) dispatchSinglePacket(decoded []byte) bool {
+	if e.hdrSize > 0 {
+		if len(decoded) < e.hdrSize {
+			e.logger.Debug("dropping frame too short", "size", len(decoded))
+			return false
+		}
+		eth := header.Ethernet(decoded)
+		vv := buffer.NewViewFromBytes(decoded[e.hdrSize:]).ToVectorisedView()
+		e.dispatcher.DeliverNetworkPacket(e, eth.SourceAddress(), eth.DestinationAddress(), eth.Type(), vv)
+		return true
+	}
 
-	//log.Printf("dispatchLoop: read buffer %v", decoded)
 	ipv4Packet := header.IPv4(decoded)
 	if ipv4Packet.IsValid(len(decoded)) {
-		//log.Printf("dispatchLoop: valid ipv4 packet received, src: %s, dest: %s", ipv4Packet.SourceAddress(), ipv4Packet.DestinationAddress())
 		vv := buffer.NewViewFromBytes(decoded).ToVectorisedView()
 		e.dispatcher.DeliverNetworkPacket(e, "", "", ipv4.ProtocolNumber, vv)
 		return true
 	}
-	log.Printf("dispatchLoop: Invalid ipv4 packet recvd: %v", decoded)
+	e.logger.Debug("dropping invalid IPv4 packet", "size", len(decoded))
 	return false
 }
 
@@ -116,9 +183,14 @@ func (e *endpoint) IsAttached() bool {
 }
 
 // MTU implements stack.LinkEndpoint.MTU.
-// Maximum tag length
-func (*endpoint) MTU() uint32 {
-	return 189
+// Maximum tag length, less the sealing overhead when a network key is used
+// and the ethernet header when there is one.
+func (e *endpoint) MTU() uint32 {
+	mtu := uint32(189 - e.hdrSize)
+	if e.sealer != nil {
+		mtu -= secure.Overhead
+	}
+	return mtu
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities. Loopback advertises
@@ -128,10 +200,10 @@ func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
 	//return stack.CapabilityChecksumOffload | stack.CapabilitySaveRestore | stack.CapabilityLoopback
 }
 
-// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. Given that the
-// loopback interface doesn't have a header, it just returns 0.
-func (*endpoint) MaxHeaderLength() uint16 {
-	return 0
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. Without an
+// ethernet header, it just returns 0.
+func (e *endpoint) MaxHeaderLength() uint16 {
+	return uint16(e.hdrSize)
 }
 
 // LinkAddress returns the link address of this endpoint.
@@ -142,18 +214,45 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 // WritePacket implements stack.LinkEndpoint.WritePacket. It delivers outbound
 // packets to the network-layer dispatcher.
 func (e *endpoint) WritePacket(s *stack.Route, _ *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.hdrSize > 0 {
+		ethHdr := &header.EthernetFields{
+			SrcAddr: s.LocalLinkAddress,
+			DstAddr: s.RemoteLinkAddress,
+			Type:    protocol,
+		}
+		// Preserve the addresses in the route, bridges send frames of others.
+		if ethHdr.SrcAddr == "" {
+			ethHdr.SrcAddr = e.laddr
+		}
+		if ethHdr.DstAddr == "" {
+			ethHdr.DstAddr = e.raddr
+		}
+		header.Ethernet(hdr.Prepend(header.EthernetMinimumSize)).Encode(ethHdr)
+	}
 	views := make([]buffer.View, 1, 1+len(payload.Views()))
 	views[0] = hdr.View()
 	views = append(views, payload.Views()...)
 	vv := buffer.NewVectorisedView(len(views[0])+payload.Size(), views)
 
-	_, err := e.tagLink.Write(vv.ToView())
+	data := []byte(vv.ToView())
+	if e.sealer != nil {
+		data = e.sealer.Seal(data, nil)
+	}
+	_, err := e.tagLink.Write(data)
+	if err == budget.ErrOverBudget {
+		e.stats.Drop(stats.DropOverBudget)
+		return nil
+	}
 	if err != nil {
-		log.Printf("WritePacket: Error writing to link buffer, dropping packet: %v", err)
-		log.Printf("WritePacket: Available Write Buffers: %d", e.tagLink.txBuffer.avail)
-		e.stats.TxErrors++
+		e.logger.Warn("dropping packet, could not write it", "err", err)
+		e.stats.Drop(stats.DropWriteFailed)
 		return nil
 	}
-	e.stats.TxPackets++
+	e.stats.Sent(len(data))
 	return nil
 }
+
+// Stats implements stats.Source.
+func (e *endpoint) Stats() stats.Snapshot {
+	return e.stats.Snapshot()
+}
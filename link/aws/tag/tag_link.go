@@ -2,26 +2,18 @@ package tag
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/stats"
 )
 
 type FunctionTags map[string]string
 
-// TagStats captures data on packets sent or received in AWS Lambda tags
-type TagStats struct {
-	RxErrors      uint32
-	TxErrors      uint32
-	AwsRequests   uint32
-	UpdatedTxTags uint32
-	DeletedRxTags uint32
-}
-
 func (t FunctionTags) String() string {
 	a := make([]string, 0)
 	for k := range t {
@@ -38,7 +30,8 @@ type TagLink struct {
 	ep       *endpoint
 	rxBuffer *TagRing
 	txBuffer *TagRing
-	stats    *TagStats
+	stats    *stats.Counters
+	budget   *budget.Meter
 	mtu      int
 	// todo: look into implementing this with channels
 	txHarvester *TagHarvester
@@ -59,6 +52,12 @@ type TagConfig struct {
 	Endpoint      *endpoint
 	RxArn         string // local (receive lambda tags)
 	TxArn         string // remote (transmit lambda tags)
+	// Stats counts calls to AWS Lambda and buffered packets, the link keeps
+	// its own if nil.
+	Stats *stats.Counters
+	// Budget meters the calls to AWS Lambda and limits them to the budget
+	// of the network, calls are not limited if nil.
+	Budget *budget.Meter
 }
 
 type TagHarvester struct {
@@ -66,12 +65,17 @@ type TagHarvester struct {
 	d          time.Duration
 	svc        *lambda.Lambda
 	arn        string
-	mux        sync.Mutex
+	mux        *sync.Mutex
 	tagHandler func(map[string]*string, error)
 	err        chan error
+	// budget, if set, skips polls over the budget of the network.
+	budget *budget.Meter
 }
 
-func NewTagHarvester(d time.Duration, svc *lambda.Lambda, arn string, mux sync.Mutex, tagHandler func(map[string]*string, error)) *TagHarvester {
+// NewTagHarvester polls the tags of arn every d and hands them to
+// tagHandler, holding mux so that they don't change under readers and
+// writers of the buffers.
+func NewTagHarvester(d time.Duration, svc *lambda.Lambda, arn string, mux *sync.Mutex, tagHandler func(map[string]*string, error)) *TagHarvester {
 	return &TagHarvester{
 		d:          d,
 		arn:        arn,
@@ -87,6 +91,9 @@ func (th *TagHarvester) Start() {
 		for {
 			select {
 			case <-th.t.C:
+				if th.budget.Admit("ListTags", 0) != nil {
+					continue
+				}
 				th.mux.Lock()
 				tagsOutput, err := th.svc.ListTags(&lambda.ListTagsInput{Resource: aws.String(th.arn)})
 				if err != nil {
@@ -111,12 +118,31 @@ var BufConfig = []int{255, 255, 255, 255, 255, 255, 255, 255}
 const PollInterval = 500 * time.Millisecond
 
 func NewTagLink(config *TagConfig) *TagLink {
-	tagLink := TagLink{mtu: 255, txArn: config.TxArn, rxArn: config.RxArn, svc: config.LambdaService, stats: &TagStats{}, ep: config.Endpoint}
+	counters := config.Stats
+	if counters == nil {
+		counters = &stats.Counters{}
+	}
+	tagLink := &TagLink{mtu: 255, txArn: config.TxArn, rxArn: config.RxArn, svc: config.LambdaService, stats: counters, budget: config.Budget, ep: config.Endpoint}
 	tagLink.txBuffer = NewTagRing(len(BufConfig), TransmitType)
 	tagLink.rxBuffer = NewTagRing(len(BufConfig), ReceiveType)
-	tagLink.txHarvester = NewTagHarvester(PollInterval, config.LambdaService, config.TxArn, tagLink.txMux, tagLink.refreshTxInternalBuffers)
-	tagLink.rxHarvester = NewTagHarvester(PollInterval, config.LambdaService, config.RxArn, tagLink.rxMux, tagLink.refreshRxInternalBuffers)
-	return &tagLink
+	tagLink.txHarvester = NewTagHarvester(PollInterval, config.LambdaService, config.TxArn, &tagLink.txMux, tagLink.refreshTxInternalBuffers)
+	tagLink.rxHarvester = NewTagHarvester(PollInterval, config.LambdaService, config.RxArn, &tagLink.rxMux, tagLink.refreshRxInternalBuffers)
+	tagLink.txHarvester.budget = config.Budget
+	tagLink.rxHarvester.budget = config.Budget
+	if config.LambdaService != nil {
+		config.LambdaService.Handlers.Complete.PushBackNamed(counters.Handler())
+	}
+	counters.SetQueue("rx", func() int {
+		tagLink.rxMux.Lock()
+		defer tagLink.rxMux.Unlock()
+		return tagLink.rxBuffer.avail
+	})
+	counters.SetQueue("tx", func() int {
+		tagLink.txMux.Lock()
+		defer tagLink.txMux.Unlock()
+		return tagLink.txBuffer.ringSize - tagLink.txBuffer.avail
+	})
+	return tagLink
 }
 
 func (t *TagLink) StartPolling() {
@@ -220,7 +246,6 @@ func (t *TagLink) FlushTransmit() (*string, error) {
 	if err != nil {
 		return nil, err
 	}
-	t.stats.UpdatedTxTags++
 	return aws.String(t.TxTagIndex(i)), nil
 }
 
@@ -248,7 +273,6 @@ func (t *TagLink) FlushReceive() (*string, error) {
 	if err != nil {
 		return nil, err
 	}
-	t.stats.DeletedRxTags++
 	return aws.String(clearTag), nil
 }
 
@@ -283,7 +307,6 @@ func (t *TagLink) Write(p []byte) (int, error) {
 	_, err = t.FlushTransmit()
 	if err != nil {
 		// TODO: how to recover from this (?)
-		log.Printf("WritePacket: Error flushing to remote link, dropping packet: %v", err)
 		return 0, err
 	}
 
@@ -291,7 +314,9 @@ func (t *TagLink) Write(p []byte) (int, error) {
 }
 
 func (t *TagLink) removeTags(tagKeys []string) (*lambda.UntagResourceOutput, error) {
-	t.stats.AwsRequests++
+	if err := t.budget.Admit("UntagResource", 0); err != nil {
+		return nil, err
+	}
 	tagInput := &lambda.UntagResourceInput{
 		Resource: aws.String(t.rxArn),
 		TagKeys:  aws.StringSlice(tagKeys),
@@ -304,7 +329,9 @@ func (t *TagLink) removeTags(tagKeys []string) (*lambda.UntagResourceOutput, err
 }
 
 func (t *TagLink) updateTags(tags FunctionTags) (*lambda.TagResourceOutput, error) {
-	t.stats.AwsRequests++
+	if err := t.budget.Admit("TagResource", 0); err != nil {
+		return nil, err
+	}
 	tagInput := &lambda.TagResourceInput{
 		Resource: aws.String(t.txArn),
 		Tags:     aws.StringMap(tags),
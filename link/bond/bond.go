@@ -0,0 +1,486 @@
+// Package bond bonds the links of several transports into one link
+// endpoint, so that a member of a network with both logs:* and
+// lambda:TagResource permissions can use the rate limits of both. Frames
+// are scheduled on the member link expected to deliver them first, from the
+// latency of its calls, the frames it has queued and its capacity. Links
+// that get throttled or fail are avoided for a while, and frames received
+// again through another link are dropped.
+package bond
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/qos"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// Defaults of Options and Member.
+const (
+	// DefaultCapacity are the frames per second of members without one.
+	DefaultCapacity = 5
+	// DefaultDedupWindow should cover the difference of the delays of the
+	// transports, Cloudwatch Logs taking over a second.
+	DefaultDedupWindow = 5 * time.Second
+	// DefaultHolddown is how long a member that was throttled or failed is
+	// avoided.
+	DefaultHolddown = 10 * time.Second
+)
+
+// checkInterval is how often the statistics of members are read.
+const checkInterval = time.Second
+
+// faultDrops are the drops of a member that mean it can't keep up.
+var faultDrops = []string{stats.DropWriteFailed, stats.DropOverBudget, stats.DropQueueFull}
+
+// Member is a link of the bond.
+type Member struct {
+	// Name of the transport, i.e. cloudwatch or tag, in logs and stats.
+	Name string
+	// Endpoint is the link of the transport. Its latency, queues and faults
+	// are measured when it keeps statistics, see stats.Source.
+	Endpoint tcpip.LinkEndpointID
+	// Peer restricts the member to unicast frames to this address, for
+	// point to point transports like tags. The member carries every frame
+	// if empty.
+	Peer tcpip.LinkAddress
+	// Capacity are the frames per second the transport can send,
+	// DefaultCapacity if zero.
+	Capacity float64
+}
+
+// Options configure a bond.
+type Options struct {
+	// Members are the links bonded, which must have the same link address.
+	Members []Member
+	// Redundant sends control frames, ARP, ICMP and TCP segments opening,
+	// closing or resetting connections, on every usable member. The first
+	// copy received is delivered.
+	Redundant bool
+	// DedupWindow is how long received frames are remembered to drop their
+	// copies, DefaultDedupWindow if zero.
+	DedupWindow time.Duration
+	// Holddown is how long a member that was throttled or failed is
+	// avoided, DefaultHolddown if zero.
+	Holddown time.Duration
+	// Logger gets a message when members go down. logging.Default is used
+	// if nil.
+	Logger logging.Logger
+}
+
+// member is the state of a member link.
+type member struct {
+	Member
+	ep    stack.LinkEndpoint
+	stats stats.Source
+
+	// tokens are the frames the member can send before reaching its
+	// capacity, refilled at Capacity per second up to Capacity.
+	tokens float64
+	last   time.Time
+	// latency is the slowest smoothed call of the member, and queued the
+	// frames in its queues, as of the last check.
+	latency time.Duration
+	queued  int
+	// faults count throttles, errors and drops of the member, it is down
+	// until downUntil when they grow.
+	faults    uint64
+	downUntil time.Time
+	sent      uint64
+}
+
+// up returns whether m may be used at now.
+func (m *member) up(now time.Time) bool {
+	return !now.Before(m.downUntil)
+}
+
+// delay is when m is expected to send a frame written at now.
+func (m *member) delay(now time.Time) time.Duration {
+	m.refill(now)
+	d := m.latency + time.Duration(float64(m.queued)/m.Capacity*float64(time.Second))
+	if m.tokens < 1 {
+		d += time.Duration((1 - m.tokens) / m.Capacity * float64(time.Second))
+	}
+	return d
+}
+
+func (m *member) refill(now time.Time) {
+	if !m.last.IsZero() && now.After(m.last) {
+		m.tokens += now.Sub(m.last).Seconds() * m.Capacity
+		if m.tokens > m.Capacity {
+			m.tokens = m.Capacity
+		}
+	}
+	m.last = now
+}
+
+// seen is a frame received recently.
+type seen struct {
+	member int
+	at     time.Time
+}
+
+// Bond is a link endpoint writing frames to the best of its members, and
+// delivering the frames they receive once. It keeps the statistics of the
+// frames of the stack, with those of the members merged.
+type Bond struct {
+	dispatcher stack.NetworkDispatcher
+	redundant  bool
+	classifier *qos.Scheduler
+	window     time.Duration
+	holddown   time.Duration
+	logger     logging.Logger
+	counters   stats.Counters
+
+	mu        sync.Mutex
+	members   []*member
+	checked   time.Time
+	seen      map[uint64]seen
+	lastSweep time.Time
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// New creates a bond of the member links of opts, which must be registered.
+func New(opts *Options) (tcpip.LinkEndpointID, *Bond) {
+	eps := make([]stack.LinkEndpoint, len(opts.Members))
+	for i, m := range opts.Members {
+		eps[i] = stack.FindLinkEndpoint(m.Endpoint)
+	}
+	b := newBond(opts, eps)
+	return stack.RegisterLinkEndpoint(b), b
+}
+
+func newBond(opts *Options, eps []stack.LinkEndpoint) *Bond {
+	b := &Bond{
+		redundant: opts.Redundant,
+		// Only classifies frames, which are queued by the members.
+		classifier: qos.New(nil),
+		window:     opts.DedupWindow,
+		holddown:   opts.Holddown,
+		logger:     logging.OrDefault(opts.Logger).With("link", "bond"),
+		seen:       map[uint64]seen{},
+		now:        time.Now,
+	}
+	if b.window == 0 {
+		b.window = DefaultDedupWindow
+	}
+	if b.holddown == 0 {
+		b.holddown = DefaultHolddown
+	}
+	for i, ep := range eps {
+		m := &member{Member: opts.Members[i], ep: ep}
+		if m.Capacity == 0 {
+			m.Capacity = DefaultCapacity
+		}
+		m.tokens = m.Capacity
+		m.stats, _ = ep.(stats.Source)
+		b.members = append(b.members, m)
+	}
+	return b
+}
+
+// Attach implements stack.LinkEndpoint.Attach.
+func (b *Bond) Attach(dispatcher stack.NetworkDispatcher) {
+	b.dispatcher = dispatcher
+	for _, m := range b.members {
+		m.ep.Attach(b)
+	}
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (b *Bond) IsAttached() bool {
+	return b.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It is the largest MTU of the
+// members, larger frames are only written to the members they fit: they
+// don't fail over to members with a smaller MTU, and go to the member with
+// the largest one even while it is down.
+func (b *Bond) MTU() uint32 {
+	var mtu uint32
+	for _, m := range b.members {
+		if n := m.ep.MTU(); n > mtu {
+			mtu = n
+		}
+	}
+	return mtu
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities, those of every
+// member.
+func (b *Bond) Capabilities() stack.LinkEndpointCapabilities {
+	var c stack.LinkEndpointCapabilities
+	for i, m := range b.members {
+		if i == 0 {
+			c = m.ep.Capabilities()
+		} else {
+			c &= m.ep.Capabilities()
+		}
+	}
+	return c
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength.
+func (b *Bond) MaxHeaderLength() uint16 {
+	var n uint16
+	for _, m := range b.members {
+		if h := m.ep.MaxHeaderLength(); h > n {
+			n = h
+		}
+	}
+	return n
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress.
+func (b *Bond) LinkAddress() tcpip.LinkAddress {
+	if len(b.members) == 0 {
+		return ""
+	}
+	return b.members[0].ep.LinkAddress()
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. Frames no member
+// can carry are dropped.
+func (b *Bond) WritePacket(r *stack.Route, gso *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	size := len(hdr.View()) + payload.Size()
+	control := b.redundant && b.classifier.Classify(protocol, packetStart(hdr, payload)) == qos.Control
+	chosen := b.choose(uint32(size), r.RemoteLinkAddress, control)
+	if len(chosen) == 0 {
+		b.counters.Drop(stats.DropNoLink)
+		return nil
+	}
+	// Members prepend their header, copies are made before the first does.
+	hdrs := []buffer.Prependable{hdr}
+	for range chosen[1:] {
+		v := hdr.View()
+		h := buffer.NewPrependable(int(b.MaxHeaderLength()) + len(v))
+		copy(h.Prepend(len(v)), v)
+		hdrs = append(hdrs, h)
+	}
+	var err *tcpip.Error
+	written := false
+	for i, m := range chosen {
+		if e := m.ep.WritePacket(r, gso, hdrs[i], payload, protocol); e != nil {
+			b.fail(m, e.String())
+			err = e
+			continue
+		}
+		written = true
+	}
+	if !written {
+		return err
+	}
+	b.counters.Sent(size)
+	return nil
+}
+
+// packetStart returns enough of the start of a packet to classify it.
+func packetStart(hdr buffer.Prependable, payload buffer.VectorisedView) []byte {
+	b := []byte(hdr.View())
+	if len(b) < qos.HeaderSize && payload.Size() > 0 {
+		b = append(append([]byte{}, b...), payload.First()...)
+	}
+	return b
+}
+
+// choose returns the members to write a frame of size bytes to dst to, all
+// the usable ones for control frames.
+func (b *Bond) choose(size uint32, dst tcpip.LinkAddress, control bool) []*member {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.check(now)
+
+	var usable, down []*member
+	for _, m := range b.members {
+		if m.ep.MTU() < size || (m.Peer != "" && m.Peer != dst) {
+			continue
+		}
+		if m.up(now) {
+			usable = append(usable, m)
+		} else {
+			down = append(down, m)
+		}
+	}
+	if len(usable) == 0 {
+		// Members down are better than none.
+		usable = down
+	}
+	if len(usable) == 0 {
+		return nil
+	}
+	if !control {
+		best := usable[0]
+		for _, m := range usable[1:] {
+			if m.delay(now) < best.delay(now) {
+				best = m
+			}
+		}
+		usable = []*member{best}
+	}
+	for _, m := range usable {
+		m.refill(now)
+		m.tokens--
+		m.sent++
+	}
+	return usable
+}
+
+// check reads the statistics of the members every checkInterval, holding
+// mu. Members whose faults grew are down for the holddown.
+func (b *Bond) check(now time.Time) {
+	if now.Sub(b.checked) < checkInterval {
+		return
+	}
+	first := b.checked.IsZero()
+	b.checked = now
+	for _, m := range b.members {
+		if m.stats == nil {
+			continue
+		}
+		s := m.stats.Stats()
+		m.latency = 0
+		for _, rtt := range s.RTT {
+			if rtt > m.latency {
+				m.latency = rtt
+			}
+		}
+		m.queued = s.Queues["tx"]
+		faults := s.Throttles + s.APIErrors
+		for _, reason := range faultDrops {
+			faults += s.Drops[reason]
+		}
+		if faults > m.faults && !first {
+			m.downUntil = now.Add(b.holddown)
+			b.logger.Warn("link down", "member", m.Name, "faults", faults-m.faults, "holddown", b.holddown)
+		}
+		m.faults = faults
+	}
+}
+
+// fail takes m down after its write failed.
+func (b *Bond) fail(m *member, reason string) {
+	b.mu.Lock()
+	m.downUntil = b.now().Add(b.holddown)
+	b.mu.Unlock()
+	b.logger.Warn("link down", "member", m.Name, "err", reason, "holddown", b.holddown)
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher. Frames received
+// through a member are dropped if another member delivered them within the
+// dedup window, frames received again through the same member are not
+// copies.
+func (b *Bond) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v|%v|%v|", remote, local, protocol)
+	for _, v := range vv.Views() {
+		h.Write(v)
+	}
+	key := h.Sum64()
+
+	b.mu.Lock()
+	from := -1
+	for i, m := range b.members {
+		if m.ep == linkEP {
+			from = i
+		}
+	}
+	now := b.now()
+	if now.Sub(b.lastSweep) > b.window {
+		for k, s := range b.seen {
+			if now.Sub(s.at) > b.window {
+				delete(b.seen, k)
+			}
+		}
+		b.lastSweep = now
+	}
+	if s, ok := b.seen[key]; ok && s.member != from && now.Sub(s.at) <= b.window {
+		b.mu.Unlock()
+		b.counters.Drop(stats.DropDuplicate)
+		return
+	}
+	b.seen[key] = seen{member: from, at: now}
+	b.mu.Unlock()
+
+	b.counters.Received(vv.Size())
+	b.dispatcher.DeliverNetworkPacket(b, remote, local, protocol, vv)
+}
+
+// Status is the state of a member.
+type Status struct {
+	Name string
+	Up   bool
+	// Delay is when the member is expected to send a frame.
+	Delay time.Duration
+	// Sent are the frames written to the member.
+	Sent uint64
+}
+
+func (s Status) String() string {
+	state := "up"
+	if !s.Up {
+		state = "down"
+	}
+	return fmt.Sprintf("%v %v delay %v sent %d", s.Name, state, s.Delay.Round(time.Millisecond), s.Sent)
+}
+
+// Members returns the state of the members.
+func (b *Bond) Members() []Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	var status []Status
+	for _, m := range b.members {
+		status = append(status, Status{Name: m.Name, Up: m.up(now), Delay: m.delay(now), Sent: m.sent})
+	}
+	return status
+}
+
+// Stats implements stats.Source. Packets are those of the stack, and the
+// other counters the sum of the members, their queues and latencies
+// prefixed by the name of the member, i.e. cloudwatch/tx.
+func (b *Bond) Stats() stats.Snapshot {
+	s := b.counters.Snapshot()
+	for _, m := range b.members {
+		if m.stats == nil {
+			continue
+		}
+		ms := m.stats.Stats()
+		s.EncodeErrors += ms.EncodeErrors
+		s.DecodeErrors += ms.DecodeErrors
+		s.APIErrors += ms.APIErrors
+		s.Throttles += ms.Throttles
+		for k, v := range ms.Drops {
+			s.Drops[k] += v
+		}
+		for k, v := range ms.Calls {
+			s.Calls[k] += v
+		}
+		for k, v := range ms.RTT {
+			s.RTT[k] = v
+		}
+		for k, v := range ms.Latency {
+			s.Latency[m.Name+"/"+k] = v
+		}
+		for k, v := range ms.Queues {
+			s.Queues[m.Name+"/"+k] = v
+		}
+	}
+	return s
+}
+
+func (b *Bond) String() string {
+	var members []string
+	for _, s := range b.Members() {
+		members = append(members, s.String())
+	}
+	return strings.Join(members, ", ")
+}
@@ -0,0 +1,200 @@
+package bond
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/stats"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+const (
+	localMAC tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x01"
+	peerMAC  tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x02"
+	otherMAC tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x03"
+)
+
+// fakeEndpoint counts written frames and keeps statistics.
+type fakeEndpoint struct {
+	mtu        uint32
+	dispatcher stack.NetworkDispatcher
+	written    int
+	stats      stats.Counters
+}
+
+func (e *fakeEndpoint) MTU() uint32                                  { return e.mtu }
+func (e *fakeEndpoint) Capabilities() stack.LinkEndpointCapabilities { return 0 }
+func (e *fakeEndpoint) MaxHeaderLength() uint16                      { return header.EthernetMinimumSize }
+func (e *fakeEndpoint) LinkAddress() tcpip.LinkAddress               { return localMAC }
+func (e *fakeEndpoint) Attach(dispatcher stack.NetworkDispatcher)    { e.dispatcher = dispatcher }
+func (e *fakeEndpoint) IsAttached() bool                             { return e.dispatcher != nil }
+func (e *fakeEndpoint) Stats() stats.Snapshot                        { return e.stats.Snapshot() }
+func (e *fakeEndpoint) WritePacket(r *stack.Route, _ *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	// Prepend a header like transports do, copies must not share it.
+	hdr.Prepend(header.EthernetMinimumSize)
+	e.written++
+	return nil
+}
+
+func (e *fakeEndpoint) take() int {
+	n := e.written
+	e.written = 0
+	return n
+}
+
+// delivered counts the frames delivered to the stack.
+type delivered int
+
+func (d *delivered) DeliverNetworkPacket(stack.LinkEndpoint, tcpip.LinkAddress, tcpip.LinkAddress, tcpip.NetworkProtocolNumber, buffer.VectorisedView) {
+	*d++
+}
+
+// newTestBond returns an attached bond of cloudwatch and tag, on a fake
+// clock.
+func newTestBond(opts *Options) (*Bond, *fakeEndpoint, *fakeEndpoint, *time.Time, *delivered) {
+	cw := &fakeEndpoint{mtu: 1024}
+	tag := &fakeEndpoint{mtu: 175}
+	opts.Members = []Member{{Name: "cloudwatch", Capacity: 5}, {Name: "tag", Peer: peerMAC, Capacity: 2}}
+	opts.Logger = logging.Discard
+	b := newBond(opts, []stack.LinkEndpoint{cw, tag})
+	now := time.Unix(1546300800, 0)
+	b.now = func() time.Time { return now }
+	d := new(delivered)
+	b.Attach(d)
+	return b, cw, tag, &now, d
+}
+
+// write writes an IPv4 packet of size bytes to dst.
+func write(b *Bond, dst tcpip.LinkAddress, size int, flags uint8) {
+	hdr := buffer.NewPrependable(header.EthernetMinimumSize + header.IPv4MinimumSize + header.TCPMinimumSize)
+	tcp := header.TCP(hdr.Prepend(header.TCPMinimumSize))
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	header.IPv4(hdr.Prepend(header.IPv4MinimumSize)).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(size),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+	})
+	payload := buffer.NewView(size - header.IPv4MinimumSize - header.TCPMinimumSize).ToVectorisedView()
+	b.WritePacket(&stack.Route{RemoteLinkAddress: dst}, nil, hdr, payload, header.IPv4ProtocolNumber)
+}
+
+func TestBond_Schedule(t *testing.T) {
+	b, cw, tag, now, _ := newTestBond(&Options{})
+	if b.MTU() != 1024 {
+		t.Errorf("Expected the MTU of the largest member, got %d", b.MTU())
+	}
+	cw.stats.SetQueue("tx", func() int { return 0 })
+
+	// Frames are shared by capacity when latencies are equal.
+	for i := 0; i < 14; i++ {
+		write(b, peerMAC, 100, header.TCPFlagAck)
+	}
+	if n, m := cw.take(), tag.take(); n != 10 || m != 4 {
+		t.Errorf("Expected 10 frames on cloudwatch and 4 on tag, got %d and %d", n, m)
+	}
+
+	// Frames too large for tags and to other peers only go to cloudwatch.
+	*now = now.Add(time.Minute)
+	write(b, peerMAC, 500, header.TCPFlagAck)
+	write(b, otherMAC, 100, header.TCPFlagAck)
+	write(b, otherMAC, 100, header.TCPFlagAck)
+	write(b, otherMAC, 100, header.TCPFlagAck)
+	if n, m := cw.take(), tag.take(); n != 4 || m != 0 {
+		t.Errorf("Expected every frame on cloudwatch, got %d and %d on tag", n, m)
+	}
+	write(b, peerMAC, 2000, header.TCPFlagAck)
+	if n, m := cw.take(), tag.take(); n+m != 0 || b.Stats().Drops[stats.DropNoLink] != 1 {
+		t.Errorf("Expected a frame larger than every MTU to be dropped")
+	}
+}
+
+func TestBond_Failover(t *testing.T) {
+	b, cw, tag, now, _ := newTestBond(&Options{Holddown: 10 * time.Second})
+	write(b, peerMAC, 100, header.TCPFlagAck)
+	cw.take()
+	tag.take()
+
+	// Cloudwatch is throttled, frames go through tags until the holddown.
+	cw.stats.Drop(stats.DropQueueFull)
+	*now = now.Add(2 * time.Second)
+	for i := 0; i < 3; i++ {
+		write(b, peerMAC, 100, header.TCPFlagAck)
+	}
+	if n, m := cw.take(), tag.take(); n != 0 || m != 3 {
+		t.Errorf("Expected frames to fail over to tags, got %d on cloudwatch and %d on tag", n, m)
+	}
+	// Frames tags can't carry still go to cloudwatch.
+	write(b, otherMAC, 100, header.TCPFlagAck)
+	if cw.take() != 1 {
+		t.Errorf("Expected a member down to be used rather than none")
+	}
+	*now = now.Add(11 * time.Second)
+	write(b, peerMAC, 100, header.TCPFlagAck)
+	if cw.take() != 1 {
+		t.Errorf("Expected cloudwatch to be used again after the holddown")
+	}
+}
+
+func TestBond_FailoverBulk(t *testing.T) {
+	b, cw, tag, now, _ := newTestBond(&Options{Holddown: 10 * time.Second})
+	write(b, peerMAC, 100, header.TCPFlagAck)
+	cw.take()
+	tag.take()
+
+	// While cloudwatch is down, bulk frames that fit tags fail over, those
+	// of the bond's MTU still go to cloudwatch.
+	cw.stats.Drop(stats.DropQueueFull)
+	*now = now.Add(2 * time.Second)
+	write(b, peerMAC, 150, header.TCPFlagAck)
+	if n, m := cw.take(), tag.take(); n != 0 || m != 1 {
+		t.Errorf("Expected a frame that fits tags to fail over, got %d on cloudwatch and %d on tag", n, m)
+	}
+	write(b, peerMAC, int(b.MTU()), header.TCPFlagAck)
+	if n, m := cw.take(), tag.take(); n != 1 || m != 0 {
+		t.Errorf("Expected a frame of the MTU to go to cloudwatch, got %d on cloudwatch and %d on tag", n, m)
+	}
+	if b.Stats().Drops[stats.DropNoLink] != 0 {
+		t.Errorf("Expected no frames to be dropped")
+	}
+}
+
+func TestBond_Redundant(t *testing.T) {
+	b, cw, tag, _, _ := newTestBond(&Options{Redundant: true})
+	write(b, peerMAC, 60, header.TCPFlagSyn)
+	if n, m := cw.take(), tag.take(); n != 1 || m != 1 {
+		t.Errorf("Expected a SYN on every member, got %d and %d", n, m)
+	}
+	write(b, peerMAC, 60, header.TCPFlagAck)
+	if n, m := cw.take(), tag.take(); n+m != 1 {
+		t.Errorf("Expected an ACK on one member, got %d and %d", n, m)
+	}
+	if s := b.Stats(); s.TxPackets != 2 {
+		t.Errorf("Expected the frames of the stack to be counted once, got %d", s.TxPackets)
+	}
+}
+
+func TestBond_Dedup(t *testing.T) {
+	b, cw, tag, now, d := newTestBond(&Options{DedupWindow: 5 * time.Second})
+	frame := buffer.NewViewFromBytes([]byte("a frame")).ToVectorisedView()
+	cw.dispatcher.DeliverNetworkPacket(cw, peerMAC, localMAC, header.IPv4ProtocolNumber, frame)
+	tag.dispatcher.DeliverNetworkPacket(tag, peerMAC, localMAC, header.IPv4ProtocolNumber, frame)
+	if *d != 1 || b.Stats().Drops[stats.DropDuplicate] != 1 {
+		t.Errorf("Expected the copy through tags to be dropped, delivered %d", *d)
+	}
+	// Frames sent again through the same member are not copies.
+	cw.dispatcher.DeliverNetworkPacket(cw, peerMAC, localMAC, header.IPv4ProtocolNumber, frame)
+	if *d != 2 {
+		t.Errorf("Expected a frame received again through cloudwatch to be delivered")
+	}
+	*now = now.Add(6 * time.Second)
+	tag.dispatcher.DeliverNetworkPacket(tag, peerMAC, localMAC, header.IPv4ProtocolNumber, frame)
+	if *d != 3 {
+		t.Errorf("Expected frames to be forgotten after the window")
+	}
+}
@@ -0,0 +1,366 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// portLocal is the port of the stack attached to a Bridge.
+const portLocal Port = "local"
+
+// echoWindow is how long a frame written to a Listener port may take to
+// come back through it, longer than Cloudwatch takes to return a frame.
+const echoWindow = 30 * time.Second
+
+// Listener is implemented by endpoints that only receive frames for the
+// addresses they listen on, like Cloudwatch endpoints. A bridge makes them
+// listen on the addresses it learns on its other ports.
+type Listener interface {
+	Listen(addr tcpip.LinkAddress) error
+}
+
+// PortOptions configure a port of a Bridge.
+type PortOptions struct {
+	Name Port
+	// Endpoint must deliver frames with their link addresses, and send
+	// frames from the route's LocalLinkAddress.
+	Endpoint tcpip.LinkEndpointID
+}
+
+// BridgeOptions configure a Bridge.
+type BridgeOptions struct {
+	Ports []PortOptions
+	// Address is the link address of the bridge itself, for a stack
+	// attached to it. Frames are only delivered to a stack for this address
+	// and group addresses.
+	Address tcpip.LinkAddress
+	// Ageing is DefaultAgeing if zero.
+	Ageing time.Duration
+	// HoldDown is DefaultHoldDown if zero.
+	HoldDown time.Duration
+	// Logger gets the messages of the bridge, logging.Default if nil.
+	Logger logging.Logger
+}
+
+// PortStats are the counters of a bridge port.
+type PortStats struct {
+	Port     Port
+	RxFrames uint64
+	TxFrames uint64
+	// TooBig counts frames larger than the MTU of the port, dropped.
+	TooBig uint64
+	// Looped counts received frames dropped to avoid a loop.
+	Looped uint64
+}
+
+func (s PortStats) String() string {
+	return fmt.Sprintf("%v rx %d tx %d too big %d looped %d", s.Port, s.RxFrames, s.TxFrames, s.TooBig, s.Looped)
+}
+
+type port struct {
+	name  Port
+	ep    stack.LinkEndpoint
+	stats PortStats
+
+	// sent are the sources of the frames last written to a Listener port
+	// and when, nil on other ports.
+	mu   sync.Mutex
+	sent map[tcpip.LinkAddress]time.Time
+}
+
+// Bridge is a learning bridge between any number of link endpoints, such as
+// a tap device, tag links and Cloudwatch networks. It is also an endpoint, a
+// stack attached to it is reached like a host on another port.
+type Bridge struct {
+	addr       tcpip.LinkAddress
+	ports      []*port
+	local      *port
+	fdb        *Table
+	dispatcher stack.NetworkDispatcher
+	start      sync.Once
+	logger     logging.Logger
+}
+
+// NewBridge creates a bridge between registered endpoints.
+func NewBridge(opts *BridgeOptions) (*Bridge, error) {
+	eps := make([]stack.LinkEndpoint, len(opts.Ports))
+	for i, p := range opts.Ports {
+		if eps[i] = stack.FindLinkEndpoint(p.Endpoint); eps[i] == nil {
+			return nil, fmt.Errorf("NewBridge: unknown link endpoint for port %v", p.Name)
+		}
+	}
+	return newBridge(opts, eps)
+}
+
+func newBridge(opts *BridgeOptions, eps []stack.LinkEndpoint) (*Bridge, error) {
+	if len(opts.Ports) < 2 && opts.Address == "" {
+		return nil, fmt.Errorf("NewBridge: a bridge needs at least two ports")
+	}
+	b := &Bridge{
+		addr:   opts.Address,
+		local:  &port{name: portLocal, stats: PortStats{Port: portLocal}},
+		fdb:    NewTable(&TableOptions{Ageing: opts.Ageing, HoldDown: opts.HoldDown}),
+		logger: logging.OrDefault(opts.Logger),
+	}
+	names := map[Port]bool{portLocal: true}
+	for i, p := range opts.Ports {
+		if names[p.Name] {
+			return nil, fmt.Errorf("NewBridge: duplicate port name %q", p.Name)
+		}
+		names[p.Name] = true
+		bp := &port{name: p.Name, ep: eps[i], stats: PortStats{Port: p.Name}}
+		if _, ok := eps[i].(Listener); ok {
+			bp.sent = map[tcpip.LinkAddress]time.Time{}
+		}
+		b.ports = append(b.ports, bp)
+	}
+	if b.addr != "" {
+		b.fdb.AddStatic(b.addr, portLocal)
+	}
+	return b, nil
+}
+
+// Start attaches the bridge to its ports. It is called by Attach when a
+// stack uses the bridge.
+func (b *Bridge) Start() {
+	b.start.Do(func() {
+		for _, p := range b.ports {
+			p.ep.Attach(&bridgePort{b, p})
+		}
+	})
+}
+
+// MACTable returns the bridge's forwarding table.
+func (b *Bridge) MACTable() *Table {
+	return b.fdb
+}
+
+// Stats returns the counters of every port, the local stack's last.
+func (b *Bridge) Stats() []PortStats {
+	ports := make([]*port, 0, len(b.ports)+1)
+	ports = append(append(ports, b.ports...), b.local)
+	var stats []PortStats
+	for _, p := range ports {
+		stats = append(stats, PortStats{
+			Port:     p.name,
+			RxFrames: atomic.LoadUint64(&p.stats.RxFrames),
+			TxFrames: atomic.LoadUint64(&p.stats.TxFrames),
+			TooBig:   atomic.LoadUint64(&p.stats.TooBig),
+			Looped:   atomic.LoadUint64(&p.stats.Looped),
+		})
+	}
+	return stats
+}
+
+// bridgePort is the dispatcher of one of the bridge's endpoints.
+type bridgePort struct {
+	b    *Bridge
+	port *port
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (d *bridgePort) DeliverNetworkPacket(_ stack.LinkEndpoint, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	b, p := d.b, d.port
+	atomic.AddUint64(&p.stats.RxFrames, 1)
+	if !b.learn(p, src) {
+		atomic.AddUint64(&p.stats.Looped, 1)
+		return
+	}
+	b.forward(p, src, dst, protocol, vv)
+}
+
+// learn records that src lives behind p, it returns false if the frame must
+// be dropped to avoid a loop. Transports like Cloudwatch return the frames
+// the bridge sent through them on behalf of other ports, those echoes are
+// dropped. The table moves hosts seen on another port after the hold-down.
+func (b *Bridge) learn(p *port, src tcpip.LinkAddress) bool {
+	if src == "" {
+		return true
+	}
+	if p.echo(src, b.fdb.now()) {
+		return false
+	}
+	known, ok := b.fdb.Lookup(src)
+	if !b.fdb.Learn(src, p.name) {
+		return false
+	}
+	if ok && known == p.name {
+		return true
+	}
+	// Ports that only read frames for the addresses they listen on must
+	// listen for new and moved hosts.
+	for _, other := range b.ports {
+		if l, ok := other.ep.(Listener); ok && other != p {
+			if err := l.Listen(src); err != nil {
+				b.logger.Warn("could not listen for host", "port", other.name, "peer", src, "err", err)
+			}
+		}
+	}
+	return true
+}
+
+// egress returns the ports a frame that arrived on ingress is forwarded to.
+// Group addresses and unknown unicast are flooded to every other port, but
+// unknown unicast isn't delivered to the local stack, whose address is
+// always known.
+func (b *Bridge) egress(ingress *port, dst tcpip.LinkAddress) []*port {
+	if name, ok := b.fdb.Lookup(dst); ok && !IsGroup(dst) {
+		if name == ingress.name {
+			return nil
+		}
+		if name == portLocal {
+			return []*port{b.local}
+		}
+		for _, p := range b.ports {
+			if p.name == name {
+				return []*port{p}
+			}
+		}
+	}
+	var ports []*port
+	for _, p := range b.ports {
+		if p != ingress {
+			ports = append(ports, p)
+		}
+	}
+	if ingress != b.local && IsGroup(dst) && b.dispatcher != nil {
+		ports = append(ports, b.local)
+	}
+	return ports
+}
+
+// forward sends a frame, without its link header, to the ports of dst.
+func (b *Bridge) forward(ingress *port, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	local := false
+	for _, p := range b.egress(ingress, dst) {
+		if p == b.local {
+			// Delivered last, the stack may consume the payload.
+			local = b.dispatcher != nil
+			continue
+		}
+		b.write(p, src, dst, protocol, vv)
+	}
+	if local {
+		atomic.AddUint64(&b.local.stats.TxFrames, 1)
+		b.dispatcher.DeliverNetworkPacket(b, src, dst, protocol, vv)
+	}
+}
+
+// write sends a frame out of p, if it fits its MTU.
+func (b *Bridge) write(p *port, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	if mtu := p.ep.MTU(); mtu > 0 && vv.Size() > int(mtu) {
+		atomic.AddUint64(&p.stats.TooBig, 1)
+		return
+	}
+	// Each port prepends its own link header to a copy of the first view.
+	payload := vv
+	first := payload.First()
+	hdr := buffer.NewPrependable(int(p.ep.MaxHeaderLength()) + len(first))
+	copy(hdr.Prepend(len(first)), first)
+	payload.RemoveFirst()
+
+	r := &stack.Route{
+		NetProto:          protocol,
+		LocalLinkAddress:  src,
+		RemoteLinkAddress: dst,
+	}
+	if err := p.ep.WritePacket(r, nil, hdr, payload, protocol); err != nil {
+		b.logger.Warn("could not write frame", "port", p.name, "peer", dst, "err", err)
+		return
+	}
+	atomic.AddUint64(&p.stats.TxFrames, 1)
+	p.wrote(src, b.fdb.now())
+}
+
+// wrote records that a frame from src was written to p at now.
+func (p *port) wrote(src tcpip.LinkAddress, now time.Time) {
+	if p.sent == nil || src == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.sent) >= maxEntries {
+		for mac, at := range p.sent {
+			if now.Sub(at) > echoWindow {
+				delete(p.sent, mac)
+			}
+		}
+	}
+	if _, ok := p.sent[src]; ok || len(p.sent) < maxEntries {
+		p.sent[src] = now
+	}
+}
+
+// echo reports whether a frame from src received on p is one the bridge
+// wrote to p itself.
+func (p *port) echo(src tcpip.LinkAddress, now time.Time) bool {
+	if p.sent == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at, ok := p.sent[src]
+	return ok && now.Sub(at) <= echoWindow
+}
+
+// Attach implements stack.LinkEndpoint.Attach, it starts the bridge.
+func (b *Bridge) Attach(dispatcher stack.NetworkDispatcher) {
+	b.dispatcher = dispatcher
+	b.Start()
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (b *Bridge) IsAttached() bool {
+	return b.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU, the smallest MTU of the ports, so
+// that packets of the attached stack fit every port.
+func (b *Bridge) MTU() uint32 {
+	var mtu uint32
+	for _, p := range b.ports {
+		if m := p.ep.MTU(); mtu == 0 || (m > 0 && m < mtu) {
+			mtu = m
+		}
+	}
+	return mtu
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (b *Bridge) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength, the largest
+// link header of the ports.
+func (b *Bridge) MaxHeaderLength() uint16 {
+	var n uint16
+	for _, p := range b.ports {
+		if h := p.ep.MaxHeaderLength(); h > n {
+			n = h
+		}
+	}
+	return n
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress.
+func (b *Bridge) LinkAddress() tcpip.LinkAddress {
+	return b.addr
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. Packets from the
+// attached stack are forwarded like frames from any other port.
+func (b *Bridge) WritePacket(r *stack.Route, _ *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	atomic.AddUint64(&b.local.stats.RxFrames, 1)
+	views := append([]buffer.View{hdr.View()}, payload.Views()...)
+	vv := buffer.NewVectorisedView(len(views[0])+payload.Size(), views)
+	b.forward(b.local, b.addr, r.RemoteLinkAddress, protocol, vv)
+	return nil
+}
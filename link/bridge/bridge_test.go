@@ -0,0 +1,155 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// listenerEndpoint records the addresses it is asked to listen on.
+type listenerEndpoint struct {
+	fakeEndpoint
+	listening []tcpip.LinkAddress
+}
+
+func (e *listenerEndpoint) Listen(addr tcpip.LinkAddress) error {
+	e.listening = append(e.listening, addr)
+	return nil
+}
+
+// recorder is a stack attached to a bridge.
+type recorder struct {
+	frames []frame
+}
+
+func (r *recorder) DeliverNetworkPacket(_ stack.LinkEndpoint, _, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	r.frames = append(r.frames, frame{dst, protocol, vv.ToView()})
+}
+
+func send(e *fakeEndpoint, src, dst tcpip.LinkAddress, size int) {
+	e.dispatcher.DeliverNetworkPacket(e, src, dst, header.IPv4ProtocolNumber, buffer.NewView(size).ToVectorisedView())
+}
+
+func TestBridge(t *testing.T) {
+	const (
+		bridgeMAC tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x01"
+		hostA     tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x0a"
+		hostB     tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x0b"
+	)
+	tap := &fakeEndpoint{mtu: 1500}
+	tag := &fakeEndpoint{mtu: 175}
+	cw := &listenerEndpoint{fakeEndpoint: fakeEndpoint{mtu: 1024}}
+	b, err := newBridge(&BridgeOptions{
+		Ports:   []PortOptions{{Name: "tap"}, {Name: "tag"}, {Name: "cloudwatch"}},
+		Address: bridgeMAC,
+	}, []stack.LinkEndpoint{tap, tag, cw})
+	if err != nil {
+		t.Fatalf("newBridge: unexpected error: %v", err)
+	}
+	local := &recorder{}
+	b.Attach(local)
+
+	// Unknown destinations are flooded, but not to the stack.
+	send(tap, hostA, hostB, 100)
+	if len(tag.take()) != 1 || len(cw.take()) != 1 || len(local.frames) != 0 {
+		t.Fatalf("Expected the frame to be flooded to tag and cloudwatch")
+	}
+	if len(cw.listening) != 1 || cw.listening[0] != hostA {
+		t.Errorf("Expected cloudwatch to listen for %v, got %v", hostA, cw.listening)
+	}
+
+	// Learned destinations only go to their port.
+	send(tag, hostB, hostA, 100)
+	if frames := tap.take(); len(frames) != 1 || frames[0].dst != hostA || len(cw.take()) != 0 {
+		t.Errorf("Expected the reply only on tap, got %v", frames)
+	}
+
+	// Frames too big for a port are dropped there.
+	send(&cw.fakeEndpoint, "\x42\x00\x00\x00\x00\x0c", hostB, 500)
+	if len(tag.take()) != 0 {
+		t.Errorf("Expected the frame to be too big for tag")
+	}
+
+	// Echoes of hosts on other ports are dropped.
+	send(&cw.fakeEndpoint, hostA, broadcast, 100)
+	if len(tap.take()) != 0 || len(tag.take()) != 0 {
+		t.Errorf("Expected the echo to be dropped")
+	}
+
+	// Broadcasts reach the stack, and its frames are forwarded.
+	send(tap, hostA, broadcast, 100)
+	if len(local.frames) != 1 || len(tag.take()) != 1 || len(cw.take()) != 1 {
+		t.Errorf("Expected the broadcast to be delivered everywhere")
+	}
+	hdr := buffer.NewPrependable(int(b.MaxHeaderLength()) + 20)
+	hdr.Prepend(20)
+	b.WritePacket(&stack.Route{RemoteLinkAddress: hostB}, nil, hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber)
+	if frames := tag.take(); len(frames) != 1 || len(frames[0].data) != 20 {
+		t.Errorf("Expected the stack's frame on tag, got %v", frames)
+	}
+
+	if mtu := b.MTU(); mtu != 175 {
+		t.Errorf("Expected the smallest MTU of the ports, got %d", mtu)
+	}
+	stats := b.Stats()
+	if len(stats) != 4 || stats[1].TooBig != 1 || stats[2].Looped != 1 || stats[3].RxFrames != 1 {
+		t.Errorf("Unexpected stats: %v", stats)
+	}
+}
+
+func TestBridge_Move(t *testing.T) {
+	const (
+		hostA tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x0a"
+		hostB tcpip.LinkAddress = "\x42\x00\x00\x00\x00\x0b"
+	)
+	tap := &fakeEndpoint{mtu: 1500}
+	tag := &fakeEndpoint{mtu: 175}
+	cw := &listenerEndpoint{fakeEndpoint: fakeEndpoint{mtu: 1024}}
+	b, err := newBridge(&BridgeOptions{
+		Ports:    []PortOptions{{Name: "tap"}, {Name: "tag"}, {Name: "cloudwatch"}},
+		HoldDown: 2 * time.Second,
+	}, []stack.LinkEndpoint{tap, tag, cw})
+	if err != nil {
+		t.Fatalf("newBridge: unexpected error: %v", err)
+	}
+	now := time.Unix(1546300800, 0)
+	b.fdb.now = func() time.Time { return now }
+	b.Start()
+
+	send(tap, hostA, broadcast, 100)
+	send(tag, hostB, hostA, 100)
+	tap.take()
+	tag.take()
+	cw.take()
+
+	// Cloudwatch returns the broadcast of hostA after the hold-down, it
+	// stays on tap.
+	now = now.Add(5 * time.Second)
+	send(&cw.fakeEndpoint, hostA, broadcast, 100)
+	if len(tap.take()) != 0 || len(tag.take()) != 0 {
+		t.Errorf("Expected the echo to be dropped")
+	}
+
+	// hostB shows up on tap: too soon it is flapping, after the hold-down
+	// it moved.
+	send(tag, hostB, hostA, 100)
+	tap.take()
+	now = now.Add(time.Second)
+	send(tap, hostB, hostA, 100)
+	if p, _ := b.fdb.Lookup(hostB); p != "tag" {
+		t.Errorf("Expected hostB to stay on tag within the hold-down, got %v", p)
+	}
+	now = now.Add(5 * time.Second)
+	send(tap, hostB, broadcast, 100)
+	send(&cw.fakeEndpoint, "\x42\x00\x00\x00\x00\x0c", hostB, 100)
+	if frames := tap.take(); len(frames) != 1 || frames[0].dst != hostB || len(tag.take()) != 1 {
+		t.Errorf("Expected frames to hostB on tap after it moved, got %v", frames)
+	}
+	if e := b.fdb.Entries(); len(e) != 3 || e[1].MAC != hostB || e[1].Moves != 1 || e[1].Flaps != 1 {
+		t.Errorf("Expected hostB to have moved once, got %v", e)
+	}
+}
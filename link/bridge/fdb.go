@@ -0,0 +1,200 @@
+// Package bridge forwards frames between link endpoints like an ethernet
+// switch.
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	// DefaultAgeing is how long a learned address is remembered without
+	// seeing frames from it.
+	DefaultAgeing = 5 * time.Minute
+	// DefaultHoldDown is how long an address stays on a port before it can
+	// move to another one. Addresses that move faster are flapping, which
+	// happens when frames loop, and their frames are dropped.
+	DefaultHoldDown = 2 * time.Second
+
+	maxEntries = 4096
+)
+
+// Port names a side of a bridge.
+type Port string
+
+// Entry is an address in the forwarding table.
+type Entry struct {
+	MAC  tcpip.LinkAddress
+	Port Port
+	// Static entries are the bridge's own addresses, they never age or move.
+	Static   bool
+	LastSeen time.Time
+	// Moves counts how often the address moved to another port.
+	Moves uint64
+	// Flaps counts frames dropped because the address moved too quickly.
+	Flaps uint64
+}
+
+func (e Entry) String() string {
+	if e.Static {
+		return fmt.Sprintf("%v %v static", e.MAC, e.Port)
+	}
+	return fmt.Sprintf("%v %v seen %v moves %d flaps %d", e.MAC, e.Port, e.LastSeen.Format(time.RFC3339), e.Moves, e.Flaps)
+}
+
+// TableOptions configure a Table.
+type TableOptions struct {
+	// Ageing is DefaultAgeing if zero.
+	Ageing time.Duration
+	// HoldDown is DefaultHoldDown if zero.
+	HoldDown time.Duration
+}
+
+// Table is a forwarding database that learns on which port each address
+// lives from the source of received frames.
+type Table struct {
+	ageing   time.Duration
+	holdDown time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	entries   map[tcpip.LinkAddress]*Entry
+	lastSweep time.Time
+}
+
+// NewTable creates an empty forwarding table.
+func NewTable(opts *TableOptions) *Table {
+	t := &Table{
+		ageing:   opts.Ageing,
+		holdDown: opts.HoldDown,
+		now:      time.Now,
+		entries:  map[tcpip.LinkAddress]*Entry{},
+	}
+	if t.ageing == 0 {
+		t.ageing = DefaultAgeing
+	}
+	if t.holdDown == 0 {
+		t.holdDown = DefaultHoldDown
+	}
+	return t
+}
+
+// IsGroup reports whether mac is a broadcast or multicast address.
+func IsGroup(mac tcpip.LinkAddress) bool {
+	return len(mac) > 0 && mac[0]&1 != 0
+}
+
+// AddStatic adds one of the bridge's own addresses.
+func (t *Table) AddStatic(mac tcpip.LinkAddress, port Port) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[mac] = &Entry{MAC: mac, Port: port, Static: true, LastSeen: t.now()}
+}
+
+// Learn records that a frame from mac arrived on port. It returns false if
+// the frame should be dropped to avoid a loop: the source is one of the
+// bridge's own addresses seen on another port, a group address, or an
+// address that is flapping between ports.
+func (t *Table) Learn(mac tcpip.LinkAddress, port Port) bool {
+	if mac == "" {
+		return true
+	}
+	if IsGroup(mac) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if now.Sub(t.lastSweep) > t.ageing/2 || len(t.entries) >= maxEntries {
+		t.sweep(now)
+	}
+
+	e, ok := t.entries[mac]
+	switch {
+	case ok && e.Static:
+		return e.Port == port
+	case ok && t.expired(e, now):
+		ok = false
+	case ok && e.Port != port:
+		if now.Sub(e.LastSeen) < t.holdDown {
+			e.Flaps++
+			return false
+		}
+		e.Port = port
+		e.Moves++
+	}
+	if !ok {
+		if len(t.entries) >= maxEntries {
+			// Keep forwarding, unknown addresses are flooded.
+			return true
+		}
+		e = &Entry{MAC: mac, Port: port}
+		t.entries[mac] = e
+	}
+	e.LastSeen = now
+	return true
+}
+
+// Lookup returns the port of mac, if it was learned and hasn't aged out.
+func (t *Table) Lookup(mac tcpip.LinkAddress) (Port, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[mac]
+	if !ok || t.expired(e, t.now()) {
+		return "", false
+	}
+	return e.Port, true
+}
+
+// Entries returns the current table, sorted by address.
+func (t *Table) Entries() []Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	entries := make([]Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		if !t.expired(e, now) {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].MAC < entries[j].MAC })
+	return entries
+}
+
+// Flush forgets learned addresses, keeping static ones.
+func (t *Table) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for mac, e := range t.entries {
+		if !e.Static {
+			delete(t.entries, mac)
+		}
+	}
+}
+
+func (t *Table) String() string {
+	var lines []string
+	for _, e := range t.Entries() {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t *Table) expired(e *Entry, now time.Time) bool {
+	return !e.Static && now.Sub(e.LastSeen) > t.ageing
+}
+
+// sweep forgets aged out addresses, called with t.mu held.
+func (t *Table) sweep(now time.Time) {
+	for mac, e := range t.entries {
+		if t.expired(e, now) {
+			delete(t.entries, mac)
+		}
+	}
+	t.lastSweep = now
+}
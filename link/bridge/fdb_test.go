@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	local tcpip.LinkAddress = "\x42\x42\x42\x42\x42\x42"
+	host  tcpip.LinkAddress = "\x74\x74\x74\x74\x74\x74"
+	bcast tcpip.LinkAddress = "\xff\xff\xff\xff\xff\xff"
+)
+
+func TestTable_Learn(t *testing.T) {
+	now := time.Now()
+	tbl := NewTable(&TableOptions{Ageing: time.Minute, HoldDown: time.Second})
+	tbl.now = func() time.Time { return now }
+	tbl.AddStatic(local, "local")
+
+	tables := []struct {
+		after time.Duration
+		mac   tcpip.LinkAddress
+		port  Port
+		ok    bool
+	}{
+		{0, host, "tap", true},
+		{0, bcast, "tap", false},               // group source
+		{0, local, "cloud", false},             // own address looped back
+		{0, host, "cloud", false},              // flapping
+		{2 * time.Second, host, "cloud", true}, // moved after hold-down
+	}
+	for i, table := range tables {
+		now = now.Add(table.after)
+		if ok := tbl.Learn(table.mac, table.port); ok != table.ok {
+			t.Errorf("[%d] Learn(%v, %v): expected %v, got %v", i, table.mac, table.port, table.ok, ok)
+		}
+	}
+
+	if port, ok := tbl.Lookup(host); !ok || port != "cloud" {
+		t.Errorf("Lookup: expected cloud, got %v (%v)", port, ok)
+	}
+	entries := tbl.Entries()
+	if len(entries) != 2 || entries[1].Moves != 1 || entries[1].Flaps != 1 {
+		t.Errorf("Entries: unexpected table %v", entries)
+	}
+
+	// Learned addresses age out, static ones don't.
+	now = now.Add(2 * time.Minute)
+	if _, ok := tbl.Lookup(host); ok {
+		t.Errorf("Lookup: expected %v to age out", host)
+	}
+	if port, ok := tbl.Lookup(local); !ok || port != "local" {
+		t.Errorf("Lookup: expected static entry, got %v (%v)", port, ok)
+	}
+}
@@ -0,0 +1,586 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+const (
+	// DefaultARPTimeout is how long the gateway waits for an ARP reply before
+	// asking again. Replies over AWS transports take seconds.
+	DefaultARPTimeout = 5 * time.Second
+	// DefaultARPRetries is how often the gateway asks before giving up.
+	DefaultARPRetries = 3
+	// neighborTimeout is how long resolved addresses are remembered.
+	neighborTimeout = 10 * time.Minute
+	// maxPending is the number of packets queued per unresolved address.
+	maxPending = 16
+	defaultTTL = 64
+)
+
+// ICMP types and codes sent by the gateway.
+const (
+	icmpEchoReply       = 0
+	icmpUnreachable     = 3
+	icmpEcho            = 8
+	icmpTimeExceeded    = 11
+	icmpParamProblem    = 12
+	codeNetUnreachable  = 0
+	codeHostUnreachable = 1
+	codeFragNeeded      = 4
+)
+
+// GatewayOptions configure a Gateway.
+type GatewayOptions struct {
+	// Tun is the endpoint of a tun device, carrying IP packets without link
+	// headers.
+	Tun tcpip.LinkEndpointID
+	// Overlay is the overlay endpoint, with ethernet link addresses.
+	Overlay tcpip.LinkEndpointID
+	// Address is the gateway's address on the overlay.
+	Address net.IP
+	// Network is the overlay network, its addresses are resolved with ARP.
+	Network *net.IPNet
+	// Routes are the networks behind the tun device. The gateway answers ARP
+	// requests for them on the overlay, so that members reach them without a
+	// route. When empty, every address outside Network is behind the tun.
+	Routes []*net.IPNet
+	// ARPTimeout is DefaultARPTimeout if zero.
+	ARPTimeout time.Duration
+	// ARPRetries is DefaultARPRetries if zero.
+	ARPRetries int
+	// Masquerade rewrites the source of packets from the tun side to the
+	// gateway's address, so that overlay hosts need no route back.
+	Masquerade bool
+	// PortForwards publish overlay services on the tun side.
+	PortForwards []PortForward
+	// Logger gets the messages of the gateway, logging.Default if nil.
+	Logger logging.Logger
+}
+
+// GatewayStats are the counters of a Gateway.
+type GatewayStats struct {
+	Forwarded   uint64
+	TTLExceeded uint64
+	Unreachable uint64
+	TooBig      uint64
+	ARPRequests uint64
+	ARPReplies  uint64
+	Translated  uint64
+	Dropped     uint64
+}
+
+// Neighbor is a resolved overlay address.
+type Neighbor struct {
+	IP       net.IP
+	MAC      tcpip.LinkAddress
+	LastSeen time.Time
+}
+
+func (n Neighbor) String() string {
+	return fmt.Sprintf("%v at %v seen %v", n.IP, n.MAC, n.LastSeen.Format(time.RFC3339))
+}
+
+type neighbor struct {
+	mac      tcpip.LinkAddress
+	lastSeen time.Time
+}
+
+// pending holds packets waiting for their next hop to be resolved.
+type pending struct {
+	packets  []queued
+	attempts int
+	retry    time.Time
+}
+
+// queued is a packet waiting for its next hop, with the packet its sender
+// sent, before NAT, to quote in errors.
+type queued struct {
+	packet []byte
+	orig   []byte
+}
+
+// Gateway routes IPv4 between a tun device and the overlay. It resolves
+// next hops on the overlay with ARP, answers ARP for the networks behind the
+// tun device, decrements the TTL of forwarded packets and reports errors to
+// senders with ICMP. It answers pings to its own address.
+//
+// It routes itself rather than through the stack's forwarding: netstack
+// forwards with the link address of the sender, without resolving the next
+// hop, decrementing the TTL or sending ICMP errors.
+type Gateway struct {
+	tun        stack.LinkEndpoint
+	overlay    stack.LinkEndpoint
+	addr       tcpip.Address
+	network    *net.IPNet
+	routes     []*net.IPNet
+	arpTimeout time.Duration
+	arpRetries int
+	nat        *nat
+	now        func() time.Time
+	logger     logging.Logger
+
+	mu        sync.Mutex
+	neighbors map[tcpip.Address]*neighbor
+	pending   map[tcpip.Address]*pending
+
+	stats GatewayStats
+	stop  chan struct{}
+}
+
+// side is the dispatcher of one of the gateway's endpoints.
+type side struct {
+	g    *Gateway
+	port Port
+}
+
+const (
+	portTun     Port = "tun"
+	portOverlay Port = "overlay"
+)
+
+// NewGateway creates a gateway between two registered endpoints.
+func NewGateway(opts *GatewayOptions) (*Gateway, error) {
+	tun := stack.FindLinkEndpoint(opts.Tun)
+	overlay := stack.FindLinkEndpoint(opts.Overlay)
+	if tun == nil || overlay == nil {
+		return nil, fmt.Errorf("NewGateway: unknown link endpoint")
+	}
+	return newGateway(tun, overlay, opts)
+}
+
+func newGateway(tun, overlay stack.LinkEndpoint, opts *GatewayOptions) (*Gateway, error) {
+	addr := opts.Address.To4()
+	if addr == nil || opts.Network == nil || !opts.Network.Contains(addr) {
+		return nil, fmt.Errorf("NewGateway: address %v is not in the overlay network %v", opts.Address, opts.Network)
+	}
+	g := &Gateway{
+		tun:        tun,
+		overlay:    overlay,
+		addr:       tcpip.Address(addr),
+		network:    opts.Network,
+		routes:     opts.Routes,
+		arpTimeout: opts.ARPTimeout,
+		arpRetries: opts.ARPRetries,
+		now:        time.Now,
+		logger:     logging.OrDefault(opts.Logger),
+		neighbors:  map[tcpip.Address]*neighbor{},
+		pending:    map[tcpip.Address]*pending{},
+	}
+	if g.arpTimeout == 0 {
+		g.arpTimeout = DefaultARPTimeout
+	}
+	if g.arpRetries == 0 {
+		g.arpRetries = DefaultARPRetries
+	}
+	if opts.Masquerade || len(opts.PortForwards) > 0 {
+		n, err := newNAT(g.addr, g.network, opts.Masquerade, opts.PortForwards)
+		if err != nil {
+			return nil, fmt.Errorf("NewGateway: %v", err)
+		}
+		g.nat = n
+	}
+	return g, nil
+}
+
+// Start attaches the gateway to its endpoints and starts resolving next hops.
+func (g *Gateway) Start() {
+	g.stop = make(chan struct{})
+	g.tun.Attach(&side{g, portTun})
+	g.overlay.Attach(&side{g, portOverlay})
+	go g.retryLoop()
+}
+
+// Stop stops retrying ARP requests, packets are still forwarded.
+func (g *Gateway) Stop() {
+	if g.stop != nil {
+		close(g.stop)
+		g.stop = nil
+	}
+}
+
+// Stats returns a snapshot of the gateway's counters.
+func (g *Gateway) Stats() GatewayStats {
+	return GatewayStats{
+		Forwarded:   atomic.LoadUint64(&g.stats.Forwarded),
+		TTLExceeded: atomic.LoadUint64(&g.stats.TTLExceeded),
+		Unreachable: atomic.LoadUint64(&g.stats.Unreachable),
+		TooBig:      atomic.LoadUint64(&g.stats.TooBig),
+		ARPRequests: atomic.LoadUint64(&g.stats.ARPRequests),
+		ARPReplies:  atomic.LoadUint64(&g.stats.ARPReplies),
+		Translated:  atomic.LoadUint64(&g.stats.Translated),
+		Dropped:     atomic.LoadUint64(&g.stats.Dropped),
+	}
+}
+
+// Neighbors returns the resolved overlay addresses.
+func (g *Gateway) Neighbors() []Neighbor {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ns []Neighbor
+	for addr, n := range g.neighbors {
+		ns = append(ns, Neighbor{IP: net.IP(addr), MAC: n.mac, LastSeen: n.lastSeen})
+	}
+	sort.Slice(ns, func(i, j int) bool { return string(ns[i].IP) < string(ns[j].IP) })
+	return ns
+}
+
+// NATFlows returns the flows being translated, nil without NAT.
+func (g *Gateway) NATFlows() []NATFlow {
+	if g.nat == nil {
+		return nil
+	}
+	return g.nat.flows()
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (s *side) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	switch {
+	case protocol == header.ARPProtocolNumber && s.port == portOverlay:
+		s.g.handleARP(header.ARP(vv.ToView()))
+	case protocol == header.IPv4ProtocolNumber:
+		s.g.handleIPv4(s.port, remote, vv.ToView())
+	case protocol == 0 && s.port == portTun && len(vv.First()) > 0 && header.IPVersion(vv.First()) == header.IPv4Version:
+		// Tun devices don't tell the protocol.
+		s.g.handleIPv4(s.port, remote, vv.ToView())
+	default:
+		atomic.AddUint64(&s.g.stats.Dropped, 1)
+	}
+}
+
+// behindTun reports whether addr is routed to the tun device.
+func (g *Gateway) behindTun(addr net.IP) bool {
+	if len(g.routes) == 0 {
+		return !g.network.Contains(addr)
+	}
+	for _, r := range g.routes {
+		if r.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gateway) handleIPv4(ingress Port, remote tcpip.LinkAddress, packet []byte) {
+	ip := header.IPv4(packet)
+	if len(packet) < header.IPv4MinimumSize || !ip.IsValid(len(packet)) {
+		atomic.AddUint64(&g.stats.Dropped, 1)
+		return
+	}
+	packet = packet[:ip.TotalLength()]
+	// Errors quote the packet as its sender sent it.
+	orig := packet
+	if g.nat != nil {
+		var ok bool
+		if packet, ok = g.translate(ingress, packet); !ok {
+			atomic.AddUint64(&g.stats.Dropped, 1)
+			return
+		}
+		ip = header.IPv4(packet)
+	}
+	dst := net.IP(ip.DestinationAddress())
+
+	if ip.DestinationAddress() == g.addr {
+		g.handleLocal(ingress, remote, packet)
+		return
+	}
+
+	egress := portOverlay
+	if ingress == portOverlay {
+		if !g.behindTun(dst) {
+			atomic.AddUint64(&g.stats.Dropped, 1)
+			return
+		}
+		egress = portTun
+	} else if !g.network.Contains(dst) {
+		g.sendICMPError(ingress, remote, orig, icmpUnreachable, codeNetUnreachable, 0)
+		atomic.AddUint64(&g.stats.Unreachable, 1)
+		return
+	}
+
+	if ip.TTL() <= 1 {
+		g.sendICMPError(ingress, remote, orig, icmpTimeExceeded, 0, 0)
+		atomic.AddUint64(&g.stats.TTLExceeded, 1)
+		return
+	}
+	out := g.endpoint(egress)
+	if mtu := int(out.MTU()); mtu > 0 && len(packet) > mtu {
+		atomic.AddUint64(&g.stats.TooBig, 1)
+		if ip.Flags()&header.IPv4FlagDontFragment != 0 {
+			g.sendICMPError(ingress, remote, orig, icmpUnreachable, codeFragNeeded, uint16(mtu))
+		}
+		return
+	}
+
+	// Forwarded packets are modified, so copy them.
+	packet = append([]byte(nil), packet...)
+	ip = header.IPv4(packet)
+	decrementTTL(ip)
+
+	if egress == portTun {
+		g.write(portTun, "", packet)
+		atomic.AddUint64(&g.stats.Forwarded, 1)
+		return
+	}
+	g.sendOverlay(ip.DestinationAddress(), packet, orig)
+}
+
+// translate applies NAT to a packet, it returns false if the packet must
+// be dropped.
+func (g *Gateway) translate(ingress Port, packet []byte) ([]byte, bool) {
+	translated := packet
+	if ingress == portTun {
+		var ok bool
+		if translated, ok = g.nat.outbound(packet); !ok {
+			return nil, false
+		}
+	} else {
+		translated = g.nat.inbound(packet)
+	}
+	if &translated[0] != &packet[0] {
+		atomic.AddUint64(&g.stats.Translated, 1)
+	}
+	return translated, true
+}
+
+// decrementTTL decrements the TTL and recomputes the header checksum.
+func decrementTTL(ip header.IPv4) {
+	ip[8]--
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+}
+
+// sendOverlay sends a packet to a next hop on the overlay, resolving its
+// link address first if needed. If it can't be resolved, orig is reported
+// to its sender.
+func (g *Gateway) sendOverlay(nextHop tcpip.Address, packet, orig []byte) {
+	g.mu.Lock()
+	n, ok := g.neighbors[nextHop]
+	if ok && g.now().Sub(n.lastSeen) < neighborTimeout {
+		mac := n.mac
+		g.mu.Unlock()
+		g.write(portOverlay, mac, packet)
+		atomic.AddUint64(&g.stats.Forwarded, 1)
+		return
+	}
+	p, ok := g.pending[nextHop]
+	if !ok {
+		p = &pending{}
+		g.pending[nextHop] = p
+	}
+	if len(p.packets) < maxPending {
+		p.packets = append(p.packets, queued{packet, append([]byte(nil), orig...)})
+	} else {
+		atomic.AddUint64(&g.stats.Dropped, 1)
+	}
+	request := !ok
+	if request {
+		p.attempts = 1
+		p.retry = g.now().Add(g.arpTimeout)
+	}
+	g.mu.Unlock()
+
+	if request {
+		g.sendARP(header.ARPRequest, broadcast, nextHop, g.overlay.LinkAddress(), g.addr)
+	}
+}
+
+var broadcast = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+
+// retryLoop asks again for next hops that didn't answer, and gives up on
+// them after the configured retries.
+func (g *Gateway) retryLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			g.retry()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func (g *Gateway) retry() {
+	now := g.now()
+	var ask []tcpip.Address
+	var failed [][]byte
+	g.mu.Lock()
+	for addr, p := range g.pending {
+		if now.Before(p.retry) {
+			continue
+		}
+		if p.attempts >= g.arpRetries {
+			for _, q := range p.packets {
+				failed = append(failed, q.orig)
+			}
+			delete(g.pending, addr)
+			continue
+		}
+		p.attempts++
+		p.retry = now.Add(g.arpTimeout)
+		ask = append(ask, addr)
+	}
+	g.mu.Unlock()
+
+	for _, addr := range ask {
+		g.sendARP(header.ARPRequest, broadcast, addr, g.overlay.LinkAddress(), g.addr)
+	}
+	for _, packet := range failed {
+		g.sendICMPError(portTun, "", packet, icmpUnreachable, codeHostUnreachable, 0)
+		atomic.AddUint64(&g.stats.Unreachable, 1)
+	}
+}
+
+func (g *Gateway) handleARP(a header.ARP) {
+	if !a.IsValid() {
+		atomic.AddUint64(&g.stats.Dropped, 1)
+		return
+	}
+	sender := tcpip.Address(a.ProtocolAddressSender())
+	senderMAC := tcpip.LinkAddress(a.HardwareAddressSender())
+	target := tcpip.Address(a.ProtocolAddressTarget())
+
+	// Learn from every ARP packet, and flush packets waiting for the sender.
+	var waiting []queued
+	if g.network.Contains(net.IP(sender)) && sender != g.addr {
+		g.mu.Lock()
+		g.neighbors[sender] = &neighbor{mac: senderMAC, lastSeen: g.now()}
+		if p, ok := g.pending[sender]; ok {
+			waiting = p.packets
+			delete(g.pending, sender)
+		}
+		g.mu.Unlock()
+	}
+	for _, q := range waiting {
+		g.write(portOverlay, senderMAC, q.packet)
+		atomic.AddUint64(&g.stats.Forwarded, 1)
+	}
+
+	if a.Op() != header.ARPRequest {
+		return
+	}
+	if target == g.addr || g.behindTun(net.IP(target)) {
+		atomic.AddUint64(&g.stats.ARPReplies, 1)
+		g.sendARP(header.ARPReply, senderMAC, sender, g.overlay.LinkAddress(), target)
+	}
+}
+
+// sendARP sends an ARP packet on the overlay, saying that senderIP is at
+// senderMAC.
+func (g *Gateway) sendARP(op header.ARPOp, dstMAC tcpip.LinkAddress, targetIP tcpip.Address, senderMAC tcpip.LinkAddress, senderIP tcpip.Address) {
+	if op == header.ARPRequest {
+		atomic.AddUint64(&g.stats.ARPRequests, 1)
+	}
+	hdr := buffer.NewPrependable(int(g.overlay.MaxHeaderLength()) + header.ARPSize)
+	a := header.ARP(hdr.Prepend(header.ARPSize))
+	a.SetIPv4OverEthernet()
+	a.SetOp(op)
+	copy(a.HardwareAddressSender(), senderMAC)
+	copy(a.ProtocolAddressSender(), senderIP)
+	if op == header.ARPReply {
+		copy(a.HardwareAddressTarget(), dstMAC)
+	}
+	copy(a.ProtocolAddressTarget(), targetIP)
+	r := &stack.Route{
+		NetProto:          header.ARPProtocolNumber,
+		LocalLinkAddress:  g.overlay.LinkAddress(),
+		RemoteLinkAddress: dstMAC,
+	}
+	g.overlay.WritePacket(r, nil, hdr, buffer.VectorisedView{}, header.ARPProtocolNumber)
+}
+
+// handleLocal answers pings to the gateway's own address. Replies to
+// masqueraded flows are translated before they get here.
+func (g *Gateway) handleLocal(ingress Port, remote tcpip.LinkAddress, packet []byte) {
+	ip := header.IPv4(packet)
+	hlen := int(ip.HeaderLength())
+	if ip.TransportProtocol() != header.ICMPv4ProtocolNumber || len(packet) < hlen+header.ICMPv4MinimumSize || packet[hlen] != icmpEcho {
+		atomic.AddUint64(&g.stats.Dropped, 1)
+		return
+	}
+	body := append([]byte(nil), packet[hlen:]...)
+	body[0] = icmpEchoReply
+	g.sendICMP(ingress, remote, ip.SourceAddress(), body)
+}
+
+// sendICMPError reports a problem with packet to its sender. Errors are
+// never sent about ICMP errors, fragments or packets to group addresses.
+func (g *Gateway) sendICMPError(ingress Port, remote tcpip.LinkAddress, packet []byte, typ, code byte, mtu uint16) {
+	ip := header.IPv4(packet)
+	hlen := int(ip.HeaderLength())
+	if ip.FragmentOffset() != 0 || net.IP(ip.DestinationAddress()).IsMulticast() || ip.DestinationAddress() == "\xff\xff\xff\xff" {
+		return
+	}
+	if ip.TransportProtocol() == header.ICMPv4ProtocolNumber && len(packet) > hlen {
+		switch packet[hlen] {
+		case icmpUnreachable, icmpTimeExceeded, icmpParamProblem:
+			return
+		}
+	}
+	// The original header and the first 8 bytes of its payload.
+	quoted := packet
+	if len(quoted) > hlen+8 {
+		quoted = quoted[:hlen+8]
+	}
+	body := make([]byte, header.ICMPv4MinimumSize, header.ICMPv4MinimumSize+len(quoted))
+	body[0], body[1] = typ, code
+	binary.BigEndian.PutUint16(body[6:], mtu)
+	body = append(body, quoted...)
+	g.sendICMP(ingress, remote, ip.SourceAddress(), body)
+}
+
+// sendICMP sends an ICMP message from the gateway back out the port it came
+// from.
+func (g *Gateway) sendICMP(port Port, remote tcpip.LinkAddress, dst tcpip.Address, body []byte) {
+	body[2], body[3] = 0, 0
+	binary.BigEndian.PutUint16(body[2:], ^header.Checksum(body, 0))
+
+	packet := make([]byte, header.IPv4MinimumSize+len(body))
+	ip := header.IPv4(packet)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(packet)),
+		TTL:         defaultTTL,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     g.addr,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(packet[header.IPv4MinimumSize:], body)
+	g.write(port, remote, packet)
+}
+
+func (g *Gateway) endpoint(port Port) stack.LinkEndpoint {
+	if port == portTun {
+		return g.tun
+	}
+	return g.overlay
+}
+
+// write sends a whole IPv4 packet out of a port.
+func (g *Gateway) write(port Port, dstMAC tcpip.LinkAddress, packet []byte) {
+	ep := g.endpoint(port)
+	hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + len(packet))
+	copy(hdr.Prepend(len(packet)), packet)
+	r := &stack.Route{
+		NetProto:          header.IPv4ProtocolNumber,
+		LocalLinkAddress:  ep.LinkAddress(),
+		RemoteLinkAddress: dstMAC,
+	}
+	if err := ep.WritePacket(r, nil, hdr, buffer.VectorisedView{}, header.IPv4ProtocolNumber); err != nil {
+		g.logger.Warn("could not write packet", "port", port, "peer", dstMAC, "err", err)
+	}
+}
@@ -0,0 +1,279 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+type frame struct {
+	dst      tcpip.LinkAddress
+	protocol tcpip.NetworkProtocolNumber
+	data     []byte
+}
+
+// fakeEndpoint records written frames.
+type fakeEndpoint struct {
+	addr       tcpip.LinkAddress
+	mtu        uint32
+	dispatcher stack.NetworkDispatcher
+	frames     []frame
+}
+
+func (e *fakeEndpoint) MTU() uint32                                  { return e.mtu }
+func (e *fakeEndpoint) Capabilities() stack.LinkEndpointCapabilities { return 0 }
+func (e *fakeEndpoint) MaxHeaderLength() uint16                      { return 0 }
+func (e *fakeEndpoint) LinkAddress() tcpip.LinkAddress               { return e.addr }
+func (e *fakeEndpoint) Attach(dispatcher stack.NetworkDispatcher)    { e.dispatcher = dispatcher }
+func (e *fakeEndpoint) IsAttached() bool                             { return e.dispatcher != nil }
+func (e *fakeEndpoint) WritePacket(r *stack.Route, _ *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	data := append(append([]byte(nil), hdr.View()...), payload.ToView()...)
+	e.frames = append(e.frames, frame{r.RemoteLinkAddress, protocol, data})
+	return nil
+}
+
+func (e *fakeEndpoint) deliver(src tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, data []byte) {
+	e.dispatcher.DeliverNetworkPacket(e, src, e.addr, protocol, buffer.NewViewFromBytes(data).ToVectorisedView())
+}
+
+func (e *fakeEndpoint) take() []frame {
+	frames := e.frames
+	e.frames = nil
+	return frames
+}
+
+const (
+	gwMAC   tcpip.LinkAddress = "\x42\x42\x42\x42\x42\x01"
+	peerMAC tcpip.LinkAddress = "\x42\x42\x42\x42\x42\x02"
+)
+
+func ipPacket(src, dst string, ttl uint8, size int) []byte {
+	b := make([]byte, size)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(size),
+		TTL:         ttl,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.Address(net.ParseIP(src).To4()),
+		DstAddr:     tcpip.Address(net.ParseIP(dst).To4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return b
+}
+
+func arpPacket(op header.ARPOp, senderMAC tcpip.LinkAddress, sender, target string) []byte {
+	a := header.ARP(make([]byte, header.ARPSize))
+	a.SetIPv4OverEthernet()
+	a.SetOp(op)
+	copy(a.HardwareAddressSender(), senderMAC)
+	copy(a.ProtocolAddressSender(), net.ParseIP(sender).To4())
+	copy(a.ProtocolAddressTarget(), net.ParseIP(target).To4())
+	return a
+}
+
+func setupGateway(t *testing.T) (*Gateway, *fakeEndpoint, *fakeEndpoint) {
+	tun := &fakeEndpoint{mtu: 1500}
+	overlay := &fakeEndpoint{addr: gwMAC, mtu: 1024}
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	_, hosts, _ := net.ParseCIDR("10.0.0.0/24")
+	g, err := newGateway(tun, overlay, &GatewayOptions{
+		Address: net.ParseIP("192.168.1.1"),
+		Network: network,
+		Routes:  []*net.IPNet{hosts},
+	})
+	if err != nil {
+		t.Fatalf("newGateway: unexpected error: %v", err)
+	}
+	tun.Attach(&side{g, portTun})
+	overlay.Attach(&side{g, portOverlay})
+	return g, tun, overlay
+}
+
+func TestGateway_Forward(t *testing.T) {
+	g, tun, overlay := setupGateway(t)
+
+	// The next hop is resolved before the packet is sent.
+	tun.deliver("", header.IPv4ProtocolNumber, ipPacket("10.0.0.2", "192.168.1.21", 64, 100))
+	frames := overlay.take()
+	if len(frames) != 1 || frames[0].protocol != header.ARPProtocolNumber || frames[0].dst != broadcast {
+		t.Fatalf("Expected a broadcast ARP request, got %v", frames)
+	}
+	overlay.deliver(peerMAC, header.ARPProtocolNumber, arpPacket(header.ARPReply, peerMAC, "192.168.1.21", "192.168.1.1"))
+	frames = overlay.take()
+	if len(frames) != 1 || frames[0].dst != peerMAC {
+		t.Fatalf("Expected the queued packet to be sent to %v, got %v", peerMAC, frames)
+	}
+	ip := header.IPv4(frames[0].data)
+	if ip.TTL() != 63 || !ip.IsValid(len(ip)) || ip.CalculateChecksum() != 0xffff {
+		t.Errorf("Expected TTL 63 with a valid checksum, got TTL %d checksum %x", ip.TTL(), ip.CalculateChecksum())
+	}
+
+	// Replies go back through the tun.
+	overlay.deliver(peerMAC, header.IPv4ProtocolNumber, ipPacket("192.168.1.21", "10.0.0.2", 64, 100))
+	if frames := tun.take(); len(frames) != 1 || header.IPv4(frames[0].data).TTL() != 63 {
+		t.Errorf("Expected the reply on the tun, got %v", frames)
+	}
+	// Members resolve hosts behind the tun to the gateway.
+	overlay.deliver(peerMAC, header.ARPProtocolNumber, arpPacket(header.ARPRequest, peerMAC, "192.168.1.21", "10.0.0.2"))
+	frames = overlay.take()
+	if len(frames) != 1 || header.ARP(frames[0].data).Op() != header.ARPReply || tcpip.LinkAddress(header.ARP(frames[0].data).HardwareAddressSender()) != gwMAC {
+		t.Errorf("Expected an ARP reply with the gateway address, got %v", frames)
+	}
+	if s := g.Stats(); s.Forwarded != 2 {
+		t.Errorf("Expected 2 forwarded packets, got %v", s)
+	}
+}
+
+func TestGateway_Errors(t *testing.T) {
+	g, tun, overlay := setupGateway(t)
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	icmpType := func(f frame) byte {
+		return f.data[header.IPv4MinimumSize]
+	}
+	tables := []struct {
+		packet []byte
+		typ    byte
+	}{
+		{ipPacket("10.0.0.2", "192.168.1.21", 1, 100), icmpTimeExceeded},
+		{ipPacket("10.0.0.2", "172.16.0.1", 64, 100), icmpUnreachable},
+		{ipPacket("10.0.0.2", "192.168.1.21", 64, 2000), 255}, // too big without DF, dropped silently
+	}
+	for i, table := range tables {
+		tun.deliver("", header.IPv4ProtocolNumber, table.packet)
+		frames := tun.take()
+		if table.typ == 255 {
+			if len(frames) != 0 {
+				t.Errorf("[%d] Expected no ICMP error, got %v", i, frames)
+			}
+			continue
+		}
+		if len(frames) != 1 || icmpType(frames[0]) != table.typ {
+			t.Errorf("[%d] Expected ICMP type %d, got %v", i, table.typ, frames)
+			continue
+		}
+		if dst := header.IPv4(frames[0].data).DestinationAddress(); dst != tcpip.Address(net.ParseIP("10.0.0.2").To4()) {
+			t.Errorf("[%d] Expected ICMP error to the sender, got %v", i, dst)
+		}
+	}
+
+	// Next hops that never answer are reported unreachable.
+	tun.deliver("", header.IPv4ProtocolNumber, ipPacket("10.0.0.2", "192.168.1.99", 64, 100))
+	for i := 0; i < DefaultARPRetries; i++ {
+		now = now.Add(DefaultARPTimeout)
+		g.retry()
+	}
+	if requests := overlay.take(); len(requests) != DefaultARPRetries {
+		t.Errorf("Expected %d ARP requests, got %d", DefaultARPRetries, len(requests))
+	}
+	if frames := tun.take(); len(frames) != 1 || icmpType(frames[0]) != icmpUnreachable || frames[0].data[header.IPv4MinimumSize+1] != codeHostUnreachable {
+		t.Errorf("Expected a host unreachable error, got %v", frames)
+	}
+
+	// The gateway answers pings.
+	ping := ipPacket("10.0.0.2", "192.168.1.1", 64, header.IPv4MinimumSize+8)
+	ping[9] = uint8(header.ICMPv4ProtocolNumber)
+	ping[header.IPv4MinimumSize] = icmpEcho
+	tun.deliver("", header.IPv4ProtocolNumber, ping)
+	if frames := tun.take(); len(frames) != 1 || icmpType(frames[0]) != icmpEchoReply {
+		t.Errorf("Expected an echo reply, got %v", frames)
+	}
+}
+
+func TestGateway_UnreachableMasqueraded(t *testing.T) {
+	tun := &fakeEndpoint{mtu: 1500}
+	overlay := &fakeEndpoint{addr: gwMAC, mtu: 1024}
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	g, err := newGateway(tun, overlay, &GatewayOptions{
+		Address:    net.ParseIP("192.168.1.1"),
+		Network:    network,
+		Masquerade: true,
+	})
+	if err != nil {
+		t.Fatalf("newGateway: unexpected error: %v", err)
+	}
+	tun.Attach(&side{g, portTun})
+	overlay.Attach(&side{g, portOverlay})
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	// The error goes to the sender and quotes the packet it sent.
+	tun.deliver("", header.IPv4ProtocolNumber, ipPacket("10.0.0.2", "192.168.1.99", 64, 100))
+	for i := 0; i < DefaultARPRetries; i++ {
+		now = now.Add(DefaultARPTimeout)
+		g.retry()
+	}
+	frames := tun.take()
+	if len(frames) != 1 {
+		t.Fatalf("Expected a host unreachable error, got %v", frames)
+	}
+	ip := header.IPv4(frames[0].data)
+	quoted := header.IPv4(frames[0].data[header.IPv4MinimumSize+header.ICMPv4MinimumSize:])
+	if ip.DestinationAddress() != addr("10.0.0.2") || quoted.SourceAddress() != addr("10.0.0.2") || quoted.TTL() != 64 {
+		t.Errorf("Expected an error to 10.0.0.2 quoting its packet, got %v quoting %v TTL %d", ip.DestinationAddress(), quoted.SourceAddress(), quoted.TTL())
+	}
+}
+
+func TestGateway_ICMP(t *testing.T) {
+	g, tun, overlay := setupGateway(t)
+
+	// The error goes back to the sender on the overlay, from the gateway,
+	// quoting the header and 8 bytes of the packet as it was sent.
+	expired := ipPacket("192.168.1.21", "10.0.0.2", 1, 100)
+	overlay.deliver(peerMAC, header.IPv4ProtocolNumber, expired)
+	frames := overlay.take()
+	if len(frames) != 1 || frames[0].dst != peerMAC {
+		t.Fatalf("Expected an ICMP error to %v, got %v", peerMAC, frames)
+	}
+	ip := header.IPv4(frames[0].data)
+	body := ip.Payload()
+	if !ip.IsValid(len(ip)) || ip.CalculateChecksum() != 0xffff || ip.SourceAddress() != g.addr || ip.TransportProtocol() != header.ICMPv4ProtocolNumber {
+		t.Errorf("Expected a valid ICMP packet from the gateway, got %v", frames[0].data)
+	}
+	if body[0] != icmpTimeExceeded || header.Checksum(body, 0) != 0xffff {
+		t.Errorf("Expected a time exceeded error with a valid checksum, got type %d", body[0])
+	}
+	if quoted := body[header.ICMPv4MinimumSize:]; string(quoted) != string(expired[:header.IPv4MinimumSize+8]) {
+		t.Errorf("Expected the original header to be quoted, got %v", quoted)
+	}
+	if tun.take() != nil {
+		t.Errorf("Expected the expired packet not to be forwarded")
+	}
+
+	// Packets that don't fit the overlay with DF set get the MTU back.
+	big := ipPacket("10.0.0.2", "192.168.1.21", 64, 2000)
+	big[6] |= 0x40
+	header.IPv4(big).SetChecksum(0)
+	header.IPv4(big).SetChecksum(^header.IPv4(big).CalculateChecksum())
+	tun.deliver("", header.IPv4ProtocolNumber, big)
+	frames = tun.take()
+	if len(frames) != 1 {
+		t.Fatalf("Expected a fragmentation needed error, got %v", frames)
+	}
+	body = header.IPv4(frames[0].data).Payload()
+	if body[0] != icmpUnreachable || body[1] != codeFragNeeded || binary.BigEndian.Uint16(body[6:]) != 1024 {
+		t.Errorf("Expected fragmentation needed with MTU 1024, got %v", body[:8])
+	}
+
+	// Errors are never sent about errors.
+	icmpErr := ipPacket("10.0.0.2", "192.168.1.21", 1, header.IPv4MinimumSize+8)
+	icmpErr[9] = uint8(header.ICMPv4ProtocolNumber)
+	icmpErr[header.IPv4MinimumSize] = icmpUnreachable
+	header.IPv4(icmpErr).SetChecksum(0)
+	header.IPv4(icmpErr).SetChecksum(^header.IPv4(icmpErr).CalculateChecksum())
+	tun.deliver("", header.IPv4ProtocolNumber, icmpErr)
+	if frames := tun.take(); len(frames) != 0 {
+		t.Errorf("Expected no error about an ICMP error, got %v", frames)
+	}
+	if s := g.Stats(); s.TTLExceeded != 2 || s.TooBig != 1 || s.Forwarded != 0 {
+		t.Errorf("Unexpected counters %+v", s)
+	}
+}
@@ -0,0 +1,483 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/smithclay/rlinklayer/link/filter"
+)
+
+const (
+	// Idle timeouts of translated flows, the same as the packet filter's.
+	natTCPTimeout     = 30 * time.Minute
+	natClosingTimeout = 30 * time.Second
+	natUDPTimeout     = 2 * time.Minute
+	natICMPTimeout    = 30 * time.Second
+
+	maxNATFlows      = 16384
+	natSweepInterval = 10 * time.Second
+
+	// Masqueraded flows get a source port from this range when their own is
+	// taken.
+	natPortMin = 32768
+	natPortMax = 60999
+)
+
+// PortForward publishes a service on the overlay at a port on the tun side.
+type PortForward struct {
+	// Protocol is TCP or UDP.
+	Protocol tcpip.TransportProtocolNumber
+	// Address is the tun side address the service is published on, any
+	// address routed to the tun device if nil.
+	Address net.IP
+	Port    uint16
+	// To is the overlay host the connections are forwarded to.
+	To net.IP
+	// ToPort is Port if zero.
+	ToPort uint16
+}
+
+func (f PortForward) String() string {
+	from := ":" + strconv.Itoa(int(f.Port))
+	if f.Address != nil {
+		from = f.Address.String() + from
+	}
+	return fmt.Sprintf("%v %v -> %v", protocolName(f.Protocol), from, net.JoinHostPort(f.To.String(), strconv.Itoa(int(f.ToPort))))
+}
+
+// ParsePortForwards parses comma separated port forwards written as
+// proto:[address:]port=to[:toport], for example
+//
+//	tcp:8080=192.168.1.10:80,udp:10.0.0.1:53=192.168.1.2
+func ParsePortForwards(s string) ([]PortForward, error) {
+	var forwards []PortForward
+	for _, text := range strings.Split(s, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		f, err := parsePortForward(text)
+		if err != nil {
+			return nil, fmt.Errorf("ParsePortForwards: %q: %v", text, err)
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, nil
+}
+
+func parsePortForward(text string) (PortForward, error) {
+	var f PortForward
+	eq := strings.Index(text, "=")
+	colon := strings.Index(text, ":")
+	if eq < 0 || colon < 0 || colon > eq {
+		return f, fmt.Errorf("expected proto:[address:]port=to[:toport]")
+	}
+	switch text[:colon] {
+	case "tcp":
+		f.Protocol = header.TCPProtocolNumber
+	case "udp":
+		f.Protocol = header.UDPProtocolNumber
+	default:
+		return f, fmt.Errorf("unknown protocol %q", text[:colon])
+	}
+
+	from := text[colon+1 : eq]
+	if i := strings.LastIndex(from, ":"); i >= 0 {
+		if f.Address = net.ParseIP(from[:i]).To4(); f.Address == nil {
+			return f, fmt.Errorf("invalid address %q", from[:i])
+		}
+		from = from[i+1:]
+	}
+	port, err := strconv.ParseUint(from, 10, 16)
+	if err != nil || port == 0 {
+		return f, fmt.Errorf("invalid port %q", from)
+	}
+	f.Port = uint16(port)
+
+	to := text[eq+1:]
+	f.ToPort = f.Port
+	if i := strings.LastIndex(to, ":"); i >= 0 {
+		port, err := strconv.ParseUint(to[i+1:], 10, 16)
+		if err != nil || port == 0 {
+			return f, fmt.Errorf("invalid port %q", to[i+1:])
+		}
+		f.ToPort = uint16(port)
+		to = to[:i]
+	}
+	if f.To = net.ParseIP(to).To4(); f.To == nil {
+		return f, fmt.Errorf("invalid address %q", to)
+	}
+	return f, nil
+}
+
+func protocolName(p tcpip.TransportProtocolNumber) string {
+	switch p {
+	case header.TCPProtocolNumber:
+		return "tcp"
+	case header.UDPProtocolNumber:
+		return "udp"
+	case header.ICMPv4ProtocolNumber:
+		return "icmp"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// NATFlow is a translated flow, as seen on the tun side and on the overlay.
+type NATFlow struct {
+	Protocol      tcpip.TransportProtocolNumber
+	Src, Dst      string
+	TranslatedSrc string
+	TranslatedDst string
+	Expires       time.Time
+}
+
+func (f NATFlow) String() string {
+	return fmt.Sprintf("%v %v -> %v as %v -> %v expires %v", protocolName(f.Protocol), f.Src, f.Dst, f.TranslatedSrc, f.TranslatedDst, f.Expires.Format(time.RFC3339))
+}
+
+// natTuple identifies a flow in the direction of one of its packets. ICMP
+// echo messages use their identifier as both ports.
+type natTuple struct {
+	protocol tcpip.TransportProtocolNumber
+	src, dst tcpip.Address
+	sport    uint16
+	dport    uint16
+}
+
+func (t natTuple) reply() natTuple {
+	return natTuple{t.protocol, t.dst, t.src, t.dport, t.sport}
+}
+
+func (t natTuple) endpoints() (string, string) {
+	return net.JoinHostPort(net.IP(t.src).String(), strconv.Itoa(int(t.sport))),
+		net.JoinHostPort(net.IP(t.dst).String(), strconv.Itoa(int(t.dport)))
+}
+
+type natEntry struct {
+	// orig is the flow as sent from the tun side, trans as sent on the
+	// overlay.
+	orig, trans natTuple
+	expires     time.Time
+}
+
+// nat translates flows from the tun side to the overlay: sources are
+// masqueraded as the gateway and destinations of port forwards are
+// rewritten. Replies are translated back.
+type nat struct {
+	addr       tcpip.Address
+	network    *net.IPNet
+	masquerade bool
+	forwards   []PortForward
+	now        func() time.Time
+
+	mu        sync.Mutex
+	out       map[natTuple]*natEntry // by orig
+	in        map[natTuple]*natEntry // by the reply to trans
+	nextPort  uint16
+	lastSweep time.Time
+}
+
+func newNAT(addr tcpip.Address, network *net.IPNet, masquerade bool, forwards []PortForward) (*nat, error) {
+	for i := range forwards {
+		f := &forwards[i]
+		if f.Protocol != header.TCPProtocolNumber && f.Protocol != header.UDPProtocolNumber {
+			return nil, fmt.Errorf("port forward %v: only tcp and udp can be forwarded", f)
+		}
+		if f.To.To4() == nil || !network.Contains(f.To) {
+			return nil, fmt.Errorf("port forward %v: %v is not in the overlay network %v", f, f.To, network)
+		}
+		if f.ToPort == 0 {
+			f.ToPort = f.Port
+		}
+	}
+	return &nat{
+		addr:       addr,
+		network:    network,
+		masquerade: masquerade,
+		forwards:   forwards,
+		now:        time.Now,
+		out:        map[natTuple]*natEntry{},
+		in:         map[natTuple]*natEntry{},
+		nextPort:   natPortMin,
+	}, nil
+}
+
+func natTimeout(p *filter.Packet) time.Duration {
+	switch p.Protocol {
+	case header.TCPProtocolNumber:
+		if p.TCPFlags&(header.TCPFlagFin|header.TCPFlagRst) != 0 {
+			return natClosingTimeout
+		}
+		return natTCPTimeout
+	case header.UDPProtocolNumber:
+		return natUDPTimeout
+	}
+	return natICMPTimeout
+}
+
+// parseFlow returns the tuple of packets that can be translated: TCP, UDP
+// and ICMP echo.
+func parseFlow(packet []byte) (filter.Packet, natTuple, bool) {
+	p, ok := filter.ParseIPv4(packet)
+	if !ok || p.Fragment {
+		return p, natTuple{}, false
+	}
+	switch p.Protocol {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+	case header.ICMPv4ProtocolNumber:
+		if typ := header.ICMPv4(packet[header.IPv4(packet).HeaderLength():]).Type(); typ != header.ICMPv4Echo && typ != header.ICMPv4EchoReply {
+			return p, natTuple{}, false
+		}
+	default:
+		return p, natTuple{}, false
+	}
+	t := natTuple{p.Protocol, tcpip.Address(p.Src.To4()), tcpip.Address(p.Dst.To4()), p.SrcPort, p.DstPort}
+	return p, t, true
+}
+
+// outbound translates a packet from the tun side. It returns false if the
+// packet must be dropped.
+func (n *nat) outbound(packet []byte) ([]byte, bool) {
+	p, t, ok := parseFlow(packet)
+	if !ok {
+		// Non-first fragments carry no ports, but masqueraded flows all share
+		// the gateway's address.
+		if p.Fragment && n.masquerade && n.network.Contains(p.Dst) {
+			trans := natTuple{src: n.addr, dst: tcpip.Address(p.Dst.To4())}
+			return rewrite(packet, natTuple{src: tcpip.Address(p.Src.To4()), dst: trans.dst}, trans, false), true
+		}
+		return packet, true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	e, ok := n.out[t]
+	if ok && !now.Before(e.expires) {
+		n.remove(e)
+		ok = false
+	}
+	if !ok {
+		if e, ok = n.create(t, now); e == nil {
+			return packet, ok
+		}
+	}
+	e.expires = now.Add(natTimeout(&p))
+	return rewrite(packet, e.orig, e.trans, true), true
+}
+
+// inbound translates a reply from the overlay back to the tun side.
+func (n *nat) inbound(packet []byte) []byte {
+	p, t, ok := parseFlow(packet)
+	if !ok {
+		if p.Fragment {
+			return n.inboundFragment(packet, &p)
+		}
+		return packet
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	e, ok := n.in[t]
+	if !ok || !now.Before(e.expires) {
+		return packet
+	}
+	e.expires = now.Add(natTimeout(&p))
+	return rewrite(packet, t, e.orig.reply(), true)
+}
+
+// inboundFragment translates a non-first fragment of a reply by address,
+// since it carries no ports: it goes to the most recently active flow of
+// its protocol between the same addresses.
+func (n *nat) inboundFragment(packet []byte, p *filter.Packet) []byte {
+	from := natTuple{src: tcpip.Address(p.Src.To4()), dst: tcpip.Address(p.Dst.To4())}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	var latest *natEntry
+	for _, e := range n.out {
+		if e.trans.protocol != p.Protocol || e.trans.dst != from.src || e.trans.src != from.dst || !now.Before(e.expires) {
+			continue
+		}
+		if latest == nil || e.expires.After(latest.expires) {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return packet
+	}
+	return rewrite(packet, from, natTuple{src: latest.orig.dst, dst: latest.orig.src}, false)
+}
+
+// create starts translating the flow t, called with n.mu held. It returns
+// a nil entry if the flow isn't translated, and false if it must be dropped.
+func (n *nat) create(t natTuple, now time.Time) (*natEntry, bool) {
+	trans := t
+	for _, f := range n.forwards {
+		if f.Protocol == t.protocol && f.Port == t.dport && (f.Address == nil || tcpip.Address(f.Address.To4()) == t.dst) {
+			trans.dst = tcpip.Address(f.To.To4())
+			trans.dport = f.ToPort
+			break
+		}
+	}
+	if !n.network.Contains(net.IP(trans.dst)) {
+		// Not for the overlay, routing reports it.
+		return nil, true
+	}
+	if n.masquerade {
+		trans.src = n.addr
+		if !n.allocate(&trans, now) {
+			return nil, false
+		}
+	}
+	if trans == t {
+		return nil, true
+	}
+	if len(n.out) >= maxNATFlows || now.Sub(n.lastSweep) > natSweepInterval {
+		n.sweep(now)
+	}
+	if len(n.out) >= maxNATFlows {
+		return nil, false
+	}
+	e := &natEntry{orig: t, trans: trans}
+	n.out[t] = e
+	n.in[trans.reply()] = e
+	return e, true
+}
+
+// allocate picks a source port for a masqueraded flow, keeping the original
+// one if it is free. Called with n.mu held.
+func (n *nat) allocate(t *natTuple, now time.Time) bool {
+	free := func(port uint16) bool {
+		c := *t
+		c.sport = port
+		if c.protocol == header.ICMPv4ProtocolNumber {
+			c.dport = port
+		}
+		e, ok := n.in[c.reply()]
+		if ok && !now.Before(e.expires) {
+			n.remove(e)
+			ok = false
+		}
+		return !ok
+	}
+	port := t.sport
+	for i := 0; !free(port); i++ {
+		if i > natPortMax-natPortMin {
+			return false
+		}
+		port = n.nextPort
+		if n.nextPort++; n.nextPort > natPortMax {
+			n.nextPort = natPortMin
+		}
+	}
+	t.sport = port
+	if t.protocol == header.ICMPv4ProtocolNumber {
+		t.dport = port
+	}
+	return true
+}
+
+func (n *nat) remove(e *natEntry) {
+	delete(n.out, e.orig)
+	delete(n.in, e.trans.reply())
+}
+
+// sweep forgets expired flows, called with n.mu held.
+func (n *nat) sweep(now time.Time) {
+	for _, e := range n.out {
+		if !now.Before(e.expires) {
+			n.remove(e)
+		}
+	}
+	n.lastSweep = now
+}
+
+func (n *nat) flows() []NATFlow {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+	var flows []NATFlow
+	for _, e := range n.out {
+		if !now.Before(e.expires) {
+			continue
+		}
+		f := NATFlow{Protocol: e.orig.protocol, Expires: e.expires}
+		f.Src, f.Dst = e.orig.endpoints()
+		f.TranslatedSrc, f.TranslatedDst = e.trans.endpoints()
+		flows = append(flows, f)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Src+flows[i].Dst < flows[j].Src+flows[j].Dst })
+	return flows
+}
+
+// rewrite returns a copy of packet, a flow from, rewritten to the flow to.
+// Checksums are adjusted incrementally, so that first fragments remain
+// valid. Ports are only rewritten if ports is set.
+func rewrite(packet []byte, from, to natTuple, ports bool) []byte {
+	packet = append([]byte(nil), packet...)
+	ip := header.IPv4(packet)
+	oldAddrs := append([]byte(from.src), from.dst...)
+	newAddrs := append([]byte(to.src), to.dst...)
+	copy(packet[12:20], newAddrs)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	if !ports {
+		return packet
+	}
+
+	t := packet[ip.HeaderLength():]
+	oldPorts := make([]byte, 4)
+	newPorts := make([]byte, 4)
+	binary.BigEndian.PutUint16(oldPorts, from.sport)
+	binary.BigEndian.PutUint16(oldPorts[2:], from.dport)
+	binary.BigEndian.PutUint16(newPorts, to.sport)
+	binary.BigEndian.PutUint16(newPorts[2:], to.dport)
+
+	switch from.protocol {
+	case header.TCPProtocolNumber:
+		sum := binary.BigEndian.Uint16(t[16:])
+		sum = checksumAdjust(sum, append(oldAddrs, oldPorts...), append(newAddrs, newPorts...))
+		binary.BigEndian.PutUint16(t[16:], sum)
+		copy(t, newPorts)
+	case header.UDPProtocolNumber:
+		// A zero checksum means the sender didn't compute one.
+		if sum := binary.BigEndian.Uint16(t[6:]); sum != 0 {
+			sum = checksumAdjust(sum, append(oldAddrs, oldPorts...), append(newAddrs, newPorts...))
+			if sum == 0 {
+				sum = 0xffff
+			}
+			binary.BigEndian.PutUint16(t[6:], sum)
+		}
+		copy(t, newPorts)
+	case header.ICMPv4ProtocolNumber:
+		// Only the identifier, there is no pseudo header.
+		sum := binary.BigEndian.Uint16(t[2:])
+		sum = checksumAdjust(sum, oldPorts[:2], newPorts[:2])
+		binary.BigEndian.PutUint16(t[2:], sum)
+		copy(t[4:6], newPorts[:2])
+	}
+	return packet
+}
+
+// checksumAdjust updates an internet checksum after old was replaced by
+// new, both of the same even length (RFC 1624).
+func checksumAdjust(sum uint16, old, new []byte) uint16 {
+	s := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		s += uint32(^binary.BigEndian.Uint16(old[i:]))
+		s += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
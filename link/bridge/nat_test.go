@@ -0,0 +1,153 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+func tcpPacket(src string, sport uint16, dst string, dport uint16) []byte {
+	b := ipPacket(src, dst, 64, header.IPv4MinimumSize+header.TCPMinimumSize+4)
+	b[9] = uint8(header.TCPProtocolNumber)
+	ip := header.IPv4(b)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	tcp := header.TCP(b[header.IPv4MinimumSize:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    sport,
+		DstPort:    dport,
+		SeqNum:     1,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 1024,
+	})
+	copy(b[header.IPv4MinimumSize+header.TCPMinimumSize:], "ping")
+	binary.BigEndian.PutUint16(b[header.IPv4MinimumSize+16:], ^tcpChecksum(b))
+	return b
+}
+
+// tcpChecksum sums a TCP segment with its pseudo header, it is 0xffff for
+// valid segments.
+func tcpChecksum(b []byte) uint16 {
+	ip := header.IPv4(b)
+	segment := b[ip.HeaderLength():]
+	pseudo := make([]byte, 12)
+	copy(pseudo, ip.SourceAddress())
+	copy(pseudo[4:], ip.DestinationAddress())
+	pseudo[9] = uint8(header.TCPProtocolNumber)
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	return header.Checksum(segment, header.Checksum(pseudo, 0))
+}
+
+func addr(s string) tcpip.Address {
+	return tcpip.Address(net.ParseIP(s).To4())
+}
+
+func TestNAT_Masquerade(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	n, _ := newNAT(addr("192.168.1.1"), network, true, nil)
+
+	out, ok := n.outbound(tcpPacket("10.0.0.2", 40000, "192.168.1.21", 3000))
+	if !ok {
+		t.Fatalf("Expected the packet to be translated")
+	}
+	ip := header.IPv4(out)
+	if ip.SourceAddress() != addr("192.168.1.1") || ip.CalculateChecksum() != 0xffff || tcpChecksum(out) != 0xffff {
+		t.Errorf("Expected a valid packet from the gateway, got %v checksums %x %x", ip.SourceAddress(), ip.CalculateChecksum(), tcpChecksum(out))
+	}
+	if port := header.TCP(out[header.IPv4MinimumSize:]).SourcePort(); port != 40000 {
+		t.Errorf("Expected the source port to be kept, got %d", port)
+	}
+
+	// A second host using the same port gets another one.
+	out2, _ := n.outbound(tcpPacket("10.0.0.3", 40000, "192.168.1.21", 3000))
+	if port := header.TCP(out2[header.IPv4MinimumSize:]).SourcePort(); port == 40000 {
+		t.Errorf("Expected a different source port, got %d", port)
+	}
+
+	// Replies are translated back.
+	reply := n.inbound(tcpPacket("192.168.1.21", 3000, "192.168.1.1", 40000))
+	ip = header.IPv4(reply)
+	if ip.DestinationAddress() != addr("10.0.0.2") || tcpChecksum(reply) != 0xffff {
+		t.Errorf("Expected a valid reply to 10.0.0.2, got %v checksum %x", ip.DestinationAddress(), tcpChecksum(reply))
+	}
+	if len(n.flows()) != 2 {
+		t.Errorf("Expected 2 flows, got %v", n.flows())
+	}
+
+	// Idle flows expire.
+	now := n.now()
+	n.now = func() time.Time { return now.Add(natTCPTimeout) }
+	if reply := n.inbound(tcpPacket("192.168.1.21", 3000, "192.168.1.1", 40000)); header.IPv4(reply).DestinationAddress() != addr("192.168.1.1") {
+		t.Errorf("Expected expired flows not to be translated")
+	}
+}
+
+func TestNAT_PortForward(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	forwards, err := ParsePortForwards("tcp:8080=192.168.1.10:80, udp:10.0.0.1:53=192.168.1.2")
+	if err != nil || len(forwards) != 2 || forwards[1].ToPort != 53 || forwards[1].Address == nil {
+		t.Fatalf("ParsePortForwards: unexpected result %v, %v", forwards, err)
+	}
+	n, err := newNAT(addr("192.168.1.1"), network, false, forwards)
+	if err != nil {
+		t.Fatalf("newNAT: unexpected error: %v", err)
+	}
+
+	out, _ := n.outbound(tcpPacket("10.0.0.2", 40000, "10.0.0.1", 8080))
+	if ip := header.IPv4(out); ip.DestinationAddress() != addr("192.168.1.10") || ip.SourceAddress() != addr("10.0.0.2") || tcpChecksum(out) != 0xffff {
+		t.Errorf("Expected a valid packet to 192.168.1.10, got %v -> %v", ip.SourceAddress(), ip.DestinationAddress())
+	}
+	if port := header.TCP(out[header.IPv4MinimumSize:]).DestinationPort(); port != 80 {
+		t.Errorf("Expected destination port 80, got %d", port)
+	}
+	reply := n.inbound(tcpPacket("192.168.1.10", 80, "10.0.0.2", 40000))
+	if ip := header.IPv4(reply); ip.SourceAddress() != addr("10.0.0.1") || header.TCP(reply[header.IPv4MinimumSize:]).SourcePort() != 8080 {
+		t.Errorf("Expected the reply from 10.0.0.1:8080, got %v", ip.SourceAddress())
+	}
+
+	// Other traffic is left alone.
+	if out, _ := n.outbound(tcpPacket("10.0.0.2", 40000, "192.168.1.21", 8081)); header.IPv4(out).SourceAddress() != addr("10.0.0.2") {
+		t.Errorf("Expected untranslated packet")
+	}
+
+	for _, s := range []string{"tcp:8080", "sctp:1=192.168.1.2", "tcp:0=192.168.1.2", "udp:53=host"} {
+		if _, err := ParsePortForwards(s); err == nil {
+			t.Errorf("ParsePortForwards(%q): expected an error", s)
+		}
+	}
+	if _, err := newNAT(addr("192.168.1.1"), network, false, []PortForward{{Protocol: header.TCPProtocolNumber, Port: 1, To: net.ParseIP("10.1.1.1")}}); err == nil {
+		t.Errorf("newNAT: expected an error for a destination outside the overlay")
+	}
+}
+
+func TestNAT_Fragments(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	n, _ := newNAT(addr("192.168.1.1"), network, true, nil)
+	if _, ok := n.outbound(tcpPacket("10.0.0.2", 40000, "192.168.1.21", 3000)); !ok {
+		t.Fatalf("Expected the packet to be translated")
+	}
+
+	// Non-first fragments of a reply carry no ports, they follow the flow
+	// between their addresses.
+	fragment := ipPacket("192.168.1.21", "192.168.1.1", 64, 100)
+	fragment[9] = uint8(header.TCPProtocolNumber)
+	binary.BigEndian.PutUint16(fragment[6:], 185)
+	ip := header.IPv4(fragment)
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	reply := header.IPv4(n.inbound(fragment))
+	if reply.DestinationAddress() != addr("10.0.0.2") || reply.SourceAddress() != addr("192.168.1.21") || reply.CalculateChecksum() != 0xffff {
+		t.Errorf("Expected a valid fragment to 10.0.0.2, got %v -> %v checksum %x", reply.SourceAddress(), reply.DestinationAddress(), reply.CalculateChecksum())
+	}
+
+	// Fragments of other protocols are left alone.
+	fragment[9] = uint8(header.UDPProtocolNumber)
+	if reply := header.IPv4(n.inbound(fragment)); reply.DestinationAddress() != addr("192.168.1.1") {
+		t.Errorf("Expected an untranslated fragment, got %v", reply.DestinationAddress())
+	}
+}
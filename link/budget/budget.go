@@ -0,0 +1,282 @@
+// Package budget meters the calls links make to AWS and the bytes they have
+// CloudWatch Logs ingest, estimates what they cost, and enforces budgets
+// shared by the links of a network, so that a retransmit storm can't turn
+// into a surprise bill.
+package budget
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// ErrOverBudget is returned for calls that would exceed the budget, which
+// are not made.
+var ErrOverBudget = errors.New("over budget")
+
+// Actions taken when the budget is exceeded.
+const (
+	// Shed refuses calls over the budget: packets are dropped and polls
+	// skipped.
+	Shed = "shed"
+	// Delay makes calls over the budget wait for it to refill, for at most
+	// MaxDelay, and sheds them after.
+	Delay = "delay"
+)
+
+// EventOverhead are the bytes CloudWatch Logs bills for every log event on
+// top of its message.
+const EventOverhead = 26
+
+// DefaultMaxDelay is the longest a call waits for the budget with Delay.
+const DefaultMaxDelay = 10 * time.Second
+
+// Prices are what AWS charges, in dollars.
+type Prices struct {
+	// IngestedGB is the price of a gigabyte ingested by PutLogEvents.
+	IngestedGB float64
+	// Calls are the prices of a thousand calls by operation, i.e.
+	// FilterLogEvents or TagResource.
+	Calls map[string]float64
+	// OtherCalls is the price of a thousand calls to other operations.
+	OtherCalls float64
+}
+
+// DefaultPrices are the list prices of CloudWatch Logs ingestion and of
+// standard API requests in us-east-1. Prices vary by region and change, use
+// those of the bill for accurate estimates.
+var DefaultPrices = Prices{
+	IngestedGB: 0.50,
+	OtherCalls: 0.01,
+}
+
+// call returns the price of a call to op.
+func (p *Prices) call(op string) float64 {
+	if price, ok := p.Calls[op]; ok {
+		return price / 1000
+	}
+	return p.OtherCalls / 1000
+}
+
+// Limits are the budget of a network. Budgets refill continuously, a
+// network that was idle can use a whole period's budget at once.
+type Limits struct {
+	// BytesPerHour are the bytes CloudWatch Logs may ingest in an hour,
+	// unlimited if zero.
+	BytesPerHour uint64
+	// CallsPerMinute are the calls to AWS allowed in a minute, unlimited if
+	// zero.
+	CallsPerMinute uint64
+	// Action is Shed or Delay, Shed if empty.
+	Action string
+	// MaxDelay bounds the wait of calls with Delay, DefaultMaxDelay if zero.
+	MaxDelay time.Duration
+}
+
+// Options configure a Meter.
+type Options struct {
+	// Network is the name of the network metered, in log messages.
+	Network string
+	// Prices estimate the cost of calls, DefaultPrices if nil.
+	Prices *Prices
+	Limits Limits
+	// Logger gets a message every time a call is over budget, rate limited
+	// like every message. logging.Default is used if nil.
+	Logger logging.Logger
+}
+
+// Usage is what the links of a network used.
+type Usage struct {
+	// Calls are the calls made by operation.
+	Calls map[string]uint64 `json:"calls,omitempty"`
+	// IngestedBytes are the bytes of the log events put, as billed: their
+	// message plus EventOverhead each.
+	IngestedBytes uint64 `json:"ingestedBytes"`
+	// Cost is the estimated cost of the calls and ingested bytes, in
+	// dollars.
+	Cost float64 `json:"cost"`
+	// Shed are the calls refused over budget by operation, Delayed those
+	// that waited for it and Waited the time they waited.
+	Shed    map[string]uint64 `json:"shed,omitempty"`
+	Delayed map[string]uint64 `json:"delayed,omitempty"`
+	Waited  time.Duration     `json:"waited"`
+}
+
+func (u Usage) String() string {
+	parts := []string{fmt.Sprintf("ingested %dB, cost $%.4f", u.IngestedBytes, u.Cost)}
+	if len(u.Calls) > 0 {
+		parts = append(parts, "calls "+joinCounts(u.Calls))
+	}
+	if len(u.Shed) > 0 {
+		parts = append(parts, "shed "+joinCounts(u.Shed))
+	}
+	if len(u.Delayed) > 0 {
+		parts = append(parts, fmt.Sprintf("delayed %v for %v", joinCounts(u.Delayed), u.Waited.Round(time.Millisecond)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func joinCounts(m map[string]uint64) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var s []string
+	for _, k := range keys {
+		s = append(s, fmt.Sprintf("%v=%d", k, m[k]))
+	}
+	return strings.Join(s, ",")
+}
+
+// Meter meters and limits the calls of the links of a network. Links of the
+// same network in a process should share it. A nil Meter admits every call
+// without counting it.
+type Meter struct {
+	prices   Prices
+	action   string
+	maxDelay time.Duration
+	logger   logging.Logger
+
+	mu    sync.Mutex
+	bytes *bucket
+	calls *bucket
+	usage Usage
+	// now and sleep are replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// New returns a meter enforcing the limits of opts.
+func New(opts *Options) *Meter {
+	m := &Meter{
+		prices:   DefaultPrices,
+		action:   opts.Limits.Action,
+		maxDelay: opts.Limits.MaxDelay,
+		logger:   logging.OrDefault(opts.Logger).With("network", opts.Network),
+		usage:    Usage{Calls: map[string]uint64{}, Shed: map[string]uint64{}, Delayed: map[string]uint64{}},
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+	if opts.Prices != nil {
+		m.prices = *opts.Prices
+	}
+	if m.action == "" {
+		m.action = Shed
+	}
+	if m.maxDelay == 0 {
+		m.maxDelay = DefaultMaxDelay
+	}
+	if l := opts.Limits.BytesPerHour; l > 0 {
+		m.bytes = &bucket{size: float64(l), rate: float64(l) / time.Hour.Seconds()}
+	}
+	if l := opts.Limits.CallsPerMinute; l > 0 {
+		m.calls = &bucket{size: float64(l), rate: float64(l) / time.Minute.Seconds()}
+	}
+	return m
+}
+
+// Admit meters a call to op having CloudWatch Logs ingest n bytes. It
+// returns ErrOverBudget if the call would exceed the budget and must not be
+// made, after waiting for the budget with Delay.
+func (m *Meter) Admit(op string, n int) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	now := m.now()
+	wait := m.bytes.reserve(now, float64(n))
+	if w := m.calls.reserve(now, 1); w > wait {
+		wait = w
+	}
+	if wait > 0 && (m.action != Delay || wait > m.maxDelay) {
+		// Give back what was reserved, the call is not made.
+		m.bytes.cancel(float64(n))
+		m.calls.cancel(1)
+		m.usage.Shed[op]++
+		m.mu.Unlock()
+		m.logger.Warn("over budget", "action", Shed, "op", op, "bytes", n)
+		return ErrOverBudget
+	}
+	m.count(op, n)
+	if wait > 0 {
+		m.usage.Delayed[op]++
+		m.usage.Waited += wait
+	}
+	m.mu.Unlock()
+	if wait > 0 {
+		m.logger.Warn("over budget", "action", Delay, "op", op, "bytes", n, "delay", wait.Round(time.Millisecond))
+		m.sleep(wait)
+	}
+	return nil
+}
+
+// count adds a call to the usage, holding mu.
+func (m *Meter) count(op string, n int) {
+	m.usage.Calls[op]++
+	m.usage.IngestedBytes += uint64(n)
+	m.usage.Cost += m.prices.call(op) + float64(n)/1e9*m.prices.IngestedGB
+}
+
+// Usage returns what was used so far, empty for a nil Meter.
+func (m *Meter) Usage() Usage {
+	if m == nil {
+		return Usage{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usage
+	u.Calls, u.Shed, u.Delayed = copyCounts(u.Calls), copyCounts(u.Shed), copyCounts(u.Delayed)
+	return u
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// bucket is a token bucket of size tokens refilled at rate per second. A
+// nil bucket is unlimited.
+type bucket struct {
+	size   float64
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes n tokens, going into debt if there are not enough, and
+// returns how long until the debt is paid back.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.size
+	} else if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.size {
+			b.tokens = b.size
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back n reserved tokens.
+func (b *bucket) cancel(n float64) {
+	if b != nil {
+		b.tokens += n
+	}
+}
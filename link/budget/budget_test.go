@@ -0,0 +1,86 @@
+package budget
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// newTestMeter returns a meter on a fake clock, which sleeps move forward.
+func newTestMeter(limits Limits) (*Meter, *time.Time) {
+	now := time.Unix(1546300800, 0)
+	m := New(&Options{Network: "TestNet", Limits: limits, Logger: logging.Discard})
+	m.now = func() time.Time { return now }
+	m.sleep = func(d time.Duration) { now = now.Add(d) }
+	return m, &now
+}
+
+func TestMeter_Shed(t *testing.T) {
+	m, now := newTestMeter(Limits{CallsPerMinute: 2, BytesPerHour: 3600})
+	if m.Admit("FilterLogEvents", 0) != nil || m.Admit("PutLogEvents", 1000) != nil {
+		t.Fatalf("Expected calls within the budget to be admitted")
+	}
+	if err := m.Admit("FilterLogEvents", 0); err != ErrOverBudget {
+		t.Errorf("Expected a third call in a minute to be shed, got %v", err)
+	}
+	*now = now.Add(30 * time.Second)
+	if err := m.Admit("PutLogEvents", 3000); err != ErrOverBudget {
+		t.Errorf("Expected more bytes than left in the hour to be shed, got %v", err)
+	}
+	if err := m.Admit("PutLogEvents", 500); err != nil {
+		t.Errorf("Expected the refilled budget to admit a call, got %v", err)
+	}
+
+	u := m.Usage()
+	if u.Calls["FilterLogEvents"] != 1 || u.Calls["PutLogEvents"] != 2 || u.IngestedBytes != 1500 {
+		t.Errorf("Expected shed calls not to be counted, got %v", u)
+	}
+	if u.Shed["FilterLogEvents"] != 1 || u.Shed["PutLogEvents"] != 1 {
+		t.Errorf("Expected a shed call of each operation, got %v", u.Shed)
+	}
+}
+
+func TestMeter_Delay(t *testing.T) {
+	m, now := newTestMeter(Limits{CallsPerMinute: 60, Action: Delay, MaxDelay: 5 * time.Second})
+	start := *now
+	for i := 0; i < 62; i++ {
+		if err := m.Admit("TagResource", 0); err != nil {
+			t.Fatalf("Expected call %d to be delayed, got %v", i, err)
+		}
+	}
+	if waited := now.Sub(start); waited != 2*time.Second {
+		t.Errorf("Expected the calls over budget to wait a second each, waited %v", waited)
+	}
+	u := m.Usage()
+	if u.Delayed["TagResource"] != 2 || u.Waited != 2*time.Second {
+		t.Errorf("Unexpected delays %v", u)
+	}
+
+	// Concurrent callers go into debt, until waiting takes too long.
+	m.sleep = func(time.Duration) {}
+	for i := 0; i < 5; i++ {
+		m.Admit("TagResource", 0)
+	}
+	if err := m.Admit("TagResource", 0); err != ErrOverBudget {
+		t.Errorf("Expected a call waiting over MaxDelay to be shed, got %v", err)
+	}
+}
+
+func TestMeter_Cost(t *testing.T) {
+	m, _ := newTestMeter(Limits{})
+	m.prices = Prices{IngestedGB: 0.5, Calls: map[string]float64{"PutLogEvents": 0}, OtherCalls: 0.01}
+	for i := 0; i < 1000; i++ {
+		m.Admit("PutLogEvents", 1e6)
+		m.Admit("FilterLogEvents", 0)
+	}
+	if cost := m.Usage().Cost; math.Abs(cost-0.51) > 1e-9 {
+		t.Errorf("Expected a GB and a thousand calls to cost $0.51, got %v", cost)
+	}
+
+	var nilMeter *Meter
+	if nilMeter.Admit("PutLogEvents", 1<<30) != nil || nilMeter.Usage().Cost != 0 {
+		t.Errorf("Expected a nil meter to admit everything")
+	}
+}
@@ -0,0 +1,315 @@
+// Package capture records packets of link endpoints to pcapng files that
+// Wireshark and tcpdump can read.
+//
+// A Capture owns the files, each endpoint wrapped with New is an interface
+// of the capture, with the Ethernet link type when the endpoint has
+// Ethernet headers and raw IP otherwise. Captures are started and stopped
+// at runtime, optionally filtered with a tcpdump-like expression and rotated
+// by size or age.
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// DefaultMaxFiles is the number of rotated files kept when Options.MaxFiles
+// is zero.
+const DefaultMaxFiles = 5
+
+// Options configure a Capture.
+type Options struct {
+	// Path of the current file, rotated files get a .1, .2... suffix, the
+	// oldest having the largest.
+	Path string
+	// Filter is a filter expression, see ParseExpr. Every packet is
+	// recorded when empty.
+	Filter string
+	// Snaplen is the maximum recorded length of packets, DefaultSnaplen if
+	// zero.
+	Snaplen uint32
+	// MaxSize rotates the file once it reaches this many bytes, never if zero.
+	MaxSize int64
+	// MaxAge rotates the file once it is this old, never if zero.
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files kept, DefaultMaxFiles if zero.
+	MaxFiles int
+	// Logger gets the messages of the capture, logging.Default if nil.
+	Logger logging.Logger
+}
+
+// Stats are the counters of a capture.
+type Stats struct {
+	Running  bool   `json:"running"`
+	Path     string `json:"path"`
+	Filter   string `json:"filter"`
+	Packets  uint64 `json:"packets"`
+	Bytes    uint64 `json:"bytes"`
+	Filtered uint64 `json:"filtered"`
+	Errors   uint64 `json:"errors"`
+	Rotated  uint64 `json:"rotated"`
+}
+
+// iface is an endpoint recorded by the capture.
+type iface struct {
+	name     string
+	linkType uint16
+}
+
+// Capture writes the packets of its interfaces to a pcapng file.
+type Capture struct {
+	path     string
+	snaplen  uint32
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	logger   logging.Logger
+
+	running  int32 // atomic, checked before taking mu
+	packets  uint64
+	bytes    uint64
+	filtered uint64
+	errors   uint64
+	rotated  uint64
+
+	mu      sync.Mutex
+	expr    *Expr
+	ifaces  []iface
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	opened  time.Time
+	flusher *time.Ticker
+	done    chan struct{}
+}
+
+// NewCapture creates a stopped capture.
+func NewCapture(opts *Options) (*Capture, error) {
+	if opts.Path == "" {
+		return nil, errors.New("capture: a path is required")
+	}
+	c := &Capture{
+		path:     opts.Path,
+		snaplen:  opts.Snaplen,
+		maxSize:  opts.MaxSize,
+		maxAge:   opts.MaxAge,
+		maxFiles: opts.MaxFiles,
+		logger:   logging.OrDefault(opts.Logger).With("path", opts.Path),
+	}
+	if c.snaplen == 0 {
+		c.snaplen = DefaultSnaplen
+	}
+	if c.maxFiles == 0 {
+		c.maxFiles = DefaultMaxFiles
+	}
+	if err := c.SetFilter(opts.Filter); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// addInterface registers an endpoint, it returns the interface index used
+// in packet blocks.
+func (c *Capture) addInterface(name string, linkType uint16) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ifaces = append(c.ifaces, iface{name: name, linkType: linkType})
+	if c.w != nil {
+		c.countErr(c.writeN(writeInterface(c.w, name, linkType, c.snaplen)))
+	}
+	return uint32(len(c.ifaces) - 1)
+}
+
+// SetFilter replaces the filter expression, an empty one records every
+// packet.
+func (c *Capture) SetFilter(s string) error {
+	e, err := ParseExpr(s)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.expr = e
+	c.mu.Unlock()
+	return nil
+}
+
+// Start starts recording to a new file, the current file is rotated first.
+func (c *Capture) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flusher != nil {
+		return nil
+	}
+	if err := c.open(); err != nil {
+		if c.w != nil {
+			c.close()
+		}
+		return err
+	}
+	c.flusher = time.NewTicker(time.Second)
+	c.done = make(chan struct{})
+	go c.flushLoop(c.flusher, c.done)
+	atomic.StoreInt32(&c.running, 1)
+	c.logger.Info("started capture")
+	return nil
+}
+
+// Stop stops recording and closes the file.
+func (c *Capture) Stop() error {
+	atomic.StoreInt32(&c.running, 0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flusher == nil {
+		return nil
+	}
+	err := c.stop()
+	c.logger.Info("stopped capture")
+	return err
+}
+
+// stop stops the flusher and closes the file if it is still open, which it
+// isn't after a failed rotation.
+func (c *Capture) stop() error {
+	atomic.StoreInt32(&c.running, 0)
+	c.flusher.Stop()
+	close(c.done)
+	c.flusher, c.done = nil, nil
+	if c.w == nil {
+		return nil
+	}
+	return c.close()
+}
+
+// Running reports whether the capture is recording.
+func (c *Capture) Running() bool {
+	return atomic.LoadInt32(&c.running) == 1
+}
+
+// Stats returns the counters of the capture.
+func (c *Capture) Stats() Stats {
+	c.mu.Lock()
+	filter := c.expr.String()
+	c.mu.Unlock()
+	return Stats{
+		Running:  c.Running(),
+		Path:     c.path,
+		Filter:   filter,
+		Packets:  atomic.LoadUint64(&c.packets),
+		Bytes:    atomic.LoadUint64(&c.bytes),
+		Filtered: atomic.LoadUint64(&c.filtered),
+		Errors:   atomic.LoadUint64(&c.errors),
+		Rotated:  atomic.LoadUint64(&c.rotated),
+	}
+}
+
+func (c *Capture) flushLoop(t *time.Ticker, done chan struct{}) {
+	for {
+		select {
+		case <-t.C:
+			c.mu.Lock()
+			if c.w != nil {
+				c.countErr(c.w.Flush())
+			}
+			c.mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// record writes a packet of interface i if it passes the filter. data is
+// the frame as recorded, with its link header.
+func (c *Capture) record(i uint32, p *packet, data []byte, flags uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil {
+		return
+	}
+	if !c.expr.match(p) {
+		atomic.AddUint64(&c.filtered, 1)
+		return
+	}
+	if c.rotateDue() {
+		if err := c.rotate(); err != nil {
+			atomic.AddUint64(&c.errors, 1)
+			c.stop()
+			c.logger.Error("stopped capture, could not rotate the file", "err", err)
+			return
+		}
+	}
+	origLen := len(data)
+	if uint32(len(data)) > c.snaplen {
+		data = data[:c.snaplen]
+	}
+	if err := c.writeN(writePacket(c.w, i, time.Now(), data, origLen, flags)); err != nil {
+		c.countErr(err)
+		return
+	}
+	atomic.AddUint64(&c.packets, 1)
+	atomic.AddUint64(&c.bytes, uint64(origLen))
+}
+
+func (c *Capture) countErr(err error) {
+	if err != nil && atomic.AddUint64(&c.errors, 1) == 1 {
+		c.logger.Error("could not write capture", "err", err)
+	}
+}
+
+func (c *Capture) writeN(n int, err error) error {
+	c.size += int64(n)
+	return err
+}
+
+func (c *Capture) rotateDue() bool {
+	return (c.maxSize > 0 && c.size >= c.maxSize) || (c.maxAge > 0 && time.Since(c.opened) >= c.maxAge)
+}
+
+func (c *Capture) rotate() error {
+	if err := c.close(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.rotated, 1)
+	return c.open()
+}
+
+// open shifts the existing files by one and starts a new section at path.
+func (c *Capture) open() error {
+	os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxFiles))
+	for n := c.maxFiles - 1; n >= 1; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, n), fmt.Sprintf("%s.%d", c.path, n+1))
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	c.file, c.w, c.size, c.opened = f, bufio.NewWriter(f), 0, time.Now()
+	if err := c.writeN(writeSectionHeader(c.w)); err != nil {
+		return err
+	}
+	for _, i := range c.ifaces {
+		if err := c.writeN(writeInterface(c.w, i.name, i.linkType, c.snaplen)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Capture) close() error {
+	err := c.w.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.w = nil, nil
+	return err
+}
@@ -0,0 +1,281 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+func tcpPacket(src, dst string, sport, dport uint16) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     tcpip.Address(net.ParseIP(src).To4()),
+		DstAddr:     tcpip.Address(net.ParseIP(dst).To4()),
+	})
+	header.TCP(b[header.IPv4MinimumSize:]).Encode(&header.TCPFields{
+		SrcPort:    sport,
+		DstPort:    dport,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+	})
+	return b
+}
+
+func TestParseExpr(t *testing.T) {
+	web := parsePacket(header.IPv4ProtocolNumber, tcpPacket("192.168.1.3", "192.168.1.21", 40000, 80))
+	arp := parsePacket(header.ARPProtocolNumber, make([]byte, header.ARPSize))
+	tables := []struct {
+		expr     string
+		web, arp bool
+	}{
+		{"", true, true},
+		{"tcp", true, false},
+		{"udp or icmp", false, false},
+		{"arp", false, true},
+		{"port 80", true, false},
+		{"src port 80", false, false},
+		{"dst port 79-81", true, false},
+		{"host 192.168.1.21", true, false},
+		{"src host 192.168.1.21", false, false},
+		{"net 192.168.1.0/24 and tcp", true, false},
+		{"not tcp", false, true},
+		{"!(tcp && port 80)", false, true},
+		{"tcp and (port 22 or port 80)", true, false},
+		{"tcp port 80", true, false},
+	}
+	for _, table := range tables {
+		e, err := ParseExpr(table.expr)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): unexpected error: %v", table.expr, err)
+			continue
+		}
+		if e.match(web) != table.web || e.match(arp) != table.arp {
+			t.Errorf("ParseExpr(%q): got web %v arp %v, want %v %v", table.expr, e.match(web), e.match(arp), table.web, table.arp)
+		}
+	}
+	for _, s := range []string{"tcp and", "port http", "host 300.1.1.1", "(tcp", "tcp port", "sctp", "port 90-80"} {
+		if _, err := ParseExpr(s); err == nil {
+			t.Errorf("ParseExpr(%q): expected an error", s)
+		}
+	}
+}
+
+type pcapBlock struct {
+	typ  uint32
+	body []byte
+}
+
+func readBlocks(t *testing.T, path string) []pcapBlock {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var blocks []pcapBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%v: truncated block", path)
+		}
+		n := le.Uint32(data[4:])
+		if n%4 != 0 || int(n) > len(data) || le.Uint32(data[n-4:]) != n {
+			t.Fatalf("%v: invalid block length %d", path, n)
+		}
+		blocks = append(blocks, pcapBlock{le.Uint32(data), data[8 : n-4]})
+		data = data[n:]
+	}
+	return blocks
+}
+
+func newTestCapture(t *testing.T, opts *Options) (*Capture, string) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	opts.Path = filepath.Join(dir, "overlay.pcapng")
+	c, err := NewCapture(opts)
+	if err != nil {
+		t.Fatalf("NewCapture: %v", err)
+	}
+	return c, dir
+}
+
+func TestCapture_Pcapng(t *testing.T) {
+	c, dir := newTestCapture(t, &Options{Filter: "tcp"})
+	defer os.RemoveAll(dir)
+	eth := &endpoint{capture: c, index: c.addInterface("overlay", LinkTypeEthernet), ethernet: true}
+	raw := &endpoint{capture: c, index: c.addInterface("tun0", LinkTypeRaw)}
+
+	local, remote := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01"), tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	pkt := buffer.View(tcpPacket("192.168.1.3", "192.168.1.21", 40000, 80))
+	eth.record(local, remote, header.IPv4ProtocolNumber, []buffer.View{pkt}, flagOutbound)
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	eth.record(local, remote, header.IPv4ProtocolNumber, []buffer.View{pkt[:20], pkt[20:]}, flagOutbound)
+	raw.record("", "", header.IPv4ProtocolNumber, []buffer.View{pkt}, flagInbound)
+	raw.record(remote, local, header.ARPProtocolNumber, []buffer.View{make([]byte, header.ARPSize)}, flagInbound)
+	eth.record(remote, "", header.ARPProtocolNumber, []buffer.View{make([]byte, header.ARPSize)}, flagInbound)
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	s := c.Stats()
+	if s.Packets != 2 || s.Filtered != 1 || s.Errors != 0 {
+		t.Errorf("Expected 2 packets and 1 filtered, got %+v", s)
+	}
+	blocks := readBlocks(t, c.path)
+	if len(blocks) != 5 || blocks[0].typ != blockSection || blocks[1].typ != blockInterface || blocks[3].typ != blockPacket {
+		t.Fatalf("Expected a section, 2 interfaces and 2 packets, got %v blocks", len(blocks))
+	}
+	if le.Uint16(blocks[1].body) != LinkTypeEthernet || le.Uint16(blocks[2].body) != LinkTypeRaw {
+		t.Errorf("Unexpected link types")
+	}
+
+	ethPacket := blocks[3].body
+	if le.Uint32(ethPacket) != 0 || le.Uint32(ethPacket[12:]) != uint32(header.EthernetMinimumSize+len(pkt)) {
+		t.Errorf("Expected the packet on interface 0 with an Ethernet header")
+	}
+	frame := header.Ethernet(ethPacket[20:])
+	if frame.SourceAddress() != local || frame.DestinationAddress() != remote || frame.Type() != header.IPv4ProtocolNumber {
+		t.Errorf("Unexpected Ethernet header %v -> %v %v", frame.SourceAddress(), frame.DestinationAddress(), frame.Type())
+	}
+	rawPacket := blocks[4].body
+	if le.Uint32(rawPacket) != 1 || !bytes.Equal(rawPacket[20:20+len(pkt)], pkt) {
+		t.Errorf("Expected the raw packet on interface 1")
+	}
+}
+
+func TestCapture_Rotate(t *testing.T) {
+	c, dir := newTestCapture(t, &Options{MaxSize: 200, MaxFiles: 2})
+	defer os.RemoveAll(dir)
+	raw := &endpoint{capture: c, index: c.addInterface("tun0", LinkTypeRaw)}
+	pkt := buffer.View(tcpPacket("192.168.1.3", "192.168.1.21", 40000, 80))
+
+	c.Start()
+	for i := 0; i < 10; i++ {
+		raw.record("", "", header.IPv4ProtocolNumber, []buffer.View{pkt}, flagInbound)
+	}
+	c.Stop()
+
+	if s := c.Stats(); s.Packets != 10 || s.Rotated == 0 {
+		t.Errorf("Expected 10 packets over several files, got %+v", s)
+	}
+	for _, name := range []string{"overlay.pcapng", "overlay.pcapng.1", "overlay.pcapng.2"} {
+		blocks := readBlocks(t, filepath.Join(dir, name))
+		if blocks[0].typ != blockSection || blocks[1].typ != blockInterface {
+			t.Errorf("%v: expected every file to start with a section and the interfaces", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "overlay.pcapng.3")); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 rotated files to be kept")
+	}
+}
+
+func TestCapture_RotateFailure(t *testing.T) {
+	c, dir := newTestCapture(t, &Options{MaxSize: 200, MaxFiles: 1})
+	defer os.RemoveAll(dir)
+	raw := &endpoint{capture: c, index: c.addInterface("tun0", LinkTypeRaw)}
+	pkt := buffer.View(tcpPacket("192.168.1.3", "192.168.1.21", 40000, 80))
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	// The file can't be rotated over a directory that isn't empty.
+	if err := os.MkdirAll(filepath.Join(dir, "overlay.pcapng.1", "busy"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		raw.record("", "", header.IPv4ProtocolNumber, []buffer.View{pkt}, flagInbound)
+	}
+	if s := c.Stats(); s.Running || s.Errors != 1 || s.Packets == 0 || s.Packets == 10 {
+		t.Errorf("Expected the capture to stop when it couldn't rotate, got %+v", s)
+	}
+	if err := c.Stop(); err != nil {
+		t.Errorf("Stop: unexpected error: %v", err)
+	}
+
+	// It can be started again once the file can be rotated.
+	os.RemoveAll(filepath.Join(dir, "overlay.pcapng.1"))
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if !c.Running() {
+		t.Errorf("Expected the capture to run again")
+	}
+	c.Stop()
+}
+
+func TestCapture_Handler(t *testing.T) {
+	c, dir := newTestCapture(t, &Options{})
+	defer os.RemoveAll(dir)
+	srv := httptest.NewServer(c.Handler())
+	defer srv.Close()
+
+	post := func(path string) (Stats, int) {
+		resp, err := http.Post(srv.URL+path, "", nil)
+		if err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		defer resp.Body.Close()
+		var s Stats
+		json.NewDecoder(resp.Body).Decode(&s)
+		return s, resp.StatusCode
+	}
+	if s, code := post("/start?filter=udp+port+53"); code != http.StatusOK || !s.Running || s.Filter != "udp port 53" {
+		t.Errorf("Expected a running capture of DNS, got %v %+v", code, s)
+	}
+	if _, code := post("/start?filter=udp+port"); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid filter to be rejected, got %v", code)
+	}
+	if s, code := post("/stop"); code != http.StatusOK || s.Running {
+		t.Errorf("Expected a stopped capture, got %v %+v", code, s)
+	}
+	if err := c.Toggle(); err != nil || !c.Running() {
+		t.Errorf("Expected Toggle to start the capture: %v", err)
+	}
+	c.Stop()
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	a, _ := w.AddInterface("TestNet/020000000001/020000000002", LinkTypeEthernet)
+	b, _ := w.AddInterface("TestNet/ffffffffffff/020000000002", LinkTypeEthernet)
+	ts := time.Unix(1546300800, 123000000)
+	w.WritePacket(b, ts, make([]byte, 42))
+	w.WritePacket(a, ts.Add(time.Millisecond), make([]byte, 60))
+
+	f, err := ioutil.TempFile("", "writer")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(buf.Bytes())
+	f.Close()
+	blocks := readBlocks(t, f.Name())
+	if len(blocks) != 5 || blocks[3].typ != blockPacket {
+		t.Fatalf("Expected a section, 2 interfaces and 2 packets, got %v blocks", len(blocks))
+	}
+	first := blocks[3].body
+	usec := uint64(le.Uint32(first[4:]))<<32 | uint64(le.Uint32(first[8:]))
+	if le.Uint32(first) != b || usec != uint64(ts.UnixNano()/1000) || le.Uint32(first[12:]) != 42 {
+		t.Errorf("Unexpected first packet: interface %v at %v, %v bytes", le.Uint32(first), usec, le.Uint32(first[12:]))
+	}
+}
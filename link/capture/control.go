@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Toggle starts a stopped capture and stops a running one, for signal
+// handlers.
+func (c *Capture) Toggle() error {
+	if c.Running() {
+		return c.Stop()
+	}
+	return c.Start()
+}
+
+// Handler returns the control API of the capture:
+//
+//	GET  /status                 the Stats, as JSON
+//	POST /start[?filter=expr]    starts, replacing the filter if given
+//	POST /stop                   stops
+//
+// Every request answers with the Stats after it.
+func (c *Capture) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		c.reply(w, nil)
+	})
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if filter, ok := r.URL.Query()["filter"]; ok {
+			if err := c.SetFilter(filter[0]); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		c.reply(w, c.Start())
+	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		c.reply(w, c.Stop())
+	})
+	return mux
+}
+
+func (c *Capture) reply(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Stats())
+}
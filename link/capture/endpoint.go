@@ -0,0 +1,135 @@
+package capture
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// broadcastMAC stands in for frames sent without a destination, which links
+// deliver to every member.
+const broadcastMAC = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+
+// Interface describes a captured endpoint.
+type Interface struct {
+	// Name is shown by packet analyzers, i.e. "overlay" or "tun0".
+	Name string
+	// EthernetHeader records frames with an Ethernet header built from the
+	// link addresses, otherwise packets are recorded as raw IP and ARP is
+	// left out. It should match the endpoint's own option.
+	EthernetHeader bool
+}
+
+type endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+	capture    *Capture
+	index      uint32
+	ethernet   bool
+}
+
+// New creates a link endpoint that records the packets between the lower
+// endpoint and the stack to c while c is running.
+func New(lower tcpip.LinkEndpointID, c *Capture, i Interface) tcpip.LinkEndpointID {
+	linkType := uint16(LinkTypeRaw)
+	if i.EthernetHeader {
+		linkType = LinkTypeEthernet
+	}
+	return stack.RegisterLinkEndpoint(&endpoint{
+		lower:    stack.FindLinkEndpoint(lower),
+		capture:  c,
+		index:    c.addInterface(i.Name, linkType),
+		ethernet: i.EthernetHeader,
+	})
+}
+
+// frame returns the packet as recorded, with an Ethernet header if the
+// interface has them. It returns nil for packets raw IP can't carry.
+func (e *endpoint) frame(src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, views []buffer.View) []byte {
+	if !e.ethernet && protocol != header.IPv4ProtocolNumber && protocol != header.IPv6ProtocolNumber {
+		return nil
+	}
+	size := 0
+	for _, v := range views {
+		size += len(v)
+	}
+	var b []byte
+	if e.ethernet {
+		if dst == "" {
+			dst = broadcastMAC
+		}
+		b = make([]byte, header.EthernetMinimumSize, header.EthernetMinimumSize+size)
+		header.Ethernet(b).Encode(&header.EthernetFields{SrcAddr: src, DstAddr: dst, Type: protocol})
+	} else {
+		b = make([]byte, 0, size)
+	}
+	for _, v := range views {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func (e *endpoint) record(src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, views []buffer.View, flags uint32) {
+	data := e.frame(src, dst, protocol, views)
+	if data == nil {
+		return
+	}
+	payload := data
+	if e.ethernet {
+		payload = data[header.EthernetMinimumSize:]
+	}
+	e.capture.record(e.index, parsePacket(protocol, payload), data, flags)
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	if e.capture.Running() {
+		e.record(remote, local, protocol, vv.Views(), flagInbound)
+	}
+	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
+}
+
+// Attach implements stack.LinkEndpoint.Attach.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU.
+func (e *endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength.
+func (e *endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress.
+func (e *endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket.
+func (e *endpoint) WritePacket(r *stack.Route, gso *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.capture.Running() {
+		src := r.LocalLinkAddress
+		if src == "" {
+			src = e.lower.LinkAddress()
+		}
+		views := append([]buffer.View{hdr.View()}, payload.Views()...)
+		e.record(src, r.RemoteLinkAddress, protocol, views, flagOutbound)
+	}
+	return e.lower.WritePacket(r, gso, hdr, payload, protocol)
+}
@@ -0,0 +1,262 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/smithclay/rlinklayer/link/filter"
+)
+
+// packet is what filter expressions look at.
+type packet struct {
+	protocol tcpip.NetworkProtocolNumber
+	// ip is set for IPv4 packets that could be parsed.
+	ip *filter.Packet
+	// src and dst are the protocol addresses of ARP packets.
+	src, dst net.IP
+}
+
+func parsePacket(protocol tcpip.NetworkProtocolNumber, b []byte) *packet {
+	p := &packet{protocol: protocol}
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if ip, ok := filter.ParseIPv4(b); ok {
+			p.ip = &ip
+			p.src, p.dst = ip.Src, ip.Dst
+		}
+	case header.ARPProtocolNumber:
+		if a := header.ARP(b); a.IsValid() {
+			p.src = net.IP(a.ProtocolAddressSender())
+			p.dst = net.IP(a.ProtocolAddressTarget())
+		}
+	}
+	return p
+}
+
+// Expr is a compiled filter expression.
+type Expr struct {
+	text  string
+	match func(p *packet) bool
+}
+
+func (e *Expr) String() string {
+	return e.text
+}
+
+// MatchEthernet reports whether an Ethernet frame passes the expression.
+func (e *Expr) MatchEthernet(frame []byte) bool {
+	if len(frame) < header.EthernetMinimumSize {
+		return false
+	}
+	eth := header.Ethernet(frame)
+	return e.match(parsePacket(eth.Type(), frame[header.EthernetMinimumSize:]))
+}
+
+// ParseExpr compiles a filter expression in a subset of the tcpdump syntax:
+// the protocols ip, arp, tcp, udp and icmp, [src|dst] host ADDR,
+// [src|dst] net CIDR and [src|dst] port N or N-M, combined with and, or, not
+// (or &&, ||, !) and parentheses, juxtaposition meaning and. An empty
+// expression matches everything.
+//
+//	tcp and port 80
+//	host 192.168.1.21 and not (arp or icmp)
+func ParseExpr(s string) (*Expr, error) {
+	p := &exprParser{tokens: tokenize(s)}
+	if len(p.tokens) == 0 {
+		return &Expr{match: func(*packet) bool { return true }}, nil
+	}
+	match, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ParseExpr: %q: %v", s, err)
+	}
+	return &Expr{text: strings.Join(p.tokens, " "), match: match}, nil
+}
+
+func tokenize(s string) []string {
+	for _, op := range []string{"(", ")", "!"} {
+		s = strings.Replace(s, op, " "+op+" ", -1)
+	}
+	return strings.Fields(s)
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *exprParser) or() (func(*packet) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pkt *packet) bool { return l(pkt) || right(pkt) }
+	}
+	return left, nil
+}
+
+func (p *exprParser) and() (func(*packet) bool, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "", "or", "||", ")":
+			return left, nil
+		case "and", "&&":
+			p.pos++
+		}
+		// Juxtaposed primitives are and-ed, as in "udp port 53".
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pkt *packet) bool { return l(pkt) && right(pkt) }
+	}
+}
+
+func (p *exprParser) not() (func(*packet) bool, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		m, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *packet) bool { return !m(pkt) }, nil
+	case "(":
+		p.pos++
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	}
+	return p.primitive()
+}
+
+func (p *exprParser) primitive() (func(*packet) bool, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "ip":
+		return func(pkt *packet) bool { return pkt.protocol == header.IPv4ProtocolNumber }, nil
+	case "arp":
+		return func(pkt *packet) bool { return pkt.protocol == header.ARPProtocolNumber }, nil
+	case "tcp":
+		return transport(header.TCPProtocolNumber), nil
+	case "udp":
+		return transport(header.UDPProtocolNumber), nil
+	case "icmp":
+		return transport(header.ICMPv4ProtocolNumber), nil
+	}
+
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+	case "dst":
+		src = false
+	}
+	if !src || !dst {
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+	arg, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "host":
+		ip := net.ParseIP(arg).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q", arg)
+		}
+		return addresses(src, dst, func(a net.IP) bool { return ip.Equal(a) }), nil
+	case "net":
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", arg)
+		}
+		return addresses(src, dst, n.Contains), nil
+	case "port":
+		lo, hi, err := parsePorts(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *packet) bool {
+			if pkt.ip == nil || pkt.ip.Fragment {
+				return false
+			}
+			switch pkt.ip.Protocol {
+			case header.TCPProtocolNumber, header.UDPProtocolNumber:
+			default:
+				return false
+			}
+			in := func(port uint16) bool { return port >= lo && port <= hi }
+			return (src && in(pkt.ip.SrcPort)) || (dst && in(pkt.ip.DstPort))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+func transport(protocol tcpip.TransportProtocolNumber) func(*packet) bool {
+	return func(pkt *packet) bool { return pkt.ip != nil && pkt.ip.Protocol == protocol }
+}
+
+func addresses(src, dst bool, match func(net.IP) bool) func(*packet) bool {
+	return func(pkt *packet) bool {
+		return (src && pkt.src != nil && match(pkt.src)) || (dst && pkt.dst != nil && match(pkt.dst))
+	}
+}
+
+func parsePorts(s string) (uint16, uint16, error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if len(parts) == 2 {
+		if hi, err = strconv.ParseUint(parts[1], 10, 16); err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return uint16(lo), uint16(hi), nil
+}
@@ -0,0 +1,142 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Link types of interfaces, from the tcpdump.org list.
+const (
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+)
+
+// pcapng block types and options, from draft-tuexen-opsawg-pcapng.
+const (
+	blockSection   = 0x0A0D0D0A
+	blockInterface = 0x00000001
+	blockPacket    = 0x00000006
+	byteOrderMagic = 0x1A2B3C4D
+
+	optEnd      = 0
+	optIfName   = 2
+	optEPBFlags = 2
+
+	// Direction bits of epb_flags.
+	flagInbound  = 1
+	flagOutbound = 2
+)
+
+// DefaultSnaplen is the snapshot length of interfaces created without one.
+const DefaultSnaplen = 65535
+
+var le = binary.LittleEndian
+
+// pad4 returns n rounded up to a multiple of 4.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// block frames a pcapng block of type typ around body, which must be padded.
+func block(typ uint32, body []byte) []byte {
+	total := 12 + len(body)
+	b := make([]byte, total)
+	le.PutUint32(b[0:], typ)
+	le.PutUint32(b[4:], uint32(total))
+	copy(b[8:], body)
+	le.PutUint32(b[total-4:], uint32(total))
+	return b
+}
+
+// option encodes a block option, padded to 4 bytes.
+func option(code uint16, value []byte) []byte {
+	b := make([]byte, 4+pad4(len(value)))
+	le.PutUint16(b[0:], code)
+	le.PutUint16(b[2:], uint16(len(value)))
+	copy(b[4:], value)
+	return b
+}
+
+// endOfOptions ends an option list.
+var endOfOptions = option(optEnd, nil)
+
+// writeSectionHeader starts a section of unknown length.
+func writeSectionHeader(w io.Writer) (int, error) {
+	body := make([]byte, 16)
+	le.PutUint32(body[0:], byteOrderMagic)
+	le.PutUint16(body[4:], 1) // major version
+	le.PutUint16(body[6:], 0) // minor version
+	le.PutUint64(body[8:], ^uint64(0))
+	return w.Write(block(blockSection, body))
+}
+
+// writeInterface describes an interface, which packets refer to by the
+// order of interface blocks in the section. Timestamps are in microseconds,
+// the default resolution.
+func writeInterface(w io.Writer, name string, linkType uint16, snaplen uint32) (int, error) {
+	body := make([]byte, 8)
+	le.PutUint16(body[0:], linkType)
+	le.PutUint32(body[4:], snaplen)
+	if name != "" {
+		body = append(body, option(optIfName, []byte(name))...)
+		body = append(body, endOfOptions...)
+	}
+	return w.Write(block(blockInterface, body))
+}
+
+// writePacket writes an enhanced packet block for data, captured from a
+// packet of origLen bytes.
+func writePacket(w io.Writer, iface uint32, ts time.Time, data []byte, origLen int, flags uint32) (int, error) {
+	usec := uint64(ts.UnixNano() / int64(time.Microsecond))
+	body := make([]byte, 20+pad4(len(data)))
+	le.PutUint32(body[0:], iface)
+	le.PutUint32(body[4:], uint32(usec>>32))
+	le.PutUint32(body[8:], uint32(usec))
+	le.PutUint32(body[12:], uint32(len(data)))
+	le.PutUint32(body[16:], uint32(origLen))
+	copy(body[20:], data)
+	if flags != 0 {
+		f := make([]byte, 4)
+		le.PutUint32(f, flags)
+		body = append(body, option(optEPBFlags, f)...)
+		body = append(body, endOfOptions...)
+	}
+	return w.Write(block(blockPacket, body))
+}
+
+// Writer writes a pcapng section with packets of known timestamps, for
+// converting stored traffic rather than capturing it.
+type Writer struct {
+	w       io.Writer
+	snaplen uint32
+	ifaces  uint32
+}
+
+// NewWriter starts a section on w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := writeSectionHeader(w); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, snaplen: DefaultSnaplen}, nil
+}
+
+// AddInterface describes an interface and returns its index.
+func (w *Writer) AddInterface(name string, linkType uint16) (uint32, error) {
+	if _, err := writeInterface(w.w, name, linkType, w.snaplen); err != nil {
+		return 0, err
+	}
+	w.ifaces++
+	return w.ifaces - 1, nil
+}
+
+// WritePacket writes a packet of interface i received at ts, truncated to
+// the snapshot length.
+func (w *Writer) WritePacket(i uint32, ts time.Time, data []byte) error {
+	origLen := len(data)
+	if uint32(len(data)) > w.snaplen {
+		data = data[:w.snaplen]
+	}
+	_, err := writePacket(w.w, i, ts, data, origLen, 0)
+	return err
+}
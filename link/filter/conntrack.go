@@ -0,0 +1,117 @@
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+const (
+	// Idle timeouts are generous, round trips over AWS transports take
+	// seconds.
+	tcpTimeout     = 30 * time.Minute
+	closingTimeout = 30 * time.Second
+	udpTimeout     = 2 * time.Minute
+	icmpTimeout    = 30 * time.Second
+
+	maxFlows      = 16384
+	sweepInterval = 10 * time.Second
+)
+
+// flowKey identifies a flow in the direction of the packet it was built from.
+type flowKey struct {
+	protocol tcpip.TransportProtocolNumber
+	src, dst string
+	sport    uint16
+	dport    uint16
+}
+
+func newFlowKey(p *Packet) flowKey {
+	return flowKey{p.Protocol, string(p.Src.To4()), string(p.Dst.To4()), p.SrcPort, p.DstPort}
+}
+
+func (k flowKey) reverse() flowKey {
+	return flowKey{k.protocol, k.dst, k.src, k.dport, k.sport}
+}
+
+// conntrack tracks allowed flows so that the rest of a connection, and its
+// replies, are allowed without matching a rule.
+type conntrack struct {
+	mu        sync.Mutex
+	flows     map[flowKey]time.Time // expiry, keyed by the first packet
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+func newConntrack() *conntrack {
+	return &conntrack{flows: map[flowKey]time.Time{}, now: time.Now}
+}
+
+func timeout(p *Packet) time.Duration {
+	switch p.Protocol {
+	case header.TCPProtocolNumber:
+		if p.TCPFlags&(header.TCPFlagFin|header.TCPFlagRst) != 0 {
+			return closingTimeout
+		}
+		return tcpTimeout
+	case header.UDPProtocolNumber:
+		return udpTimeout
+	}
+	return icmpTimeout
+}
+
+// established reports whether p belongs to a tracked flow, in either
+// direction, and extends the flow if it does.
+func (c *conntrack) established(p *Packet) bool {
+	if p.Fragment {
+		return false
+	}
+	k := newFlowKey(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for _, key := range []flowKey{k, k.reverse()} {
+		if expires, ok := c.flows[key]; ok && now.Before(expires) {
+			c.flows[key] = now.Add(timeout(p))
+			return true
+		}
+	}
+	return false
+}
+
+// track starts tracking the flow of p. It returns false if the table is
+// full.
+func (c *conntrack) track(p *Packet) bool {
+	if p.Fragment {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.flows) >= maxFlows || now.Sub(c.lastSweep) > sweepInterval {
+		c.sweep(now)
+	}
+	if len(c.flows) >= maxFlows {
+		return false
+	}
+	c.flows[newFlowKey(p)] = now.Add(timeout(p))
+	return true
+}
+
+// sweep forgets expired flows, called with c.mu held.
+func (c *conntrack) sweep(now time.Time) {
+	for k, expires := range c.flows {
+		if !now.Before(expires) {
+			delete(c.flows, k)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *conntrack) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.flows)
+}
@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// filterHeaderSize is enough of a packet to parse the IPv4 header with
+// options and the transport ports.
+const filterHeaderSize = 60 + header.TCPMinimumSize
+
+type endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+	filter     *Filter
+}
+
+// New creates a link endpoint that filters packets between the lower
+// endpoint and the stack.
+func New(lower tcpip.LinkEndpointID, f *Filter) tcpip.LinkEndpointID {
+	return stack.RegisterLinkEndpoint(&endpoint{
+		lower:  stack.FindLinkEndpoint(lower),
+		filter: f,
+	})
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher. Packets are
+// delivered to the stack if the filter allows them.
+func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) {
+	if protocol != header.ARPProtocolNumber {
+		p, ok := e.parse(protocol, vv)
+		if !ok {
+			e.filter.Drop(Inbound)
+			return
+		}
+		p.SrcMAC, p.DstMAC = remote, local
+		if !e.filter.Inbound(&p) {
+			return
+		}
+	}
+	e.dispatcher.DeliverNetworkPacket(e, remote, local, protocol, vv)
+}
+
+func (e *endpoint) parse(protocol tcpip.NetworkProtocolNumber, vv buffer.VectorisedView) (Packet, bool) {
+	if protocol != header.IPv4ProtocolNumber {
+		return Packet{}, false
+	}
+	b := vv.First()
+	if len(b) < filterHeaderSize && len(vv.Views()) > 1 {
+		b = vv.ToView()
+	}
+	return ParseIPv4(b)
+}
+
+// Attach implements stack.LinkEndpoint.Attach.
+func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// IsAttached implements stack.LinkEndpoint.IsAttached.
+func (e *endpoint) IsAttached() bool {
+	return e.dispatcher != nil
+}
+
+// MTU implements stack.LinkEndpoint.MTU.
+func (e *endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength.
+func (e *endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress.
+func (e *endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. Packets the filter
+// denies are dropped silently, like they were lost on the link. Protocols
+// other than IPv4 aren't inspected and are written as is.
+func (e *endpoint) WritePacket(r *stack.Route, gso *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if protocol == header.IPv4ProtocolNumber {
+		views := append([]buffer.View{hdr.View()}, payload.Views()...)
+		p, ok := e.parse(protocol, buffer.NewVectorisedView(len(hdr.View())+payload.Size(), views))
+		if !ok {
+			e.filter.Drop(Outbound)
+			return nil
+		}
+		p.SrcMAC, p.DstMAC = r.LocalLinkAddress, r.RemoteLinkAddress
+		if !e.filter.Outbound(&p) {
+			return nil
+		}
+	}
+	return e.lower.WritePacket(r, gso, hdr, payload, protocol)
+}
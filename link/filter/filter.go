@@ -0,0 +1,128 @@
+// Package filter is a stateful packet filter that sits between a link
+// endpoint and the network stack.
+//
+// Inbound packets are dropped unless they match an allow rule or belong to a
+// tracked connection. Outbound packets are allowed unless they match a deny
+// rule. Allowed packets start tracking their connection, so replies pass in
+// the other direction. Only IPv4 is inspected: ARP is always allowed, and
+// other protocols are allowed out and dropped in, like packets that match no
+// rule.
+package filter
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// DefaultRule is the name of the counters for packets that matched no rule.
+const DefaultRule = "default"
+
+type counters struct {
+	allowed uint64
+	dropped uint64
+}
+
+// Filter holds rules, their counters and the connection tracking table.
+type Filter struct {
+	rules    []Rule
+	counters []counters
+	// Packets that matched no rule, by direction.
+	defaults [2]counters
+	// established counts packets allowed by connection tracking.
+	established uint64
+	conns       *conntrack
+}
+
+// RuleStats are the counters of a rule.
+type RuleStats struct {
+	Rule    string
+	Allowed uint64
+	Dropped uint64
+}
+
+func (s RuleStats) String() string {
+	return fmt.Sprintf("%s: %d allowed, %d dropped", s.Rule, s.Allowed, s.Dropped)
+}
+
+// NewFilter creates a filter that applies rules in order, the first match
+// decides.
+func NewFilter(rules []Rule) *Filter {
+	return &Filter{
+		rules:    append([]Rule(nil), rules...),
+		counters: make([]counters, len(rules)),
+		conns:    newConntrack(),
+	}
+}
+
+// Rules returns the rules of the filter.
+func (f *Filter) Rules() []Rule {
+	return append([]Rule(nil), f.rules...)
+}
+
+// Inbound reports whether a packet received from the link is allowed.
+func (f *Filter) Inbound(p *Packet) bool {
+	return f.check(Inbound, p)
+}
+
+// Outbound reports whether a packet sent by the stack is allowed.
+func (f *Filter) Outbound(p *Packet) bool {
+	return f.check(Outbound, p)
+}
+
+func (f *Filter) check(dir Direction, p *Packet) bool {
+	if f.conns.established(p) {
+		atomic.AddUint64(&f.established, 1)
+		return true
+	}
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.Direction != dir || !r.Matches(p) {
+			continue
+		}
+		return f.decide(&f.counters[i], r.Action == Allow, p)
+	}
+	// Only outbound traffic is allowed by default.
+	return f.decide(&f.defaults[dir], dir == Outbound, p)
+}
+
+func (f *Filter) decide(c *counters, allow bool, p *Packet) bool {
+	if allow && f.conns.track(p) {
+		atomic.AddUint64(&c.allowed, 1)
+		return true
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	return false
+}
+
+// Drop counts a packet that was dropped before reaching the filter, such as
+// a truncated or non-IPv4 packet.
+func (f *Filter) Drop(dir Direction) {
+	atomic.AddUint64(&f.defaults[dir].dropped, 1)
+}
+
+// Stats returns the counters of every rule, followed by those of packets
+// that matched no rule in either direction.
+func (f *Filter) Stats() []RuleStats {
+	stats := make([]RuleStats, 0, len(f.rules)+2)
+	for i := range f.rules {
+		stats = append(stats, RuleStats{
+			Rule:    f.rules[i].Name,
+			Allowed: atomic.LoadUint64(&f.counters[i].allowed),
+			Dropped: atomic.LoadUint64(&f.counters[i].dropped),
+		})
+	}
+	for _, dir := range []Direction{Inbound, Outbound} {
+		stats = append(stats, RuleStats{
+			Rule:    DefaultRule + "/" + dir.String(),
+			Allowed: atomic.LoadUint64(&f.defaults[dir].allowed),
+			Dropped: atomic.LoadUint64(&f.defaults[dir].dropped),
+		})
+	}
+	return stats
+}
+
+// Established returns the number of packets allowed because they belong to
+// a tracked connection.
+func (f *Filter) Established() uint64 {
+	return atomic.LoadUint64(&f.established)
+}
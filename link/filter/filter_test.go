@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+func tcpPacket(src, dst string, sport, dport uint16, flags uint8) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     tcpip.Address(net.ParseIP(src).To4()),
+		DstAddr:     tcpip.Address(net.ParseIP(dst).To4()),
+	})
+	t := b[header.IPv4MinimumSize:]
+	binary.BigEndian.PutUint16(t[0:], sport)
+	binary.BigEndian.PutUint16(t[2:], dport)
+	t[12] = 5 << 4
+	t[13] = flags
+	return b
+}
+
+func parse(t *testing.T, b []byte) *Packet {
+	p, ok := ParseIPv4(b)
+	if !ok {
+		t.Fatalf("ParseIPv4: could not parse packet")
+	}
+	return &p
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("allow proto=tcp src=192.168.1.0/24 dport=3000-3010 name=web;\n deny dir=out dst=10.0.0.1 smac=42:42:42:42:42:42")
+	if err != nil {
+		t.Fatalf("ParseRules: unexpected error: %v", err)
+	}
+	expected := []string{
+		"allow proto=tcp src=192.168.1.0/24 dport=3000-3010 name=web",
+		"deny dir=out dst=10.0.0.1/32 smac=42:42:42:42:42:42 name=rule2",
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("ParseRules: expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i].String() != expected[i] {
+			t.Errorf("[%d] Expected '%v', got '%v'", i, expected[i], rules[i].String())
+		}
+	}
+
+	for _, s := range []string{"permit", "allow proto=sctp", "allow dport=0", "allow dport=10-5", "allow src=300.0.0.1", "allow foo=bar", "allow dir=up"} {
+		if _, err := ParseRules(s); err == nil {
+			t.Errorf("ParseRules: expected error for '%v'", s)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rules, err := ParseRules("deny src=192.168.1.66 name=blocked; allow proto=tcp dport=3000 name=web; deny dir=out proto=tcp dport=22 name=nossh")
+	if err != nil {
+		t.Fatalf("ParseRules: unexpected error: %v", err)
+	}
+	f := NewFilter(rules)
+
+	tables := []struct {
+		dir     Direction
+		packet  []byte
+		allowed bool
+	}{
+		{Inbound, tcpPacket("192.168.1.2", "192.168.1.1", 40000, 3000, header.TCPFlagSyn), true},
+		{Outbound, tcpPacket("192.168.1.1", "192.168.1.2", 3000, 40000, header.TCPFlagSyn|header.TCPFlagAck), true},
+		{Inbound, tcpPacket("192.168.1.66", "192.168.1.1", 40000, 3000, header.TCPFlagSyn), false},
+		{Inbound, tcpPacket("192.168.1.2", "192.168.1.1", 40000, 8080, header.TCPFlagSyn), false},
+		{Outbound, tcpPacket("192.168.1.1", "192.168.1.3", 40001, 22, header.TCPFlagSyn), false},
+		// Replies to outbound connections are tracked.
+		{Outbound, tcpPacket("192.168.1.1", "192.168.1.3", 40002, 8080, header.TCPFlagSyn), true},
+		{Inbound, tcpPacket("192.168.1.3", "192.168.1.1", 8080, 40002, header.TCPFlagSyn|header.TCPFlagAck), true},
+		{Inbound, tcpPacket("192.168.1.3", "192.168.1.1", 8080, 40003, header.TCPFlagSyn|header.TCPFlagAck), false},
+	}
+	for i, table := range tables {
+		p := parse(t, table.packet)
+		var allowed bool
+		if table.dir == Inbound {
+			allowed = f.Inbound(p)
+		} else {
+			allowed = f.Outbound(p)
+		}
+		if allowed != table.allowed {
+			t.Errorf("[%d] Expected allowed %v, got %v", i, table.allowed, allowed)
+		}
+	}
+
+	expected := map[string]RuleStats{
+		"blocked":     {Dropped: 1},
+		"web":         {Allowed: 1},
+		"nossh":       {Dropped: 1},
+		"default/in":  {Dropped: 2},
+		"default/out": {Allowed: 1},
+	}
+	for _, s := range f.Stats() {
+		e := expected[s.Rule]
+		if s.Allowed != e.Allowed || s.Dropped != e.Dropped {
+			t.Errorf("Stats: expected %v for %v, got %v", e, s.Rule, s)
+		}
+	}
+	if f.Established() != 2 {
+		t.Errorf("Expected 2 established packets, got %d", f.Established())
+	}
+}
+
+func TestConntrack_Expiry(t *testing.T) {
+	f := NewFilter(nil)
+	now := time.Now()
+	f.conns.now = func() time.Time { return now }
+
+	f.Outbound(parse(t, tcpPacket("192.168.1.1", "192.168.1.2", 40000, 80, header.TCPFlagSyn)))
+	reply := parse(t, tcpPacket("192.168.1.2", "192.168.1.1", 80, 40000, header.TCPFlagAck))
+	if !f.Inbound(reply) {
+		t.Fatalf("Expected reply to be allowed")
+	}
+	f.Outbound(parse(t, tcpPacket("192.168.1.1", "192.168.1.2", 40000, 80, header.TCPFlagFin|header.TCPFlagAck)))
+	now = now.Add(closingTimeout + time.Second)
+	if f.Inbound(reply) {
+		t.Errorf("Expected closed connection to expire")
+	}
+	f.Outbound(parse(t, tcpPacket("192.168.1.1", "192.168.1.3", 40000, 80, header.TCPFlagSyn)))
+	if n := f.conns.len(); n != 1 {
+		t.Errorf("Expected expired flows to be swept, got %d flows", n)
+	}
+}
+
+// lowerEndpoint records the packets written through it.
+type lowerEndpoint struct {
+	stack.LinkEndpoint
+	written []tcpip.NetworkProtocolNumber
+}
+
+func (e *lowerEndpoint) WritePacket(r *stack.Route, _ *stack.GSO, hdr buffer.Prependable, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	e.written = append(e.written, protocol)
+	return nil
+}
+
+func TestEndpoint_Outbound(t *testing.T) {
+	rules, err := ParseRules("deny dir=out proto=tcp dport=22 name=nossh")
+	if err != nil {
+		t.Fatalf("ParseRules: unexpected error: %v", err)
+	}
+	lower := &lowerEndpoint{}
+	e := &endpoint{lower: lower, filter: NewFilter(rules)}
+	r := &stack.Route{}
+
+	arp := buffer.NewPrependable(header.ARPSize)
+	header.ARP(arp.Prepend(header.ARPSize)).SetIPv4OverEthernet()
+	ipv6 := buffer.NewPrependable(header.IPv6MinimumSize)
+	ipv6.Prepend(header.IPv6MinimumSize)
+	ssh := buffer.NewPrependable(header.IPv4MinimumSize + header.TCPMinimumSize)
+	copy(ssh.Prepend(header.IPv4MinimumSize+header.TCPMinimumSize), tcpPacket("192.168.1.1", "192.168.1.2", 40000, 22, header.TCPFlagSyn))
+
+	e.WritePacket(r, nil, arp, buffer.VectorisedView{}, header.ARPProtocolNumber)
+	e.WritePacket(r, nil, ipv6, buffer.VectorisedView{}, header.IPv6ProtocolNumber)
+	e.WritePacket(r, nil, ssh, buffer.VectorisedView{}, header.IPv4ProtocolNumber)
+	if len(lower.written) != 2 || lower.written[0] != header.ARPProtocolNumber || lower.written[1] != header.IPv6ProtocolNumber {
+		t.Errorf("Expected ARP and IPv6 to be written and ssh denied, got %v", lower.written)
+	}
+}
@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// Packet is the part of an IPv4 packet that rules and connection tracking
+// look at.
+type Packet struct {
+	SrcMAC   tcpip.LinkAddress
+	DstMAC   tcpip.LinkAddress
+	Protocol tcpip.TransportProtocolNumber
+	Src      net.IP
+	Dst      net.IP
+	// SrcPort and DstPort hold the identifier of ICMP echo messages.
+	SrcPort uint16
+	DstPort uint16
+	// TCPFlags are the flags of TCP segments.
+	TCPFlags uint8
+	// Fragment is set for non-first fragments, which carry no ports.
+	Fragment bool
+}
+
+// ParseIPv4 parses an IPv4 packet, b may be truncated after the transport
+// header. It returns false for packets too short to filter.
+func ParseIPv4(b []byte) (Packet, bool) {
+	var p Packet
+	if len(b) < header.IPv4MinimumSize {
+		return p, false
+	}
+	ip := header.IPv4(b)
+	hlen := int(ip.HeaderLength())
+	if hlen < header.IPv4MinimumSize || len(b) < hlen {
+		return p, false
+	}
+	p.Protocol = ip.TransportProtocol()
+	p.Src = net.IP(ip.SourceAddress())
+	p.Dst = net.IP(ip.DestinationAddress())
+	if ip.FragmentOffset() != 0 {
+		p.Fragment = true
+		return p, true
+	}
+
+	t := b[hlen:]
+	switch p.Protocol {
+	case header.TCPProtocolNumber:
+		if len(t) < header.TCPMinimumSize {
+			return p, false
+		}
+		tcp := header.TCP(t)
+		p.SrcPort, p.DstPort = tcp.SourcePort(), tcp.DestinationPort()
+		p.TCPFlags = uint8(tcp.Flags())
+	case header.UDPProtocolNumber:
+		if len(t) < header.UDPMinimumSize {
+			return p, false
+		}
+		udp := header.UDP(t)
+		p.SrcPort, p.DstPort = udp.SourcePort(), udp.DestinationPort()
+	case header.ICMPv4ProtocolNumber:
+		if len(t) < header.ICMPv4MinimumSize {
+			return p, false
+		}
+		switch header.ICMPv4(t).Type() {
+		case header.ICMPv4Echo, header.ICMPv4EchoReply:
+			// Echo replies carry the identifier of the request.
+			id := binary.BigEndian.Uint16(t[4:])
+			p.SrcPort, p.DstPort = id, id
+		}
+	}
+	return p, true
+}
@@ -0,0 +1,276 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// Action is what happens to packets that match a rule.
+type Action int
+
+const (
+	Deny Action = iota
+	Allow
+)
+
+func (a Action) String() string {
+	if a == Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// Direction is the direction of packets a rule applies to, relative to the
+// local stack.
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "out"
+	}
+	return "in"
+}
+
+// PortRange is an inclusive range of ports, the zero value matches any port.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (r PortRange) any() bool {
+	return r.First == 0 && r.Last == 0
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.First && port <= r.Last
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// Rule matches packets on their addresses, protocol and ports. Empty fields
+// match anything.
+type Rule struct {
+	Name      string
+	Action    Action
+	Direction Direction
+	// Protocol is a transport protocol number, 0 matches any protocol.
+	Protocol tcpip.TransportProtocolNumber
+	Src      *net.IPNet
+	Dst      *net.IPNet
+	SrcMAC   tcpip.LinkAddress
+	DstMAC   tcpip.LinkAddress
+	SrcPorts PortRange
+	DstPorts PortRange
+}
+
+// Matches reports whether p matches the rule. Non-first fragments only match
+// rules without ports, since their ports are unknown.
+func (r *Rule) Matches(p *Packet) bool {
+	if r.Protocol != 0 && r.Protocol != p.Protocol {
+		return false
+	}
+	if r.Src != nil && !r.Src.Contains(p.Src) {
+		return false
+	}
+	if r.Dst != nil && !r.Dst.Contains(p.Dst) {
+		return false
+	}
+	if r.SrcMAC != "" && r.SrcMAC != p.SrcMAC {
+		return false
+	}
+	if r.DstMAC != "" && r.DstMAC != p.DstMAC {
+		return false
+	}
+	if !r.SrcPorts.any() && (p.Fragment || !r.SrcPorts.contains(p.SrcPort)) {
+		return false
+	}
+	if !r.DstPorts.any() && (p.Fragment || !r.DstPorts.contains(p.DstPort)) {
+		return false
+	}
+	return true
+}
+
+var protocols = map[string]tcpip.TransportProtocolNumber{
+	"any":  0,
+	"icmp": header.ICMPv4ProtocolNumber,
+	"tcp":  header.TCPProtocolNumber,
+	"udp":  header.UDPProtocolNumber,
+}
+
+func protocolName(p tcpip.TransportProtocolNumber) string {
+	for name, n := range protocols {
+		if n == p {
+			return name
+		}
+	}
+	return strconv.Itoa(int(p))
+}
+
+// String formats the rule in the syntax accepted by ParseRules.
+func (r *Rule) String() string {
+	parts := []string{r.Action.String()}
+	if r.Direction != Inbound {
+		parts = append(parts, "dir="+r.Direction.String())
+	}
+	if r.Protocol != 0 {
+		parts = append(parts, "proto="+protocolName(r.Protocol))
+	}
+	if r.Src != nil {
+		parts = append(parts, "src="+r.Src.String())
+	}
+	if r.Dst != nil {
+		parts = append(parts, "dst="+r.Dst.String())
+	}
+	if r.SrcMAC != "" {
+		parts = append(parts, "smac="+r.SrcMAC.String())
+	}
+	if r.DstMAC != "" {
+		parts = append(parts, "dmac="+r.DstMAC.String())
+	}
+	if !r.SrcPorts.any() {
+		parts = append(parts, "sport="+r.SrcPorts.String())
+	}
+	if !r.DstPorts.any() {
+		parts = append(parts, "dport="+r.DstPorts.String())
+	}
+	if r.Name != "" {
+		parts = append(parts, "name="+r.Name)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseRules parses rules separated by semicolons or newlines, such as
+//
+//	allow proto=tcp src=192.168.1.0/24 dport=3000; deny dir=out dst=10.0.0.0/8
+//
+// Each rule starts with allow or deny, followed by any of dir (in or out, in
+// by default), proto (tcp, udp, icmp or a number), src, dst (an address or
+// CIDR), smac, dmac, sport, dport (a port or range like 8000-8080) and name.
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '\n' }) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		r, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("ParseRules: rule %d: %v", len(rules)+1, err)
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", len(rules)+1)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseRule(fields []string) (Rule, error) {
+	var r Rule
+	switch fields[0] {
+	case "allow":
+		r.Action = Allow
+	case "deny":
+		r.Action = Deny
+	default:
+		return r, fmt.Errorf("expected allow or deny, got '%v'", fields[0])
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("expected key=value, got '%v'", f)
+		}
+		var err error
+		switch k, v := kv[0], kv[1]; k {
+		case "name":
+			r.Name = v
+		case "dir":
+			switch v {
+			case "in":
+				r.Direction = Inbound
+			case "out":
+				r.Direction = Outbound
+			default:
+				err = fmt.Errorf("expected in or out")
+			}
+		case "proto":
+			p, ok := protocols[v]
+			if !ok {
+				var n uint64
+				n, err = strconv.ParseUint(v, 10, 8)
+				p = tcpip.TransportProtocolNumber(n)
+			}
+			r.Protocol = p
+		case "src":
+			r.Src, err = parseNet(v)
+		case "dst":
+			r.Dst, err = parseNet(v)
+		case "smac":
+			r.SrcMAC, err = parseMAC(v)
+		case "dmac":
+			r.DstMAC, err = parseMAC(v)
+		case "sport":
+			r.SrcPorts, err = parsePorts(v)
+		case "dport":
+			r.DstPorts, err = parsePorts(v)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid '%v': %v", f, err)
+		}
+	}
+	return r, nil
+}
+
+func parseNet(s string) (*net.IPNet, error) {
+	if s == "any" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "/") {
+		s += "/32"
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func parseMAC(s string) (tcpip.LinkAddress, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return "", err
+	}
+	return tcpip.LinkAddress(mac), nil
+}
+
+func parsePorts(s string) (PortRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	first, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.ParseUint(bounds[1], 10, 16); err != nil {
+			return PortRange{}, err
+		}
+	}
+	if first == 0 || last < first {
+		return PortRange{}, fmt.Errorf("invalid port range")
+	}
+	return PortRange{uint16(first), uint16(last)}, nil
+}
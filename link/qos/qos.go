@@ -0,0 +1,571 @@
+// Package qos schedules the frames links send, so that a bulk transfer
+// doesn't starve ARP, TCP acknowledgements and interactive sessions in the
+// queue of a slow transport. Frames are classified, control frames and
+// acknowledgements are sent first, and interactive and bulk frames share
+// what is left by weighted fair queuing. Queues are limited and never block,
+// frames over the limits are dropped, as are frames queued for too long with
+// CoDel. Pure TCP acknowledgements superseded by a newer one of the same
+// connection can be coalesced while they wait, and SYNs retransmitted while
+// the first is still on its way can be dropped.
+package qos
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/smithclay/rlinklayer/link/filter"
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+// Class is the traffic class of a frame.
+type Class int
+
+const (
+	// Control frames are ARP, ICMP and TCP segments opening, closing or
+	// resetting connections.
+	Control Class = iota
+	// Ack frames are TCP segments acknowledging data without carrying any.
+	Ack
+	// Interactive frames are to or from interactive ports, or marked with
+	// the expedited forwarding DSCP.
+	Interactive
+	// Bulk frames are every other frame.
+	Bulk
+)
+
+// Classes are every class, in order of priority.
+var Classes = []Class{Control, Ack, Interactive, Bulk}
+
+var classNames = []string{"control", "ack", "interactive", "bulk"}
+
+func (c Class) String() string {
+	if c < 0 || int(c) >= len(classNames) {
+		return fmt.Sprintf("class(%d)", int(c))
+	}
+	return classNames[c]
+}
+
+// ParseClass parses the name of a class.
+func ParseClass(s string) (Class, error) {
+	for i, name := range classNames {
+		if s == name {
+			return Class(i), nil
+		}
+	}
+	return 0, fmt.Errorf("ParseClass: unknown class %q", s)
+}
+
+// Defaults of Options.
+var (
+	// DefaultLimits are the frames queued per class.
+	DefaultLimits = map[Class]int{Control: 32, Ack: 32, Interactive: 32, Bulk: 64}
+	// DefaultInteractivePorts are SSH, telnet, DNS and RDP.
+	DefaultInteractivePorts = []uint16{22, 23, 53, 3389}
+)
+
+const (
+	// DefaultInteractiveWeight is the share of interactive frames for
+	// every share of bulk frames.
+	DefaultInteractiveWeight = 4
+	// DefaultTarget and DefaultInterval tune CoDel for links that poll: as
+	// frames wait for the next write, they are queued for far longer than
+	// on a wire, where CoDel targets 5ms every 100ms.
+	DefaultTarget   = time.Second
+	DefaultInterval = 10 * time.Second
+	// DefaultSynHold is how long a SYN sent holds its retransmissions: TCP
+	// retransmits SYNs after a second, before a round trip through a slow
+	// transport can answer them.
+	DefaultSynHold = 3 * time.Second
+)
+
+// HeaderSize is the longest start of a packet Classify looks at.
+const HeaderSize = 120
+
+// quantum is the bytes a weight of one lets a fair queue send per round.
+const quantum = 1500
+
+// dscpEF is the expedited forwarding code point, for voice and other
+// interactive traffic.
+const dscpEF = 46
+
+// Options configure a Scheduler.
+type Options struct {
+	// Limits are the frames queued per class, DefaultLimits for classes
+	// missing.
+	Limits map[Class]int
+	// InteractiveWeight is the share of interactive frames for every share
+	// of bulk frames, DefaultInteractiveWeight if zero.
+	InteractiveWeight int
+	// InteractivePorts are the TCP and UDP ports of Interactive frames,
+	// DefaultInteractivePorts if nil.
+	InteractivePorts []uint16
+	// CoDel drops frames that were queued for longer than Target for an
+	// Interval, instead of only dropping frames over the limits.
+	CoDel    bool
+	Target   time.Duration
+	Interval time.Duration
+	// CoalesceAcks replaces a queued pure ACK by a newer one of the same
+	// connection acknowledging more, as the newer one says all the older
+	// one does. Duplicate ACKs and ACKs with SACK blocks are kept, TCP
+	// needs them to recover losses.
+	CoalesceAcks bool
+	// CoalesceSyns drops a TCP SYN or SYN-ACK whose copy is queued or was
+	// sent less than SynHold ago, DefaultSynHold if zero. The copy opens
+	// the connection just as well, while the retransmission only adds to
+	// the queue. Once SynHold has passed SYNs are sent again, in case the
+	// copy was lost.
+	CoalesceSyns bool
+	SynHold      time.Duration
+	// OnDrop, if set, is called for every dropped frame with the reason,
+	// stats.DropQueueFull, stats.DropCoDel, stats.DropAckCoalesced or
+	// stats.DropSynDuplicate.
+	OnDrop func(c Class, reason string)
+}
+
+// item is a queued frame.
+type item struct {
+	v        interface{}
+	size     int
+	enqueued time.Time
+	// ack is set for pure ACKs that may be coalesced.
+	ack *ack
+	// syn is set for SYNs whose retransmissions may be dropped.
+	syn *syn
+}
+
+// ack is a pure TCP acknowledgement.
+type ack struct {
+	flow   flow
+	number seqnum.Value
+	// sack is set if the ACK carries SACK blocks.
+	sack bool
+}
+
+// syn is a TCP SYN or SYN-ACK, retransmissions have the same.
+type syn struct {
+	flow   flow
+	number seqnum.Value
+}
+
+// flow is the direction of a TCP connection.
+type flow struct {
+	src, dst     tcpip.Address
+	sport, dport uint16
+}
+
+// parseTCP parses the flow and TCP header of b, the start of an IPv4 packet
+// as passed to Classify.
+func parseTCP(b []byte) (flow, header.TCP, bool) {
+	if len(b) < header.IPv4MinimumSize {
+		return flow{}, nil, false
+	}
+	ip := header.IPv4(b)
+	hlen := int(ip.HeaderLength())
+	if ip.TransportProtocol() != header.TCPProtocolNumber || hlen < header.IPv4MinimumSize || len(b) < hlen+header.TCPMinimumSize {
+		return flow{}, nil, false
+	}
+	tcp := header.TCP(b[hlen:])
+	if int(tcp.DataOffset()) < header.TCPMinimumSize || len(tcp) < int(tcp.DataOffset()) {
+		return flow{}, nil, false
+	}
+	return flow{ip.SourceAddress(), ip.DestinationAddress(), tcp.SourcePort(), tcp.DestinationPort()}, tcp, true
+}
+
+// parseAck parses a pure ACK, b is as passed to Classify.
+func parseAck(b []byte) (*ack, bool) {
+	f, tcp, ok := parseTCP(b)
+	if !ok {
+		return nil, false
+	}
+	return &ack{
+		flow:   f,
+		number: seqnum.Value(tcp.AckNumber()),
+		sack:   len(tcp.ParsedOptions().SACKBlocks) > 0,
+	}, true
+}
+
+// parseSyn parses a SYN or SYN-ACK, b is as passed to Classify.
+func parseSyn(b []byte) (*syn, bool) {
+	f, tcp, ok := parseTCP(b)
+	if !ok || tcp.Flags()&(header.TCPFlagSyn|header.TCPFlagRst) != header.TCPFlagSyn {
+		return nil, false
+	}
+	return &syn{flow: f, number: seqnum.Value(tcp.SequenceNumber())}, true
+}
+
+// queue is the queue of a class, with the state of CoDel.
+type queue struct {
+	items []item
+	limit int
+	// deficit are the bytes a fair queue may send this round.
+	deficit int
+	weight  int
+
+	firstAbove time.Time
+	dropNext   time.Time
+	count      int
+	lastCount  int
+	dropping   bool
+}
+
+// Scheduler queues the frames of a link by class. It is safe for concurrent
+// use.
+type Scheduler struct {
+	ports    map[uint16]bool
+	codel    bool
+	coalesce bool
+	target   time.Duration
+	interval time.Duration
+	// synHold is zero if SYNs aren't coalesced.
+	synHold time.Duration
+	onDrop  func(Class, string)
+
+	mu     sync.Mutex
+	queues [4]*queue
+	// syns are the SYNs queued, with a zero time, or sent within synHold,
+	// with the time they were sent.
+	syns map[syn]time.Time
+	// fair is the fair queue whose turn it is.
+	fair int
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// New returns a scheduler configured by opts, the defaults if nil.
+func New(opts *Options) *Scheduler {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &Scheduler{
+		ports:    map[uint16]bool{},
+		codel:    opts.CoDel,
+		coalesce: opts.CoalesceAcks,
+		target:   opts.Target,
+		interval: opts.Interval,
+		onDrop:   opts.OnDrop,
+		fair:     int(Interactive),
+		now:      time.Now,
+	}
+	ports := opts.InteractivePorts
+	if ports == nil {
+		ports = DefaultInteractivePorts
+	}
+	for _, p := range ports {
+		s.ports[p] = true
+	}
+	if s.target == 0 {
+		s.target = DefaultTarget
+	}
+	if s.interval == 0 {
+		s.interval = DefaultInterval
+	}
+	if opts.CoalesceSyns {
+		s.synHold = opts.SynHold
+		if s.synHold == 0 {
+			s.synHold = DefaultSynHold
+		}
+		s.syns = map[syn]time.Time{}
+	}
+	weight := opts.InteractiveWeight
+	if weight == 0 {
+		weight = DefaultInteractiveWeight
+	}
+	for _, c := range Classes {
+		limit, ok := opts.Limits[c]
+		if !ok {
+			limit = DefaultLimits[c]
+		}
+		s.queues[c] = &queue{limit: limit, weight: 1}
+	}
+	s.queues[Interactive].weight = weight
+	return s
+}
+
+// Classify returns the class of a packet of protocol, b is the start of the
+// packet without link header, at least HeaderSize bytes of it if it's that
+// long.
+func (s *Scheduler) Classify(protocol tcpip.NetworkProtocolNumber, b []byte) Class {
+	switch protocol {
+	case header.ARPProtocolNumber:
+		return Control
+	case header.IPv4ProtocolNumber:
+	default:
+		return Bulk
+	}
+	p, ok := filter.ParseIPv4(b)
+	if !ok || p.Fragment {
+		return Bulk
+	}
+	ip := header.IPv4(b)
+	tos, _ := ip.TOS()
+	switch {
+	case p.Protocol == header.ICMPv4ProtocolNumber:
+		return Control
+	case tos>>2 == dscpEF:
+		return Interactive
+	case p.Protocol == header.TCPProtocolNumber:
+		if p.TCPFlags&(header.TCPFlagSyn|header.TCPFlagFin|header.TCPFlagRst) != 0 {
+			return Control
+		}
+		tcp := header.TCP(b[ip.HeaderLength():])
+		if p.TCPFlags&header.TCPFlagAck != 0 && int(ip.TotalLength())-int(ip.HeaderLength())-int(tcp.DataOffset()) <= 0 {
+			return Ack
+		}
+	case p.Protocol != header.UDPProtocolNumber:
+		return Bulk
+	}
+	if s.ports[p.SrcPort] || s.ports[p.DstPort] {
+		return Interactive
+	}
+	return Bulk
+}
+
+// Enqueue queues v, a frame of class c and size bytes, b is the start of its
+// packet as passed to Classify. It returns false if the frame was dropped
+// because the queue of c is full.
+func (s *Scheduler) Enqueue(c Class, b []byte, size int, v interface{}) bool {
+	var a *ack
+	if c == Ack && s.coalesce {
+		a, _ = parseAck(b)
+	}
+	var sy *syn
+	if c == Control && s.synHold > 0 {
+		sy, _ = parseSyn(b)
+	}
+	s.mu.Lock()
+	now := s.now()
+	q := s.queues[c]
+	if a != nil && s.coalesceAck(q, a, size, v) {
+		s.mu.Unlock()
+		s.drop(c, stats.DropAckCoalesced)
+		return true
+	}
+	if sy != nil && s.duplicateSyn(sy, now) {
+		s.mu.Unlock()
+		s.drop(c, stats.DropSynDuplicate)
+		return true
+	}
+	if len(q.items) >= q.limit {
+		s.mu.Unlock()
+		s.drop(c, stats.DropQueueFull)
+		return false
+	}
+	q.items = append(q.items, item{v: v, size: size, enqueued: now, ack: a, syn: sy})
+	if sy != nil {
+		s.syns[*sy] = time.Time{}
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// duplicateSyn returns whether a copy of sy is queued or was sent within
+// synHold of now, forgetting the SYNs sent before.
+func (s *Scheduler) duplicateSyn(sy *syn, now time.Time) bool {
+	for k, sent := range s.syns {
+		if !sent.IsZero() && now.Sub(sent) >= s.synHold {
+			delete(s.syns, k)
+		}
+	}
+	_, ok := s.syns[*sy]
+	return ok
+}
+
+// coalesceAck replaces the last ACK queued in q for the connection of a by
+// v, if a acknowledges more and the queued ACK has no SACK blocks. The frame
+// keeps its place and the time it was queued.
+func (s *Scheduler) coalesceAck(q *queue, a *ack, size int, v interface{}) bool {
+	for i := len(q.items) - 1; i >= 0; i-- {
+		old := q.items[i].ack
+		if old == nil || old.flow != a.flow {
+			continue
+		}
+		if old.sack || !old.number.LessThan(a.number) {
+			return false
+		}
+		q.items[i].v, q.items[i].size, q.items[i].ack = v, size, a
+		return true
+	}
+	return false
+}
+
+// Dequeue returns the next frame to send, false if there are none.
+func (s *Scheduler) Dequeue() (interface{}, bool) {
+	s.mu.Lock()
+	var dropped []Class
+	defer func() {
+		s.mu.Unlock()
+		for _, c := range dropped {
+			s.drop(c, stats.DropCoDel)
+		}
+	}()
+	now := s.now()
+	for _, c := range []Class{Control, Ack} {
+		if it, ok := s.pop(c, now, &dropped); ok {
+			return it.v, true
+		}
+	}
+	// Deficit round robin between the fair queues, whose deficits grow by
+	// their weight every round until their first frame fits.
+	for {
+		active := false
+		for i := 0; i < 2; i++ {
+			c := Class(s.fair)
+			q := s.queues[c]
+			if len(q.items) == 0 {
+				q.deficit = 0
+				s.nextFair()
+				continue
+			}
+			active = true
+			if q.items[0].size <= q.deficit {
+				it, ok := s.pop(c, now, &dropped)
+				if !ok {
+					continue
+				}
+				q.deficit -= it.size
+				return it.v, true
+			}
+			q.deficit += q.weight * quantum
+			s.nextFair()
+		}
+		if !active {
+			return nil, false
+		}
+	}
+}
+
+// nextFair gives the turn to the other fair queue.
+func (s *Scheduler) nextFair() {
+	if s.fair == int(Interactive) {
+		s.fair = int(Bulk)
+	} else {
+		s.fair = int(Interactive)
+	}
+}
+
+// pop returns the first frame of the queue of c, dropping those queued for
+// too long with CoDel, and adding their class to dropped.
+func (s *Scheduler) pop(c Class, now time.Time, dropped *[]Class) (item, bool) {
+	q := s.queues[c]
+	for len(q.items) > 0 {
+		it := q.items[0]
+		q.items[0] = item{}
+		q.items = q.items[1:]
+		if !s.codel || !s.shouldDrop(q, it, now) {
+			if it.syn != nil {
+				s.syns[*it.syn] = now
+			}
+			return it, true
+		}
+		if it.syn != nil {
+			delete(s.syns, *it.syn)
+		}
+		*dropped = append(*dropped, c)
+	}
+	q.dropping = false
+	return item{}, false
+}
+
+// shouldDrop runs CoDel (RFC 8289) for a frame leaving q at now.
+func (s *Scheduler) shouldDrop(q *queue, it item, now time.Time) bool {
+	okToDrop := false
+	if now.Sub(it.enqueued) < s.target || len(q.items) == 0 {
+		q.firstAbove = time.Time{}
+	} else if q.firstAbove.IsZero() {
+		q.firstAbove = now.Add(s.interval)
+	} else if !now.Before(q.firstAbove) {
+		okToDrop = true
+	}
+
+	if q.dropping {
+		if !okToDrop {
+			q.dropping = false
+			return false
+		}
+		if !now.Before(q.dropNext) {
+			q.count++
+			q.dropNext = s.controlLaw(q.dropNext, q.count)
+			return true
+		}
+		return false
+	}
+	if !okToDrop {
+		return false
+	}
+	q.dropping = true
+	// Drop faster if the queue was dropping recently.
+	if delta := q.count - q.lastCount; delta > 1 && now.Sub(q.dropNext) < 16*s.interval {
+		q.count = delta
+	} else {
+		q.count = 1
+	}
+	q.lastCount = q.count
+	q.dropNext = s.controlLaw(now, q.count)
+	return true
+}
+
+// controlLaw returns when to drop next after t, having dropped count frames.
+func (s *Scheduler) controlLaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(s.interval) / math.Sqrt(float64(count))))
+}
+
+func (s *Scheduler) drop(c Class, reason string) {
+	if s.onDrop != nil {
+		s.onDrop(c, reason)
+	}
+}
+
+// Len returns the frames queued in class c.
+func (s *Scheduler) Len(c Class) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queues[c].items)
+}
+
+// ParseLimits parses comma separated limits of classes, i.e.
+// "control=16,bulk=128".
+func ParseLimits(s string) (map[Class]int, error) {
+	limits := map[Class]int{}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("ParseLimits: expected class=limit, got %q", part)
+		}
+		c, err := ParseClass(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ParseLimits: invalid limit of %v %q", c, kv[1])
+		}
+		limits[c] = n
+	}
+	return limits, nil
+}
+
+// ParsePorts parses comma separated ports, i.e. "22,53".
+func ParsePorts(s string) ([]uint16, error) {
+	ports := []uint16{}
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("ParsePorts: invalid port %q", part)
+		}
+		ports = append(ports, uint16(n))
+	}
+	return ports, nil
+}
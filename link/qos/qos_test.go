@@ -0,0 +1,257 @@
+package qos
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+// packet returns an IPv4 packet of protocol with a TCP or UDP header and n
+// bytes of payload.
+func packet(protocol tcpip.TransportProtocolNumber, sport, dport uint16, flags uint8, tos uint8, n int) []byte {
+	size := header.UDPMinimumSize
+	if protocol == header.TCPProtocolNumber {
+		size = header.TCPMinimumSize
+	}
+	b := make([]byte, header.IPv4MinimumSize+size+n)
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TOS:         tos,
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(protocol),
+		SrcAddr:     tcpip.Address("\xc0\xa8\x01\x01"),
+		DstAddr:     tcpip.Address("\xc0\xa8\x01\x02"),
+	})
+	t := b[header.IPv4MinimumSize:]
+	binary.BigEndian.PutUint16(t[0:], sport)
+	binary.BigEndian.PutUint16(t[2:], dport)
+	if protocol == header.TCPProtocolNumber {
+		t[12] = 5 << 4
+		t[13] = flags
+	}
+	return b
+}
+
+func TestClassify(t *testing.T) {
+	s := New(nil)
+	for _, c := range []struct {
+		name     string
+		protocol tcpip.NetworkProtocolNumber
+		b        []byte
+		want     Class
+	}{
+		{"arp", header.ARPProtocolNumber, nil, Control},
+		{"icmp", header.IPv4ProtocolNumber, packet(header.ICMPv4ProtocolNumber, 0, 0, 0, 0, 8), Control},
+		{"syn", header.IPv4ProtocolNumber, packet(header.TCPProtocolNumber, 40000, 80, header.TCPFlagSyn, 0, 0), Control},
+		{"pure ack", header.IPv4ProtocolNumber, packet(header.TCPProtocolNumber, 40000, 80, header.TCPFlagAck, 0, 0), Ack},
+		{"ssh data", header.IPv4ProtocolNumber, packet(header.TCPProtocolNumber, 40000, 22, header.TCPFlagAck|header.TCPFlagPsh, 0, 100), Interactive},
+		{"dns", header.IPv4ProtocolNumber, packet(header.UDPProtocolNumber, 53, 40000, 0, 0, 100), Interactive},
+		{"ef", header.IPv4ProtocolNumber, packet(header.UDPProtocolNumber, 40000, 5004, 0, dscpEF<<2, 100), Interactive},
+		{"http data", header.IPv4ProtocolNumber, packet(header.TCPProtocolNumber, 40000, 80, header.TCPFlagAck, 0, 1000), Bulk},
+		{"ipv6", header.IPv6ProtocolNumber, make([]byte, 60), Bulk},
+	} {
+		if got := s.Classify(c.protocol, c.b); got != c.want {
+			t.Errorf("Classify(%v): expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestScheduler_Order(t *testing.T) {
+	s := New(&Options{InteractiveWeight: 2})
+	for i := 0; i < 4; i++ {
+		s.Enqueue(Bulk, nil, 1500, "bulk")
+		s.Enqueue(Interactive, nil, 1500, "interactive")
+	}
+	s.Enqueue(Ack, nil, 40, "ack")
+	s.Enqueue(Control, nil, 40, "control")
+
+	var got []interface{}
+	for {
+		v, ok := s.Dequeue()
+		if !ok {
+			break
+		}
+		got = append(got, v)
+	}
+	want := []interface{}{"control", "ack", "interactive", "interactive", "bulk", "interactive", "interactive", "bulk", "bulk", "bulk"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected priority then weighted fair order\n%v, got\n%v", want, got)
+	}
+}
+
+func TestScheduler_TailDrop(t *testing.T) {
+	var drops []string
+	s := New(&Options{
+		Limits: map[Class]int{Bulk: 2},
+		OnDrop: func(c Class, reason string) { drops = append(drops, c.String()+" "+reason) },
+	})
+	for i := 0; i < 3; i++ {
+		s.Enqueue(Bulk, nil, 100, i)
+	}
+	if !s.Enqueue(Interactive, nil, 100, "interactive") {
+		t.Errorf("Expected other classes to have their own queue")
+	}
+	if s.Len(Bulk) != 2 || !reflect.DeepEqual(drops, []string{"bulk " + stats.DropQueueFull}) {
+		t.Errorf("Expected the frame over the limit to be dropped, got %d queued, drops %v", s.Len(Bulk), drops)
+	}
+}
+
+func TestScheduler_CoDel(t *testing.T) {
+	dropped := 0
+	s := New(&Options{CoDel: true, OnDrop: func(Class, string) { dropped++ }})
+	now := time.Unix(1546300800, 0)
+	s.now = func() time.Time { return now }
+
+	// A standing queue: frames leave as fast as they arrive, but 2s late.
+	for i := 0; i < 3; i++ {
+		s.Enqueue(Bulk, nil, 100, i)
+	}
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Second)
+		s.Enqueue(Bulk, nil, 100, i)
+		now = now.Add(time.Second)
+		s.Dequeue()
+	}
+	if dropped == 0 {
+		t.Errorf("Expected CoDel to drop from a standing queue")
+	}
+
+	// Frames leaving within the target are not dropped.
+	dropped = 0
+	s = New(&Options{CoDel: true, OnDrop: func(Class, string) { dropped++ }})
+	s.now = func() time.Time { return now }
+	for i := 0; i < 20; i++ {
+		s.Enqueue(Bulk, nil, 100, i)
+		s.Enqueue(Bulk, nil, 100, i)
+		now = now.Add(100 * time.Millisecond)
+		s.Dequeue()
+		s.Dequeue()
+	}
+	if dropped != 0 {
+		t.Errorf("Expected no drops below the target, got %d", dropped)
+	}
+}
+
+// ackPacket returns a pure ACK of number, from port 40000 to dport, with a
+// SACK block if sack.
+func ackPacket(dport uint16, number uint32, sack bool) []byte {
+	b := packet(header.TCPProtocolNumber, 40000, dport, header.TCPFlagAck, 0, 0)
+	tcp := b[header.IPv4MinimumSize:]
+	binary.BigEndian.PutUint32(tcp[8:], number)
+	if !sack {
+		return b
+	}
+	b = append(b, header.TCPOptionNOP, header.TCPOptionNOP, header.TCPOptionSACK, 10)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint32(b[len(b)-8:], number+1000)
+	binary.BigEndian.PutUint32(b[len(b)-4:], number+2000)
+	header.IPv4(b).SetTotalLength(uint16(len(b)))
+	b[header.IPv4MinimumSize+12] = 8 << 4
+	return b
+}
+
+func TestScheduler_CoalesceAcks(t *testing.T) {
+	coalesced := 0
+	s := New(&Options{CoalesceAcks: true, OnDrop: func(_ Class, reason string) {
+		if reason == stats.DropAckCoalesced {
+			coalesced++
+		}
+	}})
+	for _, a := range []struct {
+		name string
+		b    []byte
+	}{
+		{"first", ackPacket(80, 1000, false)},
+		{"other connection", ackPacket(8080, 1000, false)},
+		{"newer", ackPacket(80, 2000, false)},
+		{"duplicate", ackPacket(80, 2000, false)},
+		{"sack", ackPacket(80, 2000, true)},
+		{"after sack", ackPacket(80, 5000, false)},
+	} {
+		s.Enqueue(Ack, a.b, len(a.b), a.name)
+	}
+	var got []interface{}
+	for {
+		v, ok := s.Dequeue()
+		if !ok {
+			break
+		}
+		got = append(got, v)
+	}
+	want := []interface{}{"newer", "other connection", "duplicate", "sack", "after sack"}
+	if !reflect.DeepEqual(got, want) || coalesced != 1 {
+		t.Errorf("Expected only the superseded ACK to be coalesced\n%v, got\n%v (%d coalesced)", want, got, coalesced)
+	}
+}
+
+// synPacket returns a SYN of sequence number, from port 40000 to dport.
+func synPacket(dport uint16, number uint32) []byte {
+	b := packet(header.TCPProtocolNumber, 40000, dport, header.TCPFlagSyn, 0, 0)
+	binary.BigEndian.PutUint32(b[header.IPv4MinimumSize+4:], number)
+	return b
+}
+
+func TestScheduler_CoalesceSyns(t *testing.T) {
+	coalesced := 0
+	s := New(&Options{CoalesceSyns: true, OnDrop: func(_ Class, reason string) {
+		if reason == stats.DropSynDuplicate {
+			coalesced++
+		}
+	}})
+	now := time.Unix(1546300800, 0)
+	s.now = func() time.Time { return now }
+	enqueue := func(v string, b []byte) {
+		s.Enqueue(s.Classify(header.IPv4ProtocolNumber, b), b, len(b), v)
+	}
+	dequeue := func() []interface{} {
+		var got []interface{}
+		for {
+			v, ok := s.Dequeue()
+			if !ok {
+				return got
+			}
+			got = append(got, v)
+		}
+	}
+
+	// Retransmitted while queued, and while the first is on its way.
+	enqueue("first", synPacket(80, 1000))
+	enqueue("other connection", synPacket(8080, 1000))
+	now = now.Add(time.Second)
+	enqueue("queued", synPacket(80, 1000))
+	got := dequeue()
+	now = now.Add(time.Second)
+	enqueue("sent", synPacket(80, 1000))
+	enqueue("new connection", synPacket(80, 5000))
+	got = append(got, dequeue()...)
+	// Retransmitted once the first could have been answered.
+	now = now.Add(DefaultSynHold)
+	enqueue("lost", synPacket(80, 1000))
+	got = append(got, dequeue()...)
+
+	want := []interface{}{"first", "other connection", "new connection", "lost"}
+	if !reflect.DeepEqual(got, want) || coalesced != 2 {
+		t.Errorf("Expected only the early retransmissions to be dropped\n%v, got\n%v (%d coalesced)", want, got, coalesced)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits("control=16, bulk=128")
+	if err != nil || !reflect.DeepEqual(limits, map[Class]int{Control: 16, Bulk: 128}) {
+		t.Errorf("Unexpected limits %v, %v", limits, err)
+	}
+	for _, s := range []string{"bulk", "video=1", "bulk=-1"} {
+		if _, err := ParseLimits(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+	if ports, err := ParsePorts("22,8022"); err != nil || !reflect.DeepEqual(ports, []uint16{22, 8022}) {
+		t.Errorf("Unexpected ports %v, %v", ports, err)
+	}
+}
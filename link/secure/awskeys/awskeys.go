@@ -0,0 +1,208 @@
+// Package awskeys distributes network keys as AWS KMS data keys. Key material
+// is only stored encrypted under a KMS key, in an SSM parameter that lists
+// the key versions in use, so members need kms:Decrypt and ssm:GetParameter
+// instead of a key in their environment.
+package awskeys
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/smithclay/rlinklayer/link/secure"
+)
+
+// DefaultKeep is the number of key versions kept in the parameter.
+const DefaultKeep = 2
+
+// Options configure a Provider.
+type Options struct {
+	// NetworkName is bound to data keys through the KMS encryption context,
+	// so keys of one network can't be used for another.
+	NetworkName string
+	// ParameterName is the SSM parameter that holds the key versions.
+	ParameterName string
+	// KeyID is the KMS key that encrypts data keys, only needed to rotate.
+	KeyID string
+	// Keep is the number of versions kept on rotation, DefaultKeep if zero.
+	Keep int
+	// Region of the default clients, us-west-2 if empty.
+	Region string
+	KMS    kmsiface.KMSAPI
+	SSM    ssmiface.SSMAPI
+}
+
+// record is a key version as stored in the parameter.
+type record struct {
+	Version    uint32 `json:"version"`
+	Ciphertext string `json:"ciphertext"`
+	NotBefore  int64  `json:"notBefore"`
+}
+
+// Provider implements secure.KeyProvider with KMS data keys.
+type Provider struct {
+	netName string
+	param   string
+	keyID   string
+	keep    int
+	kms     kmsiface.KMSAPI
+	ssm     ssmiface.SSMAPI
+
+	mu        sync.Mutex
+	plaintext map[string][]byte // by ciphertext
+}
+
+// New creates a provider, using KMS and SSM clients for opts.Region unless
+// they are set in opts.
+func New(opts *Options) *Provider {
+	p := &Provider{
+		netName:   opts.NetworkName,
+		param:     opts.ParameterName,
+		keyID:     opts.KeyID,
+		keep:      opts.Keep,
+		kms:       opts.KMS,
+		ssm:       opts.SSM,
+		plaintext: map[string][]byte{},
+	}
+	if p.keep == 0 {
+		p.keep = DefaultKeep
+	}
+	if p.kms == nil || p.ssm == nil {
+		region := opts.Region
+		if region == "" {
+			region = "us-west-2"
+		}
+		sess, _ := session.NewSession(&aws.Config{Region: aws.String(region)})
+		if p.kms == nil {
+			p.kms = kms.New(sess)
+		}
+		if p.ssm == nil {
+			p.ssm = ssm.New(sess)
+		}
+	}
+	return p
+}
+
+func (p *Provider) encryptionContext() map[string]*string {
+	return map[string]*string{"network": aws.String(p.netName)}
+}
+
+// Keys implements secure.KeyProvider.Keys. Data keys are decrypted once and
+// cached.
+func (p *Provider) Keys() ([]secure.Key, error) {
+	records, err := p.records()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]secure.Key, 0, len(records))
+	for _, r := range records {
+		material, err := p.decrypt(r.Ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("Keys: could not decrypt key version %d: %v", r.Version, err)
+		}
+		keys = append(keys, secure.Key{
+			Version:   r.Version,
+			Material:  material,
+			NotBefore: time.Unix(0, r.NotBefore*int64(time.Millisecond)),
+		})
+	}
+	return keys, nil
+}
+
+// Rotate implements secure.KeyProvider.Rotate. The parameter is overwritten
+// without checking for concurrent changes, so rotate from one place only.
+func (p *Provider) Rotate(notBefore time.Time) (secure.Key, error) {
+	records, err := p.records()
+	if err != nil {
+		return secure.Key{}, err
+	}
+	out, err := p.kms.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(p.keyID),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: p.encryptionContext(),
+	})
+	if err != nil {
+		return secure.Key{}, err
+	}
+
+	r := record{
+		Ciphertext: base64.StdEncoding.EncodeToString(out.CiphertextBlob),
+		NotBefore:  notBefore.UnixNano() / int64(time.Millisecond),
+	}
+	if n := len(records); n > 0 {
+		r.Version = records[n-1].Version + 1
+	}
+	records = append(records, r)
+	if len(records) > p.keep {
+		records = records[len(records)-p.keep:]
+	}
+	value, err := json.Marshal(records)
+	if err != nil {
+		return secure.Key{}, err
+	}
+	_, err = p.ssm.PutParameter(&ssm.PutParameterInput{
+		Name:      aws.String(p.param),
+		Value:     aws.String(string(value)),
+		Type:      aws.String(ssm.ParameterTypeString),
+		Overwrite: aws.Bool(true),
+	})
+	if err != nil {
+		return secure.Key{}, err
+	}
+
+	p.mu.Lock()
+	p.plaintext[r.Ciphertext] = out.Plaintext
+	p.mu.Unlock()
+	return secure.Key{Version: r.Version, Material: out.Plaintext, NotBefore: notBefore}, nil
+}
+
+// records reads the key versions from the parameter, oldest first. A missing
+// parameter has no versions.
+func (p *Provider) records() ([]record, error) {
+	out, err := p.ssm.GetParameter(&ssm.GetParameterInput{Name: aws.String(p.param)})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ssm.ErrCodeParameterNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := json.Unmarshal([]byte(aws.StringValue(out.Parameter.Value)), &records); err != nil {
+		return nil, fmt.Errorf("records: invalid parameter %v: %v", p.param, err)
+	}
+	return records, nil
+}
+
+func (p *Provider) decrypt(ciphertext string) ([]byte, error) {
+	p.mu.Lock()
+	material, ok := p.plaintext[ciphertext]
+	p.mu.Unlock()
+	if ok {
+		return material, nil
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.kms.Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    blob,
+		EncryptionContext: p.encryptionContext(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.plaintext[ciphertext] = out.Plaintext
+	p.mu.Unlock()
+	return out.Plaintext, nil
+}
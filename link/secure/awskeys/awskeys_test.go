@@ -0,0 +1,101 @@
+package awskeys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/smithclay/rlinklayer/link/secure"
+)
+
+// fakeKMS "encrypts" data keys by prefixing them with their context.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	decrypts int
+}
+
+func (f *fakeKMS) GenerateDataKey(in *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	blob := append([]byte(aws.StringValue(in.EncryptionContext["network"])+":"), key...)
+	return &kms.GenerateDataKeyOutput{Plaintext: key, CiphertextBlob: blob}, nil
+}
+
+func (f *fakeKMS) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	f.decrypts++
+	prefix := []byte(aws.StringValue(in.EncryptionContext["network"]) + ":")
+	if !bytes.HasPrefix(in.CiphertextBlob, prefix) {
+		return nil, errors.New("InvalidCiphertextException")
+	}
+	return &kms.DecryptOutput{Plaintext: in.CiphertextBlob[len(prefix):]}, nil
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	params map[string]string
+}
+
+func (f *fakeSSM) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	v, ok := f.params[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Value: aws.String(v)}}, nil
+}
+
+func (f *fakeSSM) PutParameter(in *ssm.PutParameterInput) (*ssm.PutParameterOutput, error) {
+	f.params[aws.StringValue(in.Name)] = aws.StringValue(in.Value)
+	return &ssm.PutParameterOutput{}, nil
+}
+
+func TestProvider_Rotate(t *testing.T) {
+	k, s := &fakeKMS{}, &fakeSSM{params: map[string]string{}}
+	admin := New(&Options{NetworkName: "TestNet", ParameterName: "/TestNet/key", KeyID: "alias/test", KMS: k, SSM: s})
+	member := New(&Options{NetworkName: "TestNet", ParameterName: "/TestNet/key", KMS: k, SSM: s})
+
+	if keys, err := member.Keys(); err != nil || len(keys) != 0 {
+		t.Fatalf("Keys: expected no keys, got %v (err: %v)", keys, err)
+	}
+	var rotated []secure.Key
+	for i := 0; i < 3; i++ {
+		key, err := admin.Rotate(time.Now())
+		if err != nil {
+			t.Fatalf("Rotate: unexpected error: %v", err)
+		}
+		rotated = append(rotated, key)
+	}
+
+	keys, err := member.Keys()
+	if err != nil {
+		t.Fatalf("Keys: unexpected error: %v", err)
+	}
+	if len(keys) != DefaultKeep {
+		t.Fatalf("Keys: expected %d versions, got %d", DefaultKeep, len(keys))
+	}
+	for i, key := range keys {
+		expected := rotated[len(rotated)-DefaultKeep+i]
+		if key.Version != expected.Version || !bytes.Equal(key.Material, expected.Material) {
+			t.Errorf("[%d] Expected version %d, got %d", i, expected.Version, key.Version)
+		}
+	}
+
+	// Data keys are only decrypted once.
+	decrypts := k.decrypts
+	if _, err := member.Keys(); err != nil || k.decrypts != decrypts {
+		t.Errorf("Keys: expected cached data keys, got %d decrypts (err: %v)", k.decrypts-decrypts, err)
+	}
+
+	// Data keys are bound to the network.
+	other := New(&Options{NetworkName: "OtherNet", ParameterName: "/TestNet/key", KMS: k, SSM: s})
+	if _, err := other.Keys(); err == nil {
+		t.Errorf("Keys: expected error decrypting keys of another network")
+	}
+}
@@ -0,0 +1,151 @@
+package secure
+
+import (
+	"crypto/rand"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// DefaultRefreshInterval is how often a KeyWatcher checks for new key
+// versions. Rotations should activate new versions later than this.
+const DefaultRefreshInterval = time.Minute
+
+// KeyProvider distributes versioned network keys to the members of a
+// network.
+type KeyProvider interface {
+	// Keys returns the key versions in use, oldest first.
+	Keys() ([]Key, error)
+	// Rotate publishes a new key version that becomes active at notBefore.
+	Rotate(notBefore time.Time) (Key, error)
+}
+
+// NewProviderSealer creates a sealer with the keys of a provider.
+func NewProviderSealer(p KeyProvider, grace time.Duration) (*Sealer, error) {
+	keys, err := p.Keys()
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(grace, keys...)
+}
+
+// KeyWatcher adds key versions published by a provider to a sealer.
+type KeyWatcher struct {
+	// Logger gets refresh failures, logging.Default if nil.
+	Logger logging.Logger
+
+	provider KeyProvider
+	sealer   *Sealer
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewKeyWatcher creates a watcher that refreshes every interval,
+// DefaultRefreshInterval is used if zero.
+func NewKeyWatcher(p KeyProvider, s *Sealer, interval time.Duration) *KeyWatcher {
+	if interval == 0 {
+		interval = DefaultRefreshInterval
+	}
+	return &KeyWatcher{provider: p, sealer: s, interval: interval}
+}
+
+// Refresh adds the current keys of the provider to the sealer.
+func (w *KeyWatcher) Refresh() error {
+	keys, err := w.provider.Keys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := w.sealer.AddKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start refreshes keys in the background until Stop is called.
+func (w *KeyWatcher) Start() {
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := w.Refresh(); err != nil {
+					logging.OrDefault(w.Logger).Warn("could not refresh network keys", "err", err)
+				}
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing keys.
+func (w *KeyWatcher) Stop() {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+}
+
+// MemoryKeyProvider is a KeyProvider that keeps keys in memory, for tests
+// and single process networks.
+type MemoryKeyProvider struct {
+	// Keep is the number of versions kept after a rotation, 2 if zero.
+	Keep int
+
+	mu   sync.Mutex
+	keys []Key
+}
+
+// NewMemoryKeyProvider creates a provider with a random first key version.
+func NewMemoryKeyProvider() *MemoryKeyProvider {
+	p := &MemoryKeyProvider{}
+	if _, err := p.Rotate(time.Time{}); err != nil {
+		log.Fatalf("NewMemoryKeyProvider: could not generate key: %v", err)
+	}
+	return p
+}
+
+// Keys implements KeyProvider.Keys.
+func (p *MemoryKeyProvider) Keys() ([]Key, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Key(nil), p.keys...), nil
+}
+
+// Rotate implements KeyProvider.Rotate.
+func (p *MemoryKeyProvider) Rotate(notBefore time.Time) (Key, error) {
+	k := Key{Material: make([]byte, 32), NotBefore: notBefore}
+	if _, err := rand.Read(k.Material); err != nil {
+		return Key{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.keys); n > 0 {
+		k.Version = p.keys[n-1].Version + 1
+	}
+	p.keys = trimKeys(append(p.keys, k), p.Keep)
+	return k, nil
+}
+
+// trimKeys sorts keys by version and keeps the newest keep versions.
+func trimKeys(keys []Key, keep int) []Key {
+	if keep == 0 {
+		keep = 2
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Version < keys[j].Version })
+	if len(keys) > keep {
+		keys = keys[len(keys)-keep:]
+	}
+	return keys
+}
@@ -0,0 +1,430 @@
+// Package secure encrypts and authenticates link frames with a key shared by
+// every member of a network.
+//
+// Each process picks a random session ID when it starts. Frames are sealed
+// with AES-GCM under a key derived from the network key and the session ID,
+// and carry a sequence number that receivers check against a sliding window
+// to reject replays. Deriving a key per session means nonces never repeat,
+// even though many members share the network key and restart often.
+//
+// The sliding window only lasts as long as the receiver remembers the
+// session, so frames also carry the time they were sealed: receivers reject
+// frames older than MaxAge, or sealed before the receiver started, which
+// keeps frames kept in transports like CloudWatch Logs from being replayed
+// after a restart. Fields a transport sends next to the sealed frame are
+// authenticated with it as additional data.
+//
+// Network keys are versioned so they can be rotated without dropping
+// traffic: a new version is accepted as soon as it is known, used for sealing
+// once it becomes active, and the versions it replaces keep opening frames
+// for a grace period.
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	version    = 2
+	versionLen = 4
+	sessionLen = 8
+	seqLen     = 8
+	timeLen    = 8
+	headerLen  = 1 + versionLen + sessionLen + seqLen + timeLen
+	tagLen     = 16
+
+	// Overhead is the number of bytes sealing adds to a frame.
+	Overhead = headerLen + tagLen
+
+	// MinKeySize is the minimum length of a network key.
+	MinKeySize = 16
+
+	// DefaultGrace is how long frames sealed with a replaced key version are
+	// still opened.
+	DefaultGrace = 10 * time.Minute
+
+	// MaxAge is how long after being sealed frames are opened.
+	MaxAge = 5 * time.Minute
+	// maxSkew is how far the clocks of members may differ.
+	maxSkew = 30 * time.Second
+
+	windowSize = 64
+	// maxPeers bounds the number of remote sessions tracked for replay
+	// protection, idle sessions are forgotten first. Sessions are idle for
+	// longer than MaxAge, so their frames are stale when they are forgotten.
+	maxPeers   = 1024
+	peerIdle   = 10 * time.Minute
+	keyContext = "rlinklayer frame key"
+)
+
+var (
+	// ErrUnauthenticated is returned for frames that weren't sealed with the
+	// network key or were modified in transit.
+	ErrUnauthenticated = errors.New("secure: frame failed authentication")
+	// ErrReplay is returned for frames that were already received.
+	ErrReplay = errors.New("secure: replayed frame")
+	// ErrStale is returned for frames sealed more than MaxAge ago, before
+	// the receiver started or in the future.
+	ErrStale = errors.New("secure: frame sealed too long ago")
+	// ErrKeySize is returned for network keys shorter than MinKeySize.
+	ErrKeySize = errors.New("secure: network key too short")
+	// ErrUnknownKey is returned for frames sealed with a key version that
+	// isn't known yet or was retired.
+	ErrUnknownKey = errors.New("secure: frame sealed with unknown or retired key version")
+	// ErrKeyMismatch is returned when a key version is added twice with
+	// different key material.
+	ErrKeyMismatch = errors.New("secure: key version already added with different material")
+	// ErrNoKeys is returned when creating a keyring without keys.
+	ErrNoKeys = errors.New("secure: no network keys")
+)
+
+// Key is a version of a network key.
+type Key struct {
+	Version  uint32
+	Material []byte
+	// NotBefore is when members start sealing with this version. It is
+	// accepted for opening as soon as it is known, so it should be far
+	// enough in the future for every member to learn about it first.
+	NotBefore time.Time
+}
+
+type sessionID [sessionLen]byte
+
+// peerID identifies a remote session, sessions have one key per version.
+type peerID struct {
+	version uint32
+	session sessionID
+}
+
+// peer tracks a remote session.
+type peer struct {
+	aead     cipher.AEAD
+	highest  uint64
+	window   uint64 // bit i set if highest-i was received
+	lastSeen time.Time
+}
+
+// keyState is a known key version and the key of the local session for it.
+type keyState struct {
+	Key
+	aead cipher.AEAD
+}
+
+// Sealer seals outgoing frames and opens incoming ones.
+type Sealer struct {
+	session sessionID
+	seq     uint64
+	grace   time.Duration
+	started time.Time
+	now     func() time.Time
+
+	mu    sync.Mutex
+	keys  map[uint32]*keyState
+	peers map[peerID]*peer
+	// retired is the material of versions no longer accepted, which still
+	// open frames with OpenOffline.
+	retired map[uint32][]byte
+}
+
+// NewPSK creates a sealer from a pre-shared network key.
+func NewPSK(key []byte) (*Sealer, error) {
+	return NewKeyring(0, Key{Material: key})
+}
+
+// NewKeyring creates a sealer from versioned network keys. Replaced versions
+// are opened for grace after their successor becomes active, DefaultGrace is
+// used if zero.
+func NewKeyring(grace time.Duration, keys ...Key) (*Sealer, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	if grace == 0 {
+		grace = DefaultGrace
+	}
+	s := &Sealer{grace: grace, started: time.Now(), now: time.Now, keys: map[uint32]*keyState{}, peers: map[peerID]*peer{}, retired: map[uint32][]byte{}}
+	if _, err := rand.Read(s.session[:]); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if err := s.AddKey(k); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// AddKey makes a key version known. Adding a version that is already known
+// is a no-op, and versions whose grace period is over are forgotten.
+func (s *Sealer) AddKey(k Key) error {
+	if len(k.Material) < MinKeySize {
+		return ErrKeySize
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ks, ok := s.keys[k.Version]; ok {
+		if !hmac.Equal(ks.Material, k.Material) {
+			return ErrKeyMismatch
+		}
+		s.retire(s.now())
+		return nil
+	}
+	k.Material = append([]byte(nil), k.Material...)
+	aead, err := sessionAEAD(k.Material, s.session)
+	if err != nil {
+		return err
+	}
+	s.keys[k.Version] = &keyState{Key: k, aead: aead}
+	s.retire(s.now())
+	return nil
+}
+
+// Versions returns the known key versions.
+func (s *Sealer) Versions() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var versions []uint32
+	for v := range s.keys {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func sessionAEAD(key []byte, id sessionID) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(keyContext))
+	mac.Write(id[:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+// current returns the newest active key, or the oldest known key if none is
+// active yet. Called with s.mu held.
+func (s *Sealer) current(now time.Time) *keyState {
+	var cur, oldest *keyState
+	for _, k := range s.keys {
+		if oldest == nil || k.Version < oldest.Version {
+			oldest = k
+		}
+		if !k.NotBefore.After(now) && (cur == nil || k.Version > cur.Version) {
+			cur = k
+		}
+	}
+	if cur == nil {
+		return oldest
+	}
+	return cur
+}
+
+// accepted reports whether frames sealed with k are opened, which is until
+// grace after a newer version became active. Called with s.mu held.
+func (s *Sealer) accepted(k *keyState, now time.Time) bool {
+	for _, n := range s.keys {
+		if n.Version > k.Version && !n.NotBefore.After(now) && now.Sub(n.NotBefore) > s.grace {
+			return false
+		}
+	}
+	return true
+}
+
+// retire forgets key versions and sessions that are no longer accepted.
+// Called with s.mu held.
+func (s *Sealer) retire(now time.Time) {
+	for v, k := range s.keys {
+		if !s.accepted(k, now) {
+			s.retired[v] = k.Material
+			delete(s.keys, v)
+		}
+	}
+	for id := range s.peers {
+		if _, ok := s.keys[id.version]; !ok {
+			delete(s.peers, id)
+		}
+	}
+}
+
+// Seal encrypts and authenticates frame with the current key version, and
+// authenticates ad, which the transport sends in the clear. The result is
+// Overhead bytes longer.
+func (s *Sealer) Seal(frame, ad []byte) []byte {
+	now := s.now()
+	s.mu.Lock()
+	k := s.current(now)
+	s.mu.Unlock()
+
+	seq := atomic.AddUint64(&s.seq, 1)
+	out := make([]byte, headerLen, headerLen+len(frame)+tagLen)
+	out[0] = version
+	binary.BigEndian.PutUint32(out[1:], k.Version)
+	copy(out[1+versionLen:], s.session[:])
+	binary.BigEndian.PutUint64(out[1+versionLen+sessionLen:], seq)
+	binary.BigEndian.PutUint64(out[1+versionLen+sessionLen+seqLen:], uint64(now.UnixNano()))
+	return k.aead.Seal(out, nonce(seq), frame, additionalData(out[:headerLen], ad))
+}
+
+func additionalData(header, ad []byte) []byte {
+	return append(append(make([]byte, 0, len(header)+len(ad)), header...), ad...)
+}
+
+// parse returns the session, sequence number and seal time of a frame.
+func parse(sealed []byte) (peerID, uint64, time.Time, bool) {
+	var id peerID
+	if len(sealed) < Overhead || sealed[0] != version {
+		return id, 0, time.Time{}, false
+	}
+	id.version = binary.BigEndian.Uint32(sealed[1:])
+	copy(id.session[:], sealed[1+versionLen:])
+	seq := binary.BigEndian.Uint64(sealed[1+versionLen+sessionLen:])
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(sealed[1+versionLen+sessionLen+seqLen:])))
+	return id, seq, sent, true
+}
+
+// fresh reports whether a frame sealed at sent can be opened at now.
+func (s *Sealer) fresh(sent, now time.Time) bool {
+	return !sent.Before(now.Add(-MaxAge)) && !sent.Before(s.started.Add(-maxSkew)) && !sent.After(now.Add(maxSkew))
+}
+
+// Open authenticates and decrypts a sealed frame, and ad sent with it.
+// Frames that fail authentication, were already received or are stale are
+// rejected.
+func (s *Sealer) Open(sealed, ad []byte) ([]byte, error) {
+	id, seq, sent, ok := parse(sealed)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	k, ok := s.keys[id.version]
+	if !ok || !s.accepted(k, now) {
+		return nil, ErrUnknownKey
+	}
+	p, ok := s.peers[id]
+	if !ok {
+		aead, err := sessionAEAD(k.Material, id.session)
+		if err != nil {
+			return nil, err
+		}
+		p = &peer{aead: aead}
+	}
+	if !p.check(seq) {
+		return nil, ErrReplay
+	}
+
+	frame, err := p.aead.Open(nil, nonce(seq), sealed[headerLen:], additionalData(sealed[:headerLen], ad))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	// The seal time is only trusted once the frame authenticated.
+	if !s.fresh(sent, now) {
+		return nil, ErrStale
+	}
+
+	// Only remember sessions once a frame authenticated, so forged session
+	// IDs can't fill up the table.
+	if !ok {
+		s.evict(now)
+		s.peers[id] = p
+	}
+	p.accept(seq)
+	p.lastSeen = now
+	return frame, nil
+}
+
+// OpenOffline authenticates and decrypts a frame read back after the fact,
+// like the history of a network: it opens with any key version the sealer
+// knew, retired ones included, and isn't checked for replays or freshness.
+func (s *Sealer) OpenOffline(sealed, ad []byte) ([]byte, error) {
+	id, seq, _, ok := parse(sealed)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	s.mu.Lock()
+	material, ok := s.retired[id.version]
+	if k, known := s.keys[id.version]; known {
+		material, ok = k.Material, true
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	aead, err := sessionAEAD(material, id.session)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := aead.Open(nil, nonce(seq), sealed[headerLen:], additionalData(sealed[:headerLen], ad))
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	return frame, nil
+}
+
+// check reports whether seq is new and within the replay window.
+func (p *peer) check(seq uint64) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > p.highest {
+		return true
+	}
+	diff := p.highest - seq
+	if diff >= windowSize {
+		return false
+	}
+	return p.window&(1<<diff) == 0
+}
+
+// accept marks seq as received.
+func (p *peer) accept(seq uint64) {
+	if seq > p.highest {
+		shift := seq - p.highest
+		if shift >= windowSize {
+			p.window = 0
+		} else {
+			p.window <<= shift
+		}
+		p.window |= 1
+		p.highest = seq
+		return
+	}
+	p.window |= 1 << (p.highest - seq)
+}
+
+// evict makes room for a new peer, called with s.mu held.
+func (s *Sealer) evict(now time.Time) {
+	if len(s.peers) < maxPeers {
+		return
+	}
+	var oldest peerID
+	var oldestSeen time.Time
+	for id, p := range s.peers {
+		if now.Sub(p.lastSeen) > peerIdle {
+			delete(s.peers, id)
+			continue
+		}
+		if oldestSeen.IsZero() || p.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = id, p.lastSeen
+		}
+	}
+	if len(s.peers) >= maxPeers {
+		delete(s.peers, oldest)
+	}
+}
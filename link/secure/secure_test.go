@@ -0,0 +1,198 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func setup(t *testing.T, key []byte) *Sealer {
+	s, err := NewPSK(key)
+	if err != nil {
+		t.Fatalf("NewPSK: unexpected error: %v", err)
+	}
+	return s
+}
+
+func TestSealer_RoundTrip(t *testing.T) {
+	tx := setup(t, testKey)
+	rx := setup(t, testKey)
+
+	frame := []byte("helloworld")
+	sealed := tx.Seal(frame, nil)
+	if len(sealed) != len(frame)+Overhead {
+		t.Fatalf("Expected sealed length %d, got %d", len(frame)+Overhead, len(sealed))
+	}
+	if bytes.Contains(sealed, frame) {
+		t.Fatalf("Expected frame to be encrypted")
+	}
+	opened, err := rx.Open(sealed, nil)
+	if err != nil {
+		t.Fatalf("Open: unexpected error: %v", err)
+	}
+	if !bytes.Equal(frame, opened) {
+		t.Errorf("Expected '%s', got '%s'", frame, opened)
+	}
+}
+
+func TestSealer_Reject(t *testing.T) {
+	tx := setup(t, testKey)
+	rx := setup(t, testKey)
+	other := setup(t, []byte("fedcba9876543210fedcba9876543210"))
+
+	tampered := tx.Seal([]byte("helloworld"), nil)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tables := []struct {
+		frame []byte
+		err   error
+	}{
+		{[]byte("plaintext frame that is long enough"), ErrUnauthenticated},
+		{[]byte{}, ErrUnauthenticated},
+		{tampered, ErrUnauthenticated},
+		{other.Seal([]byte("helloworld"), nil), ErrUnauthenticated},
+	}
+	for i, table := range tables {
+		if _, err := rx.Open(table.frame, nil); err != table.err {
+			t.Errorf("[%d] Expected error %v, got: %v", i, table.err, err)
+		}
+	}
+	if len(rx.peers) != 0 {
+		t.Errorf("Expected unauthenticated sessions to be forgotten, got %d", len(rx.peers))
+	}
+}
+
+func TestSealer_Replay(t *testing.T) {
+	tx := setup(t, testKey)
+	rx := setup(t, testKey)
+
+	var frames [][]byte
+	for i := 0; i < windowSize+2; i++ {
+		frames = append(frames, tx.Seal([]byte{byte(i)}, nil))
+	}
+
+	tables := []struct {
+		frame int
+		err   error
+	}{
+		{1, nil},
+		{1, ErrReplay},
+		{0, nil}, // out of order, still inside the window
+		{windowSize + 1, nil},
+		{0, ErrReplay}, // fell out of the window
+		{2, nil},
+		{2, ErrReplay},
+	}
+	for i, table := range tables {
+		if _, err := rx.Open(frames[table.frame], nil); err != table.err {
+			t.Errorf("[%d] Expected error %v for frame %d, got: %v", i, table.err, table.frame, err)
+		}
+	}
+}
+
+func TestNewPSK_KeySize(t *testing.T) {
+	if _, err := NewPSK([]byte("short")); err != ErrKeySize {
+		t.Errorf("Expected error %v, got: %v", ErrKeySize, err)
+	}
+}
+
+func TestSealer_Rotate(t *testing.T) {
+	p := NewMemoryKeyProvider()
+	tx, err := NewProviderSealer(p, time.Minute)
+	if err != nil {
+		t.Fatalf("NewProviderSealer: unexpected error: %v", err)
+	}
+	rx, err := NewProviderSealer(p, time.Minute)
+	if err != nil {
+		t.Fatalf("NewProviderSealer: unexpected error: %v", err)
+	}
+	now := time.Now()
+	tx.now = func() time.Time { return now }
+	rx.now = func() time.Time { return now }
+
+	old := tx.Seal([]byte("v0"), nil)
+	if _, err := p.Rotate(now.Add(time.Minute)); err != nil {
+		t.Fatalf("Rotate: unexpected error: %v", err)
+	}
+	for _, s := range []*Sealer{tx, rx} {
+		if err := NewKeyWatcher(p, s, 0).Refresh(); err != nil {
+			t.Fatalf("Refresh: unexpected error: %v", err)
+		}
+	}
+
+	// The new version is known but not active yet.
+	if sealed := tx.Seal([]byte("v0"), nil); binary.BigEndian.Uint32(sealed[1:]) != 0 {
+		t.Errorf("Expected version 0 before activation, got %d", binary.BigEndian.Uint32(sealed[1:]))
+	}
+
+	// After activation frames are sealed with the new version, frames of the
+	// previous version still open during the grace period.
+	now = now.Add(90 * time.Second)
+	sealed := tx.Seal([]byte("v1"), nil)
+	if v := binary.BigEndian.Uint32(sealed[1:]); v != 1 {
+		t.Errorf("Expected version 1 after activation, got %d", v)
+	}
+	if _, err := rx.Open(sealed, nil); err != nil {
+		t.Errorf("Open: unexpected error for new version: %v", err)
+	}
+	if _, err := rx.Open(old, nil); err != nil {
+		t.Errorf("Open: unexpected error during grace period: %v", err)
+	}
+
+	// Once the grace period is over, the previous version is rejected.
+	now = now.Add(time.Minute)
+	if _, err := rx.Open(tx.Seal([]byte("v1"), nil), nil); err != nil {
+		t.Errorf("Open: unexpected error for new version: %v", err)
+	}
+	if _, err := rx.Open(old, nil); err != ErrUnknownKey {
+		t.Errorf("Expected error %v after grace period, got: %v", ErrUnknownKey, err)
+	}
+}
+
+func TestSealer_AdditionalData(t *testing.T) {
+	tx := setup(t, testKey)
+	rx := setup(t, testKey)
+
+	sealed := tx.Seal([]byte("helloworld"), []byte("ipv4 a b"))
+	if _, err := rx.Open(sealed, []byte("ipv4 a c")); err != ErrUnauthenticated {
+		t.Errorf("Expected error %v for other additional data, got: %v", ErrUnauthenticated, err)
+	}
+	if _, err := rx.Open(sealed, []byte("ipv4 a b")); err != nil {
+		t.Errorf("Open: unexpected error: %v", err)
+	}
+}
+
+func TestSealer_Stale(t *testing.T) {
+	tx := setup(t, testKey)
+	now := time.Now()
+	tx.now = func() time.Time { return now }
+	before := tx.Seal([]byte("before"), nil)
+
+	// A receiver that starts later rejects the frames sealed before, like a
+	// member that restarted would.
+	now = now.Add(time.Minute)
+	rx := setup(t, testKey)
+	rx.started = now
+	rx.now = func() time.Time { return now }
+	if _, err := rx.Open(before, nil); err != ErrStale {
+		t.Errorf("Expected error %v for a frame sealed before the receiver started, got: %v", ErrStale, err)
+	}
+
+	sealed := tx.Seal([]byte("fresh"), nil)
+	if _, err := rx.Open(sealed, nil); err != nil {
+		t.Errorf("Open: unexpected error: %v", err)
+	}
+	old := tx.Seal([]byte("old"), nil)
+	now = now.Add(MaxAge + time.Second)
+	if _, err := rx.Open(old, nil); err != ErrStale {
+		t.Errorf("Expected error %v for a frame older than MaxAge, got: %v", ErrStale, err)
+	}
+	future := tx.Seal([]byte("future"), nil)
+	now = now.Add(-time.Hour)
+	if _, err := rx.Open(future, nil); err != ErrStale {
+		t.Errorf("Expected error %v for a frame sealed in the future, got: %v", ErrStale, err)
+	}
+}
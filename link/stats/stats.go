@@ -0,0 +1,325 @@
+// Package stats counts what link endpoints do, with the same counters for
+// every transport: packets and bytes, drops by reason, calls to AWS by
+// operation, throttles, queue depths and round trip times.
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/smithclay/rlinklayer/link/secure"
+)
+
+// Reasons packets are dropped for.
+const (
+	// DropMalformed packets could not be decoded.
+	DropMalformed = "malformed"
+	// DropUnauthenticated packets were not sealed with a network key.
+	DropUnauthenticated = "unauthenticated"
+	// DropReplayed packets were sealed packets received again.
+	DropReplayed = "replayed"
+	// DropStale packets were sealed too long ago.
+	DropStale = "stale"
+	// DropLooped packets were sent by the link itself.
+	DropLooped = "looped"
+	// DropWriteFailed packets could not be handed to the transport.
+	DropWriteFailed = "write-failed"
+	// DropOverBudget packets were not sent to keep within the budget of the
+	// network.
+	DropOverBudget = "over-budget"
+	// DropQueueFull packets found the transmit queue of their class full.
+	DropQueueFull = "queue-full"
+	// DropCoDel packets were queued for too long.
+	DropCoDel = "codel"
+	// DropAckCoalesced pure ACKs were replaced in the transmit queue by a
+	// newer ACK of their connection.
+	DropAckCoalesced = "ack-coalesced"
+	// DropSynDuplicate TCP SYNs were retransmitted while the first was
+	// queued or recently sent.
+	DropSynDuplicate = "syn-duplicate"
+	// DropNoLink packets fit no link of a bond.
+	DropNoLink = "no-link"
+	// DropDuplicate packets were received again through another link of a
+	// bond.
+	DropDuplicate = "duplicate"
+)
+
+// OpenFailure returns the reason to drop a packet that a secure.Sealer
+// couldn't open with err.
+func OpenFailure(err error) string {
+	switch err {
+	case secure.ErrReplay:
+		return DropReplayed
+	case secure.ErrStale:
+		return DropStale
+	}
+	return DropUnauthenticated
+}
+
+// rttWeight is the weight of a new sample in round trip and latency
+// estimates, as the smoothed RTT of TCP.
+const rttWeight = 0.125
+
+// Source is implemented by link endpoints that keep statistics.
+type Source interface {
+	Stats() Snapshot
+}
+
+// Find returns the statistics of a registered endpoint, nil if it keeps
+// none. Wrappers like filters and captures hide the statistics of the
+// endpoint they wrap, so it should be given the transport endpoint.
+func Find(id tcpip.LinkEndpointID) Source {
+	s, _ := stack.FindLinkEndpoint(id).(Source)
+	return s
+}
+
+// Snapshot are the counters of a link at some point.
+type Snapshot struct {
+	RxPackets    uint64 `json:"rxPackets"`
+	RxBytes      uint64 `json:"rxBytes"`
+	TxPackets    uint64 `json:"txPackets"`
+	TxBytes      uint64 `json:"txBytes"`
+	EncodeErrors uint64 `json:"encodeErrors"`
+	DecodeErrors uint64 `json:"decodeErrors"`
+	// Drops are dropped packets by reason.
+	Drops map[string]uint64 `json:"drops,omitempty"`
+	// Calls are the calls made to AWS by operation, APIErrors those that
+	// failed and Throttles those that failed because of rate limits.
+	Calls     map[string]uint64 `json:"calls,omitempty"`
+	APIErrors uint64            `json:"apiErrors"`
+	Throttles uint64            `json:"throttles"`
+	// RTT are smoothed durations of successful calls by operation.
+	RTT map[string]time.Duration `json:"rtt,omitempty"`
+	// Latency are smoothed delays of packets in the link by kind, i.e. the
+	// time spent queued before being written, or from being written by the
+	// sender to being read.
+	Latency map[string]time.Duration `json:"latency,omitempty"`
+	// Queues are the number of packets waiting in the link's queues.
+	Queues map[string]int `json:"queues,omitempty"`
+}
+
+func (s Snapshot) String() string {
+	parts := []string{
+		fmt.Sprintf("rx %d/%dB tx %d/%dB", s.RxPackets, s.RxBytes, s.TxPackets, s.TxBytes),
+		fmt.Sprintf("errors encode %d decode %d api %d throttled %d", s.EncodeErrors, s.DecodeErrors, s.APIErrors, s.Throttles),
+	}
+	if len(s.Drops) > 0 {
+		parts = append(parts, "drops "+joinCounts(s.Drops))
+	}
+	if len(s.Calls) > 0 {
+		parts = append(parts, "calls "+joinCounts(s.Calls))
+	}
+	if len(s.RTT) > 0 {
+		var rtt []string
+		for _, op := range sortedKeys(s.RTT) {
+			rtt = append(rtt, fmt.Sprintf("%v=%v", op, s.RTT[op].Round(time.Millisecond)))
+		}
+		parts = append(parts, "rtt "+strings.Join(rtt, ","))
+	}
+	if len(s.Latency) > 0 {
+		var latency []string
+		for _, k := range sortedKeys(s.Latency) {
+			latency = append(latency, fmt.Sprintf("%v=%v", k, s.Latency[k].Round(time.Millisecond)))
+		}
+		parts = append(parts, "latency "+strings.Join(latency, ","))
+	}
+	if len(s.Queues) > 0 {
+		var queues []string
+		for _, q := range sortedKeys(s.Queues) {
+			queues = append(queues, fmt.Sprintf("%v=%d", q, s.Queues[q]))
+		}
+		parts = append(parts, "queues "+strings.Join(queues, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func joinCounts(m map[string]uint64) string {
+	var s []string
+	for _, k := range sortedKeys(m) {
+		s = append(s, fmt.Sprintf("%v=%d", k, m[k]))
+	}
+	return strings.Join(s, ",")
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]time.Duration:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counters are the statistics of a link, safe for concurrent use. The zero
+// value is ready to use.
+type Counters struct {
+	rxPackets    uint64
+	rxBytes      uint64
+	txPackets    uint64
+	txBytes      uint64
+	encodeErrors uint64
+	decodeErrors uint64
+	apiErrors    uint64
+	throttles    uint64
+
+	mu      sync.Mutex
+	drops   map[string]uint64
+	calls   map[string]uint64
+	rtt     map[string]time.Duration
+	latency map[string]time.Duration
+	queues  map[string]func() int
+}
+
+// Received counts a packet of n bytes delivered to the stack.
+func (c *Counters) Received(n int) {
+	atomic.AddUint64(&c.rxPackets, 1)
+	atomic.AddUint64(&c.rxBytes, uint64(n))
+}
+
+// Sent counts a packet of n bytes handed to the transport.
+func (c *Counters) Sent(n int) {
+	atomic.AddUint64(&c.txPackets, 1)
+	atomic.AddUint64(&c.txBytes, uint64(n))
+}
+
+// EncodeError counts a packet that could not be encoded for the transport.
+func (c *Counters) EncodeError() {
+	atomic.AddUint64(&c.encodeErrors, 1)
+}
+
+// DecodeError counts data from the transport that could not be decoded.
+func (c *Counters) DecodeError() {
+	atomic.AddUint64(&c.decodeErrors, 1)
+}
+
+// Drop counts a packet dropped for reason.
+func (c *Counters) Drop(reason string) {
+	c.mu.Lock()
+	if c.drops == nil {
+		c.drops = map[string]uint64{}
+	}
+	c.drops[reason]++
+	c.mu.Unlock()
+}
+
+// Call counts a call to operation op started at start, which returned err.
+func (c *Counters) Call(op string, start time.Time, err error) {
+	if err != nil {
+		atomic.AddUint64(&c.apiErrors, 1)
+		if request.IsErrorThrottle(err) {
+			atomic.AddUint64(&c.throttles, 1)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = map[string]uint64{}
+		c.rtt = map[string]time.Duration{}
+	}
+	c.calls[op]++
+	if err == nil {
+		smooth(c.rtt, op, time.Since(start))
+	}
+}
+
+// Latency adds a sample of the delay of packets of kind.
+func (c *Counters) Latency(kind string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latency == nil {
+		c.latency = map[string]time.Duration{}
+	}
+	smooth(c.latency, kind, d)
+}
+
+// smooth adds sample to the moving average of key in m.
+func smooth(m map[string]time.Duration, key string, sample time.Duration) {
+	if avg, ok := m[key]; ok {
+		m[key] = avg + time.Duration(rttWeight*float64(sample-avg))
+	} else {
+		m[key] = sample
+	}
+}
+
+// Handler counts the requests of an AWS client, add it to its Complete
+// handlers.
+func (c *Counters) Handler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "rlinklayer.stats",
+		Fn: func(r *request.Request) {
+			c.Call(r.Operation.Name, r.AttemptTime, r.Error)
+		},
+	}
+}
+
+// SetQueue reports the depth of queue name, as returned by depth, in
+// snapshots.
+func (c *Counters) SetQueue(name string, depth func() int) {
+	c.mu.Lock()
+	if c.queues == nil {
+		c.queues = map[string]func() int{}
+	}
+	c.queues[name] = depth
+	c.mu.Unlock()
+}
+
+// Snapshot returns the current value of the counters.
+func (c *Counters) Snapshot() Snapshot {
+	s := Snapshot{
+		RxPackets:    atomic.LoadUint64(&c.rxPackets),
+		RxBytes:      atomic.LoadUint64(&c.rxBytes),
+		TxPackets:    atomic.LoadUint64(&c.txPackets),
+		TxBytes:      atomic.LoadUint64(&c.txBytes),
+		EncodeErrors: atomic.LoadUint64(&c.encodeErrors),
+		DecodeErrors: atomic.LoadUint64(&c.decodeErrors),
+		APIErrors:    atomic.LoadUint64(&c.apiErrors),
+		Throttles:    atomic.LoadUint64(&c.throttles),
+		Drops:        map[string]uint64{},
+		Calls:        map[string]uint64{},
+		RTT:          map[string]time.Duration{},
+		Latency:      map[string]time.Duration{},
+		Queues:       map[string]int{},
+	}
+	queues := map[string]func() int{}
+	c.mu.Lock()
+	for k, v := range c.drops {
+		s.Drops[k] = v
+	}
+	for k, v := range c.calls {
+		s.Calls[k] = v
+	}
+	for k, v := range c.rtt {
+		s.RTT[k] = v
+	}
+	for k, v := range c.latency {
+		s.Latency[k] = v
+	}
+	for k, depth := range c.queues {
+		queues[k] = depth
+	}
+	c.mu.Unlock()
+	// Queues may be guarded by locks held while counting, so their depth is
+	// read without holding mu.
+	for k, depth := range queues {
+		s.Queues[k] = depth()
+	}
+	return s
+}
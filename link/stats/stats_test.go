@@ -0,0 +1,86 @@
+package stats
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/smithclay/rlinklayer/link/secure"
+)
+
+func TestCounters(t *testing.T) {
+	var c Counters
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Received(10)
+				c.Sent(20)
+				c.Drop(DropLooped)
+			}
+		}()
+	}
+	wg.Wait()
+	c.DecodeError()
+	c.Drop(OpenFailure(secure.ErrReplay))
+	c.Drop(OpenFailure(secure.ErrUnauthenticated))
+	c.Drop(OpenFailure(secure.ErrStale))
+	depth := 3
+	c.SetQueue("tx", func() int { return depth })
+
+	s := c.Snapshot()
+	if s.RxPackets != 800 || s.RxBytes != 8000 || s.TxPackets != 800 || s.TxBytes != 16000 || s.DecodeErrors != 1 {
+		t.Errorf("Unexpected packet counters %+v", s)
+	}
+	if s.Drops[DropLooped] != 800 || s.Drops[DropReplayed] != 1 || s.Drops[DropUnauthenticated] != 1 || s.Drops[DropStale] != 1 {
+		t.Errorf("Unexpected drops %v", s.Drops)
+	}
+	if s.Queues["tx"] != 3 {
+		t.Errorf("Expected a tx queue of 3, got %v", s.Queues)
+	}
+	s.Drops[DropLooped] = 0
+	if c.Snapshot().Drops[DropLooped] != 800 {
+		t.Errorf("Expected snapshots to be copies")
+	}
+}
+
+func TestCounters_Call(t *testing.T) {
+	var c Counters
+	now := time.Now()
+	c.Call("PutLogEvents", now.Add(-100*time.Millisecond), nil)
+	c.Call("PutLogEvents", now.Add(-900*time.Millisecond), nil)
+	c.Call("PutLogEvents", now, awserr.New("ThrottlingException", "Rate exceeded", nil))
+	c.Call("FilterLogEvents", now, errors.New("connection reset"))
+
+	s := c.Snapshot()
+	if s.Calls["PutLogEvents"] != 3 || s.Calls["FilterLogEvents"] != 1 {
+		t.Errorf("Unexpected calls %v", s.Calls)
+	}
+	if s.APIErrors != 2 || s.Throttles != 1 {
+		t.Errorf("Expected 2 errors and 1 throttle, got %v and %v", s.APIErrors, s.Throttles)
+	}
+	// 100ms + (900ms - 100ms) / 8
+	if rtt := s.RTT["PutLogEvents"]; rtt < 195*time.Millisecond || rtt > 210*time.Millisecond {
+		t.Errorf("Expected a smoothed RTT of about 200ms, got %v", rtt)
+	}
+	if _, ok := s.RTT["FilterLogEvents"]; ok {
+		t.Errorf("Expected failed calls to be left out of RTT estimates")
+	}
+	if str := s.String(); !strings.Contains(str, "calls FilterLogEvents=1,PutLogEvents=3") {
+		t.Errorf("Unexpected string %q", str)
+	}
+}
+
+func TestCounters_Latency(t *testing.T) {
+	var c Counters
+	c.Latency("queue", time.Second)
+	c.Latency("queue", 9*time.Second)
+	if got := c.Snapshot().Latency["queue"]; got != 2*time.Second {
+		t.Errorf("Expected a smoothed latency of 2s, got %v", got)
+	}
+}
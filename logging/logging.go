@@ -0,0 +1,308 @@
+// Package logging is the leveled, structured logger of the links and the
+// overlay. Its Logger has the methods of log/slog, so a *slog.Logger can be
+// used through FromSlog, and messages carry key-value fields like the
+// network, MAC address, peer or log stream they are about instead of ad-hoc
+// prefixes. The default logger prints messages at info and above, at most
+// a few of each per minute.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is a leveled logger with fields. args are alternating keys and
+// values, like the arguments of slog.Logger methods.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+	// With returns a logger adding args to every message.
+	With(args ...interface{}) Logger
+}
+
+// Level is the importance of a message, with the values of slog levels.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("ParseLevel: unknown level %q", s)
+}
+
+// Defaults of Options.
+const (
+	DefaultInterval = time.Minute
+	DefaultBurst    = 10
+)
+
+// Options configure a logger created with New.
+type Options struct {
+	// Output is where messages are written, os.Stderr if nil.
+	Output io.Writer
+	// Level is the least important level printed.
+	Level Level
+	// Burst and Interval limit how often each message is printed, see
+	// RateLimit. A negative Burst disables rate limiting.
+	Burst    int
+	Interval time.Duration
+	// NoTime leaves the time out of messages, for outputs that add it like
+	// the logs of Lambda functions.
+	NoTime bool
+}
+
+// New returns a logger printing messages in the logfmt format of
+// slog.TextHandler:
+//
+//	time=2019-03-01T10:00:00.000Z level=INFO msg="joined network" network=TestNet
+func New(opts *Options) Logger {
+	o := *opts
+	if o.Output == nil {
+		o.Output = os.Stderr
+	}
+	l := &textLogger{out: &output{opts: o}}
+	if o.Burst < 0 {
+		return l
+	}
+	return RateLimit(l, o.Burst, o.Interval)
+}
+
+// output is shared by a logger and the loggers derived from it with With.
+type output struct {
+	opts Options
+	mu   sync.Mutex
+}
+
+type textLogger struct {
+	out    *output
+	fields string
+}
+
+func (l *textLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *textLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *textLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *textLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+func (l *textLogger) With(args ...interface{}) Logger {
+	return &textLogger{out: l.out, fields: l.fields + formatArgs(args)}
+}
+
+func (l *textLogger) log(level Level, msg string, args []interface{}) {
+	o := l.out
+	if level < o.opts.Level {
+		return
+	}
+	var b strings.Builder
+	if !o.opts.NoTime {
+		b.WriteString("time=")
+		b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		b.WriteByte(' ')
+	}
+	b.WriteString("level=")
+	b.WriteString(level.String())
+	b.WriteString(" msg=")
+	b.WriteString(quote(msg))
+	b.WriteString(l.fields)
+	b.WriteString(formatArgs(args))
+	b.WriteByte('\n')
+	o.mu.Lock()
+	io.WriteString(o.opts.Output, b.String())
+	o.mu.Unlock()
+}
+
+// RateLimit returns a logger printing each message through l at most burst
+// times per interval, whatever its fields. The others are counted, and the
+// count is added to the next one printed as the suppressed field.
+// DefaultBurst and DefaultInterval are used if zero.
+func RateLimit(l Logger, burst int, interval time.Duration) Logger {
+	if burst == 0 {
+		burst = DefaultBurst
+	}
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	return &limited{l: l, limiter: &limiter{burst: burst, interval: interval, limits: map[string]*limit{}}}
+}
+
+// limiter is shared by a limited logger and the loggers derived from it.
+type limiter struct {
+	burst    int
+	interval time.Duration
+
+	mu     sync.Mutex
+	limits map[string]*limit
+}
+
+// limit counts the messages with the same level and text in the current
+// interval.
+type limit struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// allow reports whether a message can be printed, and how many were
+// suppressed before it.
+func (r *limiter) allow(level Level, msg string) (bool, int) {
+	now := time.Now()
+	key := level.String() + " " + msg
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lim := r.limits[key]
+	suppressed := 0
+	if lim == nil || now.Sub(lim.start) >= r.interval {
+		if lim != nil {
+			suppressed = lim.suppressed
+		}
+		lim = &limit{start: now}
+		r.limits[key] = lim
+	}
+	if lim.count >= r.burst {
+		lim.suppressed++
+		return false, 0
+	}
+	lim.count++
+	return true, suppressed
+}
+
+type limited struct {
+	l       Logger
+	limiter *limiter
+}
+
+func (r *limited) Debug(msg string, args ...interface{}) {
+	if args, ok := r.allow(LevelDebug, msg, args); ok {
+		r.l.Debug(msg, args...)
+	}
+}
+
+func (r *limited) Info(msg string, args ...interface{}) {
+	if args, ok := r.allow(LevelInfo, msg, args); ok {
+		r.l.Info(msg, args...)
+	}
+}
+
+func (r *limited) Warn(msg string, args ...interface{}) {
+	if args, ok := r.allow(LevelWarn, msg, args); ok {
+		r.l.Warn(msg, args...)
+	}
+}
+
+func (r *limited) Error(msg string, args ...interface{}) {
+	if args, ok := r.allow(LevelError, msg, args); ok {
+		r.l.Error(msg, args...)
+	}
+}
+
+func (r *limited) With(args ...interface{}) Logger {
+	return &limited{l: r.l.With(args...), limiter: r.limiter}
+}
+
+func (r *limited) allow(level Level, msg string, args []interface{}) ([]interface{}, bool) {
+	ok, suppressed := r.limiter.allow(level, msg)
+	if suppressed > 0 {
+		args = append(args[:len(args):len(args)], "suppressed", suppressed)
+	}
+	return args, ok
+}
+
+// formatArgs formats key-value pairs as " key=value" fields. A key without
+// a value is printed as the value of !BADKEY, like slog does.
+func formatArgs(args []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(args); i += 2 {
+		key, value := "!BADKEY", args[i]
+		if i+1 < len(args) {
+			key, value = fmt.Sprint(args[i]), args[i+1]
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(quote(fmt.Sprint(value)))
+	}
+	return b.String()
+}
+
+// quote quotes s if it is empty or has spaces, quotes or equal signs.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=\\") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+type discard struct{}
+
+func (discard) Debug(string, ...interface{}) {}
+func (discard) Info(string, ...interface{})  {}
+func (discard) Warn(string, ...interface{})  {}
+func (discard) Error(string, ...interface{}) {}
+func (d discard) With(...interface{}) Logger { return d }
+
+// Discard is a logger that prints nothing.
+var Discard Logger = discard{}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = New(&Options{})
+)
+
+// Default returns the logger used by components given no logger: the one
+// set with SetDefault, or one printing messages at info and above to
+// os.Stderr.
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the logger returned by Default.
+func SetDefault(l Logger) {
+	defaultMu.Lock()
+	defaultLogger = l
+	defaultMu.Unlock()
+}
+
+// OrDefault returns l, or Default if l is nil. Components call it on the
+// logger of their options.
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&Options{Output: &buf, NoTime: true}).With("network", "TestNet")
+	l.Debug("polling")
+	l.Info("joined network", "ip", "192.168.1.2", "err", "rate exceeded")
+	l.Warn("odd", "key")
+
+	want := `level=INFO msg="joined network" network=TestNet ip=192.168.1.2 err="rate exceeded"` + "\n" +
+		"level=WARN msg=odd network=TestNet !BADKEY=key\n"
+	if buf.String() != want {
+		t.Errorf("Expected:\n%vgot:\n%v", want, buf.String())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&Options{Output: &buf, NoTime: true, Burst: 2, Interval: 50 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		l.With("peer", i).Warn("could not write")
+	}
+	l.Warn("other")
+	if n := strings.Count(buf.String(), "could not write"); n != 2 {
+		t.Errorf("Expected 2 messages in the interval, got %v:\n%v", n, buf.String())
+	}
+	time.Sleep(60 * time.Millisecond)
+	buf.Reset()
+	l.Warn("could not write")
+	if want := "level=WARN msg=\"could not write\" suppressed=3\n"; buf.String() != want {
+		t.Errorf("Expected %q after the interval, got %q", want, buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"": LevelInfo, "DEBUG": LevelDebug, "warn": LevelWarn, "error": LevelError} {
+		if l, err := ParseLevel(s); err != nil || l != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, expected %v", s, l, err, want)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,24 @@
+// +build go1.21
+
+package logging
+
+import "log/slog"
+
+// FromSlog returns a Logger printing through l. Wrap it with RateLimit to
+// limit repeated messages.
+func FromSlog(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Debug(msg string, args ...interface{}) { s.l.Debug(msg, args...) }
+func (s slogLogger) Info(msg string, args ...interface{})  { s.l.Info(msg, args...) }
+func (s slogLogger) Warn(msg string, args ...interface{})  { s.l.Warn(msg, args...) }
+func (s slogLogger) Error(msg string, args ...interface{}) { s.l.Error(msg, args...) }
+
+func (s slogLogger) With(args ...interface{}) Logger {
+	return slogLogger{s.l.With(args...)}
+}
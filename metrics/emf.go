@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EMF writes samples as CloudWatch embedded metric format log lines, which
+// CloudWatch turns into metrics when a Lambda function prints them. Samples
+// with the same labels go on one line, with the labels as dimensions.
+// Counters are emitted as the increase since the previous emit, so that
+// summing them in CloudWatch gives the totals.
+type EMF struct {
+	w         io.Writer
+	namespace string
+
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+// NewEMF returns an emitter writing to w, e.g. the stdout of a function, in
+// namespace.
+func NewEMF(w io.Writer, namespace string) *EMF {
+	return &EMF{w: w, namespace: namespace, last: map[string]float64{}}
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// maxEMFMetrics is the most metrics CloudWatch accepts in a directive.
+const maxEMFMetrics = 100
+
+// Emit writes samples at now.
+func (e *EMF) Emit(samples []Sample, now time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	type line struct {
+		labels  map[string]string
+		metrics []emfMetric
+		values  map[string]float64
+	}
+	lines := map[string]*line{}
+	var order []string
+	for _, s := range samples {
+		key := s.labelKey()
+		l, ok := lines[key]
+		if !ok {
+			l = &line{labels: s.Labels, values: map[string]float64{}}
+			lines[key] = l
+			order = append(order, key)
+		}
+		name := emfName(s.Name)
+		if _, ok := l.values[name]; ok || len(l.metrics) == maxEMFMetrics {
+			continue
+		}
+		v := s.Value
+		if s.Type == Counter {
+			id := s.Name + "{" + key + "}"
+			v, e.last[id] = s.Value-e.last[id], s.Value
+		}
+		l.metrics = append(l.metrics, emfMetric{Name: name, Unit: emfUnit(s)})
+		l.values[name] = v
+	}
+
+	enc := json.NewEncoder(e.w)
+	for _, key := range order {
+		l := lines[key]
+		dims := []string{}
+		doc := map[string]interface{}{}
+		for k, v := range l.labels {
+			dims = append(dims, k)
+			doc[k] = v
+		}
+		sort.Strings(dims)
+		for k, v := range l.values {
+			doc[k] = v
+		}
+		doc["_aws"] = emfMetadata{
+			Timestamp: now.UnixNano() / int64(time.Millisecond),
+			CloudWatchMetrics: []emfDirective{{
+				Namespace:  e.namespace,
+				Dimensions: [][]string{dims},
+				Metrics:    l.metrics,
+			}},
+		}
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emfName is the CloudWatch name of a metric, its Prometheus name without
+// the rlinklayer_ prefix.
+func emfName(name string) string {
+	return strings.TrimPrefix(name, "rlinklayer_")
+}
+
+func emfUnit(s Sample) string {
+	switch {
+	case s.Type == Counter && strings.HasSuffix(s.Name, "_bytes_total"):
+		return "Bytes"
+	case s.Type == Counter:
+		return "Count"
+	case strings.HasSuffix(s.Name, "_seconds"):
+		return "Seconds"
+	}
+	return "None"
+}
+
+// Run emits the samples of r every interval, until stop is closed.
+func (e *EMF) Run(r *Registry, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			if err := e.Emit(r.Gather(), now); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package metrics exports what the overlay and its links count, in the
+// Prometheus text format for bridges and nodes, and as CloudWatch embedded
+// metric format (EMF) log lines for Lambda functions, without depending on a
+// metrics library.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/link/budget"
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+// Type is the kind of a metric.
+type Type string
+
+const (
+	// Counter metrics only go up, and are reset when the process restarts.
+	Counter Type = "counter"
+	// Gauge metrics are a current value.
+	Gauge Type = "gauge"
+)
+
+// Sample is the value of a metric with some labels.
+type Sample struct {
+	// Name is the Prometheus name of the metric, e.g. rlinklayer_link_rx_packets_total.
+	Name   string
+	Help   string
+	Type   Type
+	Labels map[string]string
+	Value  float64
+}
+
+// labelKey returns the labels of s as a canonical string.
+func (s *Sample) labelKey() string {
+	var keys []string
+	for k := range s.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(s.Labels[k])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// Collector returns the current samples of some metrics.
+type Collector interface {
+	Collect() []Sample
+}
+
+// CollectorFunc is a function used as a Collector.
+type CollectorFunc func() []Sample
+
+// Collect calls f.
+func (f CollectorFunc) Collect() []Sample {
+	return f()
+}
+
+// Registry gathers samples from collectors. The zero value is ready to use.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// Register adds c to the collectors of r.
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Gather returns the samples of every collector, sorted by name and labels.
+func (r *Registry) Gather() []Sample {
+	r.mu.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mu.Unlock()
+	var samples []Sample
+	for _, c := range collectors {
+		samples = append(samples, c.Collect()...)
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return samples[i].labelKey() < samples[j].labelKey()
+	})
+	return samples
+}
+
+// WithLabels returns a collector adding labels to the samples of c, e.g. the
+// network a process is part of.
+func WithLabels(c Collector, labels map[string]string) Collector {
+	return CollectorFunc(func() []Sample {
+		return Label(c.Collect(), labels)
+	})
+}
+
+// Label adds labels to samples, keeping the labels samples already have.
+func Label(samples []Sample, labels map[string]string) []Sample {
+	for i := range samples {
+		l := map[string]string{}
+		for k, v := range labels {
+			l[k] = v
+		}
+		for k, v := range samples[i].Labels {
+			l[k] = v
+		}
+		samples[i].Labels = l
+	}
+	return samples
+}
+
+// Link returns a collector of the statistics of a link endpoint, labelled
+// with its name.
+func Link(name string, src stats.Source) Collector {
+	return CollectorFunc(func() []Sample {
+		return LinkSamples(name, src.Stats())
+	})
+}
+
+// LinkSamples returns the samples of a snapshot of link name.
+func LinkSamples(name string, s stats.Snapshot) []Sample {
+	link := map[string]string{"link": name}
+	with := func(k, v string) map[string]string {
+		return map[string]string{"link": name, k: v}
+	}
+	samples := []Sample{
+		{Name: "rlinklayer_link_rx_packets_total", Help: "Packets received from the link.", Type: Counter, Labels: link, Value: float64(s.RxPackets)},
+		{Name: "rlinklayer_link_rx_bytes_total", Help: "Bytes received from the link.", Type: Counter, Labels: link, Value: float64(s.RxBytes)},
+		{Name: "rlinklayer_link_tx_packets_total", Help: "Packets sent to the link.", Type: Counter, Labels: link, Value: float64(s.TxPackets)},
+		{Name: "rlinklayer_link_tx_bytes_total", Help: "Bytes sent to the link.", Type: Counter, Labels: link, Value: float64(s.TxBytes)},
+		{Name: "rlinklayer_link_encode_errors_total", Help: "Packets that could not be encoded for the transport.", Type: Counter, Labels: link, Value: float64(s.EncodeErrors)},
+		{Name: "rlinklayer_link_decode_errors_total", Help: "Data from the transport that could not be decoded.", Type: Counter, Labels: link, Value: float64(s.DecodeErrors)},
+		{Name: "rlinklayer_link_api_errors_total", Help: "Calls to AWS that failed.", Type: Counter, Labels: link, Value: float64(s.APIErrors)},
+		{Name: "rlinklayer_link_api_throttles_total", Help: "Calls to AWS that were throttled.", Type: Counter, Labels: link, Value: float64(s.Throttles)},
+	}
+	for reason, n := range s.Drops {
+		samples = append(samples, Sample{Name: "rlinklayer_link_drops_total", Help: "Packets dropped by reason.", Type: Counter, Labels: with("reason", reason), Value: float64(n)})
+	}
+	for op, n := range s.Calls {
+		samples = append(samples, Sample{Name: "rlinklayer_link_api_calls_total", Help: "Calls to AWS by operation.", Type: Counter, Labels: with("operation", op), Value: float64(n)})
+	}
+	for op, rtt := range s.RTT {
+		samples = append(samples, Sample{Name: "rlinklayer_link_api_rtt_seconds", Help: "Smoothed duration of successful calls to AWS by operation.", Type: Gauge, Labels: with("operation", op), Value: rtt.Seconds()})
+	}
+	for kind, d := range s.Latency {
+		samples = append(samples, Sample{Name: "rlinklayer_link_latency_seconds", Help: "Smoothed delay of packets in the link by kind.", Type: Gauge, Labels: with("kind", kind), Value: d.Seconds()})
+	}
+	for q, n := range s.Queues {
+		samples = append(samples, Sample{Name: "rlinklayer_link_queue_depth", Help: "Packets waiting in the queues of the link.", Type: Gauge, Labels: with("queue", q), Value: float64(n)})
+	}
+	return samples
+}
+
+// Budget returns a collector of the usage metered by m.
+func Budget(m *budget.Meter) Collector {
+	return CollectorFunc(func() []Sample {
+		return BudgetSamples(m.Usage())
+	})
+}
+
+// BudgetSamples returns the samples of the usage of a network.
+func BudgetSamples(u budget.Usage) []Sample {
+	samples := []Sample{
+		{Name: "rlinklayer_budget_ingested_bytes_total", Help: "Bytes ingested by CloudWatch Logs, as billed.", Type: Counter, Value: float64(u.IngestedBytes)},
+		{Name: "rlinklayer_budget_cost_dollars_total", Help: "Estimated cost of the calls to AWS and ingested bytes.", Type: Counter, Value: u.Cost},
+		{Name: "rlinklayer_budget_delay_seconds_total", Help: "Time calls over budget waited for it.", Type: Counter, Value: u.Waited.Seconds()},
+	}
+	for op, n := range u.Calls {
+		samples = append(samples, Sample{Name: "rlinklayer_budget_calls_total", Help: "Calls to AWS metered by operation.", Type: Counter, Labels: map[string]string{"operation": op}, Value: float64(n)})
+	}
+	for action, counts := range map[string]map[string]uint64{budget.Shed: u.Shed, budget.Delay: u.Delayed} {
+		for op, n := range counts {
+			samples = append(samples, Sample{Name: "rlinklayer_budget_exceeded_total", Help: "Calls over budget by operation and action taken.", Type: Counter, Labels: map[string]string{"operation": op, "action": action}, Value: float64(n)})
+		}
+	}
+	return samples
+}
+
+// TCPSamples returns the samples of the TCP counters of a netstack stack.
+func TCPSamples(s tcpip.Stats) []Sample {
+	tcp := s.TCP
+	var samples []Sample
+	for _, c := range []struct {
+		name, help string
+		typ        Type
+		counter    *tcpip.StatCounter
+	}{
+		{"rlinklayer_tcp_active_opens_total", "TCP connections opened by the stack.", Counter, tcp.ActiveConnectionOpenings},
+		{"rlinklayer_tcp_passive_opens_total", "TCP connections accepted by the stack.", Counter, tcp.PassiveConnectionOpenings},
+		{"rlinklayer_tcp_established", "TCP connections currently established.", Gauge, tcp.CurrentEstablished},
+		{"rlinklayer_tcp_failed_connections_total", "TCP connection attempts that failed.", Counter, tcp.FailedConnectionAttempts},
+		{"rlinklayer_tcp_segments_received_total", "TCP segments received.", Counter, tcp.ValidSegmentsReceived},
+		{"rlinklayer_tcp_segments_sent_total", "TCP segments sent.", Counter, tcp.SegmentsSent},
+		{"rlinklayer_tcp_retransmits_total", "TCP segments retransmitted.", Counter, tcp.Retransmits},
+		{"rlinklayer_tcp_fast_retransmits_total", "TCP segments retransmitted by fast retransmit.", Counter, tcp.FastRetransmit},
+		{"rlinklayer_tcp_timeouts_total", "TCP retransmission timer expirations.", Counter, tcp.Timeouts},
+		{"rlinklayer_tcp_resets_sent_total", "TCP resets sent.", Counter, tcp.ResetsSent},
+	} {
+		// Counters are nil in stats that weren't filled by a stack.
+		if c.counter == nil {
+			continue
+		}
+		samples = append(samples, Sample{Name: c.name, Help: c.help, Type: c.typ, Value: float64(c.counter.Value())})
+	}
+	return samples
+}
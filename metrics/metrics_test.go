@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smithclay/rlinklayer/link/stats"
+)
+
+func TestWriteText(t *testing.T) {
+	var r Registry
+	r.Register(WithLabels(CollectorFunc(func() []Sample {
+		return LinkSamples("cloudwatch", stats.Snapshot{
+			RxPackets: 3,
+			Drops:     map[string]uint64{"looped": 2},
+			Queues:    map[string]int{"tx": 1},
+		})
+	}), map[string]string{"network": `Test"Net`}))
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf, r.Gather()); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	text := buf.String()
+	for _, want := range []string{
+		"# HELP rlinklayer_link_rx_packets_total Packets received from the link.\n# TYPE rlinklayer_link_rx_packets_total counter\n",
+		`rlinklayer_link_rx_packets_total{link="cloudwatch",network="Test\"Net"} 3` + "\n",
+		`rlinklayer_link_drops_total{link="cloudwatch",network="Test\"Net",reason="looped"} 2` + "\n",
+		"# TYPE rlinklayer_link_queue_depth gauge\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %q in:\n%v", want, text)
+		}
+	}
+	if n := strings.Count(text, "# TYPE rlinklayer_link_drops_total"); n != 1 {
+		t.Errorf("Expected one TYPE line per metric, got %v", n)
+	}
+}
+
+func TestEMF(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEMF(&buf, "rlinklayer")
+	value := 5.0
+	samples := func() []Sample {
+		return []Sample{
+			{Name: "rlinklayer_link_tx_packets_total", Type: Counter, Labels: map[string]string{"link": "tag"}, Value: value},
+			{Name: "rlinklayer_link_queue_depth", Type: Gauge, Labels: map[string]string{"link": "tag", "queue": "tx"}, Value: 2},
+		}
+	}
+	now := time.Unix(1546300800, 0)
+	e.Emit(samples(), now)
+	value = 8
+	e.Emit(samples(), now.Add(time.Minute))
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var l map[string]interface{}
+		if err := dec.Decode(&l); err != nil {
+			t.Fatalf("Invalid EMF line: %v", err)
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("Expected a line per label set per emit, got %v", len(lines))
+	}
+	if lines[0]["link_tx_packets_total"] != 5.0 || lines[2]["link_tx_packets_total"] != 3.0 {
+		t.Errorf("Expected counters to be emitted as increases, got %v and %v", lines[0], lines[2])
+	}
+	if lines[3]["link_queue_depth"] != 2.0 || lines[3]["queue"] != "tx" {
+		t.Errorf("Unexpected gauge line %v", lines[3])
+	}
+	meta := lines[1]["_aws"].(map[string]interface{})
+	directive := meta["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	dims := directive["Dimensions"].([]interface{})[0].([]interface{})
+	if meta["Timestamp"] != 1546300800000.0 || directive["Namespace"] != "rlinklayer" || len(dims) != 2 {
+		t.Errorf("Unexpected metadata %v", meta)
+	}
+}
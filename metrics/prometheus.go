@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// WriteText writes samples, sorted by name, in the Prometheus text
+// exposition format.
+func WriteText(w io.Writer, samples []Sample) error {
+	bw := bufio.NewWriter(w)
+	last := ""
+	for _, s := range samples {
+		if s.Name != last {
+			fmt.Fprintf(bw, "# HELP %s %s\n", s.Name, escapeHelp(s.Help))
+			fmt.Fprintf(bw, "# TYPE %s %s\n", s.Name, s.Type)
+			last = s.Name
+		}
+		bw.WriteString(s.Name)
+		if len(s.Labels) > 0 {
+			var keys []string
+			for k := range s.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			bw.WriteByte('{')
+			for i, k := range keys {
+				if i > 0 {
+					bw.WriteByte(',')
+				}
+				fmt.Fprintf(bw, "%s=\"%s\"", k, escapeLabel(s.Labels[k]))
+			}
+			bw.WriteByte('}')
+		}
+		bw.WriteByte(' ')
+		bw.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Handler serves the samples of r to Prometheus scrapes.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteText(w, r.Gather()); err != nil {
+			logging.Default().Debug("could not write metrics", "err", err)
+		}
+	})
+}
+
+// Serve serves the metrics of r at /metrics on addr, until the listener
+// fails.
+func Serve(addr string, r *Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(r))
+	logging.Default().Info("serving metrics", "url", "http://"+addr+"/metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logging.Default().Error("could not serve metrics", "err", err)
+	}
+}
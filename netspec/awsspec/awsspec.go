@@ -0,0 +1,61 @@
+// Package awsspec loads network specs from Amazon S3 objects and SSM
+// parameters.
+package awsspec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/smithclay/rlinklayer/netspec"
+)
+
+// Register registers the s3 and ssm loaders with clients for region, or
+// us-west-2 if empty.
+func Register(region string) {
+	if region == "" {
+		region = "us-west-2"
+	}
+	sess, _ := session.NewSession(&aws.Config{Region: aws.String(region)})
+	netspec.RegisterLoader("s3", NewS3Loader(s3.New(sess)))
+	netspec.RegisterLoader("ssm", NewSSMLoader(ssm.New(sess)))
+}
+
+// NewS3Loader returns a loader for s3://bucket/key locations.
+func NewS3Loader(svc s3iface.S3API) netspec.Loader {
+	return netspec.LoaderFunc(func(u *url.URL) ([]byte, error) {
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("expected s3://bucket/key")
+		}
+		out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(u.Host), Key: aws.String(key)})
+		if err != nil {
+			return nil, err
+		}
+		defer out.Body.Close()
+		return ioutil.ReadAll(out.Body)
+	})
+}
+
+// NewSSMLoader returns a loader for ssm:/parameter/name locations. The
+// parameter can be a SecureString, since specs may hold a network key.
+func NewSSMLoader(svc ssmiface.SSMAPI) netspec.Loader {
+	return netspec.LoaderFunc(func(u *url.URL) ([]byte, error) {
+		name := netspec.Name(u)
+		if name == "" {
+			return nil, fmt.Errorf("expected ssm:/parameter/name")
+		}
+		out, err := svc.GetParameter(&ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+		if err != nil {
+			return nil, err
+		}
+		return []byte(aws.StringValue(out.Parameter.Value)), nil
+	})
+}
@@ -0,0 +1,64 @@
+package awsspec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/smithclay/rlinklayer/netspec"
+)
+
+const doc = "name: TestNet\ncidr: 192.168.1.0/24\n"
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	v, ok := f.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader([]byte(v)))}, nil
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	params map[string]string
+}
+
+func (f *fakeSSM) GetParameter(in *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	v, ok := f.params[aws.StringValue(in.Name)]
+	if !ok {
+		return nil, awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: in.Name, Value: aws.String(v)}}, nil
+}
+
+func TestLoaders(t *testing.T) {
+	netspec.RegisterLoader("s3", NewS3Loader(&fakeS3{objects: map[string]string{"specs/net.yaml": doc}}))
+	netspec.RegisterLoader("ssm", NewSSMLoader(&fakeSSM{params: map[string]string{"/rlinklayer/TestNet": doc}}))
+
+	for _, location := range []string{"s3://specs/net.yaml", "ssm:/rlinklayer/TestNet"} {
+		s, err := netspec.Load(location)
+		if err != nil {
+			t.Errorf("Load(%v): unexpected error: %v", location, err)
+			continue
+		}
+		if s.Name != "TestNet" {
+			t.Errorf("Load(%v): got network %q", location, s.Name)
+		}
+	}
+	for _, location := range []string{"s3://specs/other.yaml", "s3://specs", "ssm:/rlinklayer/Other"} {
+		if _, err := netspec.Load(location); err == nil {
+			t.Errorf("Load(%v): expected an error", location)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package netspec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Loader reads the spec document at a location, a URL whose scheme the
+// loader was registered for.
+type Loader interface {
+	Load(u *url.URL) ([]byte, error)
+}
+
+// LoaderFunc adapts a function to a Loader.
+type LoaderFunc func(u *url.URL) ([]byte, error)
+
+// Load implements Loader.Load.
+func (f LoaderFunc) Load(u *url.URL) ([]byte, error) {
+	return f(u)
+}
+
+var (
+	loadersMu sync.RWMutex
+	loaders   = map[string]Loader{
+		"file": LoaderFunc(loadFile),
+		"env":  LoaderFunc(loadEnv),
+	}
+)
+
+// RegisterLoader makes Load read locations with scheme through l, replacing
+// any loader registered for it before. file and env are built in, see
+// awsspec for s3 and ssm.
+func RegisterLoader(scheme string, l Loader) {
+	loadersMu.Lock()
+	defer loadersMu.Unlock()
+	loaders[scheme] = l
+}
+
+// Load reads and parses the spec at location, a path or a URL:
+//
+//	/etc/rlinklayer/net.yaml, file:///etc/rlinklayer/net.yaml
+//	env:OL_SPEC_DOC           the document in an environment variable
+//	s3://bucket/net.yaml      with awsspec registered
+//	ssm:/rlinklayer/TestNet   with awsspec registered
+func Load(location string) (*Spec, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("netspec: invalid location %q: %v", location, err)
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "file"
+	}
+	loadersMu.RLock()
+	l, ok := loaders[scheme]
+	loadersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("netspec: no loader for %v, in %q", scheme, location)
+	}
+
+	data, err := l.Load(u)
+	if err != nil {
+		return nil, fmt.Errorf("netspec: could not load %v: %v", location, err)
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", location, err)
+	}
+	return s, nil
+}
+
+// Name returns the name in opaque URLs like env:NAME, or the path in
+// scheme:/path.
+func Name(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+func loadFile(u *url.URL) ([]byte, error) {
+	return ioutil.ReadFile(Name(u))
+}
+
+func loadEnv(u *url.URL) ([]byte, error) {
+	v, ok := os.LookupEnv(Name(u))
+	if !ok {
+		return nil, fmt.Errorf("%v is not set", Name(u))
+	}
+	return []byte(v), nil
+}
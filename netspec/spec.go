@@ -0,0 +1,419 @@
+// Package netspec describes a whole network in one document: its name,
+// transport, addressing, static members, port forwards, packet filter,
+// encryption and routes. Specs are written in YAML or JSON and loaded from
+// a file, an environment variable or any source with a registered Loader.
+package netspec
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/lambda/overlay"
+	"github.com/smithclay/rlinklayer/link/bridge"
+	"github.com/smithclay/rlinklayer/link/filter"
+	"github.com/smithclay/rlinklayer/link/secure"
+	"github.com/smithclay/rlinklayer/link/secure/awskeys"
+	"github.com/smithclay/rlinklayer/proxy"
+	"github.com/smithclay/rlinklayer/routing"
+	"gopkg.in/yaml.v2"
+)
+
+// Transport types.
+const (
+	Cloudwatch = "cloudwatch"
+	Tag        = "tag"
+	// Multipath networks are cloudwatch networks where the 2 members with
+	// an arn also reach each other through tags.
+	Multipath = "multipath"
+)
+
+// Spec describes a network.
+type Spec struct {
+	Name      string    `yaml:"name"`
+	Transport Transport `yaml:"transport"`
+	// CIDR is the network of the overlay, members without a static address
+	// lease one from it.
+	CIDR     string        `yaml:"cidr"`
+	LeaseTTL time.Duration `yaml:"leaseTTL"`
+	// Members are the members with a static identity.
+	Members []Member `yaml:"members"`
+	// Publish are port forwards of gateways, written like
+	// proto:[address:]port=to[:toport], see bridge.ParsePortForwards.
+	Publish []string `yaml:"publish"`
+	// Forwards are local port forwards of proxies, written like ssh -L, see
+	// proxy.ParseForward.
+	Forwards []string `yaml:"forwards"`
+	// ACL are packet filter rules, one per entry, see filter.ParseRules.
+	ACL        []string   `yaml:"acl"`
+	Encryption Encryption `yaml:"encryption"`
+	// Routes are static routes of members, written like
+	// 10.0.0.0/8 via 192.168.1.1, see overlay.ParseRoute.
+	Routes []string `yaml:"routes"`
+	// Routing has members learn routes from the gateway members, only
+	// static routes are used if nil.
+	Routing *Routing `yaml:"routing"`
+}
+
+// Routing configures the routing protocol between the gateways of networks.
+type Routing struct {
+	// Interval is how often routes are announced, routing.DefaultInterval
+	// if zero.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Transport is the link layer of a network.
+type Transport struct {
+	// Type is cloudwatch, the default, tag or multipath.
+	Type   string `yaml:"type"`
+	Region string `yaml:"region"`
+	// RetentionDays is the retention of log groups created on cloudwatch
+	// networks, zero keeps them forever.
+	RetentionDays int64 `yaml:"retentionDays"`
+	// LeaseArn is the function whose tags hold leases on tag networks.
+	LeaseArn string `yaml:"leaseArn"`
+	// RoleArn is a role members assume to use Cloudwatch Logs, when the
+	// network is in another account than theirs.
+	RoleArn string `yaml:"roleArn"`
+}
+
+// Member is a member with a static identity.
+type Member struct {
+	Name string `yaml:"name"`
+	MAC  string `yaml:"mac"`
+	// IP is the static address of the member, it leases one if empty.
+	IP string `yaml:"ip"`
+	// Arn is the function of the member on tag and multipath networks.
+	Arn string `yaml:"arn"`
+	// Gateway members forward packets between this network and the other
+	// networks they join, and announce the networks they reach.
+	Gateway bool `yaml:"gateway"`
+}
+
+// Encryption configures the network key, frames are sent in the clear when
+// neither is set.
+type Encryption struct {
+	// Key is a base64 encoded key shared by every member.
+	Key string `yaml:"key"`
+	// KeyParam is an SSM parameter with rotating keys, see awskeys.
+	KeyParam string `yaml:"keyParam"`
+}
+
+// Error lists every problem found in a spec.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "netspec: invalid network spec:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func (e *Error) addf(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Parse parses and validates a YAML or JSON spec. Unknown keys are errors,
+// so that typos don't go unnoticed.
+func Parse(data []byte) (*Spec, error) {
+	var s Spec
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return nil, fmt.Errorf("netspec: %v", err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// logGroupName matches the characters Cloudwatch allows in log group names.
+var logGroupName = regexp.MustCompile(`^[\.\-_/#A-Za-z0-9]+$`)
+
+var roleArn = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/.+$`)
+
+// Validate checks the spec, the error is an *Error with every problem.
+func (s *Spec) Validate() error {
+	e := &Error{}
+	if s.Name == "" {
+		e.addf("name: required")
+	} else if !logGroupName.MatchString(s.Name) {
+		e.addf("name: %q may only contain letters, digits and . - _ / #", s.Name)
+	}
+
+	switch s.Transport.Type {
+	case "", Cloudwatch, Tag, Multipath:
+	default:
+		e.addf("transport.type: %q is not %v, %v or %v", s.Transport.Type, Cloudwatch, Tag, Multipath)
+	}
+	if s.Transport.RetentionDays < 0 {
+		e.addf("transport.retentionDays: must not be negative")
+	}
+	if s.Transport.LeaseArn != "" && s.Transport.Type != Tag {
+		e.addf("transport.leaseArn: only used on %v networks", Tag)
+	}
+	if s.Transport.RoleArn != "" {
+		if s.Transport.Type == Tag {
+			e.addf("transport.roleArn: not used on %v networks", Tag)
+		} else if !roleArn.MatchString(s.Transport.RoleArn) {
+			e.addf("transport.roleArn: %q is not the arn of an IAM role", s.Transport.RoleArn)
+		}
+	}
+
+	var network *net.IPNet
+	if s.CIDR != "" {
+		ip, n, err := net.ParseCIDR(s.CIDR)
+		if err != nil || ip.To4() == nil {
+			e.addf("cidr: %q is not an IPv4 network", s.CIDR)
+		} else {
+			network = n
+		}
+	}
+	if s.LeaseTTL < 0 {
+		e.addf("leaseTTL: must not be negative")
+	}
+
+	s.validateMembers(e, network)
+
+	for i, p := range s.Publish {
+		if _, err := bridge.ParsePortForwards(p); err != nil {
+			e.addf("publish[%d]: %v", i, err)
+		}
+	}
+	for i, f := range s.Forwards {
+		if _, err := proxy.ParseForward(f); err != nil {
+			e.addf("forwards[%d]: %v", i, err)
+		}
+	}
+	for i, r := range s.ACL {
+		if _, err := filter.ParseRules(r); err != nil {
+			e.addf("acl[%d]: %v", i, err)
+		}
+	}
+	for i, r := range s.Routes {
+		if _, err := overlay.ParseRoute(r); err != nil {
+			e.addf("routes[%d]: %v", i, err)
+		}
+	}
+	if s.Routing != nil && s.Routing.Interval < 0 {
+		e.addf("routing.interval: must not be negative")
+	}
+
+	if s.Encryption.Key != "" && s.Encryption.KeyParam != "" {
+		e.addf("encryption: key and keyParam are exclusive")
+	}
+	if s.Encryption.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(s.Encryption.Key)
+		if err != nil {
+			e.addf("encryption.key: not base64: %v", err)
+		} else if len(key) < secure.MinKeySize {
+			e.addf("encryption.key: %d bytes, at least %d are needed", len(key), secure.MinKeySize)
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (s *Spec) validateMembers(e *Error, network *net.IPNet) {
+	names, macs, ips := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	withArn := 0
+	for i, m := range s.Members {
+		field := fmt.Sprintf("members[%d]", i)
+		if m.Name == "" {
+			e.addf("%v.name: required", field)
+		} else if names[m.Name] {
+			e.addf("%v.name: %q is used twice", field, m.Name)
+		}
+		names[m.Name] = true
+
+		if m.MAC != "" {
+			if mac, err := net.ParseMAC(m.MAC); err != nil || len(mac) != 6 {
+				e.addf("%v.mac: %q is not a MAC address", field, m.MAC)
+			} else if macs[mac.String()] {
+				e.addf("%v.mac: %v is used twice", field, mac)
+			} else {
+				macs[mac.String()] = true
+			}
+		}
+
+		switch ip := net.ParseIP(m.IP).To4(); {
+		case m.IP == "" && network == nil:
+			e.addf("%v.ip: required when the network has no cidr", field)
+		case m.IP == "":
+		case ip == nil:
+			e.addf("%v.ip: %q is not an IPv4 address", field, m.IP)
+		case network != nil && !network.Contains(ip):
+			e.addf("%v.ip: %v is outside %v", field, ip, s.CIDR)
+		case ips[ip.String()]:
+			e.addf("%v.ip: %v is used twice", field, ip)
+		default:
+			ips[ip.String()] = true
+		}
+
+		if m.Gateway && s.Routing == nil {
+			e.addf("%v.gateway: needs routing", field)
+		}
+
+		if m.Arn != "" {
+			withArn++
+			if s.Transport.Type != Tag && s.Transport.Type != Multipath {
+				e.addf("%v.arn: only used on %v and %v networks", field, Tag, Multipath)
+			}
+		}
+	}
+	if s.Transport.Type == Tag && withArn != 2 {
+		e.addf("members: %v networks are point to point and need exactly 2 members with an arn, got %d", Tag, withArn)
+	}
+	if s.Transport.Type == Multipath && withArn != 2 {
+		e.addf("members: %v networks need exactly 2 members with an arn, the ends of the tag path, got %d", Multipath, withArn)
+	}
+}
+
+// Member returns the static member called name.
+func (s *Spec) Member(name string) (*Member, bool) {
+	for i := range s.Members {
+		if s.Members[i].Name == name {
+			return &s.Members[i], true
+		}
+	}
+	return nil, false
+}
+
+// LinkAddress returns the MAC address of the member, empty if it has none.
+func (m *Member) LinkAddress() tcpip.LinkAddress {
+	mac, err := net.ParseMAC(m.MAC)
+	if err != nil {
+		return ""
+	}
+	return tcpip.LinkAddress(mac)
+}
+
+// peer returns the other end of a tag network.
+func (s *Spec) peer(self *Member) *Member {
+	for i := range s.Members {
+		if m := &s.Members[i]; m != self && m.Arn != "" {
+			return m
+		}
+	}
+	return nil
+}
+
+// Reserved returns the static addresses of members other than self, which
+// must not be leased.
+func (s *Spec) Reserved(self string) []net.IP {
+	var ips []net.IP
+	for _, m := range s.Members {
+		if ip := net.ParseIP(m.IP).To4(); ip != nil && m.Name != self {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Rules returns the packet filter rules, nil if every packet is accepted.
+func (s *Spec) Rules() []filter.Rule {
+	if len(s.ACL) == 0 {
+		return nil
+	}
+	rules, _ := filter.ParseRules(strings.Join(s.ACL, "\n"))
+	return rules
+}
+
+// StaticRoutes returns the static routes of members.
+func (s *Spec) StaticRoutes() []overlay.Route {
+	var routes []overlay.Route
+	for _, r := range s.Routes {
+		if route, err := overlay.ParseRoute(r); err == nil {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// PortForwards returns the port forwards of gateways.
+func (s *Spec) PortForwards() []bridge.PortForward {
+	forwards, _ := bridge.ParsePortForwards(strings.Join(s.Publish, ","))
+	return forwards
+}
+
+// LocalForwards returns the local port forwards of proxies.
+func (s *Spec) LocalForwards() []proxy.Forward {
+	var forwards []proxy.Forward
+	for _, text := range s.Forwards {
+		f, _ := proxy.ParseForward(text)
+		forwards = append(forwards, f)
+	}
+	return forwards
+}
+
+// NetworkKey returns the shared network key, nil if there is none.
+func (s *Spec) NetworkKey() []byte {
+	key, _ := base64.StdEncoding.DecodeString(s.Encryption.Key)
+	if len(key) == 0 {
+		return nil
+	}
+	return key
+}
+
+// Options returns the overlay options of the member called self, or of a
+// member without a static identity if self is empty.
+func (s *Spec) Options(self string) (overlay.Options, error) {
+	opts := overlay.Options{
+		NetworkName:   s.Name,
+		OverlayType:   overlay.CloudwatchLog,
+		CIDR:          s.CIDR,
+		LeaseTTL:      s.LeaseTTL,
+		RetentionDays: s.Transport.RetentionDays,
+		Region:        s.Transport.Region,
+		RoleArn:       s.Transport.RoleArn,
+		ACL:           s.Rules(),
+		NetworkKey:    s.NetworkKey(),
+		Reserved:      s.Reserved(self),
+		Routes:        s.StaticRoutes(),
+	}
+	if s.Encryption.KeyParam != "" {
+		opts.KeyProvider = awskeys.New(&awskeys.Options{
+			NetworkName:   s.Name,
+			ParameterName: s.Encryption.KeyParam,
+			Region:        s.Transport.Region,
+		})
+	}
+
+	var m *Member
+	if self != "" {
+		var ok bool
+		if m, ok = s.Member(self); !ok {
+			return opts, fmt.Errorf("netspec: %v has no member %q", s.Name, self)
+		}
+		opts.IP = m.IP
+		opts.MacAddress = string(m.LinkAddress())
+	}
+	if s.Routing != nil {
+		opts.Routing = &routing.Options{Interval: s.Routing.Interval, Gateway: m != nil && m.Gateway}
+	}
+	if s.Transport.Type == Tag {
+		if m == nil || m.Arn == "" {
+			return opts, fmt.Errorf("netspec: %v is a %v network, only its members with an arn can join", s.Name, Tag)
+		}
+		peer := s.peer(m)
+		opts.OverlayType = overlay.LambdaTag
+		opts.LocalArn = m.Arn
+		opts.RemoteArn = peer.Arn
+		opts.RemoteMacAddress = string(peer.LinkAddress())
+		opts.LeaseArn = s.Transport.LeaseArn
+	}
+	// Members without an arn only use Cloudwatch.
+	if s.Transport.Type == Multipath && m != nil && m.Arn != "" {
+		peer := s.peer(m)
+		opts.OverlayType = overlay.Multipath
+		opts.LocalArn = m.Arn
+		opts.RemoteArn = peer.Arn
+		opts.RemoteMacAddress = string(peer.LinkAddress())
+	}
+	return opts, nil
+}
@@ -0,0 +1,184 @@
+package netspec
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smithclay/rlinklayer/lambda/overlay"
+)
+
+func TestParse_Example(t *testing.T) {
+	data, err := ioutil.ReadFile("../examples/network.yaml")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	s, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+	if s.Name != "TestNet" || s.LeaseTTL != 5*time.Minute || len(s.Members) != 2 {
+		t.Errorf("Unexpected spec %+v", s)
+	}
+	if len(s.Rules()) != 1 || len(s.PortForwards()) != 1 || len(s.LocalForwards()) != 1 {
+		t.Errorf("Expected a rule and a forward of each kind")
+	}
+
+	opts, err := s.Options("http")
+	if err != nil {
+		t.Fatalf("Options: unexpected error: %v", err)
+	}
+	if opts.IP != "192.168.1.21" || opts.MacAddress != "\x42\x42\x42\x42\x42\x42" || opts.KeyProvider == nil {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+	if len(opts.Reserved) != 1 || !opts.Reserved[0].Equal(net.ParseIP("192.168.1.3")) {
+		t.Errorf("Expected the bridge address to be reserved, got %v", opts.Reserved)
+	}
+	if _, err := s.Options("nobody"); err == nil {
+		t.Errorf("Expected an error for an unknown member")
+	}
+}
+
+func TestParse_JSON(t *testing.T) {
+	s, err := Parse([]byte(`{"name": "TestNet", "transport": {"type": "tag"}, "members": [
+		{"name": "a", "ip": "192.168.1.1", "mac": "02:00:00:00:00:01", "arn": "arn:a"},
+		{"name": "b", "ip": "192.168.1.2", "mac": "02:00:00:00:00:02", "arn": "arn:b"}]}`))
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+	opts, err := s.Options("a")
+	if err != nil {
+		t.Fatalf("Options: unexpected error: %v", err)
+	}
+	if opts.OverlayType != overlay.LambdaTag || opts.LocalArn != "arn:a" || opts.RemoteArn != "arn:b" || opts.RemoteMacAddress != "\x02\x00\x00\x00\x00\x02" {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+	if _, err := s.Options(""); err == nil {
+		t.Errorf("Expected an error for a member without an arn")
+	}
+}
+
+func TestOptions_Multipath(t *testing.T) {
+	s, err := Parse([]byte(`{"name": "TestNet", "cidr": "192.168.1.0/24", "transport": {"type": "multipath"}, "members": [
+		{"name": "a", "mac": "02:00:00:00:00:01", "arn": "arn:a"},
+		{"name": "b", "mac": "02:00:00:00:00:02", "arn": "arn:b"},
+		{"name": "c", "mac": "02:00:00:00:00:03"}]}`))
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+	opts, err := s.Options("b")
+	if err != nil {
+		t.Fatalf("Options: unexpected error: %v", err)
+	}
+	if opts.OverlayType != overlay.Multipath || opts.LocalArn != "arn:b" || opts.RemoteArn != "arn:a" || opts.RemoteMacAddress != "\x02\x00\x00\x00\x00\x01" {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+	for _, self := range []string{"c", ""} {
+		if opts, err := s.Options(self); err != nil || opts.OverlayType != overlay.CloudwatchLog {
+			t.Errorf("Expected members without an arn to only use Cloudwatch, got %v, %v", opts.OverlayType, err)
+		}
+	}
+}
+
+func TestOptions_Routing(t *testing.T) {
+	s, err := Parse([]byte(`{"name": "TestNet", "cidr": "192.168.1.0/24", "routes": ["10.9.0.0/16 via 192.168.1.1"], "routing": {"interval": "30s"}, "members": [
+		{"name": "gw", "ip": "192.168.1.1", "gateway": true},
+		{"name": "web", "ip": "192.168.1.2"}]}`))
+	if err != nil {
+		t.Fatalf("Parse: unexpected error: %v", err)
+	}
+	want := []overlay.Route{{Destination: "10.9.0.0/16", Gateway: "192.168.1.1"}}
+	for _, c := range []struct {
+		self    string
+		gateway bool
+	}{{"gw", true}, {"web", false}, {"", false}} {
+		opts, err := s.Options(c.self)
+		if err != nil {
+			t.Fatalf("Options: unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(opts.Routes, want) || opts.Routing == nil || opts.Routing.Interval != 30*time.Second || opts.Routing.Gateway != c.gateway {
+			t.Errorf("Unexpected routes of %q: %v, %+v", c.self, opts.Routes, opts.Routing)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tables := []struct {
+		doc     string
+		problem string
+	}{
+		{"cidr: 192.168.1.0/24", "name: required"},
+		{"name: Test Net", "name: \"Test Net\" may only contain"},
+		{"name: n\ntransport: {type: sqs}", "transport.type"},
+		{"name: n\ncidr: 10.0.0.0/33", "cidr:"},
+		{"name: n\nmembers: [{name: a}]", "members[0].ip: required when the network has no cidr"},
+		{"name: n\ncidr: 192.168.1.0/24\nmembers: [{name: a, ip: 10.0.0.1}]", "members[0].ip: 10.0.0.1 is outside"},
+		{"name: n\ncidr: 192.168.1.0/24\nmembers: [{name: a, ip: 192.168.1.1}, {name: a, ip: 192.168.1.1}]", "members[1].name: \"a\" is used twice"},
+		{"name: n\ncidr: 192.168.1.0/24\nmembers: [{name: a, mac: 1:2}]", "members[0].mac"},
+		{"name: n\ntransport: {type: tag}", "need exactly 2 members"},
+		{"name: n\ntransport: {type: multipath}", "need exactly 2 members"},
+		{"name: n\nacl: [allow proto=sctp]", "acl[0]"},
+		{"name: n\npublish: [tcp:80]", "publish[0]"},
+		{"name: n\nforwards: [80:host:80]", "forwards[0]"},
+		{"name: n\nencryption: {key: c2hvcnQ=}", "encryption.key: 5 bytes"},
+		{"name: n\nroutes: [10.0.0.0/8 via gw]", "routes[0]"},
+		{"name: n\ncidr: 192.168.1.0/24\nmembers: [{name: a, gateway: true}]", "members[0].gateway: needs routing"},
+		{"name: n\nrouting: {interval: -1s}", "routing.interval"},
+		{"name: n\ntransport: {roleArn: overlay}", "transport.roleArn: \"overlay\" is not the arn"},
+		{"name: n\ntransport: {type: tag, roleArn: \"arn:aws:iam::123456789012:role/overlay\"}", "transport.roleArn: not used on tag"},
+	}
+	for _, table := range tables {
+		_, err := Parse([]byte(table.doc))
+		if err == nil || !strings.Contains(err.Error(), table.problem) {
+			t.Errorf("Parse(%q): expected %q, got %v", table.doc, table.problem, err)
+		}
+	}
+
+	// Unknown keys are typos.
+	if _, err := Parse([]byte("name: n\ncdir: 192.168.1.0/24")); err == nil {
+		t.Errorf("Expected an error for an unknown key")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netspec")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "net.json")
+	if err := ioutil.WriteFile(path, []byte(`{"name": "FileNet"}`), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	os.Setenv("NETSPEC_TEST_DOC", "name: EnvNet")
+	defer os.Unsetenv("NETSPEC_TEST_DOC")
+
+	tables := []struct {
+		location string
+		name     string
+	}{
+		{path, "FileNet"},
+		{"file://" + path, "FileNet"},
+		{"env:NETSPEC_TEST_DOC", "EnvNet"},
+	}
+	for _, table := range tables {
+		s, err := Load(table.location)
+		if err != nil {
+			t.Errorf("Load(%v): unexpected error: %v", table.location, err)
+			continue
+		}
+		if s.Name != table.name {
+			t.Errorf("Load(%v): got %v, want %v", table.location, s.Name, table.name)
+		}
+	}
+	for _, location := range []string{"env:NETSPEC_TEST_UNSET", "gopher://spec", filepath.Join(dir, "missing.yaml")} {
+		if _, err := Load(location); err == nil {
+			t.Errorf("Load(%v): expected an error", location)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package proxy lets unprivileged processes reach the overlay through a
+// userspace network stack, with local port forwards and a SOCKS5 listener,
+// so no tun or tap device is needed.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// DialFunc dials a connection, usually into the overlay.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Forward forwards connections to a local address to an overlay address,
+// like ssh -L.
+type Forward struct {
+	Listen string
+	To     string
+}
+
+func (f Forward) String() string {
+	return f.Listen + " -> " + f.To
+}
+
+// ParseForward parses a forward written like ssh -L,
+// [bind_address:]port:host:hostport. Forwards listen on localhost unless a
+// bind address is given.
+func ParseForward(s string) (Forward, error) {
+	parts := strings.Split(s, ":")
+	var f Forward
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"127.0.0.1"}, parts...)
+	case 4:
+	default:
+		return f, fmt.Errorf("ParseForward: %q: expected [bind_address:]port:host:hostport", s)
+	}
+	for _, port := range []string{parts[1], parts[3]} {
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return f, fmt.Errorf("ParseForward: %q: invalid port %q", s, port)
+		}
+	}
+	if net.ParseIP(parts[2]) == nil {
+		return f, fmt.Errorf("ParseForward: %q: the overlay has no names, %q must be an address", s, parts[2])
+	}
+	f.Listen = net.JoinHostPort(parts[0], parts[1])
+	f.To = net.JoinHostPort(parts[2], parts[3])
+	return f, nil
+}
+
+// ServeForward accepts connections on l and forwards each to the address
+// to. It returns when l is closed.
+func ServeForward(l net.Listener, dial DialFunc, to string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := dial(context.Background(), "tcp", to)
+			if err != nil {
+				logging.Default().Warn("could not dial forwarded address", "to", to, "client", conn.RemoteAddr(), "err", err)
+				return
+			}
+			defer remote.Close()
+			relay(conn, remote)
+		}()
+	}
+}
+
+// relay copies between two connections until both directions are done.
+func relay(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		// Let the other side see EOF, but keep reading its reply.
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
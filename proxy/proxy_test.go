@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	tables := []struct {
+		s          string
+		listen, to string
+		err        bool
+	}{
+		{"8080:192.168.1.21:3000", "127.0.0.1:8080", "192.168.1.21:3000", false},
+		{"0.0.0.0:8080:192.168.1.21:3000", "0.0.0.0:8080", "192.168.1.21:3000", false},
+		{"8080:function:3000", "", "", true},
+		{"8080:192.168.1.21", "", "", true},
+		{"0:192.168.1.21:3000", "", "", true},
+	}
+	for _, table := range tables {
+		f, err := ParseForward(table.s)
+		if (err != nil) != table.err {
+			t.Errorf("ParseForward(%q): unexpected error %v", table.s, err)
+			continue
+		}
+		if f.Listen != table.listen || f.To != table.to {
+			t.Errorf("ParseForward(%q): got %v, want %v -> %v", table.s, f, table.listen, table.to)
+		}
+	}
+}
+
+// echoServer echoes lines on a local port, it stands in for an overlay host.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	return l
+}
+
+func expectEcho(t *testing.T, conn net.Conn, r *bufio.Reader) {
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("Expected the echo, got %q, %v", line, err)
+	}
+}
+
+func TestServeForward(t *testing.T) {
+	to := echoServer(t)
+	l := listen(t)
+	defer l.Close()
+	dialed := make(chan string, 1)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	go ServeForward(l, dial, to)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, bufio.NewReader(conn))
+	if address := <-dialed; address != to {
+		t.Errorf("Expected %v to be dialed, got %v", to, address)
+	}
+}
+
+func TestServeSOCKS(t *testing.T) {
+	to := echoServer(t)
+	l := listen(t)
+	defer l.Close()
+	go ServeSOCKS(l, (&net.Dialer{}).DialContext)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", to)
+	req := []byte{socksVersion, 1, authNone, socksVersion, cmdConnect, 0, atypIPv4}
+	req = append(req, tcpAddr.IP.To4()...)
+	req = append(req, byte(tcpAddr.Port>>8), byte(tcpAddr.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if reply[1] != authNone || reply[3] != replySucceeded {
+		t.Fatalf("Expected no authentication and success, got %v", reply)
+	}
+	expectEcho(t, conn, r)
+
+	// Names can't be resolved on the overlay.
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn2.Close()
+	req = []byte{socksVersion, 1, authNone, socksVersion, cmdConnect, 0, atypDomain, 4, 'h', 'o', 's', 't', 0, 80}
+	conn2.Write(req)
+	if _, err := io.ReadFull(conn2, reply); err != nil || reply[3] != replyAddressUnsupported {
+		t.Errorf("Expected address type not supported, got %v, %v", reply, err)
+	}
+}
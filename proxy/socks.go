@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// SOCKS5 constants from RFC 1928.
+const (
+	socksVersion = 5
+
+	authNone         = 0
+	authUnacceptable = 0xff
+
+	cmdConnect = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	replySucceeded          = 0
+	replyFailure            = 1
+	replyHostUnreachable    = 4
+	replyCommandUnsupported = 7
+	replyAddressUnsupported = 8
+
+	// handshakeTimeout bounds how long a client takes to send its request.
+	handshakeTimeout = 30 * time.Second
+)
+
+var errUnsupported = errors.New("socks: unsupported request")
+
+// ServeSOCKS accepts SOCKS5 clients on l and connects them through dial.
+// Only CONNECT without authentication is supported, and since the overlay
+// has no names, domain names must be addresses. It returns when l is closed.
+func ServeSOCKS(l net.Listener, dial DialFunc) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSOCKS(conn, dial)
+	}
+}
+
+func serveSOCKS(conn net.Conn, dial DialFunc) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+	to, err := readRequest(r, conn)
+	if err != nil {
+		logging.Default().Warn("invalid SOCKS request", "client", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	remote, err := dial(ctx, "tcp", to)
+	cancel()
+	if err != nil {
+		logging.Default().Warn("could not dial SOCKS destination", "to", to, "client", conn.RemoteAddr(), "err", err)
+		writeReply(conn, replyHostUnreachable, nil)
+		return
+	}
+	defer remote.Close()
+	if err := writeReply(conn, replySucceeded, remote.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The client may have sent data right after its request.
+	if n := r.Buffered(); n > 0 {
+		b, _ := r.Peek(n)
+		if _, err := remote.Write(b); err != nil {
+			return
+		}
+	}
+	relay(conn, remote)
+}
+
+// readRequest negotiates authentication and returns the address of a
+// CONNECT request.
+func readRequest(r *bufio.Reader, w io.Writer) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("socks: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	method := byte(authUnacceptable)
+	for _, m := range methods {
+		if m == authNone {
+			method = authNone
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == authUnacceptable {
+		return "", errors.New("socks: client requires authentication")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("socks: unsupported version %d", req[0])
+	}
+	if req[1] != cmdConnect {
+		writeReply(w, replyCommandUnsupported, nil)
+		return "", errUnsupported
+	}
+
+	var host string
+	switch req[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		if net.ParseIP(string(name)) == nil {
+			writeReply(w, replyAddressUnsupported, nil)
+			return "", fmt.Errorf("socks: cannot resolve %q on the overlay", name)
+		}
+		host = string(name)
+	default:
+		writeReply(w, replyAddressUnsupported, nil)
+		return "", errUnsupported
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeReply answers a request, with the local address of the connection to
+// the destination when it succeeded.
+func writeReply(w io.Writer, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := bound.(*net.TCPAddr); ok && a.IP.To4() != nil {
+		ip, port = a.IP.To4(), a.Port
+	}
+	b := []byte{socksVersion, code, 0, atypIPv4}
+	b = append(b, ip...)
+	b = append(b, byte(port>>8), byte(port))
+	_, err := w.Write(b)
+	return err
+}
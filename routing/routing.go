@@ -0,0 +1,326 @@
+// Package routing runs a distance-vector protocol between the gateways of
+// overlay networks, so that members of one network reach the networks
+// behind its gateways. Like RIP, gateways periodically announce the networks
+// they reach with their distance in hops, on a channel of every network they
+// are on, i.e. its members group on Cloudwatch. Members keep the latest
+// announcement of each gateway and route each network through the nearest
+// one. Routes a gateway learned through a network are announced back on it
+// as unreachable, so that two gateways don't count to infinity through each
+// other, and a gateway that stops announcing is forgotten after Timeout.
+package routing
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// Infinity is the distance of unreachable networks, networks are at most
+// Infinity-1 hops away.
+const Infinity = 16
+
+// DefaultInterval is how often announcements are read and sent when
+// Options.Interval is not set.
+const DefaultInterval = time.Minute
+
+// Advert is a network announced by a gateway, with its distance in hops.
+type Advert struct {
+	Destination string `json:"dst"`
+	Metric      int    `json:"metric"`
+}
+
+// Announcement are the networks a gateway reaches, announced on a network.
+// Each announcement replaces the previous ones of its gateway.
+type Announcement struct {
+	// From is the link address of the gateway on the network, Gateway its
+	// address.
+	From    tcpip.LinkAddress
+	Gateway string
+	Routes  []Advert
+	// Sent is when the announcement was sent.
+	Sent time.Time
+}
+
+// Channel carries the announcements of the gateways of a network.
+type Channel interface {
+	Announce(a Announcement) error
+	// Announcements returns the announcements sent since start, oldest
+	// first.
+	Announcements(start time.Time) ([]Announcement, error)
+}
+
+// Interface is an interface of a member on a network with a channel.
+type Interface struct {
+	NIC  tcpip.NICID
+	Name string
+	// MAC and IP are the link address and address of the member on the
+	// network, announcements from MAC are its own.
+	MAC     tcpip.LinkAddress
+	IP      string
+	// Address returns the current address of the member if set, used
+	// instead of IP for leased addresses that can change.
+	Address func() string
+	Channel Channel
+}
+
+// address returns the address of the member on the network, empty while it
+// has none.
+func (ifc Interface) address() string {
+	if ifc.Address != nil {
+		return ifc.Address()
+	}
+	return ifc.IP
+}
+
+// Route is a route to a network learned from a gateway.
+type Route struct {
+	Destination string
+	Gateway     string
+	NIC         tcpip.NICID
+	Metric      int
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("%v via %v nic %d metric %d", r.Destination, r.Gateway, r.NIC, r.Metric)
+}
+
+// Options configure the protocol.
+type Options struct {
+	// Gateway announces the networks the member reaches. Other members only
+	// learn routes.
+	Gateway bool
+	// Interval is how often announcements are read and sent,
+	// DefaultInterval if zero.
+	Interval time.Duration
+	// Timeout is how long the announcement of a gateway is valid, three
+	// intervals if zero.
+	Timeout time.Duration
+	// Logger gets route changes and errors of channels, logging.Default if
+	// nil.
+	Logger logging.Logger
+}
+
+// Speaker learns routes from the gateways of its networks and, on gateways,
+// announces its own.
+type Speaker struct {
+	gateway    bool
+	interval   time.Duration
+	timeout    time.Duration
+	logger     logging.Logger
+	interfaces []Interface
+	local      []Advert
+	onChange   func([]Route)
+	now        func() time.Time
+
+	mu sync.Mutex
+	// heard are the latest announcements of each gateway by interface.
+	heard  map[tcpip.NICID]map[tcpip.LinkAddress]Announcement
+	routes []Route
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewSpeaker returns a speaker on interfaces. local are the networks the
+// member reaches itself, announced by gateways and never learned, and
+// onChange is called with the learned routes whenever they change.
+func NewSpeaker(opts *Options, interfaces []Interface, local []Advert, onChange func([]Route)) *Speaker {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &Speaker{
+		gateway:    opts.Gateway,
+		interval:   opts.Interval,
+		timeout:    opts.Timeout,
+		logger:     logging.OrDefault(opts.Logger),
+		interfaces: interfaces,
+		local:      local,
+		onChange:   onChange,
+		now:        time.Now,
+		heard:      map[tcpip.NICID]map[tcpip.LinkAddress]Announcement{},
+	}
+	if s.interval <= 0 {
+		s.interval = DefaultInterval
+	}
+	if s.timeout <= 0 {
+		s.timeout = 3 * s.interval
+	}
+	return s
+}
+
+// Start runs the protocol in the background until Stop, starting with a
+// round right away.
+func (s *Speaker) Start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		t := time.NewTicker(s.interval)
+		defer t.Stop()
+		for {
+			s.Round()
+			select {
+			case <-t.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the protocol, routes learned so far are kept.
+func (s *Speaker) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+}
+
+// Routes returns the learned routes.
+func (s *Speaker) Routes() []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Route(nil), s.routes...)
+}
+
+// Round reads the announcements of every network, updates the routes and,
+// on gateways, announces the networks the member reaches.
+func (s *Speaker) Round() {
+	now := s.now()
+	own := map[tcpip.LinkAddress]bool{}
+	for _, ifc := range s.interfaces {
+		own[ifc.MAC] = true
+	}
+	for _, ifc := range s.interfaces {
+		announcements, err := ifc.Channel.Announcements(now.Add(-s.timeout))
+		if err != nil {
+			// Announcements heard before stay valid until they time out.
+			s.logger.Warn("could not read route announcements", "interface", ifc.Name, "err", err)
+			continue
+		}
+		heard := map[tcpip.LinkAddress]Announcement{}
+		for _, a := range announcements {
+			if !own[a.From] {
+				heard[a.From] = a
+			}
+		}
+		s.mu.Lock()
+		s.heard[ifc.NIC] = heard
+		s.mu.Unlock()
+	}
+
+	s.update(now)
+	if !s.gateway {
+		return
+	}
+	for _, ifc := range s.interfaces {
+		ip := ifc.address()
+		if ip == "" {
+			// A lost lease is being replaced.
+			continue
+		}
+		a := Announcement{From: ifc.MAC, Gateway: ip, Routes: s.adverts(ifc.NIC), Sent: now}
+		if err := ifc.Channel.Announce(a); err != nil {
+			s.logger.Warn("could not announce routes", "interface", ifc.Name, "err", err)
+		}
+	}
+}
+
+// update computes the routes from the valid announcements, and calls
+// onChange if they changed.
+func (s *Speaker) update(now time.Time) {
+	local := map[string]bool{}
+	for _, a := range s.local {
+		local[a.Destination] = true
+	}
+	best := map[string]Route{}
+	s.mu.Lock()
+	for _, ifc := range s.interfaces {
+		for _, a := range s.heard[ifc.NIC] {
+			if now.Sub(a.Sent) > s.timeout || net.ParseIP(a.Gateway).To4() == nil {
+				continue
+			}
+			for _, adv := range a.Routes {
+				metric := adv.Metric + 1
+				if local[adv.Destination] || metric >= Infinity || adv.Metric < 0 || !isNetwork(adv.Destination) {
+					continue
+				}
+				r := Route{Destination: adv.Destination, Gateway: a.Gateway, NIC: ifc.NIC, Metric: metric}
+				if cur, ok := best[r.Destination]; !ok || better(r, cur) {
+					best[r.Destination] = r
+				}
+			}
+		}
+	}
+	routes := make([]Route, 0, len(best))
+	for _, r := range best {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Destination < routes[j].Destination })
+	changed := !equal(routes, s.routes)
+	s.routes = routes
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	s.logger.Info("routes changed", "routes", len(routes))
+	for _, r := range routes {
+		s.logger.Debug("learned route", "route", r)
+	}
+	if s.onChange != nil {
+		s.onChange(routes)
+	}
+}
+
+// isNetwork tells if s is an IPv4 network in canonical form, as announced
+// by gateways.
+func isNetwork(s string) bool {
+	_, network, err := net.ParseCIDR(s)
+	return err == nil && network.IP.To4() != nil && network.String() == s
+}
+
+// better tells if r should be preferred to cur: it is shorter, or as short
+// and through a lower interface or gateway, so that every round picks the
+// same route.
+func better(r, cur Route) bool {
+	if r.Metric != cur.Metric {
+		return r.Metric < cur.Metric
+	}
+	if r.NIC != cur.NIC {
+		return r.NIC < cur.NIC
+	}
+	return r.Gateway < cur.Gateway
+}
+
+func equal(a, b []Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// adverts returns the networks to announce on the interface nic: the local
+// networks and the learned routes, those learned through nic as
+// unreachable.
+func (s *Speaker) adverts(nic tcpip.NICID) []Advert {
+	adverts := append([]Advert(nil), s.local...)
+	for _, r := range s.Routes() {
+		metric := r.Metric
+		if r.NIC == nic {
+			metric = Infinity
+		}
+		adverts = append(adverts, Advert{Destination: r.Destination, Metric: metric})
+	}
+	return adverts
+}
@@ -0,0 +1,153 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// channel keeps announcements in memory.
+type channel struct {
+	announcements []Announcement
+}
+
+func (c *channel) Announce(a Announcement) error {
+	c.announcements = append(c.announcements, a)
+	return nil
+}
+
+func (c *channel) Announcements(start time.Time) ([]Announcement, error) {
+	var list []Announcement
+	for _, a := range c.announcements {
+		if !a.Sent.Before(start) {
+			list = append(list, a)
+		}
+	}
+	return list, nil
+}
+
+// last returns the latest announcement from mac.
+func (c *channel) last(mac tcpip.LinkAddress) Announcement {
+	for i := len(c.announcements) - 1; i >= 0; i-- {
+		if c.announcements[i].From == mac {
+			return c.announcements[i]
+		}
+	}
+	return Announcement{}
+}
+
+func TestSpeaker(t *testing.T) {
+	now := time.Unix(1546300800, 0)
+	clock := func() time.Time { return now }
+	a, b, c := &channel{}, &channel{}, &channel{}
+
+	// g1 links networks a and b, g2 links b and c, m is a member of a.
+	g1 := NewSpeaker(&Options{Gateway: true, Interval: time.Minute, Logger: logging.Discard}, []Interface{
+		{NIC: 1, MAC: "\x02\x00\x00\x00\x01\x01", IP: "10.1.0.1", Channel: a},
+		{NIC: 2, MAC: "\x02\x00\x00\x00\x01\x02", IP: "10.2.0.1", Channel: b},
+	}, []Advert{{"10.1.0.0/16", 0}, {"10.2.0.0/16", 0}}, nil)
+	g2 := NewSpeaker(&Options{Gateway: true, Interval: time.Minute, Logger: logging.Discard}, []Interface{
+		{NIC: 1, MAC: "\x02\x00\x00\x00\x02\x01", IP: "10.2.0.2", Channel: b},
+		{NIC: 2, MAC: "\x02\x00\x00\x00\x02\x02", IP: "10.3.0.2", Channel: c},
+	}, []Advert{{"10.2.0.0/16", 0}, {"10.3.0.0/16", 0}}, nil)
+	var changes [][]Route
+	m := NewSpeaker(&Options{Interval: time.Minute, Logger: logging.Discard}, []Interface{
+		{NIC: 1, MAC: "\x02\x00\x00\x00\x03\x01", IP: "10.1.0.9", Channel: a},
+	}, []Advert{{"10.1.0.0/16", 0}}, func(r []Route) { changes = append(changes, r) })
+	for _, s := range []*Speaker{g1, g2, m} {
+		s.now = clock
+	}
+
+	for i := 0; i < 3; i++ {
+		g2.Round()
+		g1.Round()
+		m.Round()
+		now = now.Add(time.Minute)
+	}
+	want := []Route{
+		{Destination: "10.2.0.0/16", Gateway: "10.1.0.1", NIC: 1, Metric: 1},
+		{Destination: "10.3.0.0/16", Gateway: "10.1.0.1", NIC: 1, Metric: 2},
+	}
+	if got := m.Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the member to route through g1\n%v, got\n%v", want, got)
+	}
+	if len(changes) != 1 || len(a.last(m.interfaces[0].MAC).Routes) != 0 {
+		t.Errorf("Expected one change and no announcement from the member, got %d changes", len(changes))
+	}
+
+	// g1 announces the networks of g2 back on b as unreachable.
+	poisoned := false
+	adverts := b.last(g1.interfaces[1].MAC).Routes
+	for _, adv := range adverts {
+		if adv.Destination == "10.3.0.0/16" {
+			poisoned = adv.Metric == Infinity
+		}
+	}
+	if !poisoned {
+		t.Errorf("Expected a poisoned reverse route to 10.3.0.0/16, got %v", adverts)
+	}
+
+	// Routes through g2 are forgotten when it stops announcing.
+	for i := 0; i < 4; i++ {
+		g1.Round()
+		m.Round()
+		now = now.Add(time.Minute)
+	}
+	want = want[:1]
+	if got := m.Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the routes of g2 to time out\n%v, got\n%v", want, got)
+	}
+}
+
+func TestBetter(t *testing.T) {
+	r := Route{Destination: "10.3.0.0/16", Gateway: "10.1.0.2", NIC: 1, Metric: 2}
+	for _, c := range []struct {
+		cur  Route
+		want bool
+	}{
+		{Route{Gateway: "10.1.0.1", NIC: 1, Metric: 3}, true},
+		{Route{Gateway: "10.1.0.3", NIC: 1, Metric: 1}, false},
+		{Route{Gateway: "10.2.0.1", NIC: 2, Metric: 2}, true},
+		{Route{Gateway: "10.1.0.1", NIC: 1, Metric: 2}, false},
+	} {
+		if got := better(r, c.cur); got != c.want {
+			t.Errorf("better(%v, %v): expected %v", r, c.cur, c.want)
+		}
+	}
+}
+
+func TestSpeaker_Invalid(t *testing.T) {
+	now := time.Unix(1546300800, 0)
+	a := &channel{}
+	m := NewSpeaker(&Options{Logger: logging.Discard}, []Interface{{NIC: 1, MAC: "\x02\x00\x00\x00\x03\x01", Channel: a}}, nil, nil)
+	m.now = func() time.Time { return now }
+	a.Announce(Announcement{From: "\x02\x00\x00\x00\x01\x01", Gateway: "10.1.0.1", Sent: now, Routes: []Advert{
+		{"10.2.0.0/16", 0}, {"10.3.0.1/16", 0}, {"fd00::/8", 0}, {"10.4.0.0/16", -3}, {"10.5.0.0/16", Infinity - 1},
+	}})
+	a.Announce(Announcement{From: "\x02\x00\x00\x00\x01\x02", Gateway: "gateway", Sent: now, Routes: []Advert{{"10.6.0.0/16", 0}}})
+	m.Round()
+	want := []Route{{Destination: "10.2.0.0/16", Gateway: "10.1.0.1", NIC: 1, Metric: 1}}
+	if got := m.Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected invalid and unreachable routes to be ignored\n%v, got\n%v", want, got)
+	}
+}
+
+func TestSpeaker_LeasedAddress(t *testing.T) {
+	a := &channel{}
+	ip := "10.1.0.1"
+	g := NewSpeaker(&Options{Gateway: true, Logger: logging.Discard}, []Interface{
+		{NIC: 1, MAC: "\x02\x00\x00\x00\x01\x01", Address: func() string { return ip }, Channel: a},
+	}, []Advert{{"10.2.0.0/16", 0}}, nil)
+	g.Round()
+	// The lease is lost, and replaced by another address.
+	ip = ""
+	g.Round()
+	ip = "10.1.0.7"
+	g.Round()
+	if len(a.announcements) != 2 || a.announcements[0].Gateway != "10.1.0.1" || a.announcements[1].Gateway != "10.1.0.7" {
+		t.Errorf("Expected announcements with the current address, got %+v", a.announcements)
+	}
+}
@@ -0,0 +1,121 @@
+// Package tcpprofile tunes the TCP of the userspace stacks of the overlay.
+// Netstack's defaults suit a LAN, while packets through Cloudwatch Logs take
+// from a quarter of a second to over a second each way: windows must be
+// larger to keep the link busy, losses are better recovered with SACK, and
+// the pure ACKs a transfer sends mostly wait in the transmit queue of the
+// link, where the older ones are redundant.
+//
+// The retransmission timeout of a connection starts at a second, a constant
+// of netstack, and follows the measured round trip once there is one. Only
+// handshakes are retransmitted early then, so profiles have links drop the
+// SYNs retransmitted while the first is still on its way.
+package tcpprofile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/smithclay/rlinklayer/link/qos"
+)
+
+// BufferSize bounds the buffer of connections, in bytes.
+type BufferSize struct {
+	Min, Default, Max int
+}
+
+// Profile is a tuning of TCP.
+type Profile struct {
+	// Name of the profile, i.e. for -tcp-profile.
+	Name string
+	// SendBuffer and ReceiveBuffer bound the buffers of connections, and so
+	// their windows. Netstack's are kept if zero.
+	SendBuffer    BufferSize
+	ReceiveBuffer BufferSize
+	// SACK enables selective acknowledgements.
+	SACK bool
+	// CongestionControl is reno or cubic, netstack's if empty.
+	CongestionControl string
+	// CoalesceAcks has links replace pure ACKs waiting to be sent by newer
+	// ones, see qos.Options.
+	CoalesceAcks bool
+	// CoalesceSyns has links drop SYNs retransmitted before the first could
+	// be answered, see qos.Options.
+	CoalesceSyns bool
+}
+
+var (
+	// Default keeps the settings of netstack.
+	Default = &Profile{Name: "default"}
+	// HighLatency is tuned for links with round trips of seconds: buffers
+	// fit a few seconds of a fast transfer, SACK recovers several losses
+	// per round trip, and cubic grows windows by time rather than round
+	// trips.
+	HighLatency = &Profile{
+		Name:              "high-latency",
+		SendBuffer:        BufferSize{Min: 4 << 10, Default: 1 << 20, Max: 4 << 20},
+		ReceiveBuffer:     BufferSize{Min: 4 << 10, Default: 1 << 20, Max: 4 << 20},
+		SACK:              true,
+		CongestionControl: "cubic",
+		CoalesceAcks:      true,
+		CoalesceSyns:      true,
+	}
+)
+
+// Profiles are the profiles by name.
+var Profiles = map[string]*Profile{
+	Default.Name:     Default,
+	HighLatency.Name: HighLatency,
+}
+
+// Parse returns the profile named name.
+func Parse(name string) (*Profile, error) {
+	if p, ok := Profiles[name]; ok {
+		return p, nil
+	}
+	var names []string
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	return nil, fmt.Errorf("Parse: unknown TCP profile %q, expected one of %v", name, strings.Join(names, ", "))
+}
+
+func (p *Profile) String() string {
+	return p.Name
+}
+
+// Apply sets the options of the profile on the TCP of s.
+func (p *Profile) Apply(s *stack.Stack) error {
+	var opts []interface{}
+	if p.SendBuffer != (BufferSize{}) {
+		opts = append(opts, tcp.SendBufferSizeOption{Min: p.SendBuffer.Min, Default: p.SendBuffer.Default, Max: p.SendBuffer.Max})
+	}
+	if p.ReceiveBuffer != (BufferSize{}) {
+		opts = append(opts, tcp.ReceiveBufferSizeOption{Min: p.ReceiveBuffer.Min, Default: p.ReceiveBuffer.Default, Max: p.ReceiveBuffer.Max})
+	}
+	if p.SACK {
+		opts = append(opts, tcp.SACKEnabled(true))
+	}
+	if p.CongestionControl != "" {
+		opts = append(opts, tcp.CongestionControlOption(p.CongestionControl))
+	}
+	for _, opt := range opts {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return fmt.Errorf("Apply: could not set %T of profile %v: %v", opt, p.Name, err)
+		}
+	}
+	return nil
+}
+
+// QoS returns a copy of opts, the defaults if nil, coalescing ACKs and SYNs
+// as the profile does.
+func (p *Profile) QoS(opts *qos.Options) *qos.Options {
+	var o qos.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.CoalesceAcks = p.CoalesceAcks
+	o.CoalesceSyns = p.CoalesceSyns
+	return &o
+}
@@ -0,0 +1,60 @@
+package tcpprofile
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/smithclay/rlinklayer/link/qos"
+)
+
+func TestParse(t *testing.T) {
+	if p, err := Parse("high-latency"); err != nil || p != HighLatency {
+		t.Errorf("Expected the high-latency profile, got %v, %v", p, err)
+	}
+	if _, err := Parse("satellite"); err == nil {
+		t.Errorf("Expected an unknown profile to fail")
+	}
+}
+
+func TestProfile_QoS(t *testing.T) {
+	opts := &qos.Options{CoDel: true}
+	got := HighLatency.QoS(opts)
+	if !got.CoalesceAcks || !got.CoalesceSyns || !got.CoDel || opts.CoalesceAcks {
+		t.Errorf("Expected a copy of the options coalescing ACKs and SYNs, got %+v", got)
+	}
+	if o := Default.QoS(nil); o.CoalesceAcks || o.CoalesceSyns {
+		t.Errorf("Expected the default profile not to coalesce ACKs or SYNs")
+	}
+}
+
+func TestProfile_Apply(t *testing.T) {
+	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName}, stack.Options{})
+	if err := HighLatency.Apply(s); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	var sack tcp.SACKEnabled
+	var cc tcp.CongestionControlOption
+	var snd tcp.SendBufferSizeOption
+	var rcv tcp.ReceiveBufferSizeOption
+	for _, opt := range []interface{}{&sack, &cc, &snd, &rcv} {
+		if err := s.TransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			t.Fatalf("TransportProtocolOption(%T): %v", opt, err)
+		}
+	}
+	if !sack {
+		t.Errorf("Expected SACK to be enabled")
+	}
+	if cc != "cubic" {
+		t.Errorf("Expected cubic congestion control, got %q", cc)
+	}
+	want := HighLatency.SendBuffer
+	if got := (BufferSize{snd.Min, snd.Default, snd.Max}); got != want {
+		t.Errorf("Expected send buffers of %+v, got %+v", want, got)
+	}
+	want = HighLatency.ReceiveBuffer
+	if got := (BufferSize{rcv.Min, rcv.Default, rcv.Max}); got != want {
+		t.Errorf("Expected receive buffers of %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEndpoint is the OTLP/HTTP address of a local collector.
+const DefaultEndpoint = "http://localhost:4318"
+
+// scopeName is the instrumentation scope of the spans.
+const scopeName = "github.com/smithclay/rlinklayer/tracing"
+
+// OTLP exports spans to an OpenTelemetry collector over OTLP/HTTP, in its
+// JSON encoding.
+type OTLP struct {
+	// Endpoint is the base URL of the collector, spans are posted to its
+	// /v1/traces path. A URL ending with /v1/traces is used as is.
+	Endpoint string
+	// Headers are added to the requests, as the API key of a hosted
+	// collector.
+	Headers map[string]string
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// NewOTLP returns an exporter to the collector at endpoint, DefaultEndpoint
+// if empty.
+func NewOTLP(endpoint string) *OTLP {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	return &OTLP{Endpoint: endpoint, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Export implements Exporter.
+func (o *OTLP) Export(resource map[string]interface{}, spans []Span) error {
+	body, err := json.Marshal(encodeRequest(resource, spans))
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(o.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Export: collector returned %v: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// File exports spans as lines of OTLP JSON, one request per line like the
+// file exporter of the collector, for tests and offline analysis.
+type File struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewFile returns an exporter writing to w.
+func NewFile(w io.Writer) *File {
+	return &File{w: w}
+}
+
+// CreateFile returns an exporter writing to the file at path, appending if
+// it exists.
+func CreateFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &File{w: f, c: f}, nil
+}
+
+// Export implements Exporter.
+func (f *File) Export(resource map[string]interface{}, spans []Span) error {
+	line, err := json.Marshal(encodeRequest(resource, spans))
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file of an exporter created with CreateFile.
+func (f *File) Close() error {
+	if f.c == nil {
+		return nil
+	}
+	return f.c.Close()
+}
+
+// The OTLP JSON encoding of ExportTraceServiceRequest: IDs are hex, 64 bit
+// integers are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string         `json:"traceId"`
+		SpanID       string         `json:"spanId"`
+		ParentSpanID string         `json:"parentSpanId,omitempty"`
+		Name         string         `json:"name"`
+		Kind         int            `json:"kind"`
+		Start        string         `json:"startTimeUnixNano"`
+		End          string         `json:"endTimeUnixNano"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string  `json:"stringValue,omitempty"`
+		Bool   *bool    `json:"boolValue,omitempty"`
+		Int    *string  `json:"intValue,omitempty"`
+		Double *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// spanKindInternal is SPAN_KIND_INTERNAL.
+const spanKindInternal = 1
+
+func encodeRequest(resource map[string]interface{}, spans []Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		e := otlpSpan{
+			TraceID:    s.TraceID.String(),
+			SpanID:     s.SpanID.String(),
+			Name:       s.Name,
+			Kind:       spanKindInternal,
+			Start:      strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: encodeAttributes(s.Attributes),
+		}
+		if !s.Parent.IsZero() {
+			e.ParentSpanID = s.Parent.String()
+		}
+		encoded = append(encoded, e)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttributes(resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: encoded}},
+	}}}
+}
+
+// encodeAttributes encodes attrs sorted by key. Values of other types than
+// strings, booleans, integers and floats are encoded as strings.
+func encodeAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: encodeValue(attrs[k])})
+	}
+	return kvs
+}
+
+func encodeValue(v interface{}) otlpValue {
+	integer := func(i int64) otlpValue {
+		s := strconv.FormatInt(i, 10)
+		return otlpValue{Int: &s}
+	}
+	switch v := v.(type) {
+	case string:
+		return otlpValue{String: &v}
+	case bool:
+		return otlpValue{Bool: &v}
+	case int:
+		return integer(int64(v))
+	case int64:
+		return integer(v)
+	case uint64:
+		return integer(int64(v))
+	case uint32:
+		return integer(int64(v))
+	case uint16:
+		return integer(int64(v))
+	case float64:
+		return otlpValue{Double: &v}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{String: &s}
+}
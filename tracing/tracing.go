@@ -0,0 +1,378 @@
+// Package tracing follows frames across the overlay. Senders stamp sampled
+// frames with a Context, a trace ID and the time the frame left the stack,
+// and export a send span once the frame is put. Receivers split the time it
+// took to arrive into the stages of the transport: waiting in the sender's
+// write queue, being put and ingested by the service, and waiting for the
+// receiver's next poll. Each frame becomes a trace of spans, exported over
+// OTLP to an OpenTelemetry collector or to a file.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smithclay/rlinklayer/logging"
+)
+
+// TraceID identifies the spans of a frame.
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span in a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsZero reports whether s is unset, as the parent of root spans.
+func (s SpanID) IsZero() bool {
+	return s == SpanID{}
+}
+
+// Context is the trace metadata sent along with a frame. It is not sealed
+// with the frame, so receivers only trust it for tracing.
+type Context struct {
+	TraceID TraceID
+	// SpanID is the span of the sender the transit spans are children of.
+	SpanID SpanID
+	// Origin is when the frame was written to the link by the sender.
+	Origin time.Time
+}
+
+// contextJSON is the encoding of a Context in frames, short since it is
+// repeated in every traced frame.
+type contextJSON struct {
+	ID     string `json:"id"`
+	Span   string `json:"span"`
+	Origin int64  `json:"ts"`
+}
+
+func (c *Context) MarshalJSON() ([]byte, error) {
+	return json.Marshal(contextJSON{c.TraceID.String(), c.SpanID.String(), c.Origin.UnixNano()})
+}
+
+func (c *Context) UnmarshalJSON(b []byte) error {
+	var j contextJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if err := decodeID(c.TraceID[:], j.ID); err != nil {
+		return fmt.Errorf("tracing: invalid trace ID: %v", err)
+	}
+	if err := decodeID(c.SpanID[:], j.Span); err != nil {
+		return fmt.Errorf("tracing: invalid span ID: %v", err)
+	}
+	c.Origin = time.Unix(0, j.Origin)
+	return nil
+}
+
+func decodeID(dst []byte, s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(dst) {
+		return fmt.Errorf("%q is not %d bytes long", s, len(dst))
+	}
+	copy(dst, b)
+	return nil
+}
+
+// Span is a timed operation of a trace.
+type Span struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Parent is zero for the root span of a trace.
+	Parent     SpanID
+	Name       string
+	Start, End time.Time
+	// Attributes are strings, integers, floats or booleans.
+	Attributes map[string]interface{}
+}
+
+// Transit are the times a frame went through the stages of the transport.
+// Origin and Sent are read from the clock of the sender, Ingested from the
+// clock of the service and Fetched and Delivered from the clock of the
+// receiver, so stages between them include the clock skew.
+type Transit struct {
+	// Origin is when the sender wrote the frame to its link.
+	Origin time.Time
+	// Sent is when the sender's write poller put the frame, the timestamp of
+	// its log event.
+	Sent time.Time
+	// Ingested is when the service stored the frame.
+	Ingested time.Time
+	// Fetched is when the receiver's read poller got the frame.
+	Fetched time.Time
+	// Delivered is when the receiver handed the frame to its stack.
+	Delivered time.Time
+}
+
+// Stages of a Transit, the names of the spans under the transit span.
+const (
+	StageQueue   = "queue"
+	StageAPI     = "api"
+	StagePoll    = "poll"
+	StageDeliver = "deliver"
+)
+
+// Spans returns a transit span for the frame of ctx, child of the sender's
+// span, with a child span per stage. Stages with unknown times are left out,
+// and stages ending before they start, because of clock skew, are empty.
+func (t Transit) Spans(ctx *Context, attrs map[string]interface{}) []Span {
+	root := Span{
+		TraceID:    ctx.TraceID,
+		SpanID:     newSpanID(),
+		Parent:     ctx.SpanID,
+		Name:       "transit",
+		Start:      t.Origin,
+		End:        t.Delivered,
+		Attributes: attrs,
+	}
+	spans := []Span{root}
+	stages := []struct {
+		name       string
+		start, end time.Time
+	}{
+		{StageQueue, t.Origin, t.Sent},
+		{StageAPI, t.Sent, t.Ingested},
+		{StagePoll, t.Ingested, t.Fetched},
+		{StageDeliver, t.Fetched, t.Delivered},
+	}
+	for _, s := range stages {
+		if s.start.IsZero() || s.end.IsZero() {
+			continue
+		}
+		end := s.end
+		if end.Before(s.start) {
+			end = s.start
+		}
+		spans = append(spans, Span{
+			TraceID: ctx.TraceID,
+			SpanID:  newSpanID(),
+			Parent:  root.SpanID,
+			Name:    s.name,
+			Start:   s.start,
+			End:     end,
+		})
+	}
+	return spans
+}
+
+// Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	// Export sends spans of the process described by resource attributes.
+	// spans is reused once Export returns.
+	Export(resource map[string]interface{}, spans []Span) error
+}
+
+// Defaults of Options.
+const (
+	DefaultBatchSize = 512
+	DefaultInterval  = 5 * time.Second
+	DefaultService   = "rlinklayer"
+)
+
+// DefaultSampleRate is the fraction of sent frames commands and functions
+// trace when they aren't given one, low enough for busy links.
+const DefaultSampleRate = 0.01
+
+// Options configure a Tracer.
+type Options struct {
+	// Exporter gets the spans of received frames.
+	Exporter Exporter
+	// SampleRate is the fraction of sent frames that are traced, from 0 to 1.
+	// No frame is traced if zero, the tracer only exports the transit of
+	// traced frames it receives.
+	SampleRate float64
+	// Service is the service.name of the spans, DefaultService if empty.
+	Service string
+	// Resource are other attributes of the process, like its network.
+	Resource map[string]interface{}
+	// BatchSize and Interval bound how many spans are exported at once and
+	// how long they wait to be. DefaultBatchSize and DefaultInterval are
+	// used if zero.
+	BatchSize int
+	Interval  time.Duration
+	// Logger gets export failures, logging.Default if nil.
+	Logger logging.Logger
+}
+
+// Tracer stamps frames sent by a link and exports the spans of traced frames
+// it receives. The methods of a nil Tracer do nothing, so links can call them
+// whether tracing is enabled or not.
+type Tracer struct {
+	// dropped is first to be aligned for atomic operations.
+	dropped uint64
+
+	exporter   Exporter
+	sampleRate float64
+	resource   map[string]interface{}
+	batchSize  int
+	interval   time.Duration
+	logger     logging.Logger
+
+	spans chan Span
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// New creates a tracer and starts exporting in the background until Stop.
+func New(opts *Options) *Tracer {
+	t := &Tracer{
+		exporter:   opts.Exporter,
+		sampleRate: opts.SampleRate,
+		resource:   map[string]interface{}{"service.name": opts.Service},
+		batchSize:  opts.BatchSize,
+		interval:   opts.Interval,
+		logger:     logging.OrDefault(opts.Logger),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if opts.Service == "" {
+		t.resource["service.name"] = DefaultService
+	}
+	for k, v := range opts.Resource {
+		t.resource[k] = v
+	}
+	if t.sampleRate > 1 {
+		t.sampleRate = 1
+	}
+	if t.batchSize == 0 {
+		t.batchSize = DefaultBatchSize
+	}
+	if t.interval == 0 {
+		t.interval = DefaultInterval
+	}
+	t.spans = make(chan Span, 4*t.batchSize)
+	go t.run()
+	return t
+}
+
+// Start returns the context of a frame being sent, or nil if the frame is
+// not sampled.
+func (t *Tracer) Start() *Context {
+	if t == nil || t.sampleRate <= 0 || (t.sampleRate < 1 && mathrand.Float64() >= t.sampleRate) {
+		return nil
+	}
+	ctx := &Context{SpanID: newSpanID(), Origin: time.Now()}
+	rand.Read(ctx.TraceID[:])
+	return ctx
+}
+
+// Sent records the span of the sender of the frame stamped with ctx, from
+// its origin to now, when the frame was put. Transit spans of receivers are
+// its children.
+func (t *Tracer) Sent(ctx *Context, attrs map[string]interface{}) {
+	if t == nil || ctx == nil {
+		return
+	}
+	t.Record(Span{
+		TraceID:    ctx.TraceID,
+		SpanID:     ctx.SpanID,
+		Name:       "send",
+		Start:      ctx.Origin,
+		End:        time.Now(),
+		Attributes: attrs,
+	})
+}
+
+// Received records the transit of a frame stamped with ctx, with attributes
+// describing it like its source and destination.
+func (t *Tracer) Received(ctx *Context, transit Transit, attrs map[string]interface{}) {
+	if t == nil || ctx == nil {
+		return
+	}
+	for _, s := range transit.Spans(ctx, attrs) {
+		t.Record(s)
+	}
+}
+
+// Record queues a finished span for export. Spans are dropped while the
+// exporter can't keep up.
+func (t *Tracer) Record(s Span) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Dropped returns the number of spans dropped because the queue was full.
+func (t *Tracer) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Stop exports the queued spans and stops the tracer.
+func (t *Tracer) Stop() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		close(t.stop)
+		<-t.done
+	})
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(t.interval)
+	defer tick.Stop()
+	var batch []Span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) >= t.batchSize {
+				batch = t.export(batch)
+			}
+		case <-tick.C:
+			batch = t.export(batch)
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export exports batch and returns it emptied. Spans that can't be exported
+// are dropped.
+func (t *Tracer) export(batch []Span) []Span {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := t.exporter.Export(t.resource, batch); err != nil {
+		t.logger.Warn("could not export spans", "spans", len(batch), "err", err)
+	}
+	return batch[:0]
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestContext_JSON(t *testing.T) {
+	tr := New(&Options{Exporter: NewFile(ioutil.Discard), SampleRate: 1})
+	defer tr.Stop()
+	ctx := tr.Start()
+	b, err := json.Marshal(ctx)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var decoded Context
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Unmarshal %s: %v", b, err)
+	}
+	if decoded.TraceID != ctx.TraceID || decoded.SpanID != ctx.SpanID || !decoded.Origin.Equal(ctx.Origin) {
+		t.Errorf("Expected %+v, got %+v", ctx, decoded)
+	}
+	if err := json.Unmarshal([]byte(`{"id":"00","span":"00","ts":0}`), &decoded); err == nil {
+		t.Errorf("Expected an error for short IDs")
+	}
+
+	var nilTracer *Tracer
+	if nilTracer.Start() != nil {
+		t.Errorf("Expected a nil tracer not to trace")
+	}
+	nilTracer.Received(ctx, Transit{}, nil)
+	nilTracer.Stop()
+}
+
+func TestTracer_Sent(t *testing.T) {
+	off := New(&Options{Exporter: NewFile(ioutil.Discard)})
+	defer off.Stop()
+	if off.Start() != nil {
+		t.Errorf("Expected a sample rate of 0 to trace no frame")
+	}
+
+	var buf bytes.Buffer
+	tr := New(&Options{Exporter: NewFile(&buf), SampleRate: 1})
+	ctx := tr.Start()
+	tr.Sent(ctx, map[string]interface{}{"stream": "020000000001"})
+	tr.Stop()
+	var req otlpRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatalf("Unmarshal %s: %v", buf.Bytes(), err)
+	}
+	s := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if s.Name != "send" || s.SpanID != ctx.SpanID.String() || s.TraceID != ctx.TraceID.String() || s.ParentSpanID != "" {
+		t.Errorf("Expected the root span of the frame, the parent of its transit, got %+v", s)
+	}
+}
+
+func TestTransit_Spans(t *testing.T) {
+	ctx := &Context{TraceID: TraceID{1}, SpanID: SpanID{2}}
+	origin := time.Unix(1546300800, 0)
+	spans := Transit{
+		Origin:    origin,
+		Sent:      origin.Add(200 * time.Millisecond),
+		Ingested:  origin.Add(150 * time.Millisecond),
+		Fetched:   origin.Add(time.Second),
+		Delivered: origin.Add(1100 * time.Millisecond),
+	}.Spans(ctx, map[string]interface{}{"src": "02:00:00:00:00:01"})
+
+	if len(spans) != 5 {
+		t.Fatalf("Expected a transit span and 4 stages, got %v", len(spans))
+	}
+	root := spans[0]
+	if root.Name != "transit" || root.Parent != ctx.SpanID || root.End.Sub(root.Start) != 1100*time.Millisecond {
+		t.Errorf("Unexpected transit span %+v", root)
+	}
+	want := map[string]time.Duration{StageQueue: 200 * time.Millisecond, StageAPI: 0, StagePoll: 850 * time.Millisecond, StageDeliver: 100 * time.Millisecond}
+	for _, s := range spans[1:] {
+		if s.Parent != root.SpanID || s.TraceID != ctx.TraceID {
+			t.Errorf("Expected %v to be a child of the transit span", s.Name)
+		}
+		if d := s.End.Sub(s.Start); d != want[s.Name] {
+			t.Errorf("Expected %v to last %v, got %v", s.Name, want[s.Name], d)
+		}
+	}
+
+	if spans := (Transit{Origin: origin, Delivered: origin.Add(time.Second)}).Spans(ctx, nil); len(spans) != 1 {
+		t.Errorf("Expected stages with unknown times to be left out, got %v spans", len(spans))
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("Unexpected request %v %v", r.URL, r.Header)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Invalid request: %v", err)
+		}
+		requests <- req
+	}))
+	defer srv.Close()
+
+	exporter := NewOTLP(srv.URL)
+	exporter.Headers = map[string]string{"X-Api-Key": "secret"}
+	tr := New(&Options{Exporter: exporter, Resource: map[string]interface{}{"rlinklayer.network": "TestNet"}})
+	origin := time.Unix(1546300800, 0)
+	tr.Received(&Context{TraceID: TraceID{1}, SpanID: SpanID{2}, Origin: origin}, Transit{Origin: origin, Delivered: origin.Add(time.Second)}, map[string]interface{}{"bytes": 50})
+	tr.Stop()
+
+	req := <-requests
+	rs := req.ResourceSpans[0]
+	if len(rs.Resource.Attributes) != 2 || rs.Resource.Attributes[0].Key != "rlinklayer.network" || *rs.Resource.Attributes[1].Value.String != DefaultService {
+		t.Errorf("Unexpected resource %+v", rs.Resource)
+	}
+	span := rs.ScopeSpans[0].Spans[0]
+	if span.TraceID != "01000000000000000000000000000000" || span.ParentSpanID != "0200000000000000" || span.Start != "1546300800000000000" || *span.Attributes[0].Value.Int != "50" {
+		t.Errorf("Unexpected span %+v", span)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	if err := NewOTLP(failing.URL+"/v1/traces").Export(nil, nil); err == nil {
+		t.Errorf("Expected an error for a rejected export")
+	}
+}
+
+func TestFile(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewFile(&buf)
+	f.Export(nil, []Span{{Name: "a"}})
+	f.Export(nil, []Span{{Name: "b"}})
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per export, got %q", buf.String())
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(lines[1], &req); err != nil || req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name != "b" {
+		t.Errorf("Unexpected line %s: %v", lines[1], err)
+	}
+}
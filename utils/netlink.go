@@ -0,0 +1,166 @@
+// Copyright 2019 Clay Smith
+
+// +build linux
+
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// Netlink messages are in host byte order.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// SetLinkUp brings the interface name up, like ip link set name up.
+func SetLinkUp(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(syscall.RTM_NEWLINK, 0, ifInfoMsg(iface.Index, syscall.IFF_UP, syscall.IFF_UP))
+}
+
+// SetLinkAddress sets the MAC address of the interface name, like
+// ip link set name addr mac.
+func SetLinkAddress(name string, mac tcpip.LinkAddress) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	return netlinkRequest(syscall.RTM_NEWLINK, 0, ifInfoMsg(iface.Index, 0, 0), rtAttr(syscall.IFLA_ADDRESS, []byte(mac)))
+}
+
+// AddLinkAddress adds the IPv4 address addr, with the prefix length of its
+// mask, to the interface name, like ip addr add addr dev name. Adding an
+// address the interface already has is not an error.
+func AddLinkAddress(name string, addr *net.IPNet) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("AddLinkAddress: %v is not an IPv4 address", addr)
+	}
+	ones, _ := addr.Mask.Size()
+	msg := make([]byte, syscall.SizeofIfAddrmsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(ones)
+	nativeEndian.PutUint32(msg[4:], uint32(iface.Index))
+	err = netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg,
+		rtAttr(syscall.IFA_LOCAL, ip), rtAttr(syscall.IFA_ADDRESS, ip))
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+// AddRoute routes dst through the interface name, like
+// ip route add dst dev name. Adding an existing route is not an error.
+func AddRoute(dst *net.IPNet, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	ip := dst.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("AddRoute: %v is not an IPv4 network", dst)
+	}
+	ones, _ := dst.Mask.Size()
+	msg := make([]byte, syscall.SizeofRtMsg)
+	msg[0] = syscall.AF_INET
+	msg[1] = byte(ones)
+	msg[4] = syscall.RT_TABLE_MAIN
+	msg[5] = syscall.RTPROT_BOOT
+	msg[6] = syscall.RT_SCOPE_LINK
+	msg[7] = syscall.RTN_UNICAST
+	oif := make([]byte, 4)
+	nativeEndian.PutUint32(oif, uint32(iface.Index))
+	err = netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg,
+		rtAttr(syscall.RTA_DST, ip.Mask(dst.Mask)), rtAttr(syscall.RTA_OIF, oif))
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+func ifInfoMsg(index int, flags, change uint32) []byte {
+	msg := make([]byte, syscall.SizeofIfInfomsg)
+	msg[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(msg[4:], uint32(index))
+	nativeEndian.PutUint32(msg[8:], flags)
+	nativeEndian.PutUint32(msg[12:], change)
+	return msg
+}
+
+// rtAttr encodes a route attribute, padded to 4 bytes.
+func rtAttr(typ uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	b := make([]byte, (l+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	nativeEndian.PutUint16(b[0:], uint16(l))
+	nativeEndian.PutUint16(b[2:], typ)
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
+
+// netlinkRequest sends a route netlink request and waits for the kernel to
+// acknowledge it.
+func netlinkRequest(typ, flags uint16, msg []byte, attrs ...[]byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	b := make([]byte, syscall.NLMSG_HDRLEN, 256)
+	b = append(b, msg...)
+	for _, a := range attrs {
+		b = append(b, a...)
+	}
+	nativeEndian.PutUint32(b[0:], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:], typ)
+	nativeEndian.PutUint16(b[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(b[8:], 1)
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("netlinkRequest: short error message")
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
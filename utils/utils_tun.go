@@ -13,16 +13,15 @@ import (
 )
 
 func NewTapLink(tapName string, addr tcpip.LinkAddress) tcpip.LinkEndpointID {
-	mtu, err := rawfile.GetMTU(tapName)
+	// Opening creates the device if it doesn't exist yet.
+	fd, err := tun.OpenTAP(tapName)
 	if err != nil {
-		log.Fatalf("newTapLink: could not get mtu: %v", err)
+		log.Fatalf("newTapLink: could not open %v: %v", tapName, err)
 	}
 
-	var fd int
-	fd, err = tun.OpenTAP(tapName)
-
+	mtu, err := rawfile.GetMTU(tapName)
 	if err != nil {
-		log.Fatalf("newTapLink: could not open %v: %v", tapName, err)
+		log.Fatalf("newTapLink: could not get mtu: %v", err)
 	}
 
 	linkID := fdbased.New(&fdbased.Options{
@@ -35,16 +34,15 @@ func NewTapLink(tapName string, addr tcpip.LinkAddress) tcpip.LinkEndpointID {
 }
 
 func NewTunLink(tunName string) tcpip.LinkEndpointID {
-	mtu, err := rawfile.GetMTU(tunName)
+	// Opening creates the device if it doesn't exist yet.
+	fd, err := tun.Open(tunName)
 	if err != nil {
-		log.Fatalf("newTunLink: could not get mtu: %v", err)
+		log.Fatalf("newTunLink: could not open %v: %v", tunName, err)
 	}
 
-	var fd int
-	fd, err = tun.Open(tunName)
-
+	mtu, err := rawfile.GetMTU(tunName)
 	if err != nil {
-		log.Fatalf("newTunLink: could not open %v: %v", tunName, err)
+		log.Fatalf("newTunLink: could not get mtu: %v", err)
 	}
 
 	linkID := fdbased.New(&fdbased.Options{